@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// HeaderAPIKey may be used instead of an "Authorization: Bearer" header
+	HeaderAPIKey = "X-API-Key"
+
+	// query parameters used by signed urls
+	signedParamKeyName   = "key_name"
+	signedParamExpires   = "expires"
+	signedParamSignature = "signature"
+)
+
+// credentialHeaders are replaced by redactedValue when requests are logged
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", HeaderAPIKey, "Cookie"}
+
+var (
+	errNoCredentials    = errors.New("no credentials provided")
+	errUnknownKey       = errors.New("unknown api key")
+	errBadSignature     = errors.New("invalid signature")
+	errSignatureExpired = errors.New("signed url has expired")
+	errExpiryTooFar     = errors.New("signed url expiry exceeds maximum allowed ttl")
+)
+
+type principalCtxKey struct{}
+
+// principal is the authenticated caller of a request
+type principal struct {
+	key    *APIKeyConfig
+	signed bool // true when authenticated via signed url
+}
+
+func (p *principal) allowsFormat(format string) bool {
+	if len(p.key.Formats) == 0 {
+		return true
+	}
+	for _, f := range p.key.Formats {
+		if strings.EqualFold(f, format) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestPrincipal returns the authenticated caller, or nil if the request was not authenticated
+func requestPrincipal(r *http.Request) *principal {
+	p, _ := r.Context().Value(principalCtxKey{}).(*principal)
+	return p
+}
+
+// authenticator is rebuilt every time the config is reloaded
+type authenticator struct {
+	conf   *AuthConfig
+	maxTTL time.Duration
+	byHash map[[sha256.Size]byte]*APIKeyConfig
+	byName map[string]*APIKeyConfig
+}
+
+func newAuthenticator(conf *AuthConfig) *authenticator {
+	a := new(authenticator)
+	a.conf = conf
+	a.maxTTL, _ = time.ParseDuration(conf.SignedURLMaxTTL)
+	a.byHash = make(map[[sha256.Size]byte]*APIKeyConfig, len(conf.APIKeys))
+	a.byName = make(map[string]*APIKeyConfig, len(conf.APIKeys))
+
+	for _, k := range conf.APIKeys {
+		a.byHash[sha256.Sum256([]byte(k.Key))] = k
+		a.byName[k.Name] = k
+	}
+
+	return a
+}
+
+func (a *authenticator) isPublic(path string) bool {
+	for _, p := range a.conf.PublicPaths {
+		if path == p || (strings.HasSuffix(p, "/") && p != "/" && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate attempts to locate an api key either via headers or signed url query parameters
+func (a *authenticator) authenticate(r *http.Request) (*principal, error) {
+	if r.URL.Query().Get(signedParamSignature) != "" {
+		return a.verifySigned(r)
+	}
+
+	var key string
+	if v := r.Header.Get("Authorization"); strings.HasPrefix(v, "Bearer ") {
+		key = strings.TrimPrefix(v, "Bearer ")
+	} else {
+		key = r.Header.Get(HeaderAPIKey)
+	}
+	if key == "" {
+		return nil, errNoCredentials
+	}
+
+	k, ok := a.byHash[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, errUnknownKey
+	}
+
+	return &principal{key: k}, nil
+}
+
+func (a *authenticator) verifySigned(r *http.Request) (*principal, error) {
+	q := r.URL.Query()
+
+	k, ok := a.byName[q.Get(signedParamKeyName)]
+	if !ok {
+		return nil, errUnknownKey
+	}
+
+	expires, err := strconv.ParseInt(q.Get(signedParamExpires), 10, 64)
+	if err != nil {
+		return nil, errBadSignature
+	}
+
+	sig, err := hex.DecodeString(q.Get(signedParamSignature))
+	if err != nil || !hmac.Equal(sig, urlSignature(k, r.Method, r.URL.Path, q, expires)) {
+		return nil, errBadSignature
+	}
+
+	now := time.Now()
+	if now.Unix() > expires {
+		return nil, errSignatureExpired
+	}
+	if time.Unix(expires, 0).Sub(now) > a.maxTTL {
+		return nil, errExpiryTooFar
+	}
+
+	return &principal{key: k, signed: true}, nil
+}
+
+// signURL produces the query parameters that pre-authorize a single method, path and query until expires
+func (a *authenticator) signURL(k *APIKeyConfig, method, path string, query url.Values, expires time.Time) url.Values {
+	q := make(url.Values, len(query)+3)
+	for name, values := range query {
+		q[name] = append([]string(nil), values...)
+	}
+	q.Set(signedParamKeyName, k.Name)
+	q.Set(signedParamExpires, strconv.FormatInt(expires.Unix(), 10))
+	q.Set(signedParamSignature, hex.EncodeToString(urlSignature(k, method, path, q, expires.Unix())))
+	return q
+}
+
+// urlSignature is the HMAC-SHA256, keyed by the api key, of "METHOD\nPATH\nEXPIRES\nQUERY", where QUERY is the
+// query sorted by parameter name, as encoded by url.Values, without the signature and expires parameters
+func urlSignature(k *APIKeyConfig, method, path string, query url.Values, expires int64) []byte {
+	signed := make(url.Values, len(query))
+	for name, values := range query {
+		if name != signedParamSignature && name != signedParamExpires {
+			signed[name] = values
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(k.Key))
+	_, _ = fmt.Fprintf(mac, "%s\n%s\n%d\n%s", strings.ToUpper(method), path, expires, signed.Encode())
+	return mac.Sum(nil)
+}
+
+// redactedHeaders returns a copy of h with the values of credentialHeaders replaced
+func redactedHeaders(h http.Header) http.Header {
+	out := h.Clone()
+	for _, name := range credentialHeaders {
+		if _, ok := out[http.CanonicalHeaderKey(name)]; ok {
+			out.Set(name, redactedValue)
+		}
+	}
+	return out
+}
+
+// redactedURL returns a copy of u with the signature of a signed url replaced
+func redactedURL(u *url.URL) *url.URL {
+	out := *u
+	if q := u.Query(); q.Get(signedParamSignature) != "" {
+		q.Set(signedParamSignature, redactedValue)
+		out.RawQuery = q.Encode()
+	}
+	return &out
+}
+
+func (ws *WebService) authn() *authenticator {
+	return ws.auth.Load().(*authenticator)
+}
+
+func (ws *WebService) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := ws.authn()
+		if !a.conf.Enabled || a.isPublic(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		p, err := a.authenticate(r)
+		if err != nil {
+			ws.log.Warn().Err(err).Str("path", r.URL.Path).Msg("Unauthorized request")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="go-heicker"`)
+			ws.writeProblem(w, r, newProblem(http.StatusUnauthorized, codeUnauthorized, "Unauthorized: %v", err))
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalCtxKey{}, p)))
+	})
+}
+
+// getSign returns a signed url for the requested path, usable until the requested ttl.  It may only be called using
+// an api key directly.
+func (ws *WebService) getSign(w http.ResponseWriter, r *http.Request) {
+	ws.logRequest(r)
+
+	a := ws.authn()
+	p := requestPrincipal(r)
+	if p == nil || p.signed {
+		ws.writeProblem(w, r, newProblem(http.StatusForbidden, codeForbidden, "Signing urls requires auth to be enabled and an api key"))
+		return
+	}
+
+	q := r.URL.Query()
+	target, err := url.Parse(q.Get("path"))
+	if err != nil || target.IsAbs() || target.Host != "" {
+		ws.writeProblem(w, r, newProblem(http.StatusBadRequest, codeBadRequest, "path must be a path, optionally with a query"))
+		return
+	}
+	if target.Path == "" {
+		target.Path = "/convert"
+	}
+	method := q.Get("method")
+	if method == "" {
+		method = http.MethodPost
+	}
+	ttl := a.maxTTL
+	if v := q.Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > a.maxTTL {
+			ws.writeProblem(w, r, newProblem(http.StatusBadRequest, codeBadRequest, "ttl must be a duration between 0 and %s", a.maxTTL))
+			return
+		}
+		ttl = d
+	}
+
+	expires := time.Now().Add(ttl)
+	u := url.URL{Path: target.Path, RawQuery: a.signURL(p.key, method, target.Path, target.Query(), expires).Encode()}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(map[string]interface{}{
+		"url":     u.String(),
+		"method":  strings.ToUpper(method),
+		"expires": expires.Unix(),
+	})
+}
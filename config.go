@@ -3,30 +3,117 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/dcarbone/go-confinator"
+	"github.com/dcarbone/go-heicker/convert"
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/gohcl"
 	"github.com/hashicorp/hcl/v2/hclsyntax"
+	hcljson "github.com/hashicorp/hcl/v2/json"
 	"github.com/rs/zerolog"
 )
 
+const (
+	// EnvConfigFiles may contain one or more config file paths, separated by the os path list separator
+	EnvConfigFiles = "HEICKER_CONFIG"
+
+	// EnvPrefix is prepended to the upper-cased hcl name of each config attribute to produce its env var override,
+	// e.g. HEICKER_MAX_SIZE_MB
+	EnvPrefix = "HEICKER_"
+)
+
 const defaultConfigHCL = // language=hcl
 `ip = "0.0.0.0"
 port = 8191
 max_size_mb = 2
 max_concurrent = 10
-serve_path = "/opt/go-heicker/public"`
+serve_path = "/opt/go-heicker/public"
+log_level = "info"
+tls_min_version = "1.2"
+admin_endpoints = false
 
+limits {
+  max_megapixels = 100
+  max_tiles = 1024
+  max_images = 100
+}
+
+auth {
+  enabled = false
+  public_paths = ["/", "/css/", "/fonts/", "/check"]
+  signed_url_max_ttl = "1h"
+}
+
+rate_limit {
+  enabled = false
+  requests_per_second = 1
+  burst = 10
+  trusted_proxies = []
+  client_ip_headers = ["X-Forwarded-For", "X-Real-IP"]
+  daily_conversions = 0
+  daily_bytes_mb = 0
+  quota_store = "memory"
+}
+
+watch {
+  dirs = []
+  recursive = false
+  format = "jpeg"
+  quality = 75
+  originals = "keep"
+  originals_dir = ".originals"
+  quarantine_dir = ".quarantine"
+  stable_for = "2s"
+  poll_interval = "30s"
+  force_poll = false
+  parallel = 2
+}`
+
+// Config is built with the following precedence, lowest to highest:
+//
+//  1. defaultConfigHCL
+//  2. config files, in the order provided by -config flags or HEICKER_CONFIG
+//  3. HEICKER_* env vars
+//  4. flags
 type Config struct {
-	IP            string `json:"ip" hcl:"ip"`
-	Port          int    `json:"port" hcl:"port"`
-	MaxSizeMB     int64  `json:"max_size_mb" hcl:"max_size_mb"`
-	MaxConcurrent int    `json:"max_concurrent" hcl:"max_concurrent"`
-	ServePath     string `json:"serve_path" hcl:"serve_path"`
+	IP            string `json:"ip" hcl:"ip,optional"`
+	Port          int    `json:"port" hcl:"port,optional"`
+	MaxSizeMB     int64  `json:"max_size_mb" hcl:"max_size_mb,optional"`
+	MaxConcurrent int    `json:"max_concurrent" hcl:"max_concurrent,optional"`
+	ServePath     string `json:"serve_path" hcl:"serve_path,optional"`
+	LogLevel      string `json:"log_level" hcl:"log_level,optional"`
+
+	TLSCertFile     string   `json:"tls_cert_file" hcl:"tls_cert_file,optional"`
+	TLSKeyFile      string   `json:"tls_key_file" hcl:"tls_key_file,optional"`
+	TLSClientCAFile string   `json:"tls_client_ca_file" hcl:"tls_client_ca_file,optional"`
+	TLSMinVersion   string   `json:"tls_min_version" hcl:"tls_min_version,optional"`
+	TLSCipherSuites []string `json:"tls_cipher_suites" hcl:"tls_cipher_suites,optional"`
+
+	// AdminEndpoints enables /admin/ paths.  When auth is enabled they also require an api key with admin set.
+	AdminEndpoints bool `json:"admin_endpoints" hcl:"admin_endpoints,optional"`
+
+	Limits    *LimitsConfig    `json:"limits" hcl:"limits,block"`
+	Auth      *AuthConfig      `json:"auth" hcl:"auth,block"`
+	RateLimit *RateLimitConfig `json:"rate_limit" hcl:"rate_limit,block"`
+	Watch     *WatchConfig     `json:"watch" hcl:"watch,block"`
+
+	ConfigFiles []string `json:"config_files"`
 
 	BuildInfo confinator.BuildInfo `json:"build_info"`
+
+	// command is the subcommand this config was built for, used to limit validation to relevant settings
+	command string
+
+	// files contains each parsed config file, used when printing diagnostics
+	files map[string]*hcl.File
 }
 
 func (c *Config) MarshalZerologObject(ev *zerolog.Event) {
@@ -35,42 +122,671 @@ func (c *Config) MarshalZerologObject(ev *zerolog.Event) {
 	ev.Int64("max_size_mb", c.MaxSizeMB)
 	ev.Int("max_concurrent", c.MaxConcurrent)
 	ev.Str("serve_path", c.ServePath)
+	ev.Str("log_level", c.LogLevel)
+	ev.Str("tls_cert_file", c.TLSCertFile)
+	ev.Str("tls_key_file", c.TLSKeyFile)
+	ev.Str("tls_client_ca_file", c.TLSClientCAFile)
+	ev.Str("tls_min_version", c.TLSMinVersion)
+	ev.Strs("tls_cipher_suites", c.TLSCipherSuites)
+	ev.Bool("admin_endpoints", c.AdminEndpoints)
+	ev.Object("limits", c.Limits)
+	ev.Object("auth", c.Auth)
+	ev.Object("rate_limit", c.RateLimit)
+	ev.Object("watch", c.Watch)
+	ev.Strs("config_files", c.ConfigFiles)
 
 	ev.Interface("build_info", c.BuildInfo)
 }
 
-func buildConfig(fs *flag.FlagSet, bi confinator.BuildInfo) *Config {
+// buildConfig constructs a config for cmd containing the default values and registers all config flags with the
+// provided flagset.  Once the flagset has been parsed, load must be called to finish building the config.
+func buildConfig(cmd string, fs *flag.FlagSet, bi confinator.BuildInfo) (*Config, hcl.Diagnostics) {
 	conf := new(Config)
 	conf.BuildInfo = bi
-	hclFile, hclDiags := hclsyntax.ParseConfig([]byte(defaultConfigHCL), "default.hcl", hcl.Pos{Line: 1, Column: 1})
-	if hclDiags != nil && hclDiags.HasErrors() {
-		writeDiagErrors("default.hcl", hclFile, hclDiags)
-	}
-	decodeFile(conf, false, "default.hcl", hclFile)
+	conf.command = cmd
+	conf.files = make(map[string]*hcl.File)
+	diags := conf.decode("default.hcl", []byte(defaultConfigHCL))
 	addConfigFlags(conf, fs)
-	return conf
+	return conf, diags
+}
+
+// reloadConfig builds a new config from the same sources used to build prev.  fs must be the flagset originally
+// provided to buildConfig.
+func reloadConfig(prev *Config, fs *flag.FlagSet) (*Config, hcl.Diagnostics) {
+	nfs := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	next, diags := buildConfig(prev.command, nfs, prev.BuildInfo)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		rf, ok := f.Value.(*recordedFlag)
+		if !ok {
+			return
+		}
+		for _, v := range rf.seen {
+			if err := nfs.Set(f.Name, v); err != nil {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid flag value",
+					Detail:   fmt.Sprintf("Flag -%s could not be re-applied: %v", f.Name, err),
+				})
+			}
+		}
+	})
+
+	if !diags.HasErrors() {
+		diags = append(diags, next.load(nfs)...)
+	}
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	return next, diags
 }
 
 func addConfigFlags(c *Config, fs *flag.FlagSet) {
 	cf := confinator.NewConfinator()
 
+	cf.FlagVar(fs, &c.ConfigFiles, "config", "Path to HCL or JSON config file.  May be specified multiple times.")
 	cf.FlagVar(fs, &c.IP, "ip", "IP to bind")
 	cf.FlagVar(fs, &c.Port, "port", "Port to bind")
 	cf.FlagVar(fs, &c.MaxSizeMB, "max-size-mb", "Maximum file upload size in MB")
 	cf.FlagVar(fs, &c.MaxConcurrent, "max-concurrent", "Maximum number of allowable concurrent requests")
 	cf.FlagVar(fs, &c.ServePath, "serve-path", "Serve filepath")
+	cf.FlagVar(fs, &c.LogLevel, "log-level", "Log level")
+	cf.FlagVar(fs, &c.TLSCertFile, "tls-cert-file", "Path to PEM encoded TLS certificate.  Enables HTTPS.")
+	cf.FlagVar(fs, &c.TLSKeyFile, "tls-key-file", "Path to PEM encoded TLS private key")
+	cf.FlagVar(fs, &c.TLSClientCAFile, "tls-client-ca-file", "Path to PEM encoded CA bundle.  Enables mutual TLS.")
+	cf.FlagVar(fs, &c.TLSMinVersion, "tls-min-version", "Minimum TLS version (1.0, 1.1, 1.2, 1.3)")
+	cf.FlagVar(fs, &c.TLSCipherSuites, "tls-cipher-suite", "Allowed TLS cipher suite.  May be specified multiple times.")
+	if c.command == cmdWatch {
+		cf.FlagVar(fs, &c.Watch.Dirs, "watch-dir", "Directory to watch for new files.  May be specified multiple times.")
+		cf.FlagVar(fs, &c.Watch.StateFile, "watch-state-file", "Path to file recording processed files")
+	}
+
+	// record raw flag values so they may be re-applied on top of config files and env vars
+	fs.VisitAll(func(f *flag.Flag) {
+		f.Value = &recordedFlag{Value: f.Value}
+	})
+}
+
+// load must be called after the flagset provided to buildConfig has been parsed.  It applies config files, env vars,
+// and finally re-applies any flags seen before validating the result.
+func (c *Config) load(fs *flag.FlagSet) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+
+	files := c.ConfigFiles
+	if len(files) == 0 {
+		if v := os.Getenv(EnvConfigFiles); v != "" {
+			files = filepath.SplitList(v)
+		}
+	}
+
+	for _, fname := range files {
+		if fname == "" {
+			continue
+		}
+		diags = append(diags, c.decodeFile(fname)...)
+	}
+
+	diags = append(diags, c.applyEnv()...)
+
+	fs.Visit(func(f *flag.Flag) {
+		rf, ok := f.Value.(*recordedFlag)
+		if !ok {
+			return
+		}
+		if err := rf.replay(); err != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid flag value",
+				Detail:   fmt.Sprintf("Flag -%s could not be re-applied: %v", f.Name, err),
+			})
+		}
+	})
+
+	c.ConfigFiles = files
+
+	if diags.HasErrors() {
+		return diags
+	}
+
+	return append(diags, c.validate()...)
+}
+
+func (c *Config) decodeFile(filename string) hcl.Diagnostics {
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return hcl.Diagnostics{
+			&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Failed to read config file",
+				Detail:   fmt.Sprintf("Config file %q could not be read: %v", filename, err),
+			},
+		}
+	}
+	return c.decode(filename, src)
+}
+
+func (c *Config) decode(filename string, src []byte) hcl.Diagnostics {
+	var (
+		file  *hcl.File
+		diags hcl.Diagnostics
+	)
+
+	if strings.EqualFold(filepath.Ext(filename), ".json") {
+		file, diags = hcljson.Parse(src, filename)
+	} else {
+		file, diags = hclsyntax.ParseConfig(src, filename, hcl.Pos{Line: 1, Column: 1})
+	}
+	if file != nil {
+		c.files[filename] = file
+	}
+	if diags.HasErrors() {
+		return diags
+	}
+
+	return append(diags, gohcl.DecodeBody(file.Body, nil, c)...)
+}
+
+// applyEnv sets any top-level attribute with a corresponding HEICKER_* env var
+func (c *Config) applyEnv() hcl.Diagnostics {
+	var diags hcl.Diagnostics
+
+	rv := reflect.ValueOf(c).Elem()
+	rt := rv.Type()
+
+	for i := 0; i < rt.NumField(); i++ {
+		name := strings.Split(rt.Field(i).Tag.Get("hcl"), ",")[0]
+		if name == "" {
+			continue
+		}
+		envName := EnvPrefix + strings.ToUpper(name)
+		v, ok := os.LookupEnv(envName)
+		if !ok {
+			continue
+		}
+		if err := setFromString(rv.Field(i), v); err != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid environment variable",
+				Detail:   fmt.Sprintf("Unable to use value of %s for %q: %v", envName, name, err),
+			})
+		}
+	}
+
+	return diags
+}
+
+func (c *Config) validate() hcl.Diagnostics {
+	var diags hcl.Diagnostics
+
+	invalid := func(name, detail string, args ...interface{}) {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  fmt.Sprintf("Invalid value for %q", name),
+			Detail:   fmt.Sprintf(detail, args...),
+		})
+	}
+
+	if c.Port < 1 || c.Port > 65535 {
+		invalid("port", "Port must be between 1 and 65535, saw %d", c.Port)
+	}
+	if c.MaxSizeMB < 1 {
+		invalid("max_size_mb", "Maximum upload size must be at least 1, saw %d", c.MaxSizeMB)
+	}
+	if c.MaxConcurrent < 1 {
+		invalid("max_concurrent", "Maximum concurrency must be at least 1, saw %d", c.MaxConcurrent)
+	}
+	if c.command == cmdServe {
+		if fi, err := os.Stat(c.ServePath); err != nil {
+			invalid("serve_path", "Unable to stat %q: %v", c.ServePath, err)
+		} else if !fi.IsDir() {
+			invalid("serve_path", "%q is not a directory", c.ServePath)
+		}
+	}
+	if _, err := zerolog.ParseLevel(c.LogLevel); err != nil {
+		invalid("log_level", "%v", err)
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		invalid("tls_cert_file", "tls_cert_file and tls_key_file must be set together")
+	}
+	if c.TLSClientCAFile != "" && c.TLSCertFile == "" {
+		invalid("tls_client_ca_file", "tls_client_ca_file requires tls_cert_file and tls_key_file")
+	}
+	for _, f := range [][2]string{
+		{"tls_cert_file", c.TLSCertFile},
+		{"tls_key_file", c.TLSKeyFile},
+		{"tls_client_ca_file", c.TLSClientCAFile},
+	} {
+		if f[1] == "" {
+			continue
+		}
+		if _, err := os.Stat(f[1]); err != nil {
+			invalid(f[0], "Unable to stat %q: %v", f[1], err)
+		}
+	}
+	if _, ok := tlsVersions[c.TLSMinVersion]; !ok {
+		invalid("tls_min_version", "Unknown TLS version %q", c.TLSMinVersion)
+	}
+	if _, err := parseCipherSuites(c.TLSCipherSuites); err != nil {
+		invalid("tls_cipher_suites", "%v", err)
+	}
+
+	if c.Limits != nil {
+		diags = append(diags, c.Limits.validate()...)
+	}
+	if c.Auth != nil {
+		diags = append(diags, c.Auth.validate()...)
+	}
+	if c.RateLimit != nil {
+		diags = append(diags, c.RateLimit.validate()...)
+	}
+	if c.command == cmdWatch {
+		diags = append(diags, c.Watch.validate()...)
+	}
+
+	return diags
+}
+
+// LimitsConfig bounds the images the webservice will decode and produce, so that no upload, nor combination of
+// options such as a large width and height, can exhaust memory
+type LimitsConfig struct {
+	// MaxMegapixels applies to the decoded image, the output, and the intermediate planes of resizing
+	MaxMegapixels int64 `json:"max_megapixels" hcl:"max_megapixels,optional"`
+	MaxTiles      int   `json:"max_tiles" hcl:"max_tiles,optional"`
+	// MaxImages bounds the images converted with all=true and the frames of an animation
+	MaxImages int `json:"max_images" hcl:"max_images,optional"`
+}
+
+func (c *LimitsConfig) MarshalZerologObject(ev *zerolog.Event) {
+	ev.Int64("max_megapixels", c.MaxMegapixels)
+	ev.Int("max_tiles", c.MaxTiles)
+	ev.Int("max_images", c.MaxImages)
+}
+
+func (c *LimitsConfig) validate() hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	for _, v := range []struct {
+		name  string
+		value int64
+	}{
+		{"max_megapixels", c.MaxMegapixels},
+		{"max_tiles", int64(c.MaxTiles)},
+		{"max_images", int64(c.MaxImages)},
+	} {
+		if v.value < 1 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  fmt.Sprintf("Invalid value for %q", v.name),
+				Detail:   fmt.Sprintf("Must be at least 1, saw %d", v.value),
+			})
+		}
+	}
+	return diags
+}
+
+// convertLimits returns the limits passed to the converter
+func (c *LimitsConfig) convertLimits() convert.Limits {
+	return convert.Limits{
+		MaxPixels: c.MaxMegapixels * 1000000,
+		MaxTiles:  c.MaxTiles,
+		MaxImages: c.MaxImages,
+	}
+}
+
+type AuthConfig struct {
+	Enabled bool `json:"enabled" hcl:"enabled,optional"`
+
+	// PublicPaths never require authentication.  Entries ending in "/" match any path with that prefix.
+	PublicPaths []string `json:"public_paths" hcl:"public_paths,optional"`
+
+	// SignedURLMaxTTL is the furthest into the future a signed url may expire
+	SignedURLMaxTTL string `json:"signed_url_max_ttl" hcl:"signed_url_max_ttl,optional"`
+
+	APIKeys []*APIKeyConfig `json:"api_keys" hcl:"api_key,block"`
+}
+
+func (c *AuthConfig) MarshalZerologObject(ev *zerolog.Event) {
+	ev.Bool("enabled", c.Enabled)
+	ev.Strs("public_paths", c.PublicPaths)
+	ev.Str("signed_url_max_ttl", c.SignedURLMaxTTL)
+	names := make([]string, len(c.APIKeys))
+	for i, k := range c.APIKeys {
+		names[i] = k.Name
+	}
+	ev.Strs("api_keys", names)
+}
+
+func (c *AuthConfig) validate() hcl.Diagnostics {
+	var diags hcl.Diagnostics
+
+	invalid := func(name, detail string, args ...interface{}) {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  fmt.Sprintf("Invalid value for %q", name),
+			Detail:   fmt.Sprintf(detail, args...),
+		})
+	}
+
+	if c.Enabled && len(c.APIKeys) == 0 {
+		invalid("auth", "At least one api_key block is required when auth is enabled")
+	}
+	if ttl, err := time.ParseDuration(c.SignedURLMaxTTL); err != nil {
+		invalid("signed_url_max_ttl", "%v", err)
+	} else if ttl <= 0 {
+		invalid("signed_url_max_ttl", "Must be greater than 0, saw %s", ttl)
+	}
+
+	seen := make(map[string]bool)
+	for _, k := range c.APIKeys {
+		if seen[k.Name] {
+			invalid("api_key", "Duplicate api_key block %q", k.Name)
+		}
+		seen[k.Name] = true
+		if len(k.Key) < 16 {
+			invalid("key", "Key for api_key %q must be at least 16 characters", k.Name)
+		}
+		if k.RateLimit < 0 {
+			invalid("rate_limit", "Rate limit for api_key %q cannot be negative", k.Name)
+		}
+		if k.RateBurst < 0 {
+			invalid("rate_burst", "Rate burst for api_key %q cannot be negative", k.Name)
+		}
+		if k.DailyConversions < 0 || k.DailyBytesMB < 0 {
+			invalid("daily_conversions", "Daily quotas for api_key %q cannot be negative", k.Name)
+		}
+		for _, f := range k.Formats {
+			if _, err := convert.ParseFormat(f); err != nil {
+				invalid("formats", "Unknown format %q for api_key %q", f, k.Name)
+			}
+		}
+	}
+
+	return diags
+}
+
+type APIKeyConfig struct {
+	Name string `json:"name" hcl:"name,label"`
+	Key  string `json:"-" hcl:"key"`
+
+	// RateLimit is the number of requests per second allowed for this key.  0 means unlimited.
+	RateLimit float64 `json:"rate_limit" hcl:"rate_limit,optional"`
+	RateBurst int     `json:"rate_burst" hcl:"rate_burst,optional"`
+
+	// Formats limits the output formats this key may request.  Empty means all.
+	Formats []string `json:"formats" hcl:"formats,optional"`
+
+	// DailyConversions and DailyBytesMB override the rate_limit quotas for this key.  0 means use the default.
+	DailyConversions int64 `json:"daily_conversions" hcl:"daily_conversions,optional"`
+	DailyBytesMB     int64 `json:"daily_bytes_mb" hcl:"daily_bytes_mb,optional"`
+
+	// Admin allows this key to call /admin/ paths
+	Admin bool `json:"admin" hcl:"admin,optional"`
+}
+
+// RateLimitConfig limits clients not covered by an api key specific limit.  Clients are identified by api key when
+// authenticated, otherwise by ip address.
+type RateLimitConfig struct {
+	Enabled           bool    `json:"enabled" hcl:"enabled,optional"`
+	RequestsPerSecond float64 `json:"requests_per_second" hcl:"requests_per_second,optional"`
+	Burst             int     `json:"burst" hcl:"burst,optional"`
+
+	// ClientIPHeaders are only consulted when the request was received from one of TrustedProxies
+	TrustedProxies  []string `json:"trusted_proxies" hcl:"trusted_proxies,optional"`
+	ClientIPHeaders []string `json:"client_ip_headers" hcl:"client_ip_headers,optional"`
+
+	// DailyConversions and DailyBytesMB reset at midnight UTC.  0 means unlimited.
+	DailyConversions int64  `json:"daily_conversions" hcl:"daily_conversions,optional"`
+	DailyBytesMB     int64  `json:"daily_bytes_mb" hcl:"daily_bytes_mb,optional"`
+	QuotaStore       string `json:"quota_store" hcl:"quota_store,optional"`
+	QuotaStorePath   string `json:"quota_store_path" hcl:"quota_store_path,optional"`
 }
 
-func writeDiagErrors(filename string, file *hcl.File, diags hcl.Diagnostics) {
-	writer := hcl.NewDiagnosticTextWriter(os.Stdout, map[string]*hcl.File{filename: file}, 120, true)
+func (c *RateLimitConfig) MarshalZerologObject(ev *zerolog.Event) {
+	ev.Bool("enabled", c.Enabled)
+	ev.Float64("requests_per_second", c.RequestsPerSecond)
+	ev.Int("burst", c.Burst)
+	ev.Strs("trusted_proxies", c.TrustedProxies)
+	ev.Strs("client_ip_headers", c.ClientIPHeaders)
+	ev.Int64("daily_conversions", c.DailyConversions)
+	ev.Int64("daily_bytes_mb", c.DailyBytesMB)
+	ev.Str("quota_store", c.QuotaStore)
+	ev.Str("quota_store_path", c.QuotaStorePath)
+}
+
+func (c *RateLimitConfig) validate() hcl.Diagnostics {
+	var diags hcl.Diagnostics
+
+	invalid := func(name, detail string, args ...interface{}) {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  fmt.Sprintf("Invalid value for %q", name),
+			Detail:   fmt.Sprintf(detail, args...),
+		})
+	}
+
+	if c.Enabled && c.RequestsPerSecond <= 0 {
+		invalid("requests_per_second", "Must be greater than 0 when rate limiting is enabled, saw %v", c.RequestsPerSecond)
+	}
+	if c.Burst < 0 {
+		invalid("burst", "Cannot be negative, saw %d", c.Burst)
+	}
+	for _, p := range c.TrustedProxies {
+		if len(parseCIDRs([]string{p})) == 0 {
+			invalid("trusted_proxies", "%q is not a valid ip address or cidr", p)
+		}
+	}
+	if c.DailyConversions < 0 || c.DailyBytesMB < 0 {
+		invalid("daily_conversions", "Daily quotas cannot be negative")
+	}
+	switch c.QuotaStore {
+	case quotaStoreMemory:
+	case quotaStoreFile:
+		if c.QuotaStorePath == "" {
+			invalid("quota_store_path", "Required when quota_store is %q", quotaStoreFile)
+		} else if fi, err := os.Stat(filepath.Dir(c.QuotaStorePath)); err != nil || !fi.IsDir() {
+			invalid("quota_store_path", "Parent directory of %q must exist", c.QuotaStorePath)
+		}
+	default:
+		invalid("quota_store", "Must be one of %q or %q, saw %q", quotaStoreMemory, quotaStoreFile, c.QuotaStore)
+	}
+
+	return diags
+}
+
+// minWatchInterval is the shortest stable_for and poll_interval allowed, as files are checked for stability every
+// stable_for / 2
+const minWatchInterval = 100 * time.Millisecond
+
+// WatchConfig is used by the watch command.  Relative out_dir, originals_dir, and quarantine_dir paths are relative to
+// each watched directory.
+type WatchConfig struct {
+	Dirs      []string `json:"dirs" hcl:"dirs,optional"`
+	Recursive bool     `json:"recursive" hcl:"recursive,optional"`
+
+	// OutDir defaults to writing outputs next to their original
+	OutDir  string `json:"out_dir" hcl:"out_dir,optional"`
+	Format  string `json:"format" hcl:"format,optional"`
+	Quality int    `json:"quality" hcl:"quality,optional"`
+
+	// Originals is one of "keep", "move", or "delete".  Originals are moved to OriginalsDir.
+	Originals     string `json:"originals" hcl:"originals,optional"`
+	OriginalsDir  string `json:"originals_dir" hcl:"originals_dir,optional"`
+	QuarantineDir string `json:"quarantine_dir" hcl:"quarantine_dir,optional"`
+	StateFile     string `json:"state_file" hcl:"state_file,optional"`
+
+	// StableFor is how long a file's size and modification time must remain unchanged before it is converted
+	StableFor string `json:"stable_for" hcl:"stable_for,optional"`
+	// PollInterval is how often directories are rescanned.  When inotify is available it acts as a safety net.
+	PollInterval string `json:"poll_interval" hcl:"poll_interval,optional"`
+	ForcePoll    bool   `json:"force_poll" hcl:"force_poll,optional"`
+	Parallel     int    `json:"parallel" hcl:"parallel,optional"`
+}
+
+func (c *WatchConfig) MarshalZerologObject(ev *zerolog.Event) {
+	ev.Strs("dirs", c.Dirs)
+	ev.Bool("recursive", c.Recursive)
+	ev.Str("out_dir", c.OutDir)
+	ev.Str("format", c.Format)
+	ev.Int("quality", c.Quality)
+	ev.Str("originals", c.Originals)
+	ev.Str("originals_dir", c.OriginalsDir)
+	ev.Str("quarantine_dir", c.QuarantineDir)
+	ev.Str("state_file", c.StateFile)
+	ev.Str("stable_for", c.StableFor)
+	ev.Str("poll_interval", c.PollInterval)
+	ev.Bool("force_poll", c.ForcePoll)
+	ev.Int("parallel", c.Parallel)
+}
+
+func (c *WatchConfig) validate() hcl.Diagnostics {
+	var diags hcl.Diagnostics
+
+	invalid := func(name, detail string, args ...interface{}) {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  fmt.Sprintf("Invalid value for %q", name),
+			Detail:   fmt.Sprintf(detail, args...),
+		})
+	}
+
+	if len(c.Dirs) == 0 {
+		invalid("dirs", "At least one directory must be watched")
+	}
+	for _, d := range c.Dirs {
+		if fi, err := os.Stat(d); err != nil {
+			invalid("dirs", "Unable to stat %q: %v", d, err)
+		} else if !fi.IsDir() {
+			invalid("dirs", "%q is not a directory", d)
+		}
+	}
+	if f, err := convert.ParseFormat(c.Format); err != nil {
+		invalid("format", "%v", err)
+	} else if f == convert.FormatHEIF && c.OutDir == "" {
+		// outputs written beside their originals would be seen and converted again
+		invalid("out_dir", "Required when format is %q", f)
+	}
+	if c.Quality < 1 || c.Quality > 100 {
+		invalid("quality", "Must be between 1 and 100, saw %d", c.Quality)
+	}
+	switch c.Originals {
+	case originalsKeep, originalsDelete:
+	case originalsMove:
+		if c.OriginalsDir == "" {
+			invalid("originals_dir", "Required when originals is %q", originalsMove)
+		}
+	default:
+		invalid("originals", "Must be one of %q, %q, or %q, saw %q", originalsKeep, originalsMove, originalsDelete, c.Originals)
+	}
+	if c.QuarantineDir == "" {
+		invalid("quarantine_dir", "Required")
+	}
+	if c.StateFile == "" {
+		invalid("state_file", "Required")
+	} else if fi, err := os.Stat(filepath.Dir(c.StateFile)); err != nil || !fi.IsDir() {
+		invalid("state_file", "Parent directory of %q must exist", c.StateFile)
+	}
+	for _, d := range [][2]string{{"stable_for", c.StableFor}, {"poll_interval", c.PollInterval}} {
+		if v, err := time.ParseDuration(d[1]); err != nil {
+			invalid(d[0], "%v", err)
+		} else if v < minWatchInterval {
+			invalid(d[0], "Must be at least %s, saw %s", minWatchInterval, v)
+		}
+	}
+	if c.Parallel < 1 {
+		invalid("parallel", "Must be at least 1, saw %d", c.Parallel)
+	}
+
+	return diags
+}
+
+// writeDiags writes diagnostics to w, including source snippets for any config file they were found in
+func (c *Config) writeDiags(w io.Writer, diags hcl.Diagnostics) {
+	writer := hcl.NewDiagnosticTextWriter(w, c.files, 120, false)
 	if err := writer.WriteDiagnostics(diags); err != nil {
-		panic(fmt.Sprintf("error printing diagnostics: %v; Diagnostics: %v", err, diags))
+		_, _ = fmt.Fprintf(w, "Error printing diagnostics: %v; Diagnostics: %v\n", err, diags)
+	}
+}
+
+// recordedFlag wraps a flag.Value, keeping each raw value it was set with
+type recordedFlag struct {
+	flag.Value
+	seen []string
+}
+
+func (f *recordedFlag) Set(v string) error {
+	f.seen = append(f.seen, v)
+	return f.Value.Set(v)
+}
+
+// replay sets each previously seen value once more, resetting slice values first as they are appended to
+func (f *recordedFlag) replay() error {
+	if g, ok := f.Value.(flag.Getter); ok {
+		if rv := reflect.ValueOf(g.Get()); rv.Kind() == reflect.Ptr && rv.Elem().Kind() == reflect.Slice {
+			rv.Elem().Set(reflect.Zero(rv.Elem().Type()))
+		}
+	}
+	for _, v := range f.seen {
+		if err := f.Value.Set(v); err != nil {
+			return err
+		}
 	}
-	panic("configuration parse error")
+	return nil
 }
 
-func decodeFile(base *Config, ignoreErrors bool, filename string, file *hcl.File) {
-	if diags := gohcl.DecodeBody(file.Body, nil, base); diags.HasErrors() && !ignoreErrors {
-		writeDiagErrors(filename, file, diags)
+// setFromString parses v into the field's type.  Slices are expected to be comma-separated.
+func setFromString(field reflect.Value, v string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(v)
+
+	case reflect.Bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(v, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(i)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(v, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(u)
+
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(v, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+
+	case reflect.Slice:
+		var parts []string
+		if v != "" {
+			parts = strings.Split(v, ",")
+		}
+		sl := reflect.MakeSlice(field.Type(), len(parts), len(parts))
+		for i, p := range parts {
+			if err := setFromString(sl.Index(i), strings.TrimSpace(p)); err != nil {
+				return err
+			}
+		}
+		field.Set(sl)
+
+	default:
+		return fmt.Errorf("cannot set %s from env", field.Type())
 	}
+
+	return nil
 }
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dcarbone/go-confinator"
+	"github.com/hashicorp/hcl/v2"
+)
+
+// loadTestConfig builds a serve config from args, after the serve path, returning it with its flagset and the
+// diagnostics of loading it
+func loadTestConfig(t *testing.T, args ...string) (*Config, *flag.FlagSet, hcl.Diagnostics) {
+	t.Helper()
+	fs := flag.NewFlagSet(cmdServe, flag.ContinueOnError)
+	conf, diags := buildConfig(cmdServe, fs, confinator.BuildInfo{})
+	if diags.HasErrors() {
+		t.Fatalf("building config: %v", diags)
+	}
+	if err := fs.Parse(append([]string{"-serve-path", t.TempDir()}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	return conf, fs, conf.load(fs)
+}
+
+// writeTestConfig writes a config file named name holding src, returning its path
+func writeTestConfig(t *testing.T, name, src string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// setenv sets an env var for the duration of t
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	prev, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			_ = os.Setenv(key, prev)
+		} else {
+			_ = os.Unsetenv(key)
+		}
+	})
+}
+
+func TestConfigDefaults(t *testing.T) {
+	conf, _, diags := loadTestConfig(t)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	if conf.Port != 8191 || conf.MaxSizeMB != 2 || conf.MaxConcurrent != 10 || conf.LogLevel != "info" {
+		t.Errorf("got port %d, max_size_mb %d, max_concurrent %d, log_level %q", conf.Port, conf.MaxSizeMB, conf.MaxConcurrent, conf.LogLevel)
+	}
+	if l := conf.Limits.convertLimits(); l.MaxPixels != 100e6 || l.MaxTiles != 1024 || l.MaxImages != 100 {
+		t.Errorf("got limits %+v", l)
+	}
+	if conf.Auth.Enabled || len(conf.Auth.PublicPaths) != 4 || conf.RateLimit.Enabled || conf.RateLimit.QuotaStore != quotaStoreMemory {
+		t.Errorf("got auth %+v, rate_limit %+v", conf.Auth, conf.RateLimit)
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	hclFile := writeTestConfig(t, "a.hcl", `
+port = 9000
+max_size_mb = 5
+max_concurrent = 3
+auth {
+  enabled = true
+  api_key "ci" {
+    key = "0123456789abcdef"
+    formats = ["jpeg"]
+  }
+}`)
+	jsonFile := writeTestConfig(t, "b.json", `{"max_size_mb": 6, "ip": "127.0.0.1"}`)
+	setenv(t, "HEICKER_MAX_CONCURRENT", "4")
+	setenv(t, "HEICKER_IP", "127.0.0.2")
+
+	conf, _, diags := loadTestConfig(t, "-config", hclFile, "-config", jsonFile, "-ip", "127.0.0.3")
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	for _, c := range []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"port, from the hcl file", conf.Port, 9000},
+		{"max_size_mb, from the later json file", conf.MaxSizeMB, int64(6)},
+		{"max_concurrent, from the env", conf.MaxConcurrent, 4},
+		{"ip, from the flag", conf.IP, "127.0.0.3"},
+		{"config_files", conf.ConfigFiles, []string{hclFile, jsonFile}},
+	} {
+		if !reflect.DeepEqual(c.got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, c.got, c.want)
+		}
+	}
+	if !conf.Auth.Enabled || len(conf.Auth.APIKeys) != 1 || conf.Auth.APIKeys[0].Name != "ci" || conf.Auth.SignedURLMaxTTL != "1h" {
+		t.Errorf("got auth %+v", conf.Auth)
+	}
+}
+
+func TestConfigEnvFiles(t *testing.T) {
+	setenv(t, EnvConfigFiles, writeTestConfig(t, "a.hcl", "port = 9001")+string(os.PathListSeparator)+writeTestConfig(t, "b.hcl", "max_size_mb = 7"))
+	conf, _, diags := loadTestConfig(t)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	if conf.Port != 9001 || conf.MaxSizeMB != 7 || len(conf.ConfigFiles) != 2 {
+		t.Errorf("got port %d and max_size_mb %d from %v", conf.Port, conf.MaxSizeMB, conf.ConfigFiles)
+	}
+}
+
+func TestConfigInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		args    []string
+		env     [2]string
+		summary string
+	}{
+		{"port", []string{"-port", "0"}, [2]string{}, `"port"`},
+		{"max size", []string{"-max-size-mb", "0"}, [2]string{}, `"max_size_mb"`},
+		{"concurrency", []string{"-max-concurrent", "0"}, [2]string{}, `"max_concurrent"`},
+		{"serve path", []string{"-serve-path", "/nonexistent/public"}, [2]string{}, `"serve_path"`},
+		{"log level", []string{"-log-level", "loud"}, [2]string{}, `"log_level"`},
+		{"tls pair", []string{"-tls-cert-file", "cert.pem"}, [2]string{}, `"tls_cert_file"`},
+		{"tls version", []string{"-tls-min-version", "0.9"}, [2]string{}, `"tls_min_version"`},
+		{"cipher suite", []string{"-tls-cipher-suite", "TLS_RSA_WITH_RC4_128_SHA"}, [2]string{}, `"tls_cipher_suites"`},
+		{"env", nil, [2]string{"HEICKER_PORT", "eighty"}, "Invalid environment variable"},
+		{"missing file", []string{"-config", "/nonexistent/heicker.hcl"}, [2]string{}, "Failed to read config file"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.env[0] != "" {
+				setenv(t, tc.env[0], tc.env[1])
+			}
+			_, _, diags := loadTestConfig(t, tc.args...)
+			if !diags.HasErrors() {
+				t.Fatal("no errors")
+			}
+			if !strings.Contains(diags.Error(), tc.summary) {
+				t.Errorf("got %v, want an error for %s", diags, tc.summary)
+			}
+		})
+	}
+
+	for name, src := range map[string]string{
+		"unknown attribute": `colour = "blue"`,
+		"no api keys":       `auth { enabled = true }`,
+		"short key":         `auth { api_key "a" { key = "short" } }`,
+		"duplicate key":     `auth { api_key "a" { key = "0123456789abcdef" } api_key "a" { key = "fedcba9876543210" } }`,
+		"unknown format":    `auth { api_key "a" { key = "0123456789abcdef", formats = ["bmp"] } }`,
+		"ttl":               `auth { signed_url_max_ttl = "0s" }`,
+		"rate":              `rate_limit { enabled = true, requests_per_second = 0 }`,
+		"proxy":             `rate_limit { trusted_proxies = ["proxy"] }`,
+		"quota":             `rate_limit { daily_conversions = -1 }`,
+		"quota store":       `rate_limit { quota_store = "file" }`,
+		"quota store path":  `rate_limit { quota_store = "file", quota_store_path = "/nonexistent/quota.json" }`,
+		"megapixels":        `limits { max_megapixels = 0 }`,
+		"syntax":            `port = `,
+	} {
+		_, _, diags := loadTestConfig(t, "-config", writeTestConfig(t, "c.hcl", src))
+		if !diags.HasErrors() {
+			t.Errorf("%s: no errors", name)
+		}
+	}
+}
+
+func TestSetFromString(t *testing.T) {
+	var v struct {
+		S  string
+		B  bool
+		I  int64
+		U  uint8
+		F  float64
+		SL []string
+		IL []int
+		M  map[string]string
+	}
+	rv := reflect.ValueOf(&v).Elem()
+	for _, tc := range []struct {
+		field string
+		in    string
+		ok    bool
+	}{
+		{"S", "text", true},
+		{"B", "true", true},
+		{"B", "yes", false},
+		{"I", "-42", true},
+		{"U", "256", false},
+		{"U", "255", true},
+		{"F", "1.5", true},
+		{"SL", "a, b,c", true},
+		{"IL", "1,x", false},
+		{"IL", "1, 2", true},
+		{"M", "a=b", false},
+	} {
+		if err := setFromString(rv.FieldByName(tc.field), tc.in); (err == nil) != tc.ok {
+			t.Errorf("%s from %q: got error %v", tc.field, tc.in, err)
+		}
+	}
+	if v.S != "text" || !v.B || v.I != -42 || v.U != 255 || v.F != 1.5 || !reflect.DeepEqual(v.SL, []string{"a", "b", "c"}) || !reflect.DeepEqual(v.IL, []int{1, 2}) {
+		t.Errorf("got %+v", v)
+	}
+
+	if err := setFromString(rv.FieldByName("SL"), ""); err != nil || len(v.SL) != 0 {
+		t.Errorf("empty slice: got %v, %v", v.SL, err)
+	}
+}
+
+// loadTestWatchConfig builds a watch config of the config file holding src, watching a temporary directory
+func loadTestWatchConfig(t *testing.T, src string) (*Config, hcl.Diagnostics) {
+	t.Helper()
+	fs := flag.NewFlagSet(cmdWatch, flag.ContinueOnError)
+	conf, diags := buildConfig(cmdWatch, fs, confinator.BuildInfo{})
+	if diags.HasErrors() {
+		t.Fatalf("building config: %v", diags)
+	}
+	dir := t.TempDir()
+	args := []string{"-watch-dir", dir, "-watch-state-file", filepath.Join(dir, "state.json"), "-config", writeTestConfig(t, "w.hcl", src)}
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return conf, conf.load(fs)
+}
+
+func TestWatchConfigInvalid(t *testing.T) {
+	for _, src := range []string{"", "watch {\n  format = \"heif\"\n  out_dir = \"heif\"\n}"} {
+		if _, diags := loadTestWatchConfig(t, src); diags.HasErrors() {
+			t.Fatalf("%s: %v", src, diags)
+		}
+	}
+	for _, tc := range []struct {
+		src     string
+		summary string
+	}{
+		{`watch { stable_for = "0s" }`, `"stable_for"`},
+		{`watch { stable_for = "1ns" }`, `"stable_for"`},
+		{`watch { poll_interval = "10ms" }`, `"poll_interval"`},
+		{`watch { poll_interval = "0s" }`, `"poll_interval"`},
+		{`watch { format = "bmp" }`, `"format"`},
+		{`watch { format = "heif" }`, `"out_dir"`},
+		{`watch { originals = "shred" }`, `"originals"`},
+		{`watch { parallel = 0 }`, `"parallel"`},
+	} {
+		_, diags := loadTestWatchConfig(t, tc.src)
+		if !diags.HasErrors() || !strings.Contains(diags.Error(), tc.summary) {
+			t.Errorf("%s: got %v, want an error for %s", tc.src, diags, tc.summary)
+		}
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	path := writeTestConfig(t, "a.hcl", "port = 9000\nmax_concurrent = 3")
+	prev, fs, diags := loadTestConfig(t, "-config", path, "-port", "9100")
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("port = 9000\nmax_concurrent = 5"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	next, diags := reloadConfig(prev, fs)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	if next.Port != 9100 || next.MaxConcurrent != 5 || next.ServePath != prev.ServePath {
+		t.Errorf("got port %d and max_concurrent %d, want the flag's 9100 and the file's 5", next.Port, next.MaxConcurrent)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("max_concurrent = 0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if next, diags := reloadConfig(prev, fs); !diags.HasErrors() || next != nil {
+		t.Errorf("reloaded an invalid config")
+	}
+}
@@ -0,0 +1,127 @@
+package convert
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"time"
+
+	"github.com/dcarbone/go-heicker/heif"
+)
+
+// animation collects the frames of an animated output
+type animation interface {
+	add(img image.Image, d time.Duration) error
+	// encode writes the animation to w, returning whether exif and xmp were included
+	encode(w io.Writer, exif, xmp []byte) (bool, bool, error)
+}
+
+func newAnimation(f Format) animation {
+	if f == FormatGIF {
+		return new(gifAnimation)
+	}
+	return new(webpAnimation)
+}
+
+// defaultFrameDuration is used for samples without a duration
+const defaultFrameDuration = 100 * time.Millisecond
+
+// animationFrame is a sample of a track kept in an animation
+type animationFrame struct {
+	sample   int // numbered from 0
+	duration time.Duration
+}
+
+// animationFrames returns the samples of t from opts.FirstFrame to opts.LastFrame, dropping frames so they play at no
+// more than opts.MaxFPS.  The duration of each dropped frame is added to the frame kept before it.
+func animationFrames(t *heif.Track, opts Options) ([]animationFrame, error) {
+	first, last := opts.FirstFrame, opts.LastFrame
+	if first == 0 {
+		first = 1
+	}
+	if last == 0 || last > len(t.Samples) {
+		last = len(t.Samples)
+	}
+	if first > last {
+		return nil, newError(ErrImageNotFound, fmt.Errorf("frame %d requested, track %d has %d", first, t.ID, len(t.Samples)))
+	}
+
+	var interval time.Duration
+	if opts.MaxFPS > 0 {
+		// allow for timescales that do not divide a second exactly
+		interval = time.Duration(float64(time.Second)/opts.MaxFPS) - time.Millisecond
+	}
+	var (
+		frames        []animationFrame
+		elapsed, next time.Duration
+	)
+	for i := first - 1; i < last; i++ {
+		d := defaultFrameDuration
+		if s := t.Samples[i]; s.Duration > 0 && t.Timescale > 0 {
+			d = time.Duration(s.Duration) * time.Second / time.Duration(t.Timescale)
+		}
+		if len(frames) == 0 || elapsed >= next {
+			frames = append(frames, animationFrame{sample: i, duration: d})
+			next = elapsed + interval
+		} else {
+			frames[len(frames)-1].duration += d
+		}
+		elapsed += d
+	}
+	return frames, nil
+}
+
+// convertAnimation converts the frames of t selected by opts to an animation.  Frames are decoded in order, starting
+// from the sync sample before the first, and each transformed as a still would be.
+func convertAnimation(ctx context.Context, t *heif.Track, w io.Writer, exif, xmp []byte, opts Options) (Result, error) {
+	res := Result{Format: opts.Format, Track: t.ID}
+	frames, err := animationFrames(t, opts)
+	if err != nil {
+		return res, err
+	}
+	if max := opts.Limits.MaxImages; max > 0 && len(frames) > max {
+		return res, newError(ErrLimitExceeded, fmt.Errorf("animation has %d frames, exceeding %d", len(frames), max))
+	}
+
+	n := syncSample(t, frames[0].sample)
+	fd, err := newFrameDecoder(t, n, opts)
+	if err != nil {
+		return res, decodeError(ctx, err)
+	}
+	defer fd.free()
+
+	anim := newAnimation(opts.Format)
+	for _, f := range frames {
+		var ycc *image.YCbCr
+		for ; n <= f.sample; n++ {
+			if ycc, err = fd.frame(ctx); err == io.EOF {
+				err = fmt.Errorf("track %d ended before frame %d", t.ID, n+1)
+			}
+			if err != nil {
+				return res, decodeError(ctx, err)
+			}
+		}
+
+		ycc, res.Rotated = rotate(ycc, nil, opts.Rotation)
+		if ycc, res.Resized, err = resize(ycc, opts); err != nil {
+			return res, err
+		}
+		res.Width, res.Height = ycc.Rect.Dx(), ycc.Rect.Dy()
+		if err := anim.add(ycc, f.duration); err != nil {
+			return res, newError(ErrEncodeFailed, err)
+		}
+	}
+	res.Frames = len(frames)
+	exif = prepareEXIF(exif, opts, res)
+	xmp = prepareXMP(xmp, opts, res)
+
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+
+	if res.EXIF, res.XMP, err = anim.encode(w, exif, xmp); err != nil {
+		return res, newError(ErrEncodeFailed, err)
+	}
+	return res, nil
+}
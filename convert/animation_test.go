@@ -0,0 +1,192 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+	"time"
+
+	"github.com/dcarbone/go-heicker/heif"
+)
+
+func TestAnimationFrames(t *testing.T) {
+	// four 250ms samples and one without a duration
+	track := &heif.Track{ID: 1, Timescale: 1000}
+	for _, d := range []uint32{250, 250, 250, 250, 0} {
+		track.Samples = append(track.Samples, heif.Sample{Duration: d})
+	}
+	ms := func(v ...int) []time.Duration {
+		out := make([]time.Duration, len(v))
+		for i := range v {
+			out[i] = time.Duration(v[i]) * time.Millisecond
+		}
+		return out
+	}
+
+	for _, tc := range []struct {
+		name    string
+		opts    Options
+		samples []int
+		lengths []time.Duration
+	}{
+		{"all", Options{}, []int{0, 1, 2, 3, 4}, ms(250, 250, 250, 250, 100)},
+		{"range", Options{FirstFrame: 2, LastFrame: 3}, []int{1, 2}, ms(250, 250)},
+		{"past the end", Options{FirstFrame: 4, LastFrame: 10}, []int{3, 4}, ms(250, 100)},
+		{"fps cap", Options{MaxFPS: 2}, []int{0, 2, 4}, ms(500, 500, 100)},
+		{"fps above the rate", Options{MaxFPS: 10}, []int{0, 1, 2, 3, 4}, ms(250, 250, 250, 250, 100)},
+		{"slow", Options{MaxFPS: 0.5, FirstFrame: 2}, []int{1}, ms(850)},
+	} {
+		frames, err := animationFrames(track, tc.opts)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		ok := len(frames) == len(tc.samples)
+		for i := 0; ok && i < len(frames); i++ {
+			ok = frames[i].sample == tc.samples[i] && frames[i].duration == tc.lengths[i]
+		}
+		if !ok {
+			t.Errorf("%s: got %+v, want samples %v lasting %v", tc.name, frames, tc.samples, tc.lengths)
+		}
+	}
+
+	if _, err := animationFrames(track, Options{FirstFrame: 6}); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("got %v, want %v", err, ErrImageNotFound)
+	}
+}
+
+func TestGIFAnimation(t *testing.T) {
+	a := new(gifAnimation)
+	for _, d := range []time.Duration{33 * time.Millisecond, 33 * time.Millisecond, 34 * time.Millisecond, time.Millisecond} {
+		img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+		img.SetNRGBA(1, 1, color.NRGBA{R: 200, A: 0xff})
+		if err := a.add(img, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if _, _, err := a.encode(&buf, []byte("exif"), nil); err != nil {
+		t.Fatal(err)
+	}
+	g, err := gif.DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rounding keeps the animation in time, though no delay is shorter than minGIFDelay
+	want := []int{3, 4, 3, minGIFDelay}
+	for i, d := range g.Delay {
+		if d != want[i] {
+			t.Errorf("got delays %v, want %v", g.Delay, want)
+			break
+		}
+	}
+	if r, _, _, _ := g.Image[0].At(1, 1).RGBA(); r>>8 != 200 {
+		t.Errorf("got red %d", r>>8)
+	}
+
+	if _, _, err := new(gifAnimation).encode(&buf, nil, nil); err == nil {
+		t.Error("expected an error for an animation without frames")
+	}
+}
+
+func TestMedianCut(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	colors := []color.RGBA{{255, 0, 0, 255}, {0, 128, 0, 255}, {8, 8, 248, 255}}
+	for i := range img.Pix[:len(img.Pix)/4] {
+		c := colors[i%len(colors)]
+		img.Pix[4*i], img.Pix[4*i+1], img.Pix[4*i+2], img.Pix[4*i+3] = c.R, c.G, c.B, c.A
+	}
+	p := medianCut{}.Quantize(make(color.Palette, 0, 256), img)
+	if len(p) != len(colors) {
+		t.Fatalf("got a palette of %d colors, want %d", len(p), len(colors))
+	}
+	for _, c := range colors {
+		if p[p.Index(c)] != c {
+			t.Errorf("%v is missing from %v", c, p)
+		}
+	}
+
+	// a gradient of more colors than fit
+	pm := paletted(testNRGBA(256, 64, false))
+	if len(pm.Palette) > 256 || len(pm.Palette) < 200 {
+		t.Errorf("got a palette of %d colors", len(pm.Palette))
+	}
+}
+
+func TestConvertAnimation(t *testing.T) {
+	hvcC, samples := hevcTiles(t, "hevc.heic")
+	seq := sequenceFile(hvcC, samples, 20)
+
+	for _, tc := range []struct {
+		opts   Options
+		frames int
+		width  int
+		delays []int
+	}{
+		{Options{Format: FormatGIF}, 3, 64, []int{20, 20, 20}},
+		{Options{Format: FormatGIF, Track: 1, FirstFrame: 2}, 2, 64, []int{20, 20}},
+		{Options{Format: FormatGIF, MaxFPS: 4, Width: 32}, 2, 32, []int{40, 20}},
+		{Options{Format: FormatWebP, LastFrame: 2}, 2, 64, nil},
+	} {
+		var buf bytes.Buffer
+		res, err := Convert(context.Background(), bytes.NewReader(seq), &buf, tc.opts)
+		if err != nil || res.Frames != tc.frames || res.Track != 1 || res.Frame != 0 || res.Width != tc.width {
+			t.Fatalf("%+v: got %+v, %v", tc.opts, res, err)
+		}
+		if tc.opts.Format == FormatWebP {
+			fourccs, _ := webpChunks(t, buf.Bytes())
+			if len(fourccs) != 2+tc.frames || fourccs[1] != "ANIM" {
+				t.Errorf("%+v: got chunks %q", tc.opts, fourccs)
+			}
+			continue
+		}
+		g, err := gif.DecodeAll(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(g.Image) != tc.frames || g.Image[0].Bounds().Dx() != tc.width {
+			t.Fatalf("%+v: got %d frames of %v", tc.opts, len(g.Image), g.Image[0].Bounds())
+		}
+		for i := range tc.delays {
+			if g.Delay[i] != tc.delays[i] {
+				t.Errorf("%+v: got delays %v, want %v", tc.opts, g.Delay, tc.delays)
+				break
+			}
+		}
+	}
+
+	// a frame of an animated format is a still
+	var buf bytes.Buffer
+	if res, err := Convert(context.Background(), bytes.NewReader(seq), &buf, Options{Format: FormatWebP, Track: 1, Frame: 2}); err != nil || res.Frame != 2 || res.Frames != 0 {
+		t.Fatalf("got %+v, %v", res, err)
+	}
+	if fourccs, _ := webpChunks(t, buf.Bytes()); len(fourccs) != 1 || fourccs[0] != "VP8L" {
+		t.Errorf("got chunks %q", fourccs)
+	}
+
+	for _, tc := range []struct {
+		name string
+		opts Options
+		kind error
+	}{
+		{"frame limit", Options{Format: FormatGIF, Limits: Limits{MaxImages: 2}}, ErrLimitExceeded},
+		{"no frames", Options{Format: FormatGIF, FirstFrame: 4}, ErrImageNotFound},
+		{"last before first", Options{Format: FormatGIF, FirstFrame: 3, LastFrame: 2}, ErrInvalidOptions},
+		{"frame and range", Options{Format: FormatGIF, Track: 1, Frame: 1, LastFrame: 2}, ErrInvalidOptions},
+		{"fps", Options{Format: FormatGIF, MaxFPS: 101}, ErrInvalidOptions},
+	} {
+		if _, err := Convert(context.Background(), bytes.NewReader(seq), &buf, tc.opts); !errors.Is(err, tc.kind) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.kind)
+		}
+	}
+
+	// ConvertAll makes one animation of each track
+	buf.Reset()
+	results, err := ConvertAll(context.Background(), bytes.NewReader(seq), &buf, Options{Format: FormatGIF, LastFrame: 2})
+	if err != nil || len(results) != 1 || results[0].Frames != 2 {
+		t.Fatalf("got %+v, %v", results, err)
+	}
+}
@@ -0,0 +1,273 @@
+package convert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/dcarbone/go-heicker/heif"
+)
+
+// auxConvertible are the auxiliary image types that can be selected by Options.Aux
+var auxConvertible = []string{AuxDepth, AuxMatte}
+
+// ParseAux returns the auxiliary image type with the provided name, case-insensitively
+func ParseAux(name string) (string, error) {
+	for _, a := range auxConvertible {
+		if strings.EqualFold(a, name) {
+			return a, nil
+		}
+	}
+	return "", newError(ErrInvalidOptions, fmt.Errorf("unsupported auxiliary image %q, expected one of depth, matte", name))
+}
+
+// auxType returns the URN of an auxiliary image and its type, one of the Aux constants
+func auxType(it *heif.Item) (typ, urn string) {
+	urn, _ = it.AuxiliaryType()
+	if typ = auxTypes[urn]; typ == "" {
+		typ = AuxOther
+	}
+	return typ, urn
+}
+
+// auxImages returns the auxiliary images of type typ belonging to the image with the provided id, in the order they
+// are declared
+func auxImages(hf *heif.File, id uint32, typ string) ([]*heif.Item, error) {
+	items, err := hf.Items()
+	if err != nil {
+		return nil, err
+	}
+	var out []*heif.Item
+	for _, it := range items {
+		if t, _ := auxType(it); t == typ && imageItemTypes[it.Info.ItemType] && referencesItem(it, "auxl", id) {
+			out = append(out, it)
+		}
+	}
+	return out, nil
+}
+
+// samplePlane is a single channel image, such as a depth map, with samples from 0 to 1
+type samplePlane struct {
+	pix  []float32
+	w, h int
+}
+
+// transform returns a new plane where each sample is read from p via fn, which maps destination to source coordinates
+func (p samplePlane) transform(w, h int, fn func(x, y int) (int, int)) samplePlane {
+	out := samplePlane{pix: make([]float32, w*h), w: w, h: h}
+	for y := 0; y < h; y++ {
+		row := out.pix[y*w : (y+1)*w]
+		for x := range row {
+			sx, sy := fn(x, y)
+			row[x] = p.pix[sy*p.w+sx]
+		}
+	}
+	return out
+}
+
+// orient applies steps as rotateYCbCr and flipYCbCr do
+func (p samplePlane) orient(steps []orientStep) samplePlane {
+	for _, s := range steps {
+		q := p
+		switch {
+		case s.flip && s.horizontal:
+			p = q.transform(q.w, q.h, func(x, y int) (int, int) { return q.w - 1 - x, y })
+		case s.flip:
+			p = q.transform(q.w, q.h, func(x, y int) (int, int) { return x, q.h - 1 - y })
+		case s.turns%4 == 1:
+			p = q.transform(q.h, q.w, func(x, y int) (int, int) { return y, q.h - 1 - x })
+		case s.turns%4 == 2:
+			p = q.transform(q.w, q.h, func(x, y int) (int, int) { return q.w - 1 - x, q.h - 1 - y })
+		case s.turns%4 == 3:
+			p = q.transform(q.h, q.w, func(x, y int) (int, int) { return q.w - 1 - y, x })
+		}
+	}
+	return p
+}
+
+// resample returns a w x h plane resampled from win, as plane.resample does without rounding to bytes
+func (p samplePlane) resample(w, h int, win window, k kernel) samplePlane {
+	var (
+		cols = contributions(w, win.x, win.w, p.w, k)
+		rows = contributions(h, win.y, win.h, p.h, k)
+		tmp  = make([]float32, w*p.h)
+	)
+	for y := 0; y < p.h; y++ {
+		src, dst := p.pix[y*p.w:(y+1)*p.w], tmp[y*w:(y+1)*w]
+		for x, c := range cols {
+			var v float32
+			for j, wt := range c.weights {
+				v += src[c.start+j] * wt
+			}
+			dst[x] = v
+		}
+	}
+
+	out := samplePlane{pix: make([]float32, w*h), w: w, h: h}
+	for y, r := range rows {
+		dst := out.pix[y*w : (y+1)*w]
+		for x := range dst {
+			var v float32
+			for j, wt := range r.weights {
+				v += tmp[(r.start+j)*w+x] * wt
+			}
+			dst[x] = v
+		}
+	}
+	return out
+}
+
+// resize applies the requested crop and size as resize does, returning true if the samples were changed
+func (p samplePlane) resize(opts Options) (samplePlane, bool, error) {
+	w, h, win, err := outputSize(p.w, p.h, opts)
+	if err != nil {
+		return p, false, err
+	}
+	if win.w == float64(w) && win.h == float64(h) && win.x == math.Trunc(win.x) && win.y == math.Trunc(win.y) {
+		if w == p.w && h == p.h {
+			return p, false, nil
+		}
+		x0, y0 := int(win.x), int(win.y)
+		return p.transform(w, h, func(x, y int) (int, int) { return x0 + x, y0 + y }), true, nil
+	}
+	k, ok := kernels[opts.Filter]
+	if !ok {
+		k = kernels[FilterLanczos]
+	}
+	return p.resample(w, h, win, k), true, nil
+}
+
+// image quantizes the samples to a grayscale image of 8 or 16 bits
+func (p samplePlane) image(bits int) image.Image {
+	max := float32(int(1)<<uint(bits) - 1)
+	quantize := func(v float32) uint16 {
+		switch {
+		case v <= 0:
+			return 0
+		case v >= 1:
+			return uint16(max)
+		default:
+			return uint16(v*max + 0.5)
+		}
+	}
+	if bits == 8 {
+		g := image.NewGray(image.Rect(0, 0, p.w, p.h))
+		for i, v := range p.pix {
+			g.Pix[i] = uint8(quantize(v))
+		}
+		return g
+	}
+	g := image.NewGray16(image.Rect(0, 0, p.w, p.h))
+	for i, v := range p.pix {
+		q := quantize(v)
+		g.Pix[2*i], g.Pix[2*i+1] = uint8(q>>8), uint8(q)
+	}
+	return g
+}
+
+// samplesOf returns the luma samples of img, the decoded auxiliary image
+func samplesOf(img image.Image) (samplePlane, error) {
+	b := img.Bounds()
+	p := samplePlane{pix: make([]float32, 0, b.Dx()*b.Dy()), w: b.Dx(), h: b.Dy()}
+	switch img := img.(type) {
+	case *image.Gray:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for _, v := range img.Pix[img.PixOffset(b.Min.X, y):img.PixOffset(b.Max.X, y)] {
+				p.pix = append(p.pix, float32(v)/0xff)
+			}
+		}
+	case *image.Gray16:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			row := img.Pix[img.PixOffset(b.Min.X, y):img.PixOffset(b.Max.X, y)]
+			for i := 0; i < len(row); i += 2 {
+				p.pix = append(p.pix, float32(uint16(row[i])<<8|uint16(row[i+1]))/0xffff)
+			}
+		}
+	case *image.YCbCr:
+		// encoders without monochrome support store the samples as luma
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for _, v := range img.Y[img.YOffset(b.Min.X, y) : img.YOffset(b.Max.X-1, y)+1] {
+				p.pix = append(p.pix, float32(v)/0xff)
+			}
+		}
+	default:
+		return p, fmt.Errorf("unexpected auxiliary image type %T", img)
+	}
+	return p, nil
+}
+
+// normalizeDepth maps the samples of a depth image to inverse depth, 0 at the far plane and 1 at the near plane.
+// Samples representing inverse depth or disparity are already so, those of uniform depth are converted using the
+// near and far planes of dr.
+func normalizeDepth(p samplePlane, dr *heif.DepthRepresentation) {
+	if dr == nil || dr.Type != heif.DepthUniformZ || !dr.HasZNear || !dr.HasZFar || dr.ZNear <= 0 || dr.ZFar <= dr.ZNear {
+		return
+	}
+	near, far := dr.ZNear, dr.ZFar
+	for i, v := range p.pix {
+		z := near + float64(v)*(far-near)
+		p.pix[i] = float32((1/z - 1/far) / (1/near - 1/far))
+	}
+}
+
+// convertAux converts the first auxiliary image of type opts.Aux belonging to base to a grayscale png.  Depth images
+// are normalized by their depth representation information, if any.
+func convertAux(ctx context.Context, hf *heif.File, base *heif.Item, w io.Writer, opts Options) (Result, error) {
+	res := Result{Format: FormatPNG}
+	if base == nil {
+		return res, newError(ErrImageNotFound, errors.New("image sequences have no auxiliary images"))
+	}
+	auxs, err := auxImages(hf, base.ID, opts.Aux)
+	if err != nil {
+		return res, heifError(err)
+	}
+	if len(auxs) == 0 {
+		return res, newError(ErrImageNotFound, fmt.Errorf("image %d has no %s image", base.ID, opts.Aux))
+	}
+	it := auxs[0]
+	res.Item = it.ID
+
+	img, err := decodeAuxItem(hf, it, opts)
+	if err != nil {
+		return res, decodeError(ctx, err)
+	}
+	bits := opts.BitDepth
+	if bits == 0 {
+		bits = 8
+		if _, ok := img.(*image.Gray16); ok {
+			bits = 16
+		}
+	}
+	p, err := samplesOf(img)
+	if err != nil {
+		return res, newError(ErrDecodeFailed, err)
+	}
+	if opts.Aux == AuxDepth {
+		dr, _, err := it.DepthRepresentation()
+		if err != nil {
+			return res, newError(ErrDecodeFailed, err)
+		}
+		normalizeDepth(p, dr)
+	}
+
+	steps := orientSteps(it, opts.Rotation)
+	p, res.Rotated = p.orient(steps), len(steps) > 0
+	if p, res.Resized, err = p.resize(opts); err != nil {
+		return res, err
+	}
+	res.Width, res.Height = p.w, p.h
+
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+
+	if err := png.Encode(w, p.image(bits)); err != nil {
+		return res, newError(ErrEncodeFailed, err)
+	}
+	return res, nil
+}
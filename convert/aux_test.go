@@ -0,0 +1,116 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"testing"
+)
+
+const (
+	depthURN = "urn:mpeg:mpegB:cicp:systems:auxiliary:depth"
+	matteURN = "urn:com:apple:photo:2018:aux:portraiteffectsmatte"
+)
+
+// depthSEI is an auxC subtype holding depth representation information of uniform_z with a near plane of 1 and a far
+// plane of 3: the NAL unit length, a prefix SEI NAL unit header, payload type 177 of 5 bytes and the rbsp trailing bits
+var depthSEI = []byte{0x00, 0x0a, 0x4e, 0x01, 0xb1, 0x05, 0xc6, 0x3e, 0x01, 0x00, 0x20, 0x80}
+
+// auxFile returns a file whose primary image, the first tile of hevc.heic, has the monochrome ramp of ramp.heic as its
+// depth map with depthSubtype, and a matte of the same ramp rotated by a quarter turn
+func auxFile(t *testing.T, depthSubtype []byte) []byte {
+	hvcC, tiles := hevcTiles(t, "hevc.heic")
+	rampC, ramp := hevcTiles(t, "ramp.heic")
+	return itemFile(t, 1,
+		testItem{typ: "hvc1", data: tiles[0], props: [][]byte{hvcC, ispe(64, 64)}},
+		testItem{typ: "hvc1", data: ramp[0], hidden: true, props: [][]byte{rampC, ispe(64, 64), auxC(depthURN, depthSubtype)},
+			refs: map[string][]uint16{"auxl": {1}}},
+		testItem{typ: "hvc1", data: ramp[0], hidden: true, props: [][]byte{rampC, ispe(64, 64), auxC(matteURN, nil), testBox("irot", []byte{1})},
+			refs: map[string][]uint16{"auxl": {1}}},
+	)
+}
+
+func TestConvertAux(t *testing.T) {
+	plain, withDR := auxFile(t, nil), auxFile(t, depthSEI)
+
+	info, err := Probe(bytes.NewReader(withDR))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Auxiliary) != 2 || info.Auxiliary[0].Type != AuxDepth || info.Auxiliary[0].BitDepth != 8 || info.Auxiliary[1].Type != AuxMatte {
+		t.Fatalf("got %+v", info.Auxiliary)
+	}
+	if di := info.Auxiliary[0].DepthRepresentation; di == nil || di.Type != "uniform_z" || di.ZNear == nil || *di.ZNear != 1 || di.ZFar == nil || *di.ZFar != 3 || di.DMin != nil {
+		t.Errorf("got depth representation %+v", di)
+	}
+
+	convertPNG := func(data []byte, opts Options) (Result, image.Image) {
+		t.Helper()
+		var buf bytes.Buffer
+		res, err := Convert(context.Background(), bytes.NewReader(data), &buf, opts)
+		if err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		img, err := png.Decode(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, img
+	}
+	gray := func(img image.Image, x, y int) int {
+		return int(img.(*image.Gray).GrayAt(x, y).Y)
+	}
+	near := func(got, want int) bool { return got >= want-4 && got <= want+4 }
+
+	// the ramp as it is, or as inverse depth with depth representation information, 0 at the far plane
+	res, img := convertPNG(plain, Options{Aux: AuxDepth, Format: FormatPNG})
+	if res != (Result{Format: FormatPNG, Width: 64, Height: 64, Item: 2}) || !near(gray(img, 0, 10), 0) || !near(gray(img, 63, 10), 255) {
+		t.Errorf("got %+v from %d to %d", res, gray(img, 0, 10), gray(img, 63, 10))
+	}
+	_, img = convertPNG(withDR, Options{Aux: AuxDepth, Format: FormatPNG})
+	if !near(gray(img, 0, 10), 255) || !near(gray(img, 63, 10), 0) || !near(gray(img, 21, 10), 102) {
+		t.Errorf("got %d, %d and %d", gray(img, 0, 10), gray(img, 21, 10), gray(img, 63, 10))
+	}
+
+	// the matte's irot is applied, then the requested size
+	res, img = convertPNG(plain, Options{Aux: AuxMatte, Format: FormatPNG, Rotation: RotateAuto, Width: 32})
+	if res != (Result{Format: FormatPNG, Width: 32, Height: 32, Item: 3, Rotated: true, Resized: true}) || !near(gray(img, 10, 31), 0) || !near(gray(img, 10, 0), 255) {
+		t.Errorf("got %+v from %d to %d", res, gray(img, 10, 31), gray(img, 10, 0))
+	}
+	_, img = convertPNG(plain, Options{Aux: AuxDepth, Format: FormatPNG, BitDepth: 16, Crop: image.Rect(0, 0, 10, 10)})
+	if g, ok := img.(*image.Gray16); !ok || img.Bounds() != image.Rect(0, 0, 10, 10) || g.Gray16At(9, 0).Y&0xff != g.Gray16At(9, 0).Y>>8 {
+		t.Errorf("got a %T of %v", img, img.Bounds())
+	}
+
+	hevc := readTestdata(t, "hevc.heic")
+	for _, tc := range []struct {
+		name string
+		data []byte
+		opts Options
+		kind error
+	}{
+		{"no depth", hevc, Options{Aux: AuxDepth, Format: FormatPNG}, ErrImageNotFound},
+		{"unknown aux", plain, Options{Aux: "alpha", Format: FormatPNG}, ErrInvalidOptions},
+		{"jpeg", plain, Options{Aux: AuxDepth, Format: FormatJPEG}, ErrInvalidOptions},
+		{"track", plain, Options{Aux: AuxDepth, Format: FormatPNG, Track: 1}, ErrInvalidOptions},
+		{"thumbnail", plain, Options{Aux: AuxDepth, Format: FormatPNG, Thumbnail: ThumbnailEmbedded}, ErrInvalidOptions},
+		{"bit depth", plain, Options{Aux: AuxDepth, Format: FormatPNG, BitDepth: 12}, ErrInvalidOptions},
+		{"pixel limit", plain, Options{Aux: AuxDepth, Format: FormatPNG, Limits: Limits{MaxPixels: 64*64 - 1}}, ErrLimitExceeded},
+	} {
+		if _, err := Convert(context.Background(), bytes.NewReader(tc.data), ioutil.Discard, tc.opts); !errors.Is(err, tc.kind) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.kind)
+		}
+	}
+}
+
+func TestParseAux(t *testing.T) {
+	if a, err := ParseAux("Depth"); err != nil || a != AuxDepth {
+		t.Errorf("got %q, %v", a, err)
+	}
+	if _, err := ParseAux("alpha"); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("got %v, want %v", err, ErrInvalidOptions)
+	}
+}
@@ -0,0 +1,40 @@
+package convert
+
+import (
+	"errors"
+	"image"
+
+	"github.com/dcarbone/go-heicker/dav1d"
+	"github.com/dcarbone/go-heicker/heif"
+)
+
+// decodeAV1Picture decodes an av01 item, as found in AVIF files, as returned by dav1d, checking its size against the
+// limits of opts first.  The picture must be of the size of the item.  Items cannot be decoded when libdav1d is not
+// installed, failing as an unsupported codec.
+func decodeAV1Picture(hf *heif.File, item *heif.Item, opts Options) (image.Image, error) {
+	if _, ok := item.AV1Config(); !ok {
+		return nil, errors.New("item has no av1C")
+	}
+	width, height, ok := item.SpatialExtents()
+	if !ok {
+		return nil, errors.New("item has no dimensions")
+	}
+	if err := checkPixels(width, height, opts); err != nil {
+		return nil, err
+	}
+
+	data, err := hf.GetItemData(item)
+	if err != nil {
+		return nil, err
+	}
+
+	dec, err := dav1d.NewDecoder(width, height)
+	if err == dav1d.ErrUnavailable {
+		return nil, newError(ErrUnsupportedCodec, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Free()
+	return dec.DecodeImage(data)
+}
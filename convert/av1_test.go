@@ -0,0 +1,101 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"io/ioutil"
+	"testing"
+
+	"github.com/dcarbone/go-heicker/dav1d"
+)
+
+// meanDifference returns the mean absolute difference of the RGB samples of a and b
+func meanDifference(a, b image.Image) float64 {
+	var sum, n float64
+	r := a.Bounds()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			ar, ag, ab, _ := a.At(x, y).RGBA()
+			br, bg, bb, _ := b.At(x, y).RGBA()
+			for _, d := range []int{int(ar>>8) - int(br>>8), int(ag>>8) - int(bg>>8), int(ab>>8) - int(bb>>8)} {
+				if d < 0 {
+					d = -d
+				}
+				sum += float64(d)
+			}
+			n += 3
+		}
+	}
+	return sum / n
+}
+
+func TestConvertAV1(t *testing.T) {
+	// av1.avif codes the image of the first grid of hevc.heic
+	data := readTestdata(t, "av1.avif")
+	info, err := Probe(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Brand != "avif" || info.Codec != "av01" || info.BitDepth != 8 || info.ChromaFormat != "4:2:0" || info.Width != 64 || info.Height != 48 {
+		t.Errorf("got %+v", info)
+	}
+
+	var buf bytes.Buffer
+	if _, err := Convert(context.Background(), bytes.NewReader(data), &buf, Options{Format: FormatPNG}); errors.Is(err, dav1d.ErrUnavailable) {
+		if !errors.Is(err, ErrUnsupportedCodec) {
+			t.Errorf("got %v, want %v", err, ErrUnsupportedCodec)
+		}
+		t.Skip(err)
+	}
+	_, img := convertPNG(t, data, Options{})
+	_, want := convertPNG(t, readTestdata(t, "hevc.heic"), Options{Index: 1})
+	if img.Bounds() != want.Bounds() {
+		t.Fatalf("got %v, want %v", img.Bounds(), want.Bounds())
+	}
+	if d := meanDifference(img, want); d > 4 {
+		t.Errorf("differs from the hevc image by %.1f on average", d)
+	}
+
+	// the av1C property is required, and the picture must be of the size of the item
+	noConfig := itemFile(t, 1, testItem{typ: "av01", data: make([]byte, 16), props: [][]byte{ispe(64, 48)}})
+	i := bytes.Index(data, []byte("ispe"))
+	larger, smaller := append([]byte(nil), data...), append([]byte(nil), data...)
+	copy(larger[i+8:], be(uint32(64), uint32(64)))
+	copy(smaller[i+8:], be(uint32(32), uint32(48)))
+	for _, tc := range []struct {
+		name string
+		data []byte
+		opts Options
+		kind error
+	}{
+		{"no av1C", noConfig, Options{}, ErrDecodeFailed},
+		{"larger item", larger, Options{}, ErrDecodeFailed},
+		{"smaller item", smaller, Options{}, ErrDecodeFailed},
+		{"pixel limit", data, Options{Limits: Limits{MaxPixels: 64*48 - 1}}, ErrLimitExceeded},
+	} {
+		if _, err := Convert(context.Background(), bytes.NewReader(tc.data), ioutil.Discard, tc.opts); !errors.Is(err, tc.kind) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.kind)
+		}
+	}
+}
+
+func TestAV1ChromaFormat(t *testing.T) {
+	for _, tc := range []struct {
+		av1C []byte
+		bits int
+		want string
+	}{
+		{[]byte{0x81, 0x00, 0x0c, 0x00}, 8, "4:2:0"},
+		{[]byte{0x81, 0x20, 0x48, 0x00}, 10, "4:2:2"},
+		{[]byte{0x81, 0x40, 0x60, 0x00}, 12, "4:4:4"},
+		{[]byte{0x81, 0x00, 0x1c, 0x00}, 8, "monochrome"},
+	} {
+		data := itemFile(t, 1, testItem{typ: "av01", props: [][]byte{testBox("av1C", tc.av1C), ispe(8, 8)}})
+		info, err := Probe(bytes.NewReader(data))
+		if err != nil || info.BitDepth != tc.bits || info.ChromaFormat != tc.want {
+			t.Errorf("%x: got %+v, %v", tc.av1C, info, err)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+// Package convert decodes HEIF images, as produced by Apple devices, and encodes them as jpeg, png, gif, webp or heif.
+// Image sequences can be converted to animated gif or webp.
+package convert
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dcarbone/go-heicker/heif"
+)
+
+// Result describes a successful conversion
+type Result struct {
+	Format Format
+	// Width and Height are those of the output image, after any rotation
+	Width  int
+	Height int
+	// Rotated is true if the output pixels were rotated or mirrored
+	Rotated bool
+	// Resized is true if the output was cropped or resized
+	Resized bool
+	// Thumbnail is true if an embedded thumbnail was converted rather than the image itself
+	Thumbnail bool
+	// Item is the ID of the image converted, or Track and Frame those of the image sequence frame.  Animations have
+	// a Track and the number of Frames they hold.
+	Item   uint32
+	Track  uint32
+	Frame  int
+	Frames int
+	// EXIF and XMP are true if EXIF or XMP data was written to the output
+	EXIF bool
+	XMP  bool
+	// GainMap is true if the output is an Ultra HDR jpeg holding the HDR gain map of the image
+	GainMap bool
+}
+
+// Converter converts HEIF images.  It is safe for concurrent use.
+type Converter struct {
+	defaults Options
+}
+
+// New returns a Converter using defaults for any option left unset when calling Convert.  Unset defaults use
+// FormatJPEG, DefaultQuality, RotateNone, MetadataKeep, FitContain, FilterLanczos, ThumbnailNone, GainMapKeep,
+// HEIFCodecJPEG, and the built-in ceilings of Limits.
+func New(defaults Options) *Converter {
+	c := new(Converter)
+	c.defaults = defaults.merge(Options{
+		Format:    FormatJPEG,
+		Quality:   DefaultQuality,
+		Rotation:  RotateNone,
+		Metadata:  MetadataKeep,
+		Fit:       FitContain,
+		Filter:    FilterLanczos,
+		Thumbnail: ThumbnailNone,
+		GainMap:   GainMapKeep,
+		HEIFCodec: HEIFCodecJPEG,
+	})
+	return c
+}
+
+var defaultConverter = New(Options{})
+
+// Convert converts the primary image of r using a Converter with no defaults
+func Convert(ctx context.Context, r io.ReaderAt, w io.Writer, opts Options) (Result, error) {
+	return defaultConverter.Convert(ctx, r, w, opts)
+}
+
+// ConvertAll converts every image of r using a Converter with no defaults
+func ConvertAll(ctx context.Context, r io.ReaderAt, w io.Writer, opts Options) ([]Result, error) {
+	return defaultConverter.ConvertAll(ctx, r, w, opts)
+}
+
+// Convert decodes the image of r selected by opts, the primary image by default, or its thumbnail, and writes it to
+// w.  When a track is selected without a frame and the format is animated, its frames are converted to an animation
+// instead, and when Options.Aux is set one of its auxiliary images is converted.  Nothing is written to w unless every
+// image was decoded successfully.
+func (c *Converter) Convert(ctx context.Context, r io.ReaderAt, w io.Writer, opts Options) (Result, error) {
+	opts, err := c.options(opts)
+	if err != nil {
+		return Result{}, err
+	}
+	if !isHEIF(r) {
+		return Result{Format: opts.Format}, newError(ErrNotHEIF, nil)
+	}
+
+	hf := heif.OpenWithLimits(r, opts.Limits.Parse)
+	base, track, err := selectSource(hf, opts)
+	if err != nil {
+		return Result{Format: opts.Format}, err
+	}
+	if opts.Aux != "" {
+		return convertAux(ctx, hf, base, w, opts)
+	}
+	if track != 0 && opts.Frame == 0 && opts.Format.Animated() {
+		t, err := findTrack(hf, track)
+		if err != nil {
+			return Result{Format: opts.Format}, decodeError(ctx, err)
+		}
+		exif, _ := hf.EXIF()
+		xmp, _ := hf.XMP()
+		return convertAnimation(ctx, t, w, exif, xmp, opts)
+	}
+
+	img, err := decode(ctx, hf, base, track, opts)
+	if err != nil {
+		return Result{Format: opts.Format}, err
+	}
+	return convertImage(ctx, img, w, opts)
+}
+
+// ConvertAll converts every image of r, as listed by Probe, and every frame of its image sequences, writing them to w
+// as a zip archive.  Images are named image-<index> and frames track-<id>/frame-<n>, numbered from 1 as selected by
+// Options, which are otherwise ignored.  Animated formats convert each sequence to a single track-<id> animation
+// instead.  Options.FirstFrame and LastFrame limit the frames of each sequence.  An error may leave a partial archive
+// written to w.
+func (c *Converter) ConvertAll(ctx context.Context, r io.ReaderAt, w io.Writer, opts Options) ([]Result, error) {
+	opts, err := c.options(opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Aux != "" {
+		return nil, newError(ErrInvalidOptions, errors.New("auxiliary images cannot be converted with every image"))
+	}
+	opts.Item, opts.Index, opts.Track, opts.Frame = 0, 0, 0, 0
+	if !isHEIF(r) {
+		return nil, newError(ErrNotHEIF, nil)
+	}
+
+	hf := heif.OpenWithLimits(r, opts.Limits.Parse)
+	imgs, err := images(hf)
+	if err != nil {
+		return nil, heifError(err)
+	}
+	tracks, err := hf.Tracks()
+	if err != nil {
+		return nil, heifError(err)
+	}
+	count := len(imgs)
+	for _, t := range tracks {
+		if opts.Format.Animated() {
+			count++
+		} else {
+			count += len(t.Samples)
+		}
+	}
+	if count == 0 {
+		return nil, newError(ErrImageNotFound, errors.New("file has no images"))
+	}
+	if max := opts.Limits.MaxImages; max > 0 && count > max {
+		return nil, newError(ErrLimitExceeded, fmt.Errorf("file has %d images, frames and animations, exceeding %d", count, max))
+	}
+
+	var (
+		exif, _ = hf.EXIF()
+		xmp, _  = hf.XMP()
+		zw      = zip.NewWriter(w)
+		now     = time.Now()
+		results = make([]Result, 0, count)
+	)
+	create := func(name string) (io.Writer, error) {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: name + "." + opts.Format.Extension(), Method: zip.Store, Modified: now})
+		if err != nil {
+			return nil, newError(ErrEncodeFailed, err)
+		}
+		return f, nil
+	}
+	add := func(name string, img *decodedImage) error {
+		img.exif, img.xmp = exif, xmp
+		f, err := create(name)
+		if err != nil {
+			return err
+		}
+		res, err := convertImage(ctx, img, f, opts)
+		if err != nil {
+			return err
+		}
+		results = append(results, res)
+		return nil
+	}
+
+	for i, it := range imgs {
+		img, err := decodeImage(ctx, hf, it, opts)
+		if err == nil {
+			img.gainMap, err = selectGainMap(hf, img, opts)
+		}
+		if err != nil {
+			return results, decodeError(ctx, err)
+		}
+		if err := add(fmt.Sprintf("image-%d", i+1), img); err != nil {
+			return results, err
+		}
+	}
+	for _, t := range tracks {
+		if !opts.Format.Animated() {
+			if err := convertTrack(ctx, t, opts, add); err != nil {
+				return results, err
+			}
+			continue
+		}
+		f, err := create(fmt.Sprintf("track-%d", t.ID))
+		if err != nil {
+			return results, err
+		}
+		res, err := convertAnimation(ctx, t, f, exif, xmp, opts)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, res)
+	}
+
+	if err := zw.Close(); err != nil {
+		return results, newError(ErrEncodeFailed, err)
+	}
+	return results, nil
+}
+
+// convertTrack passes the frames of t from opts.FirstFrame to opts.LastFrame to add, in presentation order
+func convertTrack(ctx context.Context, t *heif.Track, opts Options, add func(name string, img *decodedImage) error) error {
+	first, last := opts.FirstFrame, opts.LastFrame
+	if first == 0 {
+		first = 1
+	}
+	if last == 0 || last > len(t.Samples) {
+		last = len(t.Samples)
+	}
+	if first > last {
+		return nil
+	}
+
+	n := syncSample(t, first-1) + 1
+	fd, err := newFrameDecoder(t, n-1, opts)
+	if err != nil {
+		return decodeError(ctx, err)
+	}
+	defer fd.free()
+
+	for ; n <= last; n++ {
+		ycc, err := fd.frame(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return decodeError(ctx, err)
+		}
+		if n < first {
+			continue
+		}
+		if err := add(fmt.Sprintf("track-%d/frame-%d", t.ID, n), &decodedImage{ycc: ycc, track: t.ID, frame: n}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// options merges opts with the defaults of c and validates the result.  Generated thumbnails default to
+// DefaultThumbnailSize, and auxiliary images to png.
+func (c *Converter) options(opts Options) (Options, error) {
+	if opts.Aux != "" && opts.Format == "" {
+		opts.Format = FormatPNG
+	}
+	opts = opts.merge(c.defaults)
+	if err := opts.Validate(); err != nil {
+		return opts, err
+	}
+	if opts.Thumbnail == ThumbnailGenerated || opts.Thumbnail == ThumbnailAuto {
+		if opts.Width == 0 && opts.Height == 0 && opts.Scale == 0 && opts.MaxWidth == 0 && opts.MaxHeight == 0 {
+			opts.Width, opts.Height = DefaultThumbnailSize, DefaultThumbnailSize
+		}
+	}
+	return opts, nil
+}
+
+// convertImage transforms a decoded image according to opts and encodes it to w
+func convertImage(ctx context.Context, img *decodedImage, w io.Writer, opts Options) (Result, error) {
+	res := Result{
+		Format:    opts.Format,
+		Thumbnail: img.thumbnail,
+		Item:      img.image,
+		Track:     img.track,
+		Frame:     img.frame,
+	}
+
+	var err error
+	img.ycc, res.Rotated = rotate(img.ycc, img.item, opts.Rotation)
+	if img.gainMap != nil {
+		if err := img.gainMap.fit(img.item, img.ycc.Rect.Dx(), img.ycc.Rect.Dy(), opts); err != nil {
+			return res, err
+		}
+	}
+	if img.ycc, res.Resized, err = resize(img.ycc, opts); err != nil {
+		return res, err
+	}
+	res.Width, res.Height = img.ycc.Rect.Dx(), img.ycc.Rect.Dy()
+	img.exif = prepareEXIF(img.exif, opts, res)
+	img.xmp = prepareXMP(img.xmp, opts, res)
+
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+
+	if res.EXIF, res.XMP, err = encode(w, img, opts); err != nil {
+		return res, newError(ErrEncodeFailed, err)
+	}
+	res.GainMap = img.gainMap != nil
+
+	return res, nil
+}
@@ -0,0 +1,237 @@
+package convert
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/dcarbone/go-heicker/heif"
+	"github.com/dcarbone/go-heicker/heif/bmff"
+)
+
+// testdata/hevc.heic is a 64x48 grid image of hevc tiles written by libheif
+func readTestdata(t testing.TB, name string) []byte {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestConvertErrors(t *testing.T) {
+	hevc := readTestdata(t, "hevc.heic")
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		opts Options
+		kind error
+	}{
+		{"invalid format", hevc, Options{Format: "bmp"}, ErrInvalidOptions},
+		{"invalid quality", hevc, Options{Quality: 101}, ErrInvalidOptions},
+		{"invalid rotation", hevc, Options{Rotation: "45"}, ErrInvalidOptions},
+		{"allowlist without tags", hevc, Options{Metadata: MetadataAllowlist}, ErrInvalidOptions},
+		{"unknown tag", hevc, Options{Metadata: MetadataAllowlist, MetadataTags: []string{"Make", "Nope"}}, ErrInvalidOptions},
+		{"invalid fit", hevc, Options{Fit: "squash"}, ErrInvalidOptions},
+		{"invalid filter", hevc, Options{Filter: "box"}, ErrInvalidOptions},
+		{"invalid thumbnail", hevc, Options{Thumbnail: "tiny"}, ErrInvalidOptions},
+		{"invalid width", hevc, Options{Width: 65536}, ErrInvalidOptions},
+		{"invalid scale", hevc, Options{Scale: 1001}, ErrInvalidOptions},
+		{"scale and width", hevc, Options{Scale: 50, Width: 10}, ErrInvalidOptions},
+		{"negative crop", hevc, Options{Crop: image.Rect(-1, 0, 10, 10)}, ErrInvalidOptions},
+		{"crop outside", hevc, Options{Crop: image.Rect(64, 0, 80, 10)}, ErrInvalidOptions},
+		{"output limit", hevc, Options{Scale: 200, Limits: Limits{MaxPixels: 64 * 48 * 2}}, ErrLimitExceeded},
+		{"no thumbnail", hevc, Options{Thumbnail: ThumbnailEmbedded}, ErrImageNotFound},
+		{"negative limit", hevc, Options{Limits: Limits{MaxTiles: -1}}, ErrInvalidOptions},
+		{"negative index", hevc, Options{Index: -1}, ErrInvalidOptions},
+		{"item and index", hevc, Options{Item: 2, Index: 1}, ErrInvalidOptions},
+		{"frame without track", hevc, Options{Frame: 1}, ErrInvalidOptions},
+		{"no image", hevc, Options{Index: 4}, ErrImageNotFound},
+		{"tile item", hevc, Options{Item: 1}, ErrImageNotFound},
+		{"no track", hevc, Options{Track: 1}, ErrImageNotFound},
+		{"not heif", []byte("GIF89a not a heif file"), Options{}, ErrNotHEIF},
+		{"truncated", hevc[:200], Options{}, ErrMalformed},
+		{"pixel limit", hevc, Options{Limits: Limits{MaxPixels: 64*48 - 1}}, ErrLimitExceeded},
+		{"item limit", hevc, Options{Limits: Limits{Parse: bmff.Limits{MaxItems: 5}}}, ErrLimitExceeded},
+		{"nal unit limit", hevc, Options{Limits: Limits{Parse: bmff.Limits{MaxNALUnits: 2}}}, ErrLimitExceeded},
+		{"no primary item", func() []byte {
+			// pitm renamed to an unknown box
+			b := fixtureData(t, "unci")
+			i := bytes.Index(b, []byte("pitm"))
+			copy(b[i:], "xitm")
+			return b
+		}(), Options{}, ErrMalformed},
+		{"tile ceiling", func() []byte {
+			// a 256x256 grid, with no limits set
+			w := heif.NewWriter()
+			g := w.AddItem("grid", []byte{0, 0, 255, 255, 0, testWidth, 0, testHeight})
+			g.AddProperty(heif.SpatialExtentsProperty(testWidth, testHeight))
+			g.AddReference("dimg", g.ID)
+			return writeFixture(t, w)
+		}(), Options{}, ErrLimitExceeded},
+		{"pixel ceiling", func() []byte {
+			// a grid of small spatial extents whose tiles would make a canvas of 60000x60000
+			w := heif.NewWriter()
+			g := w.AddItem("grid", []byte{0, 0, 1, 1, 0, testWidth, 0, testHeight})
+			g.AddProperty(heif.SpatialExtentsProperty(testWidth, testHeight))
+			for i := 0; i < 4; i++ {
+				tile := w.AddItem("unci", []byte{0})
+				tile.Hidden = true
+				tile.AddProperty(heif.SpatialExtentsProperty(30000, 30000))
+			}
+			g.AddReference("dimg", 2, 3, 4, 5)
+			return writeFixture(t, w)
+		}(), Options{}, ErrLimitExceeded},
+		{"upscale ceiling", hevc, Options{Width: 65535, Height: 65535, Fit: FitFill}, ErrLimitExceeded},
+		{"resample limit", hevc, Options{Width: 65535, Height: 1, Fit: FitFill, Limits: Limits{MaxPixels: 65535 * 40}}, ErrLimitExceeded},
+		{"unknown codec", func() []byte {
+			w := heif.NewWriter()
+			it := w.AddItem("xxxx", []byte{1, 2, 3})
+			it.AddProperty(heif.SpatialExtentsProperty(1, 1))
+			return writeFixture(t, w)
+		}(), Options{}, ErrUnsupportedCodec},
+		{"short unci", func() []byte {
+			w := heif.NewWriter()
+			it := w.AddUncompressed(testImage(testWidth, testHeight))
+			it.Extents[0] = it.Extents[0][:100]
+			return writeFixture(t, w)
+		}(), Options{}, ErrDecodeFailed},
+	} {
+		var buf bytes.Buffer
+		_, err := Convert(context.Background(), bytes.NewReader(tc.data), &buf, tc.opts)
+		var cerr *Error
+		if !errors.As(err, &cerr) || !errors.Is(err, tc.kind) {
+			t.Errorf("%s: got %v, want an *Error of kind %v", tc.name, err, tc.kind)
+		}
+		if buf.Len() > 0 {
+			t.Errorf("%s: %d bytes written despite failing", tc.name, buf.Len())
+		}
+	}
+}
+
+func TestConvertCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := Convert(ctx, bytes.NewReader(readTestdata(t, "hevc.heic")), ioutil.Discard, Options{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	var buf bytes.Buffer
+	res, err := New(Options{Quality: 50}).Convert(context.Background(), bytes.NewReader(readTestdata(t, "hevc.heic")), &buf, Options{Rotation: Rotate90})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != (Result{Format: FormatJPEG, Width: 48, Height: 64, Rotated: true, Item: 2}) {
+		t.Errorf("got %+v", res)
+	}
+	img, err := jpeg.Decode(&buf)
+	if err != nil || img.Bounds() != image.Rect(0, 0, 48, 64) {
+		t.Errorf("got %v, %v", img, err)
+	}
+}
+
+func TestConvertThumbnail(t *testing.T) {
+	hevc := readTestdata(t, "hevc.heic")
+	for _, tc := range []struct {
+		opts Options
+		want Result
+	}{
+		{Options{Width: 32}, Result{Width: 32, Height: 24, Resized: true}},
+		{Options{Thumbnail: ThumbnailGenerated}, Result{Width: 256, Height: 192, Resized: true}},
+		// without an embedded thumbnail, auto resizes the primary image
+		{Options{Thumbnail: ThumbnailAuto, Width: 16}, Result{Width: 16, Height: 12, Resized: true}},
+		{Options{Width: 32, Height: 32, Fit: FitCover, Rotation: Rotate90}, Result{Width: 32, Height: 32, Rotated: true, Resized: true}},
+		{Options{Crop: image.Rect(0, 0, 32, 16)}, Result{Width: 32, Height: 16, Resized: true}},
+		{Options{Scale: 50, Filter: FilterNearest}, Result{Width: 32, Height: 24, Resized: true}},
+		{Options{Crop: image.Rect(16, 0, 64, 48), MaxWidth: 12, Filter: FilterBilinear}, Result{Width: 12, Height: 12, Resized: true}},
+		{Options{MaxWidth: 100, MaxHeight: 100}, Result{Width: 64, Height: 48}},
+	} {
+		res, err := Convert(context.Background(), bytes.NewReader(hevc), ioutil.Discard, tc.opts)
+		tc.want.Format, tc.want.Item = FormatJPEG, 2
+		if err != nil || res != tc.want {
+			t.Errorf("%+v: got %+v, %v, want %+v", tc.opts, res, err, tc.want)
+		}
+	}
+}
+
+func TestConvertSelect(t *testing.T) {
+	hevc := readTestdata(t, "hevc.heic")
+	for _, tc := range []struct {
+		opts Options
+		item uint32
+	}{
+		{Options{}, 2},
+		{Options{Index: 1}, 2},
+		{Options{Index: 3}, 6},
+		{Options{Item: 4}, 4},
+	} {
+		res, err := Convert(context.Background(), bytes.NewReader(hevc), ioutil.Discard, tc.opts)
+		if err != nil || res.Item != tc.item {
+			t.Errorf("%+v: got item %d, %v, want %d", tc.opts, res.Item, err, tc.item)
+		}
+	}
+}
+
+func TestConvertAll(t *testing.T) {
+	hevc := readTestdata(t, "hevc.heic")
+
+	var buf bytes.Buffer
+	// selections are ignored
+	results, err := ConvertAll(context.Background(), bytes.NewReader(hevc), &buf, Options{Format: FormatPNG, Index: 2})
+	if err != nil || len(results) != 3 {
+		t.Fatalf("got %+v, %v", results, err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, item := range []uint32{2, 4, 6} {
+		name := fmt.Sprintf("image-%d.png", i+1)
+		if results[i].Item != item || i >= len(zr.File) || zr.File[i].Name != name {
+			t.Fatalf("result %d is %+v, want %s of item %d", i, results[i], name, item)
+		}
+		f, err := zr.File[i].Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(f)
+		if err != nil || img.Bounds() != image.Rect(0, 0, 64, 48) {
+			t.Errorf("%s: got %v, %v", name, img, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		opts Options
+		kind error
+	}{
+		{"image limit", hevc, Options{Limits: Limits{MaxImages: 2}}, ErrLimitExceeded},
+		{"not heif", []byte("GIF89a not a heif file"), Options{}, ErrNotHEIF},
+		{"invalid format", hevc, Options{Format: "bmp"}, ErrInvalidOptions},
+	} {
+		var buf bytes.Buffer
+		if _, err := ConvertAll(context.Background(), bytes.NewReader(tc.data), &buf, tc.opts); !errors.Is(err, tc.kind) || buf.Len() > 0 {
+			t.Errorf("%s: got %v and %d bytes, want %v", tc.name, err, buf.Len(), tc.kind)
+		}
+	}
+
+	// auxiliary images are not converted on their own
+	buf.Reset()
+	results, err = ConvertAll(context.Background(), bytes.NewReader(fixtureData(t, "alpha")), &buf, Options{Format: FormatPNG})
+	if err != nil || len(results) != 1 || results[0].Item != 1 {
+		t.Errorf("got %+v, %v, want only image 1", results, err)
+	}
+}
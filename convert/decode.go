@@ -0,0 +1,583 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+
+	"github.com/dcarbone/go-heicker/heif"
+	"github.com/dcarbone/go-heicker/heif/bmff"
+	"github.com/dcarbone/go-heicker/libde265"
+)
+
+func init() {
+	libde265.Init()
+}
+
+// decodedImage is the image converted from a file along with the metadata needed to encode it
+type decodedImage struct {
+	ycc *image.YCbCr
+	// item is the image item decoded, nil for frames of an image sequence
+	item *heif.Item
+	exif []byte
+	xmp  []byte
+	// image is the ID of the image selected, thumbnail is true if item is its embedded thumbnail rather than the image
+	// itself
+	image     uint32
+	thumbnail bool
+	// track and frame identify a frame of an image sequence
+	track uint32
+	frame int
+	// gainMap is the HDR gain map of item, if it is written to the output
+	gainMap *hdrGainMap
+}
+
+// isHEIF checks for an ftyp box at the start of the input, as libheif does
+func isHEIF(r io.ReaderAt) bool {
+	b := make([]byte, 8)
+	n, _ := r.ReadAt(b, 0)
+	return n == len(b) && bytes.Equal(b[4:], []byte("ftyp"))
+}
+
+// selectSource returns the image selected by opts or, when a frame of an image sequence is selected instead, the ID of
+// its track
+func selectSource(hf *heif.File, opts Options) (*heif.Item, uint32, error) {
+	if opts.Track != 0 {
+		return nil, opts.Track, nil
+	}
+	base, err := selectImage(hf, opts)
+	if err != nil {
+		// files holding only an image sequence have no primary image, their first track is converted instead
+		tracks, terr := hf.Tracks()
+		if terr != nil {
+			return nil, 0, heifError(terr)
+		}
+		if opts.Item != 0 || opts.Index != 0 || len(tracks) == 0 {
+			return nil, 0, err
+		}
+		return nil, tracks[0].ID, nil
+	}
+	return base, 0, nil
+}
+
+// decode decodes the source returned by selectSource
+func decode(ctx context.Context, hf *heif.File, base *heif.Item, track uint32, opts Options) (*decodedImage, error) {
+	var (
+		img *decodedImage
+		err error
+	)
+	if track != 0 {
+		img, err = decodeFrame(ctx, hf, track, opts)
+	} else if img, err = decodeImage(ctx, hf, base, opts); err == nil {
+		img.gainMap, err = selectGainMap(hf, img, opts)
+	}
+	if err != nil {
+		return nil, decodeError(ctx, err)
+	}
+
+	// EXIF and XMP are optional, a missing or unreadable item is not an error
+	img.exif, _ = hf.EXIF()
+	img.xmp, _ = hf.XMP()
+
+	return img, nil
+}
+
+// decodeError returns err as heifError does, unless it is already an *Error or was caused by ctx
+func decodeError(ctx context.Context, err error) error {
+	var cerr *Error
+	if errors.As(err, &cerr) || errors.Is(err, ctx.Err()) {
+		return err
+	}
+	return heifError(err)
+}
+
+// heifError returns err, an error reading a heif.File, as ErrLimitExceeded or ErrMalformed when the file's boxes
+// exceed the parse limits or are malformed, or else as ErrDecodeFailed
+func heifError(err error) error {
+	switch {
+	case errors.Is(err, bmff.ErrLimitExceeded):
+		return newError(ErrLimitExceeded, err)
+	case errors.Is(err, heif.ErrMalformed):
+		return newError(ErrMalformed, err)
+	}
+	return newError(ErrDecodeFailed, err)
+}
+
+// decodeImage decodes base, or its thumbnail according to opts.Thumbnail
+func decodeImage(ctx context.Context, hf *heif.File, base *heif.Item, opts Options) (*decodedImage, error) {
+	it, thumbnail, err := selectItem(hf, base, opts)
+	if err != nil {
+		return nil, err
+	}
+	img := &decodedImage{item: it, image: base.ID, thumbnail: thumbnail}
+	if img.ycc, err = decodeItem(ctx, hf, it, opts); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// checkPixels returns an error of kind ErrLimitExceeded if a width x height image exceeds the limits of opts
+func checkPixels(width, height int, opts Options) error {
+	// compared by division, as the dimensions of tiles multiplied out may overflow
+	if max := opts.Limits.maxPixels(); height > 0 && int64(width) > max/int64(height) {
+		return newError(ErrLimitExceeded, fmt.Errorf("image is %dx%d, exceeding %d pixels", width, height, max))
+	}
+	return nil
+}
+
+// decodableItemTypes are the item types decodeItem supports
+var decodableItemTypes = map[string]bool{
+	"hvc1": true,
+	"hev1": true,
+	"grid": true,
+	"iden": true,
+	"iovl": true,
+	"jpeg": true,
+	"unci": true,
+	"av01": true,
+}
+
+// hevcItemTypes are the coded image item types, hev1 items carrying their parameter sets in-band rather than only in
+// their hvcC
+var hevcItemTypes = map[string]bool{
+	"hvc1": true,
+	"hev1": true,
+}
+
+// derivedItemTypes are the image item types whose image is derived from those of the items they reference by dimg
+var derivedItemTypes = map[string]bool{
+	"grid": true,
+	"iden": true,
+	"iovl": true,
+}
+
+// maxDerivationDepth limits the chains of derived images followed, such as an iden of a grid, guarding against cycles
+const maxDerivationDepth = 8
+
+// decodeItem decodes a single image item, checking it against the limits of opts first
+func decodeItem(ctx context.Context, hf *heif.File, it *heif.Item, opts Options) (*image.YCbCr, error) {
+	dec, err := libde265.NewDecoder(libde265.WithSafeEncoding(true))
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Free()
+	return decodeItemDepth(ctx, dec, hf, it, opts, 0)
+}
+
+// decodeItemDepth decodes it using dec, depth being the number of derived images it is an input of
+func decodeItemDepth(ctx context.Context, dec *libde265.Decoder, hf *heif.File, it *heif.Item, opts Options, depth int) (*image.YCbCr, error) {
+	if depth > maxDerivationDepth {
+		return nil, fmt.Errorf("derived images are nested more than %d deep", maxDerivationDepth)
+	}
+	width, height, ok := it.SpatialExtents()
+	if !ok {
+		return nil, errors.New("item has no dimensions")
+	}
+	if err := checkPixels(width, height, opts); err != nil {
+		return nil, err
+	}
+	if !decodableItemTypes[it.Info.ItemType] {
+		return nil, newError(ErrUnsupportedCodec, fmt.Errorf("item type %q", it.Info.ItemType))
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	switch it.Info.ItemType {
+	case "grid":
+		return decodeGrid(ctx, dec, hf, it, width, height, opts)
+	case "iden":
+		return decodeIden(ctx, dec, hf, it, opts, depth)
+	case "iovl":
+		return decodeOverlay(ctx, dec, hf, it, width, height, opts, depth)
+	}
+	return decodeCodedItem(dec, hf, it, opts)
+}
+
+// decodeCodedItem decodes an item holding coded image data rather than a derivation, such as a grid tile
+func decodeCodedItem(dec *libde265.Decoder, hf *heif.File, item *heif.Item, opts Options) (*image.YCbCr, error) {
+	switch item.Info.ItemType {
+	case "jpeg":
+		return decodeJPEGItem(hf, item, opts)
+	case "unci":
+		return decodeUncompressed(hf, item)
+	case "av01":
+		img, err := decodeAV1Picture(hf, item, opts)
+		if err != nil {
+			return nil, err
+		}
+		return toYCbCr(img)
+	}
+	return decodeHevcItem(dec, hf, item)
+}
+
+// decodeJPEGItem decodes a jpeg item, its codestream prefixed by the header of its jpgC property, if any.  The size of
+// the codestream is checked against the item's and the limits of opts before decoding.
+func decodeJPEGItem(hf *heif.File, item *heif.Item, opts Options) (*image.YCbCr, error) {
+	data, err := hf.GetItemData(item)
+	if err != nil {
+		return nil, err
+	}
+	if jpgc, ok := item.JPEGConfig(); ok && len(jpgc.Prefix) > 0 {
+		data = append(append(make([]byte, 0, len(jpgc.Prefix)+len(data)), jpgc.Prefix...), data...)
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if width, height, ok := item.SpatialExtents(); !ok || cfg.Width != width || cfg.Height != height {
+		return nil, fmt.Errorf("jpeg codestream is %dx%d, unlike its item", cfg.Width, cfg.Height)
+	}
+	if err := checkPixels(cfg.Width, cfg.Height, opts); err != nil {
+		return nil, err
+	}
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return toYCbCr(img)
+}
+
+func decodeHevcItem(dec *libde265.Decoder, hf *heif.File, item *heif.Item) (*image.YCbCr, error) {
+	img, err := decodeHevcPicture(dec, hf, item)
+	if err != nil {
+		return nil, err
+	}
+	return toYCbCr(img)
+}
+
+// decodeHevcPicture decodes a hvc1 or hev1 item as returned by libde265, *image.YCbCr or, for monochrome items,
+// *image.Gray or *image.Gray16
+func decodeHevcPicture(dec *libde265.Decoder, hf *heif.File, item *heif.Item) (image.Image, error) {
+	if !hevcItemTypes[item.Info.ItemType] {
+		return nil, newError(ErrUnsupportedCodec, fmt.Errorf("tile item type %q", item.Info.ItemType))
+	}
+
+	hvcc, ok := item.HevcConfig()
+	if !ok {
+		return nil, errors.New("item has no hvcC")
+	}
+
+	data, err := hf.GetItemData(item)
+	if err != nil {
+		return nil, err
+	}
+
+	dec.Reset()
+	if err := dec.Push(hvcc.AsHeader()); err != nil {
+		return nil, err
+	}
+	return dec.DecodeImage(data)
+}
+
+// toYCbCr returns a decoded picture as YCbCr, monochrome pictures having neutral chroma and any other, such as a CMYK
+// jpeg, being converted to 4:4:4
+func toYCbCr(img image.Image) (*image.YCbCr, error) {
+	var gray *image.Gray
+	switch img := img.(type) {
+	case *image.YCbCr:
+		return img, nil
+	case *image.Gray:
+		gray = img
+	case *image.Gray16:
+		gray = image.NewGray(img.Rect)
+		for i := range gray.Pix {
+			gray.Pix[i] = img.Pix[2*i]
+		}
+	default:
+		b := img.Bounds()
+		ycc := image.NewYCbCr(image.Rect(0, 0, b.Dx(), b.Dy()), image.YCbCrSubsampleRatio444)
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+				i := y*ycc.YStride + x
+				ycc.Y[i], ycc.Cb[i], ycc.Cr[i] = color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(bl>>8))
+			}
+		}
+		return ycc, nil
+	}
+	ycc := image.NewYCbCr(gray.Rect, image.YCbCrSubsampleRatio420)
+	copy(ycc.Y, gray.Pix)
+	for i := range ycc.Cb {
+		ycc.Cb[i], ycc.Cr[i] = 0x80, 0x80
+	}
+	return ycc, nil
+}
+
+// decodeAuxItem decodes an auxiliary image, such as a depth map, checking it against the limits of opts first
+func decodeAuxItem(hf *heif.File, it *heif.Item, opts Options) (image.Image, error) {
+	width, height, ok := it.SpatialExtents()
+	if !ok {
+		return nil, errors.New("item has no dimensions")
+	}
+	if err := checkPixels(width, height, opts); err != nil {
+		return nil, err
+	}
+	if it.Info.ItemType == "av01" {
+		return decodeAV1Picture(hf, it, opts)
+	}
+	if !hevcItemTypes[it.Info.ItemType] {
+		return nil, newError(ErrUnsupportedCodec, fmt.Errorf("auxiliary item type %q", it.Info.ItemType))
+	}
+
+	dec, err := libde265.NewDecoder(libde265.WithSafeEncoding(true))
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Free()
+	return decodeHevcPicture(dec, hf, it)
+}
+
+// grid is the payload of a grid item, see ISO/IEC 23008-12 6.6.2.3
+type grid struct {
+	columns, rows int
+	width, height int
+}
+
+func parseGrid(data []byte) (*grid, error) {
+	if len(data) < 8 {
+		return nil, errors.New("grid data too short")
+	}
+	flags := data[1]
+	g := &grid{rows: int(data[2]) + 1, columns: int(data[3]) + 1}
+
+	if flags&1 != 0 {
+		if len(data) < 12 {
+			return nil, errors.New("grid data too short")
+		}
+		g.width = int(data[4])<<24 | int(data[5])<<16 | int(data[6])<<8 | int(data[7])
+		g.height = int(data[8])<<24 | int(data[9])<<16 | int(data[10])<<8 | int(data[11])
+	} else {
+		g.width = int(data[4])<<8 | int(data[5])
+		g.height = int(data[6])<<8 | int(data[7])
+	}
+
+	return g, nil
+}
+
+// decodeGrid decodes each tile of a grid item into a single image, cropped to the item's spatial extents
+func decodeGrid(ctx context.Context, dec *libde265.Decoder, hf *heif.File, it *heif.Item, width, height int, opts Options) (*image.YCbCr, error) {
+	data, err := hf.GetItemData(it)
+	if err != nil {
+		return nil, err
+	}
+	g, err := parseGrid(data)
+	if err != nil {
+		return nil, err
+	}
+	if max := opts.Limits.maxTiles(); g.columns*g.rows > max {
+		return nil, newError(ErrLimitExceeded, fmt.Errorf("image has %d tiles, exceeding %d", g.columns*g.rows, max))
+	}
+
+	dimg := it.Reference("dimg")
+	if dimg == nil {
+		return nil, errors.New("grid has no dimg reference")
+	}
+	if len(dimg.ToItemIDs) != g.columns*g.rows {
+		return nil, fmt.Errorf("grid expects %d tiles, saw %d", g.columns*g.rows, len(dimg.ToItemIDs))
+	}
+
+	var (
+		out                   *image.YCbCr
+		tileWidth, tileHeight int
+	)
+	for i, y := 0, 0; y < g.rows; y++ {
+		for x := 0; x < g.columns; x++ {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			item, err := hf.ItemByID(dimg.ToItemIDs[i])
+			if err != nil {
+				return nil, err
+			}
+			// the canvas is sized by the tiles rather than the grid's spatial extents, so both are checked
+			if tw, th, ok := item.SpatialExtents(); ok {
+				if err := checkPixels(tw*g.columns, th*g.rows, opts); err != nil {
+					return nil, err
+				}
+			}
+			ycc, err := decodeCodedItem(dec, hf, item, opts)
+			if err != nil {
+				return nil, err
+			}
+
+			rect := ycc.Bounds()
+			if tileWidth == 0 {
+				tileWidth, tileHeight = rect.Dx(), rect.Dy()
+				if err := checkPixels(tileWidth*g.columns, tileHeight*g.rows, opts); err != nil {
+					return nil, err
+				}
+				out = image.NewYCbCr(image.Rect(0, 0, tileWidth*g.columns, tileHeight*g.rows), ycc.SubsampleRatio)
+			}
+			if tileWidth != rect.Dx() || tileHeight != rect.Dy() {
+				return nil, errors.New("inconsistent tile dimensions")
+			}
+			if ycc.SubsampleRatio != out.SubsampleRatio {
+				return nil, errors.New("inconsistent tile chroma subsampling")
+			}
+
+			for row := 0; row < rect.Dy(); row++ {
+				copy(out.Y[(y*tileHeight+row)*out.YStride+x*tileWidth:], ycc.Y[row*ycc.YStride:row*ycc.YStride+tileWidth])
+			}
+
+			cWidth, cHeight := chromaSize(tileWidth, tileHeight, ycc.SubsampleRatio)
+			for row := 0; row < cHeight; row++ {
+				dst := (y*cHeight+row)*out.CStride + x*cWidth
+				copy(out.Cb[dst:], ycc.Cb[row*ycc.CStride:row*ycc.CStride+cWidth])
+				copy(out.Cr[dst:], ycc.Cr[row*ycc.CStride:row*ycc.CStride+cWidth])
+			}
+
+			i++
+		}
+	}
+
+	if width > out.Rect.Dx() || height > out.Rect.Dy() {
+		return nil, fmt.Errorf("image is %dx%d, larger than its %dx%d grid", width, height, out.Rect.Dx(), out.Rect.Dy())
+	}
+	out.Rect = image.Rect(0, 0, width, height)
+	return out, nil
+}
+
+// derivedInputs returns the items referenced by the dimg reference of a derived image, in order
+func derivedInputs(hf *heif.File, it *heif.Item) ([]*heif.Item, error) {
+	dimg := it.Reference("dimg")
+	if dimg == nil || len(dimg.ToItemIDs) == 0 {
+		return nil, fmt.Errorf("%s item has no dimg reference", it.Info.ItemType)
+	}
+	out := make([]*heif.Item, len(dimg.ToItemIDs))
+	for i, id := range dimg.ToItemIDs {
+		in, err := hf.ItemByID(id)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = in
+	}
+	return out, nil
+}
+
+// decodeIden decodes the input of an identity derived item, which usually applies transformative properties such as
+// irot to a grid.  The properties of the input are applied with RotateAuto, as rotate applies those of the item.
+func decodeIden(ctx context.Context, dec *libde265.Decoder, hf *heif.File, it *heif.Item, opts Options, depth int) (*image.YCbCr, error) {
+	ins, err := derivedInputs(hf, it)
+	if err != nil {
+		return nil, err
+	}
+	if len(ins) != 1 {
+		return nil, fmt.Errorf("iden item has %d inputs, expected 1", len(ins))
+	}
+	ycc, err := decodeItemDepth(ctx, dec, hf, ins[0], opts, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Rotation == RotateAuto {
+		ycc, _ = rotate(ycc, ins[0], RotateAuto)
+	}
+	return ycc, nil
+}
+
+// overlay is the payload of an iovl item, see ISO/IEC 23008-12 6.6.2.4
+type overlay struct {
+	// fill is the RGBA canvas fill colour, in 16 bits per channel
+	fill          [4]uint16
+	width, height int
+	// offsets are those of each input, in the order of the dimg reference
+	offsets []image.Point
+}
+
+func parseOverlay(data []byte, inputs int) (*overlay, error) {
+	if len(data) < 10 {
+		return nil, errors.New("overlay data too short")
+	}
+	flags := data[1]
+	o := &overlay{}
+	for i := range o.fill {
+		o.fill[i] = binary.BigEndian.Uint16(data[2+2*i:])
+	}
+
+	size := 2
+	if flags&1 != 0 {
+		size = 4
+	}
+	fields := data[10:]
+	if len(fields) < size*(2+2*inputs) {
+		return nil, fmt.Errorf("overlay data too short for %d inputs", inputs)
+	}
+	field := func(i int) int {
+		if size == 4 {
+			return int(int32(binary.BigEndian.Uint32(fields[4*i:])))
+		}
+		return int(int16(binary.BigEndian.Uint16(fields[2*i:])))
+	}
+	// the output size is unsigned
+	if size == 4 {
+		o.width, o.height = int(binary.BigEndian.Uint32(fields)), int(binary.BigEndian.Uint32(fields[4:]))
+	} else {
+		o.width, o.height = int(binary.BigEndian.Uint16(fields)), int(binary.BigEndian.Uint16(fields[2:]))
+	}
+	for i := 0; i < inputs; i++ {
+		o.offsets = append(o.offsets, image.Pt(field(2+2*i), field(3+2*i)))
+	}
+	return o, nil
+}
+
+// decodeOverlay composes the inputs of an iovl item onto a canvas of its fill colour, each drawn over the last at its
+// offset and clipped to the canvas.  The canvas is 4:4:4, so that inputs at odd offsets keep their chroma.
+func decodeOverlay(ctx context.Context, dec *libde265.Decoder, hf *heif.File, it *heif.Item, width, height int, opts Options, depth int) (*image.YCbCr, error) {
+	ins, err := derivedInputs(hf, it)
+	if err != nil {
+		return nil, err
+	}
+	if max := opts.Limits.maxTiles(); len(ins) > max {
+		return nil, newError(ErrLimitExceeded, fmt.Errorf("overlay has %d inputs, exceeding %d", len(ins), max))
+	}
+	data, err := hf.GetItemData(it)
+	if err != nil {
+		return nil, err
+	}
+	o, err := parseOverlay(data, len(ins))
+	if err != nil {
+		return nil, err
+	}
+	if o.width == 0 || o.height == 0 {
+		return nil, errors.New("overlay has no size")
+	}
+	if err := checkPixels(o.width, o.height, opts); err != nil {
+		return nil, err
+	}
+
+	out := image.NewYCbCr(image.Rect(0, 0, o.width, o.height), image.YCbCrSubsampleRatio444)
+	fy, fcb, fcr := color.RGBToYCbCr(uint8(o.fill[0]>>8), uint8(o.fill[1]>>8), uint8(o.fill[2]>>8))
+	for i := range out.Y {
+		out.Y[i], out.Cb[i], out.Cr[i] = fy, fcb, fcr
+	}
+
+	for i, in := range ins {
+		layer, err := decodeItemDepth(ctx, dec, hf, in, opts, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		off := o.offsets[i]
+		r := layer.Rect.Add(off).Intersect(out.Rect)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				sx, sy := x-off.X+layer.Rect.Min.X, y-off.Y+layer.Rect.Min.Y
+				di, ci := out.YOffset(x, y), layer.COffset(sx, sy)
+				out.Y[di] = layer.Y[layer.YOffset(sx, sy)]
+				out.Cb[di], out.Cr[di] = layer.Cb[ci], layer.Cr[ci]
+			}
+		}
+	}
+
+	if width <= o.width && height <= o.height {
+		// the spatial extents crop the canvas, as they do a grid
+		out.Rect = image.Rect(0, 0, width, height)
+	}
+	return out, nil
+}
@@ -0,0 +1,55 @@
+package convert
+
+import (
+	"fmt"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// encode writes img to w, returning whether EXIF and XMP data were included
+func encode(w io.Writer, img *decodedImage, opts Options) (exif, xmp bool, err error) {
+	switch opts.Format {
+	case FormatJPEG:
+		if img.gainMap != nil {
+			return encodeUltraHDR(w, img, opts)
+		}
+		segments := jpegEXIFSegments(img.exif)
+		exif := len(segments) > 0
+		if len(img.xmp) > 0 {
+			segments = append(segments, jpegXMPSegments(img.xmp)...)
+		}
+		iw, err := newWriterAPP1(w, segments...)
+		if err != nil {
+			return false, false, fmt.Errorf("error writing metadata: %w", err)
+		}
+		return exif, len(img.xmp) > 0, jpeg.Encode(iw, img.ycc, &jpeg.Options{Quality: opts.Quality})
+
+	case FormatPNG:
+		iw := newWriterPNGChunk(w, "iTXt", pngXMPChunk(img.xmp))
+		return false, len(img.xmp) > 0, png.Encode(iw, img.ycc)
+
+	case FormatGIF:
+		return false, false, gif.Encode(w, paletted(img.ycc), nil)
+
+	case FormatWebP:
+		return len(img.exif) > 0, len(img.xmp) > 0, encodeWebP(w, img.ycc, img.exif, img.xmp)
+
+	case FormatHEIF:
+		return len(img.exif) > 0, len(img.xmp) > 0, encodeHEIF(w, img, opts)
+
+	default:
+		return false, false, fmt.Errorf("unsupported format %q", opts.Format)
+	}
+}
+
+// jpegEXIFSegments returns the APP1 payload holding exif, which is made to fit a single segment by fitEXIF, or none if
+// there is no exif left
+func jpegEXIFSegments(exif []byte) [][]byte {
+	exif = fitEXIF(exif, jpegMaxSegment-len(exifHeader))
+	if len(exif) == 0 {
+		return nil
+	}
+	return [][]byte{append([]byte(exifHeader), exif...)}
+}
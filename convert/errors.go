@@ -0,0 +1,43 @@
+package convert
+
+import (
+	"errors"
+)
+
+// Every error returned by Convert, other than context errors, is an *Error whose Kind is one of the following.  Use
+// errors.Is to test for them.
+var (
+	ErrInvalidOptions   = errors.New("invalid options")
+	ErrNotHEIF          = errors.New("input is not a HEIF file")
+	ErrMalformed        = errors.New("malformed HEIF file")
+	ErrUnsupportedCodec = errors.New("unsupported codec")
+	ErrImageNotFound    = errors.New("requested image not found")
+	ErrLimitExceeded    = errors.New("limit exceeded")
+	ErrDecodeFailed     = errors.New("error decoding image")
+	ErrEncodeFailed     = errors.New("error encoding image")
+)
+
+// Error describes a failed conversion
+type Error struct {
+	Kind error
+	Err  error // underlying cause, may be nil
+}
+
+func newError(kind, err error) *Error {
+	return &Error{Kind: kind, Err: err}
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Kind.Error()
+	}
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
@@ -0,0 +1,470 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+const (
+	exifHeader = "Exif\x00\x00"
+
+	tagOrientation = 0x0112
+	tagPixelX      = 0xA002
+	tagPixelY      = 0xA003
+	tagExifIFD     = 0x8769
+	tagGPSIFD      = 0x8825
+	tagInteropIFD  = 0xA005
+	tagJPEGOffset  = 0x0201
+	tagJPEGLength  = 0x0202
+	tagStripOffset = 0x0111
+
+	tiffTypeShort = 3
+	tiffTypeLong  = 4
+)
+
+// exifDir identifies one of the image file directories of EXIF data
+type exifDir int
+
+const (
+	dirIFD0 exifDir = iota
+	dirExif
+	dirGPS
+	dirInterop
+	dirIFD1
+	numExifDirs
+)
+
+// exifTag is a single IFD entry.  val is in the byte order of the exifData it belongs to.
+type exifTag struct {
+	id    uint16
+	typ   uint16
+	count uint32
+	val   []byte
+	tag   *tiff.Tag // the parsed tag, nil if the tag was added or changed
+}
+
+// exifData is EXIF data parsed into its directories so that tags may be removed or changed before it is encoded
+// again.  Offsets are recalculated when encoding, so maker notes that embed offsets relative to the TIFF header may
+// not survive being rewritten.
+type exifData struct {
+	order     binary.ByteOrder
+	dirs      [numExifDirs][]exifTag // pointer and thumbnail location tags are not included
+	thumbnail []byte                 // jpeg thumbnail referenced by IFD1
+
+	// seen holds the offset of each directory read while parsing, so that none is read twice
+	seen map[int64]bool
+}
+
+// parseEXIF parses exif, which may optionally start with the "Exif\0\0" APP1 identifier.  Only IFD0, IFD1 and the
+// sub directories described by exifDir are read, each at most once, so that chains of directories that loop back on
+// themselves cannot keep the parser busy.
+func parseEXIF(b []byte) (*exifData, error) {
+	e := &exifData{seen: make(map[int64]bool)}
+	b = bytes.TrimPrefix(b, []byte(exifHeader))
+
+	if len(b) < 8 {
+		return nil, errors.New("exif is too short for a TIFF header")
+	}
+	switch string(b[:2]) {
+	case "II":
+		e.order = binary.LittleEndian
+	case "MM":
+		e.order = binary.BigEndian
+	default:
+		return nil, errors.New("exif has no TIFF byte order")
+	}
+	if e.order.Uint16(b[2:]) != 42 {
+		return nil, errors.New("exif has no TIFF marker")
+	}
+
+	next, err := e.loadDir(b, dirIFD0, int64(e.order.Uint32(b[4:])))
+	if err != nil {
+		return nil, err
+	}
+	if next != 0 {
+		if _, err := e.loadDir(b, dirIFD1, next); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// loadDir reads the directory at off into dir, returning the offset of the directory following it
+func (e *exifData) loadDir(b []byte, dir exifDir, off int64) (int64, error) {
+	if off < 8 || off >= int64(len(b)) {
+		return 0, fmt.Errorf("directory offset %d out of bounds", off)
+	}
+	if e.seen[off] {
+		return 0, fmt.Errorf("directory at offset %d is referenced more than once", off)
+	}
+	e.seen[off] = true
+	if err := e.checkCounts(b, off); err != nil {
+		return 0, err
+	}
+
+	r := bytes.NewReader(b)
+	if _, err := r.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	d, next, err := tiff.DecodeDir(r, e.order)
+	if err != nil {
+		return 0, err
+	}
+	return int64(uint32(next)), e.load(b, dir, d)
+}
+
+// tiffTypeSizes are the sizes of a single value of each TIFF type, from BYTE to DOUBLE
+var tiffTypeSizes = [...]uint64{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// checkCounts rejects the directory at off if it holds an entry with more values than b could.  goexif allocates for
+// the count of an entry before reading its values, so a few bytes of EXIF could otherwise exhaust memory.
+func (e *exifData) checkCounts(b []byte, off int64) error {
+	d := b[off:]
+	if len(d) < 2 {
+		return errors.New("directory truncated")
+	}
+	n := int(e.order.Uint16(d))
+	// goexif reads the values of an entry once its count, so truncated entries are checked too
+	for i := 0; i < n && 2+12*i+8 <= len(d); i++ {
+		entry := d[2+12*i:]
+		typ, count := e.order.Uint16(entry[2:]), e.order.Uint32(entry[4:])
+		size := uint64(1)
+		if int(typ) < len(tiffTypeSizes) && tiffTypeSizes[typ] > 0 {
+			size = tiffTypeSizes[typ]
+		}
+		if uint64(count)*size > uint64(len(b)) {
+			return fmt.Errorf("tag %#04x has %d values, more than the EXIF holds", e.order.Uint16(entry), count)
+		}
+	}
+	return nil
+}
+
+// load adds the tags of d to dir, following pointers to sub directories
+func (e *exifData) load(b []byte, dir exifDir, d *tiff.Dir) error {
+	var thumbOffset, thumbLength int64 = -1, -1
+	for _, t := range d.Tags {
+		switch {
+		case dir == dirIFD0 && t.Id == tagExifIFD:
+			if err := e.loadSub(b, dirExif, t); err != nil {
+				return err
+			}
+		case dir == dirIFD0 && t.Id == tagGPSIFD:
+			if err := e.loadSub(b, dirGPS, t); err != nil {
+				return err
+			}
+		case dir == dirExif && t.Id == tagInteropIFD:
+			if err := e.loadSub(b, dirInterop, t); err != nil {
+				return err
+			}
+		case dir == dirIFD1 && t.Id == tagJPEGOffset:
+			thumbOffset, _ = t.Int64(0)
+		case dir == dirIFD1 && t.Id == tagJPEGLength:
+			thumbLength, _ = t.Int64(0)
+		case dir == dirIFD1 && t.Id == tagStripOffset:
+			// uncompressed thumbnails are rare and not worth relocating
+			e.dirs[dirIFD1] = nil
+			return nil
+		default:
+			e.dirs[dir] = append(e.dirs[dir], exifTag{id: t.Id, typ: uint16(t.Type), count: t.Count, val: t.Val, tag: t})
+		}
+	}
+
+	if dir == dirIFD1 {
+		if thumbOffset <= 0 || thumbLength <= 0 || thumbOffset+thumbLength > int64(len(b)) {
+			// a thumbnail directory without its thumbnail is of no use
+			e.dirs[dirIFD1] = nil
+			return nil
+		}
+		e.thumbnail = b[thumbOffset : thumbOffset+thumbLength]
+	}
+	return nil
+}
+
+func (e *exifData) loadSub(b []byte, dir exifDir, ptr *tiff.Tag) error {
+	off, err := ptr.Int64(0)
+	if err != nil {
+		return fmt.Errorf("invalid sub directory pointer %#04x: %w", ptr.Id, err)
+	}
+	if _, err := e.loadDir(b, dir, off); err != nil {
+		return fmt.Errorf("sub directory pointer %#04x: %w", ptr.Id, err)
+	}
+	return nil
+}
+
+// filter removes every tag for which keep returns false.  The thumbnail is kept if keep returns true for its IFD1
+// location tag.
+func (e *exifData) filter(keep func(dir exifDir, id uint16) bool) {
+	for dir := range e.dirs {
+		tags := e.dirs[dir][:0]
+		for _, t := range e.dirs[dir] {
+			if keep(exifDir(dir), t.id) {
+				tags = append(tags, t)
+			}
+		}
+		e.dirs[dir] = tags
+	}
+	if !keep(dirIFD1, tagJPEGOffset) {
+		e.dirs[dirIFD1] = nil
+		e.thumbnail = nil
+	}
+}
+
+// setUint changes the value of an existing short or long tag, returning false if it is not present.  A short tag is
+// changed to a long if v does not fit.
+func (e *exifData) setUint(dir exifDir, id uint16, v uint32) bool {
+	for i, t := range e.dirs[dir] {
+		if t.id != id || t.count != 1 {
+			continue
+		}
+		switch {
+		case t.typ == tiffTypeShort && v <= 0xFFFF:
+			t.val = make([]byte, 2)
+			e.order.PutUint16(t.val, uint16(v))
+		case t.typ == tiffTypeShort, t.typ == tiffTypeLong:
+			t.typ = tiffTypeLong
+			t.val = make([]byte, 4)
+			e.order.PutUint32(t.val, v)
+		default:
+			return false
+		}
+		t.tag = nil
+		e.dirs[dir][i] = t
+		return true
+	}
+	return false
+}
+
+func (e *exifData) long(id uint16, v uint32) exifTag {
+	t := exifTag{id: id, typ: tiffTypeLong, count: 1, val: make([]byte, 4)}
+	e.order.PutUint32(t.val, v)
+	return t
+}
+
+// empty returns true if there are no tags left to encode
+func (e *exifData) empty() bool {
+	for _, tags := range e.dirs {
+		if len(tags) > 0 {
+			return false
+		}
+	}
+	return e.thumbnail == nil
+}
+
+// encode lays out the directories one after another, each followed by the values too large to fit in its entries,
+// with the thumbnail last
+func (e *exifData) encode() []byte {
+	var dirs [numExifDirs][]exifTag
+	for i := range e.dirs {
+		dirs[i] = append([]exifTag(nil), e.dirs[i]...)
+	}
+
+	// pointers are added with placeholder values, set once the layout is known
+	if len(dirs[dirInterop]) > 0 {
+		dirs[dirExif] = append(dirs[dirExif], e.long(tagInteropIFD, 0))
+	}
+	if len(dirs[dirExif]) > 0 {
+		dirs[dirIFD0] = append(dirs[dirIFD0], e.long(tagExifIFD, 0))
+	}
+	if len(dirs[dirGPS]) > 0 {
+		dirs[dirIFD0] = append(dirs[dirIFD0], e.long(tagGPSIFD, 0))
+	}
+	if e.thumbnail != nil {
+		dirs[dirIFD1] = append(dirs[dirIFD1], e.long(tagJPEGOffset, 0), e.long(tagJPEGLength, uint32(len(e.thumbnail))))
+	}
+
+	layout := []exifDir{dirIFD0, dirExif, dirInterop, dirGPS, dirIFD1}
+	var offsets [numExifDirs]uint32
+	off := uint32(8)
+	for _, dir := range layout {
+		sort.Slice(dirs[dir], func(i, j int) bool { return dirs[dir][i].id < dirs[dir][j].id })
+		if dir == dirIFD0 || len(dirs[dir]) > 0 {
+			offsets[dir] = off
+			off += ifdSize(dirs[dir])
+		}
+	}
+
+	pointers := map[uint16]uint32{
+		tagExifIFD:    offsets[dirExif],
+		tagGPSIFD:     offsets[dirGPS],
+		tagInteropIFD: offsets[dirInterop],
+		tagJPEGOffset: off,
+	}
+	for _, dir := range []exifDir{dirIFD0, dirExif, dirIFD1} {
+		for i, t := range dirs[dir] {
+			if v, ok := pointers[t.id]; ok && t.typ == tiffTypeLong {
+				e.order.PutUint32(dirs[dir][i].val, v)
+			}
+		}
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, int(off)+len(e.thumbnail)))
+	hdr := make([]byte, 8)
+	if e.order == binary.LittleEndian {
+		copy(hdr, "II")
+	} else {
+		copy(hdr, "MM")
+	}
+	e.order.PutUint16(hdr[2:], 42)
+	e.order.PutUint32(hdr[4:], 8)
+	buf.Write(hdr)
+
+	for _, dir := range layout {
+		if offsets[dir] == 0 {
+			continue
+		}
+		var next uint32
+		if dir == dirIFD0 {
+			next = offsets[dirIFD1]
+		}
+		e.writeIFD(buf, dirs[dir], offsets[dir], next)
+	}
+	buf.Write(e.thumbnail)
+
+	return buf.Bytes()
+}
+
+// ifdSize is the size of a directory and its out of line values, each of which is padded to an even length
+func ifdSize(tags []exifTag) uint32 {
+	n := uint32(2 + 12*len(tags) + 4)
+	for _, t := range tags {
+		if l := uint32(len(t.val)); l > 4 {
+			n += l + l%2
+		}
+	}
+	return n
+}
+
+func (e *exifData) writeIFD(buf *bytes.Buffer, tags []exifTag, offset, next uint32) {
+	data := offset + uint32(2+12*len(tags)+4)
+	entry := make([]byte, 12)
+
+	_ = binary.Write(buf, e.order, uint16(len(tags)))
+	for _, t := range tags {
+		e.order.PutUint16(entry[0:], t.id)
+		e.order.PutUint16(entry[2:], t.typ)
+		e.order.PutUint32(entry[4:], t.count)
+		copy(entry[8:], []byte{0, 0, 0, 0})
+		if l := uint32(len(t.val)); l > 4 {
+			e.order.PutUint32(entry[8:], data)
+			data += l + l%2
+		} else {
+			copy(entry[8:], t.val)
+		}
+		buf.Write(entry)
+	}
+	_ = binary.Write(buf, e.order, next)
+
+	for _, t := range tags {
+		if len(t.val) > 4 {
+			buf.Write(t.val)
+			if len(t.val)%2 == 1 {
+				buf.WriteByte(0)
+			}
+		}
+	}
+}
+
+// prepareEXIF applies the metadata policy of opts to exif, resetting the orientation when the pixels have been
+// rotated and updating the pixel dimensions when they have changed.  The result starts at the TIFF header.  EXIF that
+// cannot be parsed is dropped, even when it would be kept unmodified, so readers are never handed data they reject.
+func prepareEXIF(b []byte, opts Options, res Result) []byte {
+	if len(b) == 0 || opts.Metadata == MetadataStrip {
+		return nil
+	}
+
+	b = bytes.TrimPrefix(b, []byte(exifHeader))
+	e, err := parseEXIF(b)
+	if err != nil {
+		return nil
+	}
+	if opts.Metadata == MetadataKeep && !res.Rotated && !res.Resized {
+		return b
+	}
+
+	switch opts.Metadata {
+	case MetadataStripGPS:
+		e.filter(func(dir exifDir, _ uint16) bool { return dir != dirGPS })
+	case MetadataAllowlist:
+		allowed := make(map[exifTagKey]bool, len(opts.MetadataTags)+1)
+		for _, name := range opts.MetadataTags {
+			if k, ok := lookupEXIFTag(name); ok {
+				allowed[k] = true
+			}
+		}
+		// orientation is needed to display the image correctly
+		allowed[exifTagKey{dirIFD0, tagOrientation}] = true
+		e.filter(func(dir exifDir, id uint16) bool { return allowed[exifTagKey{dir, id}] })
+	}
+	if res.Rotated {
+		e.setUint(dirIFD0, tagOrientation, 1)
+	}
+	if res.Rotated || res.Resized {
+		e.setUint(dirExif, tagPixelX, uint32(res.Width))
+		e.setUint(dirExif, tagPixelY, uint32(res.Height))
+	}
+
+	if e.empty() {
+		return nil
+	}
+	out := e.encode()
+	if _, err := parseEXIF(out); err != nil {
+		return nil
+	}
+	return out
+}
+
+// fitEXIF returns b, EXIF starting at the TIFF header, if it is at most max bytes.  Otherwise it is returned without
+// its IFD1 thumbnail, or as nil if it still does not fit, so that the image is written without it.
+func fitEXIF(b []byte, max int) []byte {
+	if len(b) <= max {
+		return b
+	}
+	e, err := parseEXIF(b)
+	if err != nil {
+		return nil
+	}
+	e.dirs[dirIFD1], e.thumbnail = nil, nil
+	if e.empty() {
+		return nil
+	}
+	if out := e.encode(); len(out) <= max {
+		return out
+	}
+	return nil
+}
+
+// exifTagValues returns the value of each named tag in b as json.  Maker notes and values that cannot be represented
+// are skipped.
+func exifTagValues(b []byte) (map[string]json.RawMessage, error) {
+	e, err := parseEXIF(b)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]json.RawMessage)
+	for dir, tags := range e.dirs {
+		for _, t := range tags {
+			name, ok := exifTagNames[exifTagKey{exifDir(dir), t.id}]
+			if !ok || t.tag == nil || name == string(exif.MakerNote) {
+				continue
+			}
+			v, err := t.tag.MarshalJSON()
+			if err != nil || !json.Valid(v) {
+				continue
+			}
+			if t.count == 1 && bytes.HasPrefix(v, []byte("[")) {
+				v = bytes.TrimSuffix(bytes.TrimPrefix(v, []byte("[")), []byte("]"))
+			}
+			out[name] = v
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,160 @@
+package convert
+
+import (
+	"strings"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// exifTagKey identifies a tag by its directory, as tag ids are only unique within a directory
+type exifTagKey struct {
+	dir exifDir
+	id  uint16
+}
+
+// exifTags names the tags that may be used with MetadataAllowlist and are reported by Probe.  Names are those used by
+// goexif, along with some tags added in later versions of the EXIF standard.
+var exifTags = map[exif.FieldName]exifTagKey{
+	exif.ImageWidth:                {dirIFD0, 0x0100},
+	exif.ImageLength:               {dirIFD0, 0x0101},
+	exif.BitsPerSample:             {dirIFD0, 0x0102},
+	exif.Compression:               {dirIFD0, 0x0103},
+	exif.PhotometricInterpretation: {dirIFD0, 0x0106},
+	exif.ImageDescription:          {dirIFD0, 0x010E},
+	exif.Make:                      {dirIFD0, 0x010F},
+	exif.Model:                     {dirIFD0, 0x0110},
+	exif.Orientation:               {dirIFD0, 0x0112},
+	exif.SamplesPerPixel:           {dirIFD0, 0x0115},
+	exif.XResolution:               {dirIFD0, 0x011A},
+	exif.YResolution:               {dirIFD0, 0x011B},
+	exif.PlanarConfiguration:       {dirIFD0, 0x011C},
+	exif.ResolutionUnit:            {dirIFD0, 0x0128},
+	exif.Software:                  {dirIFD0, 0x0131},
+	exif.DateTime:                  {dirIFD0, 0x0132},
+	exif.Artist:                    {dirIFD0, 0x013B},
+	"HostComputer":                 {dirIFD0, 0x013C},
+	exif.YCbCrSubSampling:          {dirIFD0, 0x0212},
+	exif.YCbCrPositioning:          {dirIFD0, 0x0213},
+	exif.Copyright:                 {dirIFD0, 0x8298},
+	exif.XPTitle:                   {dirIFD0, 0x9C9B},
+	exif.XPComment:                 {dirIFD0, 0x9C9C},
+	exif.XPAuthor:                  {dirIFD0, 0x9C9D},
+	exif.XPKeywords:                {dirIFD0, 0x9C9E},
+	exif.XPSubject:                 {dirIFD0, 0x9C9F},
+	exif.ExposureTime:              {dirExif, 0x829A},
+	exif.FNumber:                   {dirExif, 0x829D},
+	exif.ExposureProgram:           {dirExif, 0x8822},
+	exif.SpectralSensitivity:       {dirExif, 0x8824},
+	exif.ISOSpeedRatings:           {dirExif, 0x8827},
+	exif.OECF:                      {dirExif, 0x8828},
+	exif.ExifVersion:               {dirExif, 0x9000},
+	exif.DateTimeOriginal:          {dirExif, 0x9003},
+	exif.DateTimeDigitized:         {dirExif, 0x9004},
+	"OffsetTime":                   {dirExif, 0x9010},
+	"OffsetTimeOriginal":           {dirExif, 0x9011},
+	"OffsetTimeDigitized":          {dirExif, 0x9012},
+	exif.ComponentsConfiguration:   {dirExif, 0x9101},
+	exif.CompressedBitsPerPixel:    {dirExif, 0x9102},
+	exif.ShutterSpeedValue:         {dirExif, 0x9201},
+	exif.ApertureValue:             {dirExif, 0x9202},
+	exif.BrightnessValue:           {dirExif, 0x9203},
+	exif.ExposureBiasValue:         {dirExif, 0x9204},
+	exif.MaxApertureValue:          {dirExif, 0x9205},
+	exif.SubjectDistance:           {dirExif, 0x9206},
+	exif.MeteringMode:              {dirExif, 0x9207},
+	exif.LightSource:               {dirExif, 0x9208},
+	exif.Flash:                     {dirExif, 0x9209},
+	exif.FocalLength:               {dirExif, 0x920A},
+	exif.SubjectArea:               {dirExif, 0x9214},
+	exif.MakerNote:                 {dirExif, 0x927C},
+	exif.UserComment:               {dirExif, 0x9286},
+	exif.SubSecTime:                {dirExif, 0x9290},
+	exif.SubSecTimeOriginal:        {dirExif, 0x9291},
+	exif.SubSecTimeDigitized:       {dirExif, 0x9292},
+	exif.FlashpixVersion:           {dirExif, 0xA000},
+	exif.ColorSpace:                {dirExif, 0xA001},
+	exif.PixelXDimension:           {dirExif, 0xA002},
+	exif.PixelYDimension:           {dirExif, 0xA003},
+	exif.RelatedSoundFile:          {dirExif, 0xA004},
+	exif.FlashEnergy:               {dirExif, 0xA20B},
+	exif.SpatialFrequencyResponse:  {dirExif, 0xA20C},
+	exif.FocalPlaneXResolution:     {dirExif, 0xA20E},
+	exif.FocalPlaneYResolution:     {dirExif, 0xA20F},
+	exif.FocalPlaneResolutionUnit:  {dirExif, 0xA210},
+	exif.SubjectLocation:           {dirExif, 0xA214},
+	exif.ExposureIndex:             {dirExif, 0xA215},
+	exif.SensingMethod:             {dirExif, 0xA217},
+	exif.FileSource:                {dirExif, 0xA300},
+	exif.SceneType:                 {dirExif, 0xA301},
+	exif.CFAPattern:                {dirExif, 0xA302},
+	exif.CustomRendered:            {dirExif, 0xA401},
+	exif.ExposureMode:              {dirExif, 0xA402},
+	exif.WhiteBalance:              {dirExif, 0xA403},
+	exif.DigitalZoomRatio:          {dirExif, 0xA404},
+	exif.FocalLengthIn35mmFilm:     {dirExif, 0xA405},
+	exif.SceneCaptureType:          {dirExif, 0xA406},
+	exif.GainControl:               {dirExif, 0xA407},
+	exif.Contrast:                  {dirExif, 0xA408},
+	exif.Saturation:                {dirExif, 0xA409},
+	exif.Sharpness:                 {dirExif, 0xA40A},
+	exif.DeviceSettingDescription:  {dirExif, 0xA40B},
+	exif.SubjectDistanceRange:      {dirExif, 0xA40C},
+	exif.ImageUniqueID:             {dirExif, 0xA420},
+	"CameraOwnerName":              {dirExif, 0xA430},
+	"BodySerialNumber":             {dirExif, 0xA431},
+	"LensSpecification":            {dirExif, 0xA432},
+	exif.LensMake:                  {dirExif, 0xA433},
+	exif.LensModel:                 {dirExif, 0xA434},
+	"LensSerialNumber":             {dirExif, 0xA435},
+	"CompositeImage":               {dirExif, 0xA460},
+	exif.GPSVersionID:              {dirGPS, 0x0000},
+	exif.GPSLatitudeRef:            {dirGPS, 0x0001},
+	exif.GPSLatitude:               {dirGPS, 0x0002},
+	exif.GPSLongitudeRef:           {dirGPS, 0x0003},
+	exif.GPSLongitude:              {dirGPS, 0x0004},
+	exif.GPSAltitudeRef:            {dirGPS, 0x0005},
+	exif.GPSAltitude:               {dirGPS, 0x0006},
+	exif.GPSTimeStamp:              {dirGPS, 0x0007},
+	exif.GPSSatelites:              {dirGPS, 0x0008},
+	exif.GPSStatus:                 {dirGPS, 0x0009},
+	exif.GPSMeasureMode:            {dirGPS, 0x000A},
+	exif.GPSDOP:                    {dirGPS, 0x000B},
+	exif.GPSSpeedRef:               {dirGPS, 0x000C},
+	exif.GPSSpeed:                  {dirGPS, 0x000D},
+	exif.GPSTrackRef:               {dirGPS, 0x000E},
+	exif.GPSTrack:                  {dirGPS, 0x000F},
+	exif.GPSImgDirectionRef:        {dirGPS, 0x0010},
+	exif.GPSImgDirection:           {dirGPS, 0x0011},
+	exif.GPSMapDatum:               {dirGPS, 0x0012},
+	exif.GPSDestLatitudeRef:        {dirGPS, 0x0013},
+	exif.GPSDestLatitude:           {dirGPS, 0x0014},
+	exif.GPSDestLongitudeRef:       {dirGPS, 0x0015},
+	exif.GPSDestLongitude:          {dirGPS, 0x0016},
+	exif.GPSDestBearingRef:         {dirGPS, 0x0017},
+	exif.GPSDestBearing:            {dirGPS, 0x0018},
+	exif.GPSDestDistanceRef:        {dirGPS, 0x0019},
+	exif.GPSDestDistance:           {dirGPS, 0x001A},
+	exif.GPSProcessingMethod:       {dirGPS, 0x001B},
+	exif.GPSAreaInformation:        {dirGPS, 0x001C},
+	exif.GPSDateStamp:              {dirGPS, 0x001D},
+	exif.GPSDifferential:           {dirGPS, 0x001E},
+	exif.InteroperabilityIndex:     {dirInterop, 0x0001},
+}
+
+var exifTagNames = make(map[exifTagKey]string, len(exifTags))
+
+func init() {
+	for name, k := range exifTags {
+		exifTagNames[k] = string(name)
+	}
+}
+
+// lookupEXIFTag returns the tag with the provided name, case-insensitively
+func lookupEXIFTag(name string) (exifTagKey, bool) {
+	for n, k := range exifTags {
+		if strings.EqualFold(string(n), name) {
+			return k, true
+		}
+	}
+	return exifTagKey{}, false
+}
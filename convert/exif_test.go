@@ -0,0 +1,316 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+// gpsTIFF returns big endian EXIF of:
+//
+//	IFD0: Make "App", Orientation 6, and pointers to the Exif and GPS directories
+//	Exif: ISOSpeedRatings 100, PixelXDimension 64, PixelYDimension 48
+//	GPS:  GPSLatitudeRef "N", GPSLatitude 51/1 30/1 0/1
+func gpsTIFF() []byte {
+	var buf bytes.Buffer
+	w := func(v ...interface{}) {
+		for _, x := range v {
+			_ = binary.Write(&buf, binary.BigEndian, x)
+		}
+	}
+	entry := func(id, typ uint16, count uint32, val []byte) {
+		w(id, typ, count)
+		buf.Write(append(val, make([]byte, 4-len(val))...))
+	}
+	u16 := func(v uint16) []byte { return []byte{byte(v >> 8), byte(v)} }
+	u32 := func(v uint32) []byte { return []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)} }
+
+	buf.WriteString("MM\x00*")
+	w(uint32(8))
+
+	// IFD0 at 8, followed by the Exif IFD at 62 and the GPS IFD at 104
+	w(uint16(4))
+	entry(0x010f, 2, 4, []byte("App\x00"))
+	entry(tagOrientation, tiffTypeShort, 1, u16(6))
+	entry(tagExifIFD, tiffTypeLong, 1, u32(62))
+	entry(tagGPSIFD, tiffTypeLong, 1, u32(104))
+	w(uint32(0))
+
+	w(uint16(3))
+	entry(0x8827, tiffTypeShort, 1, u16(100))
+	entry(tagPixelX, tiffTypeShort, 1, u16(64))
+	entry(tagPixelY, tiffTypeShort, 1, u16(48))
+	w(uint32(0))
+
+	// the latitude's rationals follow the GPS IFD, at 134
+	w(uint16(2))
+	entry(0x0001, 2, 2, []byte("N\x00"))
+	entry(0x0002, 5, 3, u32(134))
+	w(uint32(0))
+	w(uint32(51), uint32(1), uint32(30), uint32(1), uint32(0), uint32(1))
+
+	return buf.Bytes()
+}
+
+// exifTagIDs returns the tag ids of each directory of b, including pointers, keyed by the tag pointing at it
+func exifTagIDs(t *testing.T, b []byte) map[uint16][]uint16 {
+	t.Helper()
+	b = bytes.TrimPrefix(b, []byte(exifHeader))
+	x, err := tiff.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := make(map[uint16][]uint16)
+	var walk func(key uint16, d *tiff.Dir)
+	walk = func(key uint16, d *tiff.Dir) {
+		for _, tag := range d.Tags {
+			out[key] = append(out[key], tag.Id)
+			if tag.Id != tagExifIFD && tag.Id != tagGPSIFD {
+				continue
+			}
+			off, _ := tag.Int64(0)
+			r := bytes.NewReader(b)
+			_, _ = r.Seek(off, 0)
+			sub, _, err := tiff.DecodeDir(r, x.Order)
+			if err != nil {
+				t.Fatalf("reading directory of %#04x: %v", tag.Id, err)
+			}
+			walk(tag.Id, sub)
+		}
+	}
+	walk(0, x.Dirs[0])
+	return out
+}
+
+// cyclicTIFF returns 64 bytes of big endian EXIF whose IFD0, at offset 8, is followed by an IFD1 at offset 26 that is
+// followed by IFD0 again
+func cyclicTIFF() []byte {
+	b := make([]byte, 64)
+	copy(b, "MM\x00*\x00\x00\x00\x08")
+	for _, ifd := range [][2]uint32{{8, 26}, {26, 8}} {
+		off := ifd[0]
+		binary.BigEndian.PutUint16(b[off:], 1)
+		binary.BigEndian.PutUint16(b[off+2:], tagOrientation)
+		binary.BigEndian.PutUint16(b[off+4:], tiffTypeShort)
+		binary.BigEndian.PutUint32(b[off+6:], 1)
+		binary.BigEndian.PutUint16(b[off+10:], 1)
+		binary.BigEndian.PutUint32(b[off+14:], ifd[1])
+	}
+	return b
+}
+
+func TestParseEXIF(t *testing.T) {
+	e, err := parseEXIF(append([]byte(exifHeader), gpsTIFF()...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.order != binary.BigEndian {
+		t.Errorf("got order %v", e.order)
+	}
+	for dir, n := range map[exifDir]int{dirIFD0: 2, dirExif: 3, dirGPS: 2, dirInterop: 0, dirIFD1: 0} {
+		if len(e.dirs[dir]) != n {
+			t.Errorf("got %d tags in directory %d, want %d", len(e.dirs[dir]), dir, n)
+		}
+	}
+
+	// encoding keeps every tag and value
+	if got, want := exifTagIDs(t, e.encode()), exifTagIDs(t, gpsTIFF()); !reflect.DeepEqual(got, want) {
+		t.Errorf("got tags %v, want %v", got, want)
+	}
+	lat, err := parseEXIF(e.encode())
+	if err != nil || !bytes.Equal(lat.dirs[dirGPS][1].val, gpsTIFF()[134:]) {
+		t.Errorf("got GPS %+v, %v", lat.dirs[dirGPS], err)
+	}
+
+	// a sub directory pointing back at IFD0
+	sub := testTIFF()
+	binary.BigEndian.PutUint16(sub[10:], tagExifIFD)
+	binary.BigEndian.PutUint16(sub[12:], tiffTypeLong)
+	binary.BigEndian.PutUint32(sub[14:], 1)
+	binary.BigEndian.PutUint32(sub[18:], 8)
+
+	// only IFD1 follows IFD0, so the loop back to IFD0 is never read
+	done := make(chan error, 1)
+	go func() {
+		e, err := parseEXIF(cyclicTIFF())
+		if err == nil && len(e.dirs[dirIFD0]) != 1 {
+			t.Errorf("got IFD0 %+v", e.dirs[dirIFD0])
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("cyclic: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("cyclic: parsing did not return")
+	}
+
+	// a Make of 2^31+1 SHORT values, whose size overflows 32 bits to fit in the entry
+	huge := testTIFF()
+	binary.BigEndian.PutUint16(huge[12:], tiffTypeShort)
+	binary.BigEndian.PutUint32(huge[14:], 1<<31|1)
+	// and of 2^31+4, whose values are read from the start of the EXIF when the entry ends at its count
+	truncated := append([]byte(nil), huge[:18]...)
+	binary.BigEndian.PutUint32(truncated[14:], 1<<31|4)
+
+	for name, b := range map[string][]byte{
+		"sub directory":   sub,
+		"huge count":      huge,
+		"truncated entry": truncated,
+		"short":           []byte("MM\x00*\x00"),
+		"byte order":      []byte("XX\x00*\x00\x00\x00\x08"),
+		"out of bounds":   []byte("MM\x00*\x00\x00\x01\x00"),
+		"inside header":   []byte("MM\x00*\x00\x00\x00\x04"),
+		"no tiff marker":  []byte("MM\x00+\x00\x00\x00\x08"),
+	} {
+		if _, err := parseEXIF(b); err == nil {
+			t.Errorf("%s: parsed", name)
+		}
+	}
+}
+
+func TestPrepareEXIF(t *testing.T) {
+	in := append([]byte(exifHeader), gpsTIFF()...)
+
+	if got := prepareEXIF(in, Options{Metadata: MetadataKeep}, Result{}); !bytes.Equal(got, gpsTIFF()) {
+		t.Errorf("keep modified unrotated EXIF: % x", got)
+	}
+	if got := prepareEXIF(in, Options{Metadata: MetadataStrip}, Result{}); got != nil {
+		t.Errorf("strip kept % x", got)
+	}
+	for _, policy := range []MetadataPolicy{MetadataKeep, MetadataStripGPS} {
+		if got := prepareEXIF([]byte(exifHeader+"not exif"), Options{Metadata: policy}, Result{}); got != nil {
+			t.Errorf("%s kept unparseable % x", policy, got)
+		}
+	}
+
+	exifIDs := []uint16{0x8827, tagPixelX, tagPixelY}
+	for _, tc := range []struct {
+		name string
+		opts Options
+		res  Result
+		want map[uint16][]uint16
+	}{
+		{"keep rotated", Options{Metadata: MetadataKeep}, Result{Width: 48, Height: 64, Rotated: true}, map[uint16][]uint16{
+			0:          {0x010f, tagOrientation, tagExifIFD, tagGPSIFD},
+			tagExifIFD: exifIDs,
+			tagGPSIFD:  {0x0001, 0x0002},
+		}},
+		{"keep resized", Options{Metadata: MetadataKeep}, Result{Width: 70000, Height: 24, Resized: true}, map[uint16][]uint16{
+			0:          {0x010f, tagOrientation, tagExifIFD, tagGPSIFD},
+			tagExifIFD: exifIDs,
+			tagGPSIFD:  {0x0001, 0x0002},
+		}},
+		{"strip gps", Options{Metadata: MetadataStripGPS}, Result{Width: 64, Height: 48}, map[uint16][]uint16{
+			0:          {0x010f, tagOrientation, tagExifIFD},
+			tagExifIFD: exifIDs,
+		}},
+		{"allowlist", Options{Metadata: MetadataAllowlist, MetadataTags: []string{"make", "GPSLatitude"}}, Result{Width: 64, Height: 48}, map[uint16][]uint16{
+			0:         {0x010f, tagOrientation, tagGPSIFD},
+			tagGPSIFD: {0x0002},
+		}},
+		{"allowlist none", Options{Metadata: MetadataAllowlist, MetadataTags: []string{}}, Result{Width: 48, Height: 64, Rotated: true}, map[uint16][]uint16{
+			0: {tagOrientation},
+		}},
+	} {
+		out := prepareEXIF(in, tc.opts, tc.res)
+		if !bytes.HasPrefix(out, []byte("MM\x00*")) {
+			t.Errorf("%s: does not start at the TIFF header: % x", tc.name, out)
+			continue
+		}
+		if got := exifTagIDs(t, out); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got tags %v, want %v", tc.name, got, tc.want)
+		}
+
+		e, err := parseEXIF(out)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		want := map[uint16]uint32{tagOrientation: 6, tagPixelX: 64, tagPixelY: 48}
+		if tc.res.Rotated {
+			want[tagOrientation] = 1
+		}
+		if tc.res.Rotated || tc.res.Resized {
+			want[tagPixelX], want[tagPixelY] = uint32(tc.res.Width), uint32(tc.res.Height)
+		}
+		for _, tag := range append(e.dirs[dirIFD0], e.dirs[dirExif]...) {
+			v, ok := want[tag.id]
+			if !ok {
+				continue
+			}
+			got := uint32(binary.BigEndian.Uint16(tag.val))
+			if tag.typ == tiffTypeLong {
+				got = binary.BigEndian.Uint32(tag.val)
+			}
+			if got != v {
+				t.Errorf("%s: got %#04x of %d, want %d", tc.name, tag.id, got, v)
+			}
+		}
+	}
+}
+
+func TestEncodeEXIF(t *testing.T) {
+	img := &decodedImage{ycc: image.NewYCbCr(image.Rect(0, 0, 8, 8), image.YCbCrSubsampleRatio420), exif: gpsTIFF()}
+
+	var buf bytes.Buffer
+	exif, _, err := encode(&buf, img, Options{Format: FormatJPEG, Quality: DefaultQuality})
+	if err != nil || !exif {
+		t.Fatalf("got %v, %v", exif, err)
+	}
+
+	// APP1 holds the Exif identifier, then the TIFF header
+	b := buf.Bytes()
+	want := append([]byte{0xff, 0xd8, 0xff, 0xe1, 0, byte(2 + len(exifHeader) + len(img.exif))}, exifHeader...)
+	if !bytes.HasPrefix(b, append(want, img.exif...)) {
+		t.Errorf("output starts % x", b[:len(want)])
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(b)); err != nil {
+		t.Error(err)
+	}
+
+	// EXIF too large for an APP1 segment loses its thumbnail first, then is left out
+	for _, tc := range []struct {
+		name string
+		big  func(e *exifData)
+		exif bool
+	}{
+		{"thumbnail", func(e *exifData) { e.thumbnail = make([]byte, jpegMaxSegment) }, true},
+		{"description", func(e *exifData) {
+			e.dirs[dirIFD0] = append(e.dirs[dirIFD0], exifTag{id: 0x010e, typ: 2, count: jpegMaxSegment, val: make([]byte, jpegMaxSegment)})
+		}, false},
+	} {
+		e, err := parseEXIF(gpsTIFF())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.big(e)
+		img := &decodedImage{ycc: img.ycc, exif: e.encode()}
+
+		buf.Reset()
+		exif, _, err := encode(&buf, img, Options{Format: FormatJPEG, Quality: DefaultQuality})
+		if err != nil || exif != tc.exif {
+			t.Fatalf("%s: got %v, %v, want %v", tc.name, exif, err, tc.exif)
+		}
+		b := buf.Bytes()
+		if _, err := jpeg.Decode(bytes.NewReader(b)); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if i := bytes.Index(b, []byte(exifHeader)); (i >= 0) != tc.exif {
+			t.Errorf("%s: Exif identifier at %d", tc.name, i)
+		} else if tc.exif {
+			n := int(binary.BigEndian.Uint16(b[i-2:]))
+			if out, err := parseEXIF(b[i : i-2+n]); err != nil || out.thumbnail != nil || len(out.dirs[dirIFD0]) != 2 {
+				t.Errorf("%s: got %+v, %v", tc.name, out, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,626 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dcarbone/go-heicker/heif"
+	"github.com/dcarbone/go-heicker/heif/bmff"
+	"golang.org/x/image/webp"
+)
+
+// fixture is a small synthetic HEIF file and the image expected from converting it with opts
+type fixture struct {
+	name string
+	// golden names the file under testdata/golden the output is compared with, shared by fixtures of the same image
+	golden string
+	build  func(t testing.TB) []byte
+	opts   Options
+	// want is the source image as it should appear in the output, before any lossy coding
+	want image.Image
+	// check, if set, tests the file's Info and the result and output of the conversion
+	check func(t *testing.T, info *Info, res Result, out []byte)
+}
+
+const (
+	testWidth  = 64
+	testHeight = 48
+)
+
+// fixtures are built in code with heif.Writer, so the corpus needs no binary files besides the golden outputs and the
+// HEVC and AV1 images of testdata, which Go cannot encode, written by testdata/generate.c
+var fixtures = []fixture{
+	{
+		name:   "unci",
+		golden: "unci",
+		build: func(t testing.TB) []byte {
+			w := heif.NewWriter()
+			w.AddUncompressed(testImage(testWidth, testHeight))
+			return writeFixture(t, w)
+		},
+		want: testImage(testWidth, testHeight),
+	},
+	{
+		name:   "multi_extent",
+		golden: "unci",
+		build: func(t testing.TB) []byte {
+			w := heif.NewWriter()
+			it := w.AddUncompressed(testImage(testWidth, testHeight))
+			data := it.Extents[0]
+			it.Extents = [][]byte{data[:1000], data[1000:1001], data[1001:]}
+			return writeFixture(t, w)
+		},
+		want: testImage(testWidth, testHeight),
+	},
+	{
+		name:   "grid",
+		golden: "grid",
+		build: func(t testing.TB) []byte {
+			// a 2x2 grid of 40x32 tiles, cropped to 64x48 by the grid's spatial extents
+			src := testImage(80, 64)
+			w := heif.NewWriter()
+			g := w.AddItem("grid", []byte{0, 0, 1, 1, 0, testWidth, 0, testHeight})
+			g.AddProperty(heif.SpatialExtentsProperty(testWidth, testHeight))
+			for y := 0; y < 2; y++ {
+				for x := 0; x < 2; x++ {
+					tile := w.AddUncompressed(src.SubImage(image.Rect(x*40, y*32, x*40+40, y*32+32)))
+					tile.Hidden = true
+				}
+			}
+			g.AddReference("dimg", 2, 3, 4, 5)
+			return writeFixture(t, w)
+		},
+		want: testImage(80, 64).SubImage(image.Rect(0, 0, testWidth, testHeight)),
+		check: func(t *testing.T, info *Info, _ Result, _ []byte) {
+			if g := info.Grid; g == nil || g.Rows != 2 || g.Columns != 2 || g.TileWidth != 40 || g.TileHeight != 32 {
+				t.Errorf("got grid %+v", info.Grid)
+			}
+			if info.Images != 1 {
+				t.Errorf("got %d images, the tiles should not be counted", info.Images)
+			}
+		},
+	},
+	{
+		name:   "rotation",
+		golden: "rotation",
+		build: func(t testing.TB) []byte {
+			w := heif.NewWriter()
+			it := w.AddUncompressed(testImage(testWidth, testHeight))
+			it.AddProperty(heif.RotationProperty(1), heif.MirrorProperty(bmff.MirrorVertical))
+			return writeFixture(t, w)
+		},
+		opts: Options{Rotation: RotateAuto},
+		// a quarter turn anti-clockwise, then mirrored left to right
+		want: transformed(testImage(testWidth, testHeight), testHeight, testWidth, func(x, y int) (int, int) {
+			return testWidth - 1 - y, testHeight - 1 - x
+		}),
+		check: func(t *testing.T, info *Info, res Result, _ []byte) {
+			if info.Rotation != 270 || info.Mirror != "vertical" {
+				t.Errorf("got rotation %d and mirror %q", info.Rotation, info.Mirror)
+			}
+			if !res.Rotated {
+				t.Error("result is not rotated")
+			}
+		},
+	},
+	{
+		name:   "exif",
+		golden: "exif",
+		build: func(t testing.TB) []byte {
+			w := heif.NewWriter()
+			it, err := w.AddJPEG(testJPEG(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.AddEXIF(testTIFF(), it.ID)
+			return writeFixture(t, w)
+		},
+		opts: Options{Format: FormatJPEG, Quality: 95},
+		want: testImage(testWidth, testHeight),
+		check: func(t *testing.T, info *Info, res Result, out []byte) {
+			if !info.EXIF || string(info.EXIFTags["Make"]) != `"heicker"` {
+				t.Errorf("got EXIF %v, tags %s", info.EXIF, info.EXIFTags)
+			}
+			if !res.EXIF || !bytes.Contains(out, append([]byte("Exif\x00\x00"), testTIFF()...)) {
+				t.Error("output has no EXIF")
+			}
+		},
+	},
+	{
+		name:   "jpgc",
+		golden: "exif",
+		build: func(t testing.TB) []byte {
+			// the headers of the codestream, up to its start of scan, are moved to a jpgC property
+			data := testJPEG(t)
+			sos := bytes.Index(data, []byte{0xff, 0xda})
+			w := heif.NewWriter()
+			it, err := w.AddJPEG(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			it.Extents = [][]byte{data[sos:]}
+			it.AddProperty(heif.JPEGConfigProperty(data[:sos]))
+			return writeFixture(t, w)
+		},
+		opts: Options{Format: FormatJPEG, Quality: 95},
+		want: testImage(testWidth, testHeight),
+	},
+	{
+		name:   "alpha",
+		golden: "unci",
+		build: func(t testing.TB) []byte {
+			w := heif.NewWriter()
+			w.AddUncompressed(testImage(testWidth, testHeight))
+			alpha := w.AddItem("unci", bytes.Repeat([]byte{0x80}, testWidth*testHeight))
+			alpha.Hidden = true
+			alpha.AddReference("auxl", 1)
+			alpha.AddProperty(
+				heif.SpatialExtentsProperty(testWidth, testHeight),
+				heif.ComponentDefinitionProperty(bmff.ComponentMonochrome),
+				heif.UncompressedConfigProperty(&bmff.UncompressedFrameConfigBox{
+					Profile:    "gray",
+					Components: []bmff.UncompressedComponent{{Index: 0, BitDepth: 8}},
+				}),
+				heif.PixelInformationProperty(8),
+				heif.AuxiliaryTypeProperty("urn:mpeg:mpegB:cicp:systems:auxiliary:alpha"),
+			)
+			return writeFixture(t, w)
+		},
+		want: testImage(testWidth, testHeight),
+		check: func(t *testing.T, info *Info, _ Result, _ []byte) {
+			if !info.Alpha || len(info.Auxiliary) != 1 || info.Auxiliary[0].Type != AuxAlpha || info.Images != 1 {
+				t.Errorf("got alpha %v, auxiliary images %+v and %d images", info.Alpha, info.Auxiliary, info.Images)
+			}
+		},
+	},
+	{
+		// three images as libheif writes them, each a grid cropping a single 64x64 tile
+		name:   "hvc1",
+		golden: "hvc1",
+		build: func(t testing.TB) []byte {
+			return readTestdata(t, "hevc.heic")
+		},
+		want: testImage(testWidth, testHeight),
+		check: func(t *testing.T, info *Info, _ Result, _ []byte) {
+			if info.Codec != "grid" || info.ChromaFormat != "4:2:0" || info.BitDepth != 8 || info.Images != 3 {
+				t.Errorf("got codec %q, chroma format %q, bit depth %d and %d images", info.Codec, info.ChromaFormat, info.BitDepth, info.Images)
+			}
+		},
+	},
+	{
+		name:   "hev1",
+		golden: "hvc1",
+		build: func(t testing.TB) []byte {
+			// the parameter sets are moved from the hvcC to the start of the item data
+			config, tiles := hevcTileConfig(t, "hevc.heic")
+			w := heif.NewWriter()
+			addHEVC(w, "hev1", hevcConfigProperty(config, false), append(config.AsHeader(), tiles[0]...))
+			return writeFixture(t, w)
+		},
+		want: testImage(testWidth, testHeight),
+	},
+	{
+		name:   "av01",
+		golden: "hvc1",
+		build: func(t testing.TB) []byte {
+			return readTestdata(t, "av1.avif")
+		},
+		want: testImage(testWidth, testHeight),
+		check: func(t *testing.T, info *Info, _ Result, _ []byte) {
+			if info.Brand != "avif" || info.Codec != "av01" || info.ChromaFormat != "4:2:0" {
+				t.Errorf("got brand %q, codec %q and chroma format %q", info.Brand, info.Codec, info.ChromaFormat)
+			}
+		},
+	},
+	{
+		name:   "iden",
+		golden: "iden",
+		build: func(t testing.TB) []byte {
+			// a half turn applied to the grid by an identity item
+			config, tiles := hevcTileConfig(t, "hevc.heic")
+			w := heif.NewWriter()
+			iden := w.AddItem("iden")
+			iden.AddProperty(heif.SpatialExtentsProperty(testWidth, testHeight), heif.RotationProperty(2))
+			g := addHEVC(w, "hvc1", hevcConfigProperty(config, true), tiles[0])
+			g.Hidden = true
+			iden.AddReference("dimg", g.ID)
+			return writeFixture(t, w)
+		},
+		opts: Options{Rotation: RotateAuto},
+		want: transformed(testImage(testWidth, testHeight), testWidth, testHeight, func(x, y int) (int, int) {
+			return testWidth - 1 - x, testHeight - 1 - y
+		}),
+		check: func(t *testing.T, info *Info, res Result, _ []byte) {
+			if info.Codec != "iden" || info.Rotation != 180 || info.Images != 1 || !res.Rotated {
+				t.Errorf("got codec %q, rotation %d, %d images and rotated %v", info.Codec, info.Rotation, info.Images, res.Rotated)
+			}
+		},
+	},
+	{
+		name:   "iovl",
+		golden: "iovl",
+		build: func(t testing.TB) []byte {
+			// the grid and then an uncompressed image overlapping its corner, on an 80x60 canvas
+			config, tiles := hevcTileConfig(t, "hevc.heic")
+			w := heif.NewWriter()
+			ovl := w.AddItem("iovl", []byte{
+				0, 0, // version and flags, of 16 bit fields
+				0x40, 0x00, 0x80, 0x00, 0xc0, 0x00, 0xff, 0xff, // canvas fill, RGBA
+				0, 80, 0, 60, // canvas size
+				0, 8, 0, 6, // offset of the grid
+				0, 4, 0, 3, // offset of the uncompressed image
+			})
+			ovl.AddProperty(heif.SpatialExtentsProperty(80, 60))
+			g := addHEVC(w, "hvc1", hevcConfigProperty(config, true), tiles[0])
+			g.Hidden = true
+			unci := w.AddUncompressed(testImage(16, 12))
+			unci.Hidden = true
+			ovl.AddReference("dimg", g.ID, unci.ID)
+			return writeFixture(t, w)
+		},
+		want: func() image.Image {
+			img := image.NewRGBA(image.Rect(0, 0, 80, 60))
+			draw.Draw(img, img.Rect, image.NewUniform(color.RGBA{R: 0x40, G: 0x80, B: 0xc0, A: 0xff}), image.Point{}, draw.Src)
+			draw.Draw(img, image.Rect(8, 6, 8+testWidth, 6+testHeight), testImage(testWidth, testHeight), image.Point{}, draw.Src)
+			draw.Draw(img, image.Rect(4, 3, 20, 15), testImage(16, 12), image.Point{}, draw.Src)
+			return img
+		}(),
+		check: func(t *testing.T, info *Info, _ Result, _ []byte) {
+			if info.Codec != "iovl" || info.Width != 80 || info.Height != 60 || info.Images != 1 {
+				t.Errorf("got codec %q, size %dx%d and %d images", info.Codec, info.Width, info.Height, info.Images)
+			}
+		},
+	},
+	{
+		name:   "depth",
+		golden: "depth",
+		build: func(t testing.TB) []byte {
+			// a monochrome tile as the depth map of the grid
+			config, tiles := hevcTileConfig(t, "hevc.heic")
+			rampConfig, ramp := hevcTileConfig(t, "ramp.heic")
+			w := heif.NewWriter()
+			g := addHEVC(w, "hvc1", hevcConfigProperty(config, true), tiles[0])
+			depth := w.AddItem("hvc1", ramp[0])
+			depth.Hidden = true
+			depth.AddReference("auxl", g.ID)
+			depth.AddProperty(
+				hevcConfigProperty(rampConfig, true),
+				heif.SpatialExtentsProperty(hevcTileSize, hevcTileSize),
+				heif.AuxiliaryTypeProperty("urn:mpeg:mpegB:cicp:systems:auxiliary:depth"),
+			)
+			return writeFixture(t, w)
+		},
+		opts: Options{Aux: AuxDepth},
+		want: testRamp(hevcTileSize, hevcTileSize),
+		check: func(t *testing.T, info *Info, res Result, _ []byte) {
+			if !info.Depth || len(info.Auxiliary) != 1 || info.Auxiliary[0].Type != AuxDepth || res.Item != 3 {
+				t.Errorf("got depth %v, auxiliary images %+v and item %d converted", info.Depth, info.Auxiliary, res.Item)
+			}
+		},
+	},
+	{
+		name:   "gainmap",
+		golden: "hvc1",
+		build: func(t testing.TB) []byte {
+			// the ramp as the gain map of the grid, with a headroom of 4 given by its XMP
+			config, tiles := hevcTileConfig(t, "hevc.heic")
+			rampConfig, ramp := hevcTileConfig(t, "ramp.heic")
+			w := heif.NewWriter()
+			g := addHEVC(w, "hvc1", hevcConfigProperty(config, true), tiles[0])
+			gm := w.AddItem("hvc1", ramp[0])
+			gm.Hidden = true
+			gm.AddReference("auxl", g.ID)
+			gm.AddProperty(
+				hevcConfigProperty(rampConfig, true),
+				heif.SpatialExtentsProperty(hevcTileSize, hevcTileSize),
+				heif.AuxiliaryTypeProperty("urn:com:apple:photo:2020:aux:hdrgainmap"),
+			)
+			w.AddXMP([]byte(xmpPacketStart+`<rdf:Description rdf:about="" `+
+				`xmlns:HDRGainMap="http://ns.apple.com/HDRGainMap/1.0/" HDRGainMap:HDRGainMapHeadroom="4"/>`+xmpPacketEnd), gm.ID)
+			return writeFixture(t, w)
+		},
+		opts: Options{Format: FormatJPEG, Quality: 95},
+		want: testImage(testWidth, testHeight),
+		check: func(t *testing.T, _ *Info, res Result, out []byte) {
+			if !res.GainMap {
+				t.Fatal("output has no gain map")
+			}
+			// the gain map is the second codestream, following the primary image
+			i := bytes.Index(out[2:], []byte{0xff, 0xd8})
+			if i < 0 {
+				t.Fatal("no gain map codestream")
+			}
+			gm := out[2+i:]
+			if !bytes.Contains(gm, []byte(`hdrgm:GainMapMax="2"`)) {
+				t.Error("gain map XMP lacks its maximum of 2 stops")
+			}
+			img, err := jpeg.Decode(bytes.NewReader(gm))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// each sample is the sRGB encoded fraction of the headroom applied, as log2 recovery
+			want := testRamp(hevcTileSize, hevcTileSize)
+			for i, v := range want.Pix {
+				want.Pix[i] = uint8(math.Round(255 * math.Log2(1+3*srgbToLinear(float64(v)/255)) / 2))
+			}
+			assertSimilar(t, "gain map", img, want, 0, minSourcePSNR)
+		},
+	},
+	{
+		name:   "webp",
+		golden: "unci",
+		build: func(t testing.TB) []byte {
+			w := heif.NewWriter()
+			w.AddUncompressed(testImage(testWidth, testHeight))
+			return writeFixture(t, w)
+		},
+		opts: Options{Format: FormatWebP},
+		want: testImage(testWidth, testHeight),
+		check: func(t *testing.T, _ *Info, _ Result, out []byte) {
+			img, err := webp.Decode(bytes.NewReader(out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// webp outputs are lossless, so identical to png outputs
+			f, err := os.Open(filepath.Join("testdata", "golden", "unci.png"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			golden, err := png.Decode(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p := psnr(img, golden); !math.IsInf(p, 1) {
+				t.Errorf("PSNR to golden image is %.2fdB, want an exact copy", p)
+			}
+		},
+	},
+	{
+		name:   "gif",
+		golden: "gif",
+		build: func(t testing.TB) []byte {
+			// the three images as the frames of an image sequence, each lasting 200ms
+			hvcC, tiles := hevcTiles(t, "hevc.heic")
+			return sequenceFile(hvcC, tiles, 20)
+		},
+		opts: Options{Format: FormatGIF},
+		want: testFrame(0),
+		check: func(t *testing.T, info *Info, res Result, out []byte) {
+			if len(info.Tracks) != 1 || info.Tracks[0].Frames != 3 || res.Frames != 3 {
+				t.Errorf("got tracks %+v and %d frames converted", info.Tracks, res.Frames)
+			}
+			g, err := gif.DecodeAll(bytes.NewReader(out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(g.Image) != 3 {
+				t.Fatalf("got %d frames, want 3", len(g.Image))
+			}
+			for k, img := range g.Image {
+				if g.Delay[k] != 20 {
+					t.Errorf("frame %d lasts %d0ms, want 200ms", k, g.Delay[k])
+				}
+				assertSimilar(t, fmt.Sprintf("frame %d", k), img, testFrame(k), 0, minSourcePSNR)
+			}
+		},
+	},
+	{
+		name:   "heif",
+		golden: "exif",
+		build: func(t testing.TB) []byte {
+			w := heif.NewWriter()
+			it, err := w.AddJPEG(testJPEG(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.AddEXIF(testTIFF(), it.ID)
+			return writeFixture(t, w)
+		},
+		opts: Options{Format: FormatHEIF, HEIFCodec: HEIFCodecUncompressed},
+		want: testImage(testWidth, testHeight),
+		check: func(t *testing.T, _ *Info, res Result, out []byte) {
+			info, err := Probe(bytes.NewReader(out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Codec != "unci" || !info.EXIF || string(info.EXIFTags["Make"]) != `"heicker"` || !res.EXIF {
+				t.Errorf("got codec %q, EXIF %v and tags %s", info.Codec, info.EXIF, info.EXIFTags)
+			}
+		},
+	},
+}
+
+// testImage returns a w x h image of horizontal red and vertical green gradients over a blue checkerboard, whose edges
+// reveal any misplaced tile, rotation or chroma shift
+func testImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{R: uint8(x * 255 / (w - 1)), G: uint8(y * 255 / (h - 1)), A: 0xff}
+			if (x/8+y/8)%2 == 0 {
+				c.B = 0xff
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// testFrame returns frame k of the image sequence of testdata/hevc.heic, testImage with its checkerboard moved 8k
+// pixels to the left
+func testFrame(k int) *image.RGBA {
+	img := testImage(testWidth, testHeight)
+	for y := 0; y < testHeight; y++ {
+		for x := 0; x < testWidth; x++ {
+			i := img.PixOffset(x, y)
+			img.Pix[i+2] = 0
+			if ((x+8*k)/8+y/8)%2 == 0 {
+				img.Pix[i+2] = 0xff
+			}
+		}
+	}
+	return img
+}
+
+// testRamp returns a w x h image of a horizontal gray ramp, as testdata/ramp.heic holds at 64x48
+func testRamp(w, h int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetGray(x, y, color.Gray{Y: uint8(x * 255 / (w - 1))})
+		}
+	}
+	return img
+}
+
+// transformed returns a w x h image whose pixel x, y is that of src at fn(x, y)
+func transformed(src image.Image, w, h int, fn func(x, y int) (int, int)) image.Image {
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			out.Set(x, y, src.At(fn(x, y)))
+		}
+	}
+	return out
+}
+
+// testJPEG returns testImage coded as a jpeg
+func testJPEG(t testing.TB) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(testWidth, testHeight), &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testTIFF returns big endian EXIF data holding only an orientation of 1 and a Make of "heicker"
+func testTIFF() []byte {
+	b := []byte("MM\x00*\x00\x00\x00\x08")
+	entry := func(tag, typ uint16, count, value uint32) {
+		var e [12]byte
+		binary.BigEndian.PutUint16(e[0:], tag)
+		binary.BigEndian.PutUint16(e[2:], typ)
+		binary.BigEndian.PutUint32(e[4:], count)
+		binary.BigEndian.PutUint32(e[8:], value)
+		b = append(b, e[:]...)
+	}
+	b = append(b, 0, 2)
+	entry(0x010f, 2, 8, 8+2+2*12+4) // Make, ASCII, following the IFD
+	entry(0x0112, 3, 1, 1<<16)      // Orientation, SHORT, left justified
+	b = append(b, 0, 0, 0, 0)
+	return append(b, "heicker\x00"...)
+}
+
+func writeFixture(t testing.TB, w *heif.Writer) []byte {
+	var buf bytes.Buffer
+	if _, err := w.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// fixtureData returns the file of the fixture named name
+func fixtureData(t testing.TB, name string) []byte {
+	for _, fx := range fixtures {
+		if fx.name == name {
+			return fx.build(t)
+		}
+	}
+	t.Fatalf("no fixture %q", name)
+	return nil
+}
+
+// hevcTileSize is the width and height of the tiles written by libheif, the images of testdata/generate.c padded to
+// a whole coding tree block
+const hevcTileSize = 64
+
+// hevcTileConfig returns the parsed hvcC shared by the HEVC tiles of the testdata file named name, written by
+// generate.c, and the data of each tile
+func hevcTileConfig(t testing.TB, name string) (*bmff.ItemHevcConfigBox, [][]byte) {
+	hf := heif.Open(bytes.NewReader(readTestdata(t, name)))
+	items, err := hf.Items()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		config *bmff.ItemHevcConfigBox
+		tiles  [][]byte
+	)
+	for _, it := range items {
+		if it.Info.ItemType != "hvc1" {
+			continue
+		}
+		data, err := hf.GetItemData(it)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, _ = it.HevcConfig()
+		tiles = append(tiles, data)
+	}
+	if config == nil {
+		t.Fatalf("%s has no hvc1 items", name)
+	}
+	return config, tiles
+}
+
+// hevcConfigProperty returns an hvcC property of the configuration of c, holding its parameter sets if arrays is set,
+// otherwise leaving them to the item data as hev1 items may.  The constraint flags of c are not kept by the parser and
+// are written as 0.
+func hevcConfigProperty(c *bmff.ItemHevcConfigBox, arrays bool) heif.Property {
+	var units [][]byte
+	for h := c.AsHeader(); arrays && len(h) >= 4; {
+		n := binary.BigEndian.Uint32(h)
+		units, h = append(units, h[4:4+n]), h[4+n:]
+	}
+
+	cfg := c.Config
+	bw := bmff.NewWriter()
+	bw.StartBox("hvcC")
+	bw.Uint8(cfg.Version)
+	bw.Uint8(cfg.GeneralProfileSpace<<6 | cfg.GeneralTierFlag<<5 | cfg.GeneralProfileIdc)
+	bw.Uint32(cfg.GeneralProfileCompatibilityFlags)
+	bw.Write(make([]byte, 6))
+	bw.Uint8(cfg.GeneralLevelIdc)
+	bw.Uint16(0xf000 | cfg.MinSpatialSegmentationIdc)
+	bw.Uint8(0xfc | cfg.ParallelismType)
+	bw.Uint8(0xfc | cfg.ChromaFormat)
+	bw.Uint8(0xf8 | (cfg.BitDepthLuma - 8))
+	bw.Uint8(0xf8 | (cfg.BitDepthChroma - 8))
+	bw.Uint16(cfg.AvgFrameRate)
+	// 4 byte NAL unit lengths
+	bw.Uint8(cfg.ConstantFrameRate<<6 | cfg.NumTemporalLayers<<3 | cfg.TemporalIdNested<<2 | 3)
+	// an array of each unit, of its NAL unit type
+	bw.Uint8(uint8(len(units)))
+	for _, u := range units {
+		bw.Uint8(0x80 | u[0]>>1&0x3f)
+		bw.Uint16(1)
+		bw.Uint16(uint16(len(u)))
+		bw.Write(u)
+	}
+	bw.EndBox()
+	return heif.Property{Box: bw.Bytes(), Essential: true}
+}
+
+// addHEVC adds a hidden HEVC tile of type typ coded as data, and the grid cropping it to testWidth x testHeight as
+// libheif stores images smaller than a tile, returning the grid
+func addHEVC(w *heif.Writer, typ string, config heif.Property, data []byte) *heif.WriterItem {
+	g := w.AddItem("grid", []byte{0, 0, 0, 0, 0, testWidth, 0, testHeight})
+	g.AddProperty(heif.SpatialExtentsProperty(testWidth, testHeight))
+	tile := w.AddItem(typ, data)
+	tile.Hidden = true
+	tile.AddProperty(config, heif.SpatialExtentsProperty(hevcTileSize, hevcTileSize))
+	g.AddReference("dimg", tile.ID)
+	return g
+}
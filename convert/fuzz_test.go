@@ -0,0 +1,66 @@
+//go:build go1.18
+// +build go1.18
+
+package convert
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+// FuzzConvert probes and converts the input, seeded with the golden fixtures.  Every error must be an *Error.  Run
+// with go test -fuzz FuzzConvert ./convert
+func FuzzConvert(f *testing.F) {
+	for _, fx := range fixtures {
+		f.Add(fx.build(f))
+	}
+
+	// the default limits of the webservice, see LimitsConfig of heicker
+	opts := Options{Format: FormatPNG, Rotation: RotateAuto, Limits: Limits{MaxPixels: 100e6, MaxTiles: 1024, MaxImages: 100}}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var cerr *Error
+		if _, err := Probe(bytes.NewReader(data)); err != nil && !errors.As(err, &cerr) {
+			t.Fatalf("Probe returned %T: %v", err, err)
+		}
+		if _, err := Convert(context.Background(), bytes.NewReader(data), ioutil.Discard, opts); err != nil && !errors.As(err, &cerr) {
+			t.Fatalf("Convert returned %T: %v", err, err)
+		}
+	})
+}
+
+// FuzzParseEXIF parses the input as EXIF and applies each metadata policy to it, seeded with the EXIF of the fixtures
+// and a looping chain of directories.  Parsing must return, and whatever it parses must encode to EXIF that parses to
+// the same tags.  Run with go test -fuzz FuzzParseEXIF ./convert
+func FuzzParseEXIF(f *testing.F) {
+	f.Add(testTIFF())
+	f.Add(append([]byte(exifHeader), testTIFF()...))
+	f.Add(cyclicTIFF())
+
+	res := Result{Width: testWidth, Height: testHeight, Rotated: true, Resized: true}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		e, err := parseEXIF(data)
+		if err != nil {
+			return
+		}
+		if _, err := exifTagValues(data); err != nil {
+			t.Fatalf("exifTagValues failed on parsed EXIF: %v", err)
+		}
+		if !e.empty() {
+			again, err := parseEXIF(e.encode())
+			if err != nil {
+				t.Fatalf("encoded EXIF does not parse: %v", err)
+			}
+			for dir := range e.dirs {
+				if len(again.dirs[dir]) != len(e.dirs[dir]) {
+					t.Fatalf("directory %d has %d tags once encoded, %d before", dir, len(again.dirs[dir]), len(e.dirs[dir]))
+				}
+			}
+		}
+		for _, p := range metadataPolicies {
+			prepareEXIF(data, Options{Metadata: p, MetadataTags: []string{"Make", "GPSLatitude"}}, res)
+		}
+	})
+}
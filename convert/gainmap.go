@@ -0,0 +1,353 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+
+	"github.com/dcarbone/go-heicker/heif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+const (
+	// tagMakerNote is the EXIF tag holding the maker note, and tagAppleHDRHeadroom and tagAppleHDRGain the Apple maker
+	// note tags from which the headroom of older gain maps is derived
+	tagMakerNote        = 0x927c
+	tagAppleHDRHeadroom = 0x0021
+	tagAppleHDRGain     = 0x0030
+
+	// appleMakerNoteHeader precedes the big endian IFD of an Apple maker note, whose offsets are relative to its start
+	appleMakerNoteHeader = "Apple iOS\x00"
+	appleMakerNoteIFD    = 14
+
+	// mpfID identifies the APP2 segment holding the Multi-Picture Format index, see CIPA DC-007
+	mpfID = "MPF\x00"
+)
+
+// xmpGainMapHeadroom matches the headroom written to the XMP of gain maps by iOS 18 and later, as an attribute or an
+// element
+var xmpGainMapHeadroom = regexp.MustCompile(`HDRGainMapHeadroom(?:="|>)\s*([0-9.eE+-]+)`)
+
+// hdrGainMap is the gain map of a decoded image.  Samples are the log2 recovery of Ultra HDR, 0 leaving a pixel as in
+// the SDR image and 1 brightening it by the full headroom.
+type hdrGainMap struct {
+	p samplePlane
+	// item is the gain map image item, headroom the linear ratio of the brightest HDR pixel to SDR white
+	item     *heif.Item
+	headroom float64
+}
+
+// selectGainMap decodes the gain map of img if it is written to the output, only jpeg outputs of an image rather than
+// its embedded thumbnail holding one
+func selectGainMap(hf *heif.File, img *decodedImage, opts Options) (*hdrGainMap, error) {
+	if opts.Format != FormatJPEG || opts.GainMap == GainMapStrip || img.thumbnail || img.item == nil {
+		return nil, nil
+	}
+	return decodeGainMap(hf, img.item, opts)
+}
+
+// decodeGainMap decodes the HDR gain map belonging to base, returning nil if there is none, it cannot be decoded or
+// its headroom is unknown
+func decodeGainMap(hf *heif.File, base *heif.Item, opts Options) (*hdrGainMap, error) {
+	gms, err := auxImages(hf, base.ID, AuxGainMap)
+	if err != nil || len(gms) == 0 || !hevcItemTypes[gms[0].Info.ItemType] {
+		return nil, err
+	}
+	headroom, ok := gainMapHeadroom(hf, gms[0])
+	if !ok {
+		return nil, nil
+	}
+
+	img, err := decodeAuxItem(hf, gms[0], opts)
+	if err != nil {
+		return nil, err
+	}
+	p, err := samplesOf(img)
+	if err != nil {
+		return nil, err
+	}
+	// Apple gain maps hold the sRGB encoded fraction of the headroom applied to linear light
+	stops := math.Log2(headroom)
+	for i, v := range p.pix {
+		boost := 1 + (headroom-1)*srgbToLinear(float64(v))
+		p.pix[i] = float32(math.Log2(boost) / stops)
+	}
+	return &hdrGainMap{p: p, item: gms[0], headroom: headroom}, nil
+}
+
+// gainMapHeadroom returns the headroom of the gain map gm, read from its XMP or that of the file, otherwise derived
+// from the Apple maker note as Apple documents
+func gainMapHeadroom(hf *heif.File, gm *heif.Item) (float64, bool) {
+	var xmps [][]byte
+	if items, err := hf.Items(); err == nil {
+		for _, it := range items {
+			if it.Info.ItemType == "mime" && it.Info.ContentType == heif.ContentTypeXMP && referencesItem(it, "cdsc", gm.ID) {
+				if b, err := hf.GetItemData(it); err == nil {
+					xmps = append(xmps, b)
+				}
+			}
+		}
+	}
+	if b, err := hf.XMP(); err == nil {
+		xmps = append(xmps, b)
+	}
+	for _, b := range xmps {
+		if m := xmpGainMapHeadroom.FindSubmatch(b); m != nil {
+			if v, err := strconv.ParseFloat(string(m[1]), 64); err == nil && v > 1 {
+				return v, true
+			}
+		}
+	}
+
+	b, err := hf.EXIF()
+	if err != nil {
+		return 0, false
+	}
+	e, err := parseEXIF(b)
+	if err != nil {
+		return 0, false
+	}
+	for _, t := range e.dirs[dirExif] {
+		if t.id == tagMakerNote {
+			return appleHeadroom(t.val)
+		}
+	}
+	return 0, false
+}
+
+// appleHeadroom derives the headroom of a gain map from tags 33 and 48 of an Apple maker note
+func appleHeadroom(mn []byte) (float64, bool) {
+	if !bytes.HasPrefix(mn, []byte(appleMakerNoteHeader)) || len(mn) < appleMakerNoteIFD {
+		return 0, false
+	}
+	r := bytes.NewReader(mn)
+	if _, err := r.Seek(appleMakerNoteIFD, io.SeekStart); err != nil {
+		return 0, false
+	}
+	d, _, err := tiff.DecodeDir(r, binary.BigEndian)
+	if err != nil {
+		return 0, false
+	}
+
+	var (
+		maker33, maker48 float64
+		found            int
+	)
+	for _, t := range d.Tags {
+		v, ok := tagFloat(t)
+		switch {
+		case !ok:
+		case t.Id == tagAppleHDRHeadroom:
+			maker33, found = v, found+1
+		case t.Id == tagAppleHDRGain:
+			maker48, found = v, found+1
+		}
+	}
+	if found != 2 {
+		return 0, false
+	}
+
+	var stops float64
+	switch {
+	case maker33 < 1 && maker48 <= 0.01:
+		stops = -20*maker48 + 1.8
+	case maker33 < 1:
+		stops = -0.101*maker48 + 1.601
+	case maker48 <= 0.01:
+		stops = -70*maker48 + 3
+	default:
+		stops = -0.303*maker48 + 2.303
+	}
+	if stops <= 0 {
+		return 0, false
+	}
+	return math.Pow(2, stops), true
+}
+
+// tagFloat returns the first value of a rational or integer tag
+func tagFloat(t *tiff.Tag) (float64, bool) {
+	if num, den, err := t.Rat2(0); err == nil {
+		if den == 0 {
+			return 0, false
+		}
+		return float64(num) / float64(den), true
+	}
+	if v, err := t.Int64(0); err == nil {
+		return float64(v), true
+	}
+	return 0, false
+}
+
+func srgbToLinear(v float64) float64 {
+	switch {
+	case v <= 0:
+		return 0
+	case v <= 0.04045:
+		return v / 12.92
+	case v >= 1:
+		return 1
+	default:
+		return math.Pow((v+0.055)/1.055, 2.4)
+	}
+}
+
+// fit rotates, crops and resizes the gain map as the sw x sh image it belongs to, once rotated, is by opts.  Gain
+// maps are oriented by their own properties unless that leaves them at odds with the image, which is oriented by
+// those of base.
+func (g *hdrGainMap) fit(base *heif.Item, sw, sh int, opts Options) error {
+	p := g.p.orient(orientSteps(g.item, opts.Rotation))
+	if p.w != p.h && sw != sh && (p.w > p.h) != (sw > sh) {
+		p = g.p.orient(orientSteps(base, opts.Rotation))
+	}
+
+	w, h, win, err := outputSize(sw, sh, opts)
+	if err != nil {
+		return err
+	}
+	if w != sw || h != sh || win != (window{0, 0, float64(sw), float64(sh)}) {
+		sx, sy := float64(p.w)/float64(sw), float64(p.h)/float64(sh)
+		k, ok := kernels[opts.Filter]
+		if !ok {
+			k = kernels[FilterLanczos]
+		}
+		p = p.resample(atLeastOne(float64(w)*sx), atLeastOne(float64(h)*sy), window{win.x * sx, win.y * sy, win.w * sx, win.h * sy}, k)
+	}
+	g.p = p
+	return nil
+}
+
+// encodeUltraHDR writes img as an Ultra HDR jpeg, the SDR image followed by its gain map as a secondary image of the
+// Multi-Picture Format.  The hdrgm XMP properties describing the gain map are added to those of img.
+func encodeUltraHDR(w io.Writer, img *decodedImage, opts Options) (exif, xmp bool, err error) {
+	var gm bytes.Buffer
+	gw, err := newWriterAPP1(&gm, append([]byte(xmpStandardID), gainMapXMP(img.gainMap)...))
+	if err != nil {
+		return false, false, err
+	}
+	if err := jpeg.Encode(gw, img.gainMap.p.image(8), &jpeg.Options{Quality: opts.Quality}); err != nil {
+		return false, false, err
+	}
+
+	var primary bytes.Buffer
+	if err := jpeg.Encode(&primary, img.ycc, &jpeg.Options{Quality: opts.Quality}); err != nil {
+		return false, false, err
+	}
+
+	// the metadata and MPF segments follow the SOI marker, replacing the one written by the encoder.  There is always
+	// primary XMP, so newWriterAPP1 always writes the SOI marker.
+	segments := jpegEXIFSegments(img.exif)
+	exif = len(segments) > 0
+	pxmp, xmp := primaryXMP(img.xmp, gm.Len())
+	segments = append(segments, jpegXMPSegments(pxmp)...)
+	var head bytes.Buffer
+	pw, err := newWriterAPP1(&head, segments...)
+	if err != nil {
+		return false, false, fmt.Errorf("error writing metadata: %w", err)
+	}
+
+	// MPF offsets are relative to the TIFF header of the MPF segment
+	tiffStart := head.Len() + 4 + len(mpfID)
+	size := head.Len() + 4 + len(mpfID) + mpfSize + primary.Len() - 2
+	head.Write(appendJPEGSegment(nil, 0xe2, mpfSegment(uint32(size), uint32(gm.Len()), uint32(size-tiffStart))))
+	if _, err := pw.Write(primary.Bytes()); err != nil {
+		return false, false, err
+	}
+
+	for _, b := range [][]byte{head.Bytes(), gm.Bytes()} {
+		if _, err := w.Write(b); err != nil {
+			return false, false, err
+		}
+	}
+	return exif, xmp, nil
+}
+
+func appendJPEGSegment(b []byte, marker byte, payload []byte) []byte {
+	n := 2 + len(payload)
+	b = append(b, 0xff, marker, byte(n>>8), byte(n))
+	return append(b, payload...)
+}
+
+// mpfSize is the length of the MPF index written by mpfSegment, after its identifier: the TIFF header, an IFD of 3
+// entries and an MP entry for each of the 2 images
+const mpfSize = 8 + 2 + 3*12 + 4 + 2*16
+
+// mpfSegment returns the payload of the APP2 segment indexing a primary image of primarySize bytes, including the
+// gain map that follows it at gainMapOffset
+func mpfSegment(primarySize, gainMapSize, gainMapOffset uint32) []byte {
+	b := make([]byte, 0, len(mpfID)+mpfSize)
+	b = append(b, mpfID...)
+	b = append(b, 'M', 'M', 0, 42, 0, 0, 0, 8)
+
+	be := binary.BigEndian
+	entry := func(id, typ uint16, count uint32, val []byte) {
+		var e [12]byte
+		be.PutUint16(e[0:], id)
+		be.PutUint16(e[2:], typ)
+		be.PutUint32(e[4:], count)
+		copy(e[8:], val)
+		b = append(b, e[:]...)
+	}
+	u32 := func(v uint32) []byte {
+		var x [4]byte
+		be.PutUint32(x[:], v)
+		return x[:]
+	}
+	const typeUndefined = 7
+	b = append(b, 0, 3)
+	entry(0xb000, typeUndefined, 4, []byte("0100"))     // MPFVersion
+	entry(0xb001, tiffTypeLong, 1, u32(2))              // NumberOfImages
+	entry(0xb002, typeUndefined, 2*16, u32(8+2+3*12+4)) // MPEntry
+	b = append(b, 0, 0, 0, 0)
+
+	// the primary is a baseline MP primary image, the gain map an undefined type
+	b = append(b, u32(0x030000)...)
+	b = append(b, u32(primarySize)...)
+	b = append(b, u32(0)...)
+	b = append(b, 0, 0, 0, 0)
+	b = append(b, u32(0)...)
+	b = append(b, u32(gainMapSize)...)
+	b = append(b, u32(gainMapOffset)...)
+	b = append(b, 0, 0, 0, 0)
+	return b
+}
+
+const (
+	xmpPacketStart = "<?xpacket begin=\"\uFEFF\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>" +
+		`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">`
+	xmpPacketEnd = `</rdf:RDF></x:xmpmeta><?xpacket end="w"?>`
+	nsHDRGainMap = "http://ns.adobe.com/hdr-gain-map/1.0/"
+)
+
+// primaryXMP adds the hdrgm version and the GContainer directory locating a gain map of gainMapSize bytes to xmp,
+// returning whether xmp was kept.  XMP without an rdf:RDF element to add them to is replaced.
+func primaryXMP(xmp []byte, gainMapSize int) ([]byte, bool) {
+	desc := fmt.Sprintf(`<rdf:Description rdf:about="" xmlns:hdrgm="%s" `+
+		`xmlns:Container="http://ns.google.com/photos/1.0/container/" `+
+		`xmlns:Item="http://ns.google.com/photos/1.0/container/item/" hdrgm:Version="1.0">`+
+		`<Container:Directory><rdf:Seq>`+
+		`<rdf:li rdf:parseType="Resource"><Container:Item Item:Semantic="Primary" Item:Mime="image/jpeg"/></rdf:li>`+
+		`<rdf:li rdf:parseType="Resource"><Container:Item Item:Semantic="GainMap" Item:Mime="image/jpeg" Item:Length="%d"/></rdf:li>`+
+		`</rdf:Seq></Container:Directory></rdf:Description>`, nsHDRGainMap, gainMapSize)
+
+	if i := bytes.LastIndex(xmp, []byte("</rdf:RDF>")); i >= 0 {
+		out := make([]byte, 0, len(xmp)+len(desc))
+		out = append(out, xmp[:i]...)
+		out = append(out, desc...)
+		return append(out, xmp[i:]...), true
+	}
+	return []byte(xmpPacketStart + desc + xmpPacketEnd), false
+}
+
+// gainMapXMP returns the XMP describing g to Ultra HDR readers
+func gainMapXMP(g *hdrGainMap) []byte {
+	stops := strconv.FormatFloat(math.Log2(g.headroom), 'f', -1, 64)
+	return []byte(xmpPacketStart + fmt.Sprintf(`<rdf:Description rdf:about="" xmlns:hdrgm="%s" hdrgm:Version="1.0" `+
+		`hdrgm:GainMapMin="0" hdrgm:GainMapMax="%s" hdrgm:Gamma="1" hdrgm:OffsetSDR="0" hdrgm:OffsetHDR="0" `+
+		`hdrgm:HDRCapacityMin="0" hdrgm:HDRCapacityMax="%s" hdrgm:BaseRenditionIsHDR="False"/>`, nsHDRGainMap, stops, stops) +
+		xmpPacketEnd)
+}
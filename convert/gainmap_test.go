@@ -0,0 +1,198 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"math"
+	"strconv"
+	"testing"
+)
+
+const gainMapURN = "urn:com:apple:photo:2020:aux:hdrgainmap"
+
+// gainMapFile returns a file whose primary image, the first tile of hevc.heic, has the monochrome ramp of ramp.heic
+// as its gain map, with a headroom of 4 given by the XMP of the gain map, followed by extra items
+func gainMapFile(t *testing.T, extra ...testItem) []byte {
+	hvcC, tiles := hevcTiles(t, "hevc.heic")
+	rampC, ramp := hevcTiles(t, "ramp.heic")
+	xmp := []byte(xmpPacketStart + `<rdf:Description rdf:about="" xmlns:HDRGainMap="http://ns.apple.com/HDRGainMap/1.0/" ` +
+		`HDRGainMap:HDRGainMapHeadroom="4"/>` + xmpPacketEnd)
+	items := []testItem{
+		{typ: "hvc1", data: tiles[0], props: [][]byte{hvcC, ispe(64, 64)}},
+		{typ: "hvc1", data: ramp[0], hidden: true, props: [][]byte{rampC, ispe(64, 64), auxC(gainMapURN, nil)},
+			refs: map[string][]uint16{"auxl": {1}}},
+		{typ: "mime", data: xmp, contentType: "application/rdf+xml", refs: map[string][]uint16{"cdsc": {2}}},
+	}
+	return itemFile(t, 1, append(items, extra...)...)
+}
+
+func TestConvertGainMap(t *testing.T) {
+	data := gainMapFile(t)
+
+	info, err := Probe(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Auxiliary) != 1 || info.Auxiliary[0].Type != AuxGainMap || info.Auxiliary[0].Headroom != 4 {
+		t.Errorf("got %+v", info.Auxiliary)
+	}
+
+	for _, tc := range []struct {
+		opts Options
+		size int
+	}{
+		{Options{Format: FormatJPEG, Quality: 95}, 64},
+		{Options{Format: FormatJPEG, Quality: 95, Width: 32}, 32},
+	} {
+		var buf bytes.Buffer
+		res, err := Convert(context.Background(), bytes.NewReader(data), &buf, tc.opts)
+		if err != nil || !res.GainMap || !res.XMP {
+			t.Fatalf("%+v: got %+v, %v", tc.opts, res, err)
+		}
+		out := buf.Bytes()
+
+		// the gain map is the second codestream, its length given by the XMP and MPF index of the primary image
+		i := bytes.Index(out[2:], []byte{0xff, 0xd8})
+		if i < 0 {
+			t.Fatalf("%+v: no gain map codestream", tc.opts)
+		}
+		gm := out[2+i:]
+		if !bytes.Contains(out[:2+i], []byte(`Item:Semantic="GainMap" Item:Mime="image/jpeg" Item:Length="`+strconv.Itoa(len(gm))+`"`)) {
+			t.Errorf("%+v: primary XMP does not locate the gain map of %d bytes", tc.opts, len(gm))
+		}
+		mpf := bytes.Index(out, []byte(mpfID))
+		if mpf < 0 {
+			t.Fatalf("%+v: no MPF segment", tc.opts)
+		}
+		entries := out[mpf+len(mpfID)+8+2+3*12+4:]
+		size, offset := binary.BigEndian.Uint32(entries[20:]), binary.BigEndian.Uint32(entries[24:])
+		if int(size) != len(gm) || mpf+len(mpfID)+int(offset) != 2+i {
+			t.Errorf("%+v: MPF locates %d bytes at %d, want %d at %d", tc.opts, size, offset, len(gm), 2+i-mpf-len(mpfID))
+		}
+		if !bytes.Contains(gm, []byte(`hdrgm:GainMapMax="2"`)) {
+			t.Errorf("%+v: gain map XMP lacks its maximum of 2 stops", tc.opts)
+		}
+
+		img, err := jpeg.Decode(bytes.NewReader(gm))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Bounds() != image.Rect(0, 0, tc.size, tc.size) {
+			t.Fatalf("%+v: got a gain map of %v", tc.opts, img.Bounds())
+		}
+		// each sample is the sRGB encoded fraction of the headroom applied, as log2 recovery
+		y := img.(*image.Gray)
+		for _, x := range []int{0, tc.size / 3, tc.size / 2, tc.size - 1} {
+			v := (float64(x) + 0.5) / float64(tc.size)
+			want := 255 * math.Log2(1+3*srgbToLinear(v)) / 2
+			if got := float64(y.GrayAt(x, tc.size/2).Y); math.Abs(got-want) > 8 {
+				t.Errorf("%+v: got %v at %d, want %.0f", tc.opts, got, x, want)
+			}
+		}
+	}
+
+	// EXIF too large for an APP1 segment loses its thumbnail first, then is left out
+	for _, tc := range []struct {
+		name string
+		big  func(e *exifData)
+		exif bool
+	}{
+		{"thumbnail", func(e *exifData) { e.thumbnail = make([]byte, jpegMaxSegment) }, true},
+		{"description", func(e *exifData) {
+			e.dirs[dirIFD0] = append(e.dirs[dirIFD0], exifTag{id: 0x010e, typ: 2, count: jpegMaxSegment, val: make([]byte, jpegMaxSegment)})
+		}, false},
+	} {
+		e, err := parseEXIF(gpsTIFF())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.big(e)
+		data := gainMapFile(t, testItem{typ: "Exif", data: append([]byte("\x00\x00\x00\x06Exif\x00\x00"), e.encode()...),
+			refs: map[string][]uint16{"cdsc": {1}}})
+
+		var buf bytes.Buffer
+		res, err := Convert(context.Background(), bytes.NewReader(data), &buf, Options{Format: FormatJPEG, Quality: 95})
+		if err != nil || !res.GainMap || res.EXIF != tc.exif {
+			t.Fatalf("%s: got %+v, %v", tc.name, res, err)
+		}
+		out := buf.Bytes()
+		mpf := bytes.Index(out, []byte(mpfID))
+		if i := bytes.Index(out, []byte(exifHeader)); mpf < 0 || (i >= 0) != tc.exif || i > mpf {
+			t.Fatalf("%s: Exif identifier at %d, MPF at %d", tc.name, i, mpf)
+		}
+		entries := out[mpf+len(mpfID)+8+2+3*12+4:]
+		size, offset := binary.BigEndian.Uint32(entries[20:]), binary.BigEndian.Uint32(entries[24:])
+		if start := mpf + len(mpfID) + int(offset); start+int(size) != len(out) || !bytes.HasPrefix(out[start:], []byte{0xff, 0xd8}) {
+			t.Errorf("%s: MPF locates %d bytes at %d of %d", tc.name, size, start, len(out))
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+	}
+
+	// stripped, or written to formats without gain maps
+	for _, opts := range []Options{{Format: FormatJPEG, GainMap: GainMapStrip}, {Format: FormatPNG}, {Format: FormatWebP}} {
+		var buf bytes.Buffer
+		res, err := Convert(context.Background(), bytes.NewReader(data), &buf, opts)
+		if err != nil || res.GainMap || bytes.Contains(buf.Bytes(), []byte(mpfID)) {
+			t.Errorf("%+v: got %+v, %v", opts, res, err)
+		}
+	}
+}
+
+func TestAppleHeadroom(t *testing.T) {
+	// makerNote returns an Apple maker note holding tags 33 and 48 as rationals
+	makerNote := func(maker33, maker48 [2]uint32) []byte {
+		mn := append([]byte(appleMakerNoteHeader), 0, 1, 'M', 'M')
+		values := uint32(appleMakerNoteIFD + 2 + 2*12 + 4)
+		mn = append(mn, be(uint16(2),
+			uint16(tagAppleHDRHeadroom), uint16(5), uint32(1), values,
+			uint16(tagAppleHDRGain), uint16(5), uint32(1), values+8,
+			uint32(0))...)
+		return append(mn, be(maker33[0], maker33[1], maker48[0], maker48[1])...)
+	}
+
+	for _, tc := range []struct {
+		maker33, maker48 [2]uint32
+		stops            float64
+	}{
+		{[2]uint32{12, 10}, [2]uint32{2, 100}, -0.303*0.02 + 2.303},
+		{[2]uint32{12, 10}, [2]uint32{1, 100}, -70*0.01 + 3},
+		{[2]uint32{1, 2}, [2]uint32{1, 2}, -0.101*0.5 + 1.601},
+		{[2]uint32{1, 2}, [2]uint32{1, 200}, -20*0.005 + 1.8},
+	} {
+		h, ok := appleHeadroom(makerNote(tc.maker33, tc.maker48))
+		if !ok || math.Abs(math.Log2(h)-tc.stops) > 1e-9 {
+			t.Errorf("%v, %v: got %v, %v, want %v stops", tc.maker33, tc.maker48, h, ok, tc.stops)
+		}
+	}
+
+	for name, mn := range map[string][]byte{
+		"not apple":    []byte("Nikon\x00\x02\x10\x00\x00MM\x00*"),
+		"truncated":    []byte(appleMakerNoteHeader),
+		"no headroom":  makerNote([2]uint32{12, 10}, [2]uint32{1, 0})[:appleMakerNoteIFD],
+		"zero divisor": makerNote([2]uint32{12, 0}, [2]uint32{1, 100}),
+		"no stops":     makerNote([2]uint32{12, 10}, [2]uint32{10, 1}),
+	} {
+		if h, ok := appleHeadroom(mn); ok {
+			t.Errorf("%s: got %v", name, h)
+		}
+	}
+}
+
+func TestPrimaryXMP(t *testing.T) {
+	xmp := []byte(xmpPacketStart + `<rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/"/>` + xmpPacketEnd)
+	out, kept := primaryXMP(xmp, 1234)
+	if !kept || !bytes.HasPrefix(out, xmp[:len(xmp)-len(xmpPacketEnd)]) || !bytes.HasSuffix(out, []byte(xmpPacketEnd)) ||
+		!bytes.Contains(out, []byte(`Item:Length="1234"`)) || !bytes.Contains(out, []byte(`hdrgm:Version="1.0"`)) {
+		t.Errorf("got %s, %v", out, kept)
+	}
+
+	out, kept = primaryXMP([]byte("not xmp"), 1)
+	if kept || !bytes.HasPrefix(out, []byte(xmpPacketStart)) || !bytes.Contains(out, []byte(`Item:Length="1"`)) {
+		t.Errorf("got %s, %v", out, kept)
+	}
+}
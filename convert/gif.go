@@ -0,0 +1,53 @@
+package convert
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"time"
+)
+
+// minGIFDelay is the shortest frame delay, in hundredths of a second, that browsers respect.  Shorter delays are
+// commonly played as 100ms.
+const minGIFDelay = 2
+
+// paletted reduces img to 256 colors using a median cut palette and Floyd-Steinberg dithering
+func paletted(img image.Image) *image.Paletted {
+	b := img.Bounds()
+	rgba := image.NewRGBA(b)
+	draw.Draw(rgba, b, img, b.Min, draw.Src)
+	pm := image.NewPaletted(b, medianCut{}.Quantize(make(color.Palette, 0, 256), rgba))
+	draw.FloydSteinberg.Draw(pm, b, rgba, b.Min)
+	return pm
+}
+
+// gifAnimation encodes frames as an animated GIF, each with its own palette.  Delays are rounded to hundredths of a
+// second, carrying the rounding error to the next frame so the animation keeps time.
+type gifAnimation struct {
+	g       gif.GIF
+	elapsed time.Duration
+	delays  int // the sum of g.Delay
+}
+
+func (a *gifAnimation) add(img image.Image, d time.Duration) error {
+	a.elapsed += d
+	delay := int((a.elapsed+5*time.Millisecond)/(10*time.Millisecond)) - a.delays
+	if delay < minGIFDelay {
+		delay = minGIFDelay
+	}
+	a.delays += delay
+	a.g.Image = append(a.g.Image, paletted(img))
+	a.g.Delay = append(a.g.Delay, delay)
+	return nil
+}
+
+// encode writes the animation, GIF having no place for EXIF or XMP
+func (a *gifAnimation) encode(w io.Writer, _, _ []byte) (bool, bool, error) {
+	if len(a.g.Image) == 0 {
+		return false, false, errors.New("animation has no frames")
+	}
+	return false, false, gif.EncodeAll(w, &a.g)
+}
@@ -0,0 +1,198 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dcarbone/go-heicker/dav1d"
+
+	_ "golang.org/x/image/webp"
+	_ "image/gif"
+	_ "image/jpeg"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden images of testdata/golden")
+
+const (
+	// minSSIM and minPSNR are the similarity required of outputs to their golden images, which allows for changes to
+	// the encoders and resampling but not for misplaced tiles, wrong orientations or colour shifts
+	minSSIM = 0.98
+	minPSNR = 35.0
+	// minSourcePSNR is the similarity required of outputs to the source image, before lossy coding and chroma
+	// conversion
+	minSourcePSNR = 30.0
+)
+
+func TestGolden(t *testing.T) {
+	for _, fx := range fixtures {
+		fx := fx
+		t.Run(fx.name, func(t *testing.T) {
+			data := fx.build(t)
+			info, err := Probe(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("probing: %v", err)
+			}
+			var buf bytes.Buffer
+			opts := fx.opts
+			if opts.Format == "" {
+				opts.Format = FormatPNG
+			}
+			res, err := Convert(context.Background(), bytes.NewReader(data), &buf, opts)
+			if errors.Is(err, dav1d.ErrUnavailable) {
+				t.Skip(err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fx.check != nil {
+				fx.check(t, info, res, buf.Bytes())
+			}
+			if opts.Format == FormatHEIF {
+				// heif outputs are converted back to png to be compared
+				out := buf.Bytes()
+				buf = bytes.Buffer{}
+				if _, err := Convert(context.Background(), bytes.NewReader(out), &buf, Options{Format: FormatPNG}); err != nil {
+					t.Fatalf("converting output: %v", err)
+				}
+			}
+			out, _, err := image.Decode(&buf)
+			if err != nil {
+				t.Fatalf("decoding output: %v", err)
+			}
+			if b := out.Bounds(); res.Width != b.Dx() || res.Height != b.Dy() {
+				t.Errorf("result is %dx%d, output %dx%d", res.Width, res.Height, b.Dx(), b.Dy())
+			}
+
+			if fx.want != nil {
+				assertSimilar(t, "source", out, fx.want, 0, minSourcePSNR)
+			}
+
+			path := filepath.Join("testdata", "golden", fx.golden+".png")
+			if *update && fx.golden == fx.name {
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				f, err := os.Create(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				if err := png.Encode(f, out); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatalf("%v, run go test -update to create it", err)
+			}
+			defer f.Close()
+			golden, err := png.Decode(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertSimilar(t, "golden", out, golden, minSSIM, minPSNR)
+		})
+	}
+}
+
+// assertSimilar fails t unless got has the dimensions of want and is at least as similar as minSSIM, on luma, and
+// minPSNR, on RGB
+func assertSimilar(t *testing.T, name string, got, want image.Image, minSSIM, minPSNR float64) {
+	t.Helper()
+	if got.Bounds().Size() != want.Bounds().Size() {
+		t.Fatalf("output is %v, %s image %v", got.Bounds().Size(), name, want.Bounds().Size())
+	}
+	if s := ssim(got, want); s < minSSIM {
+		t.Errorf("SSIM to %s image is %.4f, want at least %.4f", name, s, minSSIM)
+	}
+	if p := psnr(got, want); p < minPSNR {
+		t.Errorf("PSNR to %s image is %.2fdB, want at least %.2fdB", name, p, minPSNR)
+	}
+}
+
+// luma returns the luma samples of img, from 0 to 255, row by row from its origin
+func luma(img image.Image) []float64 {
+	b := img.Bounds()
+	out := make([]float64, 0, b.Dx()*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			out = append(out, float64(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y))
+		}
+	}
+	return out
+}
+
+// ssim returns the mean structural similarity of the luma of a and b, of the same size, over 8x8 windows
+func ssim(a, b image.Image) float64 {
+	const (
+		win = 8
+		c1  = (0.01 * 255) * (0.01 * 255)
+		c2  = (0.03 * 255) * (0.03 * 255)
+	)
+	w, h := a.Bounds().Dx(), a.Bounds().Dy()
+	la, lb := luma(a), luma(b)
+
+	var sum float64
+	var n int
+	for y0 := 0; y0+win <= h; y0 += win / 2 {
+		for x0 := 0; x0+win <= w; x0 += win / 2 {
+			var ma, mb float64
+			for y := y0; y < y0+win; y++ {
+				for x := x0; x < x0+win; x++ {
+					ma += la[y*w+x]
+					mb += lb[y*w+x]
+				}
+			}
+			ma /= win * win
+			mb /= win * win
+			var va, vb, cov float64
+			for y := y0; y < y0+win; y++ {
+				for x := x0; x < x0+win; x++ {
+					da, db := la[y*w+x]-ma, lb[y*w+x]-mb
+					va += da * da
+					vb += db * db
+					cov += da * db
+				}
+			}
+			va /= win*win - 1
+			vb /= win*win - 1
+			cov /= win*win - 1
+			sum += (2*ma*mb + c1) * (2*cov + c2) / ((ma*ma + mb*mb + c1) * (va + vb + c2))
+			n++
+		}
+	}
+	if n == 0 {
+		return 1
+	}
+	return sum / float64(n)
+}
+
+// psnr returns the peak signal to noise ratio of the RGB samples of a and b, of the same size, in decibels
+func psnr(a, b image.Image) float64 {
+	ba, bb := a.Bounds(), b.Bounds()
+	var mse float64
+	for y := 0; y < ba.Dy(); y++ {
+		for x := 0; x < ba.Dx(); x++ {
+			r1, g1, b1, _ := a.At(ba.Min.X+x, ba.Min.Y+y).RGBA()
+			r2, g2, b2, _ := b.At(bb.Min.X+x, bb.Min.Y+y).RGBA()
+			for _, d := range []float64{float64(r1>>8) - float64(r2>>8), float64(g1>>8) - float64(g2>>8), float64(b1>>8) - float64(b2>>8)} {
+				mse += d * d
+			}
+		}
+	}
+	mse /= float64(3 * ba.Dx() * ba.Dy())
+	if mse == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(255*255/mse)
+}
@@ -0,0 +1,55 @@
+package convert
+
+import (
+	"bytes"
+	"image/jpeg"
+	"io"
+
+	"github.com/dcarbone/go-heicker/heif"
+	"github.com/dcarbone/go-heicker/heif/bmff"
+)
+
+// encodeHEIF writes img as the primary image of a HEIF file, a jpeg or unci item according to opts.HEIFCodec, along
+// with its EXIF, XMP and ICC profile.  Pixels written as stored keep the irot and imir properties of the source item so
+// that viewers orient them as before.
+func encodeHEIF(w io.Writer, img *decodedImage, opts Options) error {
+	hw := heif.NewWriter()
+	var it *heif.WriterItem
+	if opts.HEIFCodec == HEIFCodecUncompressed {
+		it = hw.AddUncompressed(img.ycc)
+	} else {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img.ycc, &jpeg.Options{Quality: opts.Quality}); err != nil {
+			return err
+		}
+		var err error
+		if it, err = hw.AddJPEG(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	if img.item != nil {
+		if icc, ok := img.item.ICCProfile(); ok {
+			it.AddProperty(heif.ICCProfileProperty(icc))
+		}
+		if opts.Rotation == RotateNone {
+			for _, p := range img.item.Properties {
+				switch p := p.(type) {
+				case *bmff.ImageRotation:
+					it.AddProperty(heif.RotationProperty(p.Angle))
+				case *bmff.ImageMirror:
+					it.AddProperty(heif.MirrorProperty(p.Mirror))
+				}
+			}
+		}
+	}
+	if len(img.exif) > 0 {
+		hw.AddEXIF(img.exif, it.ID)
+	}
+	if len(img.xmp) > 0 {
+		hw.AddXMP(img.xmp, it.ID)
+	}
+
+	_, err := hw.WriteTo(w)
+	return err
+}
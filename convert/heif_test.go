@@ -0,0 +1,74 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/dcarbone/go-heicker/heif"
+)
+
+func TestEncodeHEIF(t *testing.T) {
+	hevc := readTestdata(t, "hevc.heic")
+	_, want := convertPNG(t, hevc, Options{})
+
+	for _, tc := range []struct {
+		codec HEIFCodec
+		diff  float64
+	}{
+		{HEIFCodecJPEG, 3},
+		{HEIFCodecUncompressed, 1},
+	} {
+		var buf bytes.Buffer
+		res, err := Convert(context.Background(), bytes.NewReader(hevc), &buf, Options{Format: FormatHEIF, HEIFCodec: tc.codec, Quality: 95})
+		if err != nil || res.Format != FormatHEIF || res.Width != 64 || res.Height != 48 {
+			t.Fatalf("%s: got %+v, %v", tc.codec, res, err)
+		}
+		info, err := Probe(bytes.NewReader(buf.Bytes()))
+		if err != nil || info.Codec != string(tc.codec) || info.Width != 64 || info.Height != 48 || info.Images != 1 {
+			t.Fatalf("%s: got %+v, %v", tc.codec, info, err)
+		}
+		// outputs convert back to the source image
+		if _, img := convertPNG(t, buf.Bytes(), Options{}); meanDifference(img, want) > tc.diff {
+			t.Errorf("%s: differs from the source by %.1f on average", tc.codec, meanDifference(img, want))
+		}
+	}
+}
+
+func TestEncodeHEIFProperties(t *testing.T) {
+	hvcC, tiles := hevcTiles(t, "hevc.heic")
+	// EXIF of a single orientation tag
+	tiff := append([]byte("MM\x00*"), be(uint32(8), uint16(1), uint16(0x0112), uint16(3), uint32(1), uint16(6), uint16(0), uint32(0))...)
+	xmp := []byte(xmpPacketStart + xmpPacketEnd)
+	data := itemFile(t, 1,
+		testItem{typ: "hvc1", data: tiles[0], props: [][]byte{hvcC, ispe(64, 64), testBox("irot", []byte{1})}},
+		testItem{typ: "Exif", data: append([]byte("\x00\x00\x00\x06Exif\x00\x00"), tiff...), refs: map[string][]uint16{"cdsc": {1}}},
+		testItem{typ: "mime", data: xmp, contentType: heif.ContentTypeXMP, refs: map[string][]uint16{"cdsc": {1}}},
+	)
+
+	for _, tc := range []struct {
+		rotation  Rotation
+		rotations int
+	}{
+		// pixels written as stored keep the irot of the source, those rotated do not
+		{RotateNone, 1},
+		{RotateAuto, 0},
+	} {
+		var buf bytes.Buffer
+		res, err := Convert(context.Background(), bytes.NewReader(data), &buf, Options{Format: FormatHEIF, Rotation: tc.rotation})
+		if err != nil || !res.EXIF || !res.XMP {
+			t.Fatalf("%s: got %+v, %v", tc.rotation, res, err)
+		}
+		hf := heif.Open(bytes.NewReader(buf.Bytes()))
+		primary, err := hf.PrimaryItem()
+		if err != nil || primary.Rotations() != tc.rotations {
+			t.Errorf("%s: got %+v, %v", tc.rotation, primary, err)
+		}
+		if b, err := hf.EXIF(); err != nil || !bytes.HasPrefix(b, []byte("MM\x00*")) {
+			t.Errorf("%s: got EXIF %q, %v", tc.rotation, b, err)
+		}
+		if b, err := hf.XMP(); err != nil || !bytes.Contains(b, []byte("x:xmpmeta")) {
+			t.Errorf("%s: got XMP %q, %v", tc.rotation, b, err)
+		}
+	}
+}
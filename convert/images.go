@@ -0,0 +1,67 @@
+package convert
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dcarbone/go-heicker/heif"
+)
+
+// images returns the items intended for display in the order they are declared, which is the order Options.Index
+// numbers them in.  Thumbnails, auxiliary images, hidden items and the inputs of derived images such as grid tiles are
+// not included.
+func images(hf *heif.File) ([]*heif.Item, error) {
+	items, err := hf.Items()
+	if err != nil {
+		return nil, err
+	}
+
+	inputs := make(map[uint32]bool)
+	for _, it := range items {
+		if dimg := it.Reference("dimg"); dimg != nil {
+			for _, id := range dimg.ToItemIDs {
+				inputs[id] = true
+			}
+		}
+	}
+
+	var out []*heif.Item
+	for _, it := range items {
+		if imageItemTypes[it.Info.ItemType] && !inputs[it.ID] && !it.Hidden() &&
+			it.Reference("thmb") == nil && it.Reference("auxl") == nil {
+			out = append(out, it)
+		}
+	}
+	return out, nil
+}
+
+// selectImage returns the image selected by opts.Item or opts.Index, or the primary image if neither is set
+func selectImage(hf *heif.File, opts Options) (*heif.Item, error) {
+	if opts.Item == 0 && opts.Index == 0 {
+		primary, err := hf.PrimaryItem()
+		if err != nil {
+			return nil, heifError(err)
+		}
+		if primary.Info == nil {
+			return nil, newError(ErrDecodeFailed, errors.New("primary item has no info"))
+		}
+		return primary, nil
+	}
+
+	imgs, err := images(hf)
+	if err != nil {
+		return nil, heifError(err)
+	}
+	if opts.Index > 0 {
+		if opts.Index > len(imgs) {
+			return nil, newError(ErrImageNotFound, fmt.Errorf("image %d requested, the file has %d", opts.Index, len(imgs)))
+		}
+		return imgs[opts.Index-1], nil
+	}
+	for _, it := range imgs {
+		if it.ID == opts.Item {
+			return it, nil
+		}
+	}
+	return nil, newError(ErrImageNotFound, fmt.Errorf("no image with item ID %d", opts.Item))
+}
@@ -0,0 +1,399 @@
+package convert
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/dcarbone/go-heicker/heif"
+	"github.com/dcarbone/go-heicker/heif/bmff"
+)
+
+// auxiliary image types reported by Info
+const (
+	AuxAlpha   = "alpha"
+	AuxDepth   = "depth"
+	AuxMatte   = "matte"
+	AuxGainMap = "gainmap"
+	AuxOther   = "other"
+)
+
+// auxTypes maps the auxC urns written by common encoders to an auxiliary image type
+var auxTypes = map[string]string{
+	"urn:mpeg:mpegB:cicp:systems:auxiliary:alpha":       AuxAlpha,
+	"urn:mpeg:hevc:2015:auxid:1":                        AuxAlpha,
+	"urn:mpeg:mpegB:cicp:systems:auxiliary:depth":       AuxDepth,
+	"urn:mpeg:hevc:2015:auxid:2":                        AuxDepth,
+	"urn:com:apple:photo:2018:aux:portraiteffectsmatte": AuxMatte,
+	"urn:com:apple:photo:2019:aux:semanticskinmatte":    AuxMatte,
+	"urn:com:apple:photo:2019:aux:semantichairmatte":    AuxMatte,
+	"urn:com:apple:photo:2019:aux:semanticteethmatte":   AuxMatte,
+	"urn:com:apple:photo:2020:aux:hdrgainmap":           AuxGainMap,
+}
+
+// imageItemTypes are the item types that hold an image, as opposed to metadata
+var imageItemTypes = map[string]bool{
+	"hvc1": true,
+	"hev1": true,
+	"grid": true,
+	"iden": true,
+	"iovl": true,
+	"jpeg": true,
+	"unci": true,
+	"av01": true,
+}
+
+// Info describes a HEIF file and its primary image as read from the container, without decoding any image data
+type Info struct {
+	Brand            string   `json:"brand"`
+	CompatibleBrands []string `json:"compatible_brands"`
+
+	// Codec is the item type of the primary image, e.g. "hvc1" or "grid"
+	Codec string `json:"codec"`
+	// Width and Height are the stored dimensions of the primary image, DisplayWidth and DisplayHeight are those after
+	// Rotation is applied
+	Width         int `json:"width"`
+	Height        int `json:"height"`
+	DisplayWidth  int `json:"display_width"`
+	DisplayHeight int `json:"display_height"`
+	// Rotation is the clockwise rotation in degrees applied to the image for display, as done by RotateAuto
+	Rotation int `json:"rotation"`
+	// Mirror is the axis the image is mirrored about for display, "vertical" or "horizontal", if any
+	Mirror string `json:"mirror,omitempty"`
+
+	Grid *GridInfo `json:"grid,omitempty"`
+
+	// BitDepth and ChromaFormat are read from the decoder configuration of the image, or of its first tile
+	BitDepth     int    `json:"bit_depth,omitempty"`
+	ChromaFormat string `json:"chroma_format,omitempty"`
+
+	// Images is the number of images intended for display, not counting tiles, thumbnails and auxiliary images.
+	// ImageItems lists them in the order Options.Index numbers them in.
+	Images     int        `json:"images"`
+	ImageItems []ItemInfo `json:"image_items"`
+	// Tracks lists the image sequence tracks, if any
+	Tracks []TrackInfo `json:"tracks"`
+	// Items is the total number of items in the file, including metadata
+	Items int `json:"items"`
+
+	EXIF bool `json:"exif"`
+	// EXIFTags holds the value of each known EXIF tag, if the EXIF data could be parsed
+	EXIFTags map[string]json.RawMessage `json:"exif_tags,omitempty"`
+	XMP      bool                       `json:"xmp"`
+	ICC      bool                       `json:"icc"`
+	Depth    bool                       `json:"depth"`
+	Alpha    bool                       `json:"alpha"`
+
+	Thumbnails []ItemInfo `json:"thumbnails"`
+	Auxiliary  []ItemInfo `json:"auxiliary"`
+}
+
+// GridInfo describes the tiles of a grid image
+type GridInfo struct {
+	Rows       int `json:"rows"`
+	Columns    int `json:"columns"`
+	TileWidth  int `json:"tile_width"`
+	TileHeight int `json:"tile_height"`
+}
+
+// ItemInfo describes an image item
+type ItemInfo struct {
+	ID     uint32 `json:"id"`
+	Codec  string `json:"codec"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	// Primary is only set for the primary image of ImageItems
+	Primary bool `json:"primary,omitempty"`
+	// Type and URN are only set for auxiliary images.  Type is one of the Aux constants.
+	Type string `json:"type,omitempty"`
+	URN  string `json:"urn,omitempty"`
+	// BitDepth and DepthRepresentation are only set for auxiliary images, the latter for depth images carrying depth
+	// representation information
+	BitDepth            int        `json:"bit_depth,omitempty"`
+	DepthRepresentation *DepthInfo `json:"depth_representation,omitempty"`
+	// Headroom is only set for HDR gain maps, the ratio of the brightest HDR pixel to SDR white
+	Headroom float64 `json:"headroom,omitempty"`
+}
+
+// DepthInfo is the depth representation information of a depth image.  Values are only set when present.
+type DepthInfo struct {
+	// Type is one of uniform_inverse_z, uniform_disparity, uniform_z or nonuniform_disparity
+	Type  string   `json:"type"`
+	ZNear *float64 `json:"z_near,omitempty"`
+	ZFar  *float64 `json:"z_far,omitempty"`
+	DMin  *float64 `json:"d_min,omitempty"`
+	DMax  *float64 `json:"d_max,omitempty"`
+}
+
+// depthTypeNames are the names of the depth representation types reported by Info
+var depthTypeNames = map[heif.DepthRepresentationType]string{
+	heif.DepthUniformInverseZ:     "uniform_inverse_z",
+	heif.DepthUniformDisparity:    "uniform_disparity",
+	heif.DepthUniformZ:            "uniform_z",
+	heif.DepthNonuniformDisparity: "nonuniform_disparity",
+}
+
+// depthInfo describes dr
+func depthInfo(dr *heif.DepthRepresentation) *DepthInfo {
+	di := &DepthInfo{Type: depthTypeNames[dr.Type]}
+	if di.Type == "" {
+		di.Type = fmt.Sprintf("unknown_%d", dr.Type)
+	}
+	value := func(has bool, v float64) *float64 {
+		if !has {
+			return nil
+		}
+		return &v
+	}
+	di.ZNear, di.ZFar = value(dr.HasZNear, dr.ZNear), value(dr.HasZFar, dr.ZFar)
+	di.DMin, di.DMax = value(dr.HasDMin, dr.DMin), value(dr.HasDMax, dr.DMax)
+	return di
+}
+
+// TrackInfo describes an image sequence track
+type TrackInfo struct {
+	ID     uint32 `json:"id"`
+	Codec  string `json:"codec"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Frames int    `json:"frames"`
+	// Duration is in seconds
+	Duration float64 `json:"duration"`
+}
+
+// Probe reads the container of r and describes its primary image.  Only the metadata boxes and small items such as
+// grid descriptions are read, no image data is decoded.
+func Probe(r io.ReaderAt) (*Info, error) {
+	if !isHEIF(r) {
+		return nil, newError(ErrNotHEIF, nil)
+	}
+
+	hf := heif.Open(r)
+	ft, err := hf.FileType()
+	if err != nil {
+		return nil, heifError(err)
+	}
+	tracks, err := hf.Tracks()
+	if err != nil {
+		return nil, heifError(err)
+	}
+	items, err := hf.Items()
+	if err != nil {
+		return nil, heifError(err)
+	}
+	imgs, err := images(hf)
+	if err != nil {
+		return nil, heifError(err)
+	}
+
+	info := &Info{
+		Brand:            ft.MajorBrand,
+		CompatibleBrands: ft.Compatible,
+		Items:            len(items),
+		Images:           len(imgs),
+		ImageItems:       make([]ItemInfo, 0, len(imgs)),
+		Tracks:           make([]TrackInfo, 0, len(tracks)),
+		Thumbnails:       make([]ItemInfo, 0),
+		Auxiliary:        make([]ItemInfo, 0),
+	}
+	for _, t := range tracks {
+		ti := TrackInfo{ID: t.ID, Codec: t.Codec(), Width: t.Width, Height: t.Height, Frames: len(t.Samples)}
+		if t.Timescale > 0 {
+			ti.Duration = float64(t.Duration) / float64(t.Timescale)
+		}
+		info.Tracks = append(info.Tracks, ti)
+	}
+
+	primary, err := hf.PrimaryItem()
+	if err != nil {
+		if len(tracks) == 0 {
+			return nil, heifError(err)
+		}
+		// a file holding only an image sequence is described by its first track, as converted by default
+		t := tracks[0]
+		info.Codec = t.Codec()
+		info.Width, info.Height = t.Width, t.Height
+		info.DisplayWidth, info.DisplayHeight = t.Width, t.Height
+		if hvcc, ok := t.HevcConfig(); ok {
+			info.BitDepth = int(hvcc.Config.BitDepthLuma)
+			info.ChromaFormat = chromaFormatName(hvcc.Config.ChromaFormat)
+		}
+		return info, nil
+	}
+	info.Codec = primary.Info.ItemType
+	for _, it := range imgs {
+		ii := itemInfo(it)
+		ii.Primary = it.ID == primary.ID
+		info.ImageItems = append(info.ImageItems, ii)
+	}
+
+	var ok bool
+	if info.Width, info.Height, ok = primary.SpatialExtents(); !ok {
+		return nil, newError(ErrMalformed, errors.New("primary item has no dimensions"))
+	}
+	info.DisplayWidth, info.DisplayHeight, _ = primary.VisualDimensions()
+	info.Rotation = (4 - primary.Rotations()) % 4 * 90
+	for _, p := range primary.Properties {
+		if p, ok := p.(*bmff.ImageMirror); ok {
+			if p.Mirror == bmff.MirrorVertical {
+				info.Mirror = "vertical"
+			} else {
+				info.Mirror = "horizontal"
+			}
+		}
+	}
+
+	// a derived image's coding properties are those of its first input, or of a grid's first tile
+	coded := primary
+	for depth := 0; derivedItemTypes[coded.Info.ItemType] && depth <= maxDerivationDepth; depth++ {
+		if coded.Info.ItemType == "grid" {
+			info.Grid, coded, err = probeGrid(hf, coded)
+		} else {
+			var ins []*heif.Item
+			if ins, err = derivedInputs(hf, coded); err == nil {
+				coded = ins[0]
+			}
+		}
+		if err != nil {
+			return nil, heifError(err)
+		}
+	}
+	if hvcc, ok := coded.HevcConfig(); ok {
+		info.BitDepth = int(hvcc.Config.BitDepthLuma)
+		info.ChromaFormat = chromaFormatName(hvcc.Config.ChromaFormat)
+	} else if av1c, ok := coded.AV1Config(); ok {
+		info.BitDepth = av1c.BitDepth()
+		info.ChromaFormat = av1ChromaFormatName(av1c)
+	} else if unc, _, ok := coded.UncompressedConfig(); ok {
+		info.BitDepth = 8
+		if len(unc.Components) > 0 {
+			info.BitDepth = int(unc.Components[0].BitDepth)
+		}
+	}
+	if info.BitDepth == 0 {
+		for _, p := range coded.Properties {
+			if p, ok := p.(*bmff.PixelInformationProperty); ok && len(p.BitsPerChannel) > 0 {
+				info.BitDepth = int(p.BitsPerChannel[0])
+			}
+		}
+	}
+	if _, ok := primary.ICCProfile(); ok {
+		info.ICC = true
+	} else if _, ok := coded.ICCProfile(); ok {
+		info.ICC = true
+	}
+
+	for _, it := range items {
+		if it.Info.ItemType == "Exif" {
+			info.EXIF = true
+		}
+		if it.Info.ItemType == "mime" && it.Info.ContentType == heif.ContentTypeXMP {
+			info.XMP = true
+		}
+		if !imageItemTypes[it.Info.ItemType] {
+			continue
+		}
+
+		switch {
+		case referencesItem(it, "thmb", primary.ID):
+			info.Thumbnails = append(info.Thumbnails, itemInfo(it))
+		case referencesItem(it, "auxl", primary.ID):
+			ii := itemInfo(it)
+			ii.Type, ii.URN = auxType(it)
+			if hvcc, ok := it.HevcConfig(); ok {
+				ii.BitDepth = int(hvcc.Config.BitDepthLuma)
+			}
+			if ii.Type == AuxGainMap {
+				ii.Headroom, _ = gainMapHeadroom(hf, it)
+			}
+			if ii.Type == AuxDepth {
+				// depth representation information is optional, unreadable data is not an error
+				if dr, ok, err := it.DepthRepresentation(); ok && err == nil {
+					ii.DepthRepresentation = depthInfo(dr)
+				}
+			}
+			info.Alpha = info.Alpha || ii.Type == AuxAlpha
+			info.Depth = info.Depth || ii.Type == AuxDepth
+			info.Auxiliary = append(info.Auxiliary, ii)
+		}
+	}
+
+	if info.EXIF {
+		// EXIF is optional, unreadable data is not an error
+		if b, err := hf.EXIF(); err == nil {
+			info.EXIFTags, _ = exifTagValues(b)
+		}
+	}
+
+	return info, nil
+}
+
+// probeGrid describes the tiles of a grid item, returning the first tile
+func probeGrid(hf *heif.File, it *heif.Item) (*GridInfo, *heif.Item, error) {
+	data, err := hf.GetItemData(it)
+	if err != nil {
+		return nil, nil, err
+	}
+	g, err := parseGrid(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	dimg := it.Reference("dimg")
+	if dimg == nil || len(dimg.ToItemIDs) == 0 {
+		return nil, nil, errors.New("grid has no dimg reference")
+	}
+	tile, err := hf.ItemByID(dimg.ToItemIDs[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading first tile: %w", err)
+	}
+
+	gi := &GridInfo{Rows: g.rows, Columns: g.columns}
+	gi.TileWidth, gi.TileHeight, _ = tile.SpatialExtents()
+	return gi, tile, nil
+}
+
+func referencesItem(it *heif.Item, typ string, id uint32) bool {
+	ref := it.Reference(typ)
+	if ref == nil {
+		return false
+	}
+	for _, to := range ref.ToItemIDs {
+		if to == id {
+			return true
+		}
+	}
+	return false
+}
+
+func itemInfo(it *heif.Item) ItemInfo {
+	ii := ItemInfo{ID: it.ID, Codec: it.Info.ItemType}
+	ii.Width, ii.Height, _ = it.SpatialExtents()
+	return ii
+}
+
+// av1ChromaFormatName returns the chroma format of an av01 item as chromaFormatName does for hvcC
+func av1ChromaFormatName(c *bmff.AV1ConfigurationBox) string {
+	switch {
+	case c.Monochrome:
+		return chromaFormatName(0)
+	case c.ChromaSubsamplingX && c.ChromaSubsamplingY:
+		return chromaFormatName(1)
+	case c.ChromaSubsamplingX:
+		return chromaFormatName(2)
+	}
+	return chromaFormatName(3)
+}
+
+func chromaFormatName(f uint8) string {
+	switch f {
+	case 0:
+		return "monochrome"
+	case 1:
+		return "4:2:0"
+	case 2:
+		return "4:2:2"
+	default:
+		return "4:4:4"
+	}
+}
@@ -0,0 +1,34 @@
+package convert
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestProbe(t *testing.T) {
+	info, err := Probe(bytes.NewReader(readTestdata(t, "hevc.heic")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Brand != "heic" || info.Codec != "grid" || info.Width != 64 || info.Height != 48 || info.DisplayWidth != 64 || info.DisplayHeight != 48 {
+		t.Errorf("got %+v", info)
+	}
+	if g := info.Grid; g == nil || *g != (GridInfo{Rows: 1, Columns: 1, TileWidth: 64, TileHeight: 64}) {
+		t.Errorf("got grid %+v", g)
+	}
+	if info.BitDepth != 8 || info.ChromaFormat != "4:2:0" || info.Images != 3 || info.Items != 6 {
+		t.Errorf("got %+v", info)
+	}
+	if len(info.ImageItems) != 3 || info.ImageItems[0] != (ItemInfo{ID: 2, Codec: "grid", Width: 64, Height: 48, Primary: true}) ||
+		info.ImageItems[2].ID != 6 || info.ImageItems[2].Primary || len(info.Tracks) != 0 {
+		t.Errorf("got images %+v and tracks %+v", info.ImageItems, info.Tracks)
+	}
+	if info.EXIF || info.XMP || info.ICC || len(info.Thumbnails) != 0 || len(info.Auxiliary) != 0 {
+		t.Errorf("got %+v", info)
+	}
+
+	if _, err := Probe(bytes.NewReader([]byte("GIF89a not a heif file"))); !errors.Is(err, ErrNotHEIF) {
+		t.Errorf("got %v, want ErrNotHEIF", err)
+	}
+}
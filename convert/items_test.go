@@ -0,0 +1,243 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"testing"
+)
+
+// testBox returns a box of type typ holding the concatenated parts
+func testBox(typ string, parts ...[]byte) []byte {
+	b := make([]byte, 8)
+	copy(b[4:], typ)
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)))
+	return b
+}
+
+// testFullBox returns a full box of version 0 with no flags
+func testFullBox(typ string, parts ...[]byte) []byte {
+	return testBox(typ, append([][]byte{make([]byte, 4)}, parts...)...)
+}
+
+// be returns the big-endian encoding of each value, sized by its type
+func be(values ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, v := range values {
+		_ = binary.Write(&buf, binary.BigEndian, v)
+	}
+	return buf.Bytes()
+}
+
+// testItem is an item of a file written by itemFile, whose ID is its position among the items, counting from 1
+type testItem struct {
+	typ    string
+	data   []byte
+	hidden bool
+	// props are property boxes, all associated as essential
+	props [][]byte
+	// refs are the references from the item by type, e.g. "dimg" or "auxl"
+	refs map[string][]uint16
+	// contentType is that of mime items
+	contentType string
+}
+
+// ispe returns an ispe property of w x h
+func ispe(w, h int) []byte {
+	return testFullBox("ispe", be(uint32(w), uint32(h)))
+}
+
+// auxC returns an auxC property of type urn with the provided subtype
+func auxC(urn string, subtype []byte) []byte {
+	return testFullBox("auxC", []byte(urn+"\x00"), subtype)
+}
+
+// itemFile returns a heic file of items whose primary item is that with ID primary.  The data of every item is held
+// in a single mdat following the meta box.
+func itemFile(t *testing.T, primary uint16, items ...testItem) []byte {
+	t.Helper()
+	ftyp := testBox("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+
+	var infes, refs, props, assocs [][]byte
+	for i, it := range items {
+		id := uint16(i + 1)
+		flags := uint32(0)
+		if it.hidden {
+			flags = 1
+		}
+		infe := []byte(it.typ + "\x00")
+		if it.typ == "mime" {
+			infe = append(infe, it.contentType+"\x00"...)
+		}
+		infes = append(infes, testBox("infe", be(2<<24|flags, id, uint16(0)), infe))
+		for typ, to := range it.refs {
+			refs = append(refs, testBox(typ, be(id, uint16(len(to)), to)))
+		}
+		assoc := be(id, uint8(len(it.props)))
+		for _, p := range it.props {
+			props = append(props, p)
+			assoc = append(assoc, 0x80|uint8(len(props)))
+		}
+		assocs = append(assocs, assoc)
+	}
+	if len(props) > 127 {
+		t.Fatal("too many properties")
+	}
+
+	meta := func(offset uint32) []byte {
+		iloc := be(uint32(0), uint8(0x44), uint8(0), uint16(len(items)))
+		for i, it := range items {
+			iloc = append(iloc, be(uint16(i+1), uint16(0), uint16(1), offset, uint32(len(it.data)))...)
+			offset += uint32(len(it.data))
+		}
+		return testFullBox("meta",
+			testFullBox("hdlr", []byte("\x00\x00\x00\x00pict"), make([]byte, 12+1)),
+			testFullBox("pitm", be(primary)),
+			testFullBox("iinf", be(uint16(len(items))), bytes.Join(infes, nil)),
+			testFullBox("iref", bytes.Join(refs, nil)),
+			testBox("iprp", testBox("ipco", props...), testFullBox("ipma", be(uint32(len(items))), bytes.Join(assocs, nil))),
+			testBox("iloc", iloc))
+	}
+
+	offset := len(ftyp) + len(meta(0)) + 8
+	out := append(ftyp, meta(uint32(offset))...)
+	mdat := make([][]byte, len(items))
+	for i, it := range items {
+		mdat[i] = it.data
+	}
+	return append(out, testBox("mdat", mdat...)...)
+}
+
+// convertPNG converts data to png by opts, returning the result and the decoded output
+func convertPNG(t *testing.T, data []byte, opts Options) (Result, image.Image) {
+	t.Helper()
+	opts.Format = FormatPNG
+	var buf bytes.Buffer
+	res, err := Convert(context.Background(), bytes.NewReader(data), &buf, opts)
+	if err != nil {
+		t.Fatalf("%+v: %v", opts, err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, img
+}
+
+// overlayData returns the payload of an iovl item with 16 bit fields
+func overlayData(fill [4]uint16, w, h uint16, offsets ...int16) []byte {
+	b := be(uint8(0), uint8(0), fill, w, h)
+	for _, o := range offsets {
+		b = append(b, be(o)...)
+	}
+	return b
+}
+
+func TestConvertDerived(t *testing.T) {
+	hvcC, tiles := hevcTiles(t, "hevc.heic")
+	red := [4]uint16{0xffff, 0, 0, 0xffff}
+	data := itemFile(t, 3,
+		testItem{typ: "hvc1", data: tiles[0], hidden: true, props: [][]byte{hvcC, ispe(64, 64), testBox("irot", []byte{1})}},
+		testItem{typ: "hev1", data: tiles[1], hidden: true, props: [][]byte{hvcC, ispe(64, 64)}},
+		// the tiles overlaid on a red canvas, the second clipped by its bottom right corner
+		testItem{typ: "iovl", data: overlayData(red, 160, 80, 0, 0, 80, 40), props: [][]byte{ispe(160, 80)},
+			refs: map[string][]uint16{"dimg": {1, 2}}},
+		testItem{typ: "iden", props: [][]byte{ispe(64, 64)}, refs: map[string][]uint16{"dimg": {1}}},
+		testItem{typ: "iden", props: [][]byte{ispe(64, 64)}, refs: map[string][]uint16{"dimg": {1, 2}}},
+	)
+
+	info, err := Probe(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Width != 160 || info.Height != 80 || info.Codec != "iovl" || info.ChromaFormat != "4:2:0" || info.Images != 3 {
+		t.Errorf("got %+v", info)
+	}
+
+	// each tile is the image of hevc.heic it codes
+	hevc := readTestdata(t, "hevc.heic")
+	_, first := convertPNG(t, hevc, Options{Index: 1})
+	_, second := convertPNG(t, hevc, Options{Index: 2})
+	res, img := convertPNG(t, data, Options{})
+	if res.Width != 160 || res.Height != 80 || res.Item != 3 {
+		t.Fatalf("got %+v", res)
+	}
+	for _, tc := range []struct {
+		x, y int
+		want color.Color
+	}{
+		{10, 10, first.At(10, 10)},
+		{63, 40, first.At(63, 40)},
+		{85, 45, second.At(5, 5)},
+		{143, 79, second.At(63, 39)},
+		{70, 70, color.NRGBA{R: 0xff, A: 0xff}},
+		{100, 20, color.NRGBA{R: 0xff, A: 0xff}},
+	} {
+		if !sameColor(img.At(tc.x, tc.y), tc.want) {
+			t.Errorf("got %v at %d,%d, want %v", img.At(tc.x, tc.y), tc.x, tc.y, tc.want)
+		}
+	}
+
+	// an iden applies the irot of its input, a quarter turn counter-clockwise, with RotateAuto
+	_, iden := convertPNG(t, data, Options{Item: 4, Rotation: RotateAuto})
+	_, plain := convertPNG(t, data, Options{Item: 4})
+	for _, p := range []image.Point{{0, 0}, {10, 5}, {40, 30}} {
+		if !sameColor(iden.At(p.X, p.Y), first.At(63-p.Y, p.X)) || !sameColor(plain.At(p.X, p.Y), first.At(p.X, p.Y)) {
+			t.Errorf("iden differs at %v", p)
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		opts Options
+		kind error
+	}{
+		{"iden inputs", Options{Item: 5}, ErrDecodeFailed},
+		{"overlay inputs", Options{Limits: Limits{MaxTiles: 1}}, ErrLimitExceeded},
+		{"canvas pixels", Options{Limits: Limits{MaxPixels: 160*80 - 1}}, ErrLimitExceeded},
+	} {
+		if _, err := Convert(context.Background(), bytes.NewReader(data), ioutil.Discard, tc.opts); !errors.Is(err, tc.kind) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.kind)
+		}
+	}
+
+	// an iden of itself
+	cycle := itemFile(t, 1, testItem{typ: "iden", props: [][]byte{ispe(64, 64)}, refs: map[string][]uint16{"dimg": {1}}})
+	if _, err := Convert(context.Background(), bytes.NewReader(cycle), ioutil.Discard, Options{}); !errors.Is(err, ErrDecodeFailed) {
+		t.Errorf("got %v, want %v", err, ErrDecodeFailed)
+	}
+}
+
+// sameColor compares colours as 8 bit NRGBA, allowing for the rounding of YCbCr conversions
+func sameColor(a, b color.Color) bool {
+	ca, cb := color.NRGBAModel.Convert(a).(color.NRGBA), color.NRGBAModel.Convert(b).(color.NRGBA)
+	near := func(x, y uint8) bool { return int(x) <= int(y)+2 && int(y) <= int(x)+2 }
+	return near(ca.R, cb.R) && near(ca.G, cb.G) && near(ca.B, cb.B) && ca.A == cb.A
+}
+
+func TestParseOverlay(t *testing.T) {
+	o, err := parseOverlay(overlayData([4]uint16{1, 2, 3, 4}, 300, 200, -10, 20), 1)
+	if err != nil || o.fill != [4]uint16{1, 2, 3, 4} || o.width != 300 || o.height != 200 || len(o.offsets) != 1 || o.offsets[0] != image.Pt(-10, 20) {
+		t.Errorf("got %+v, %v", o, err)
+	}
+
+	// 32 bit fields, the size unsigned and the offsets signed
+	wide := append(be(uint8(0), uint8(1), [4]uint16{}), be(uint32(70000), uint32(3), int32(-70000), int32(1))...)
+	if o, err = parseOverlay(wide, 1); err != nil || o.width != 70000 || o.height != 3 || o.offsets[0] != image.Pt(-70000, 1) {
+		t.Errorf("got %+v, %v", o, err)
+	}
+
+	for _, b := range [][]byte{overlayData([4]uint16{}, 1, 1, 0, 0)[:9], overlayData([4]uint16{}, 1, 1, 0, 0), wide[:len(wide)-1]} {
+		if _, err := parseOverlay(b, 2); err == nil {
+			t.Errorf("expected an error for %d bytes", len(b))
+		}
+	}
+}
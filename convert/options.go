@@ -0,0 +1,535 @@
+package convert
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"strconv"
+	"strings"
+
+	"github.com/dcarbone/go-heicker/heif/bmff"
+)
+
+// Format is an output image format
+type Format string
+
+const (
+	FormatJPEG Format = "jpeg"
+	FormatPNG  Format = "png"
+	// FormatGIF and FormatWebP convert image sequences to animations, see Options.Track
+	FormatGIF  Format = "gif"
+	FormatWebP Format = "webp"
+	// FormatHEIF wraps the image in a HEIF container, coded as Options.HEIFCodec selects
+	FormatHEIF Format = "heif"
+)
+
+// DefaultQuality is used for jpeg output when Options.Quality is 0
+const DefaultQuality = jpeg.DefaultQuality
+
+var formats = []Format{FormatJPEG, FormatPNG, FormatGIF, FormatWebP, FormatHEIF}
+
+// Formats returns every supported output format
+func Formats() []Format {
+	out := make([]Format, len(formats))
+	copy(out, formats)
+	return out
+}
+
+// ParseFormat returns the format with the provided name, case-insensitively
+func ParseFormat(name string) (Format, error) {
+	for _, f := range formats {
+		if strings.EqualFold(string(f), name) {
+			return f, nil
+		}
+	}
+	return "", newError(ErrInvalidOptions, fmt.Errorf("unsupported format %q, expected one of %s", name, joinFormats(formats)))
+}
+
+// Extension returns the file extension, without leading dot, conventionally used for the format
+func (f Format) Extension() string {
+	if f == FormatJPEG {
+		return "jpg"
+	}
+	return string(f)
+}
+
+func (f Format) ContentType() string {
+	return "image/" + string(f)
+}
+
+// Animated reports whether the format can hold an animation
+func (f Format) Animated() bool {
+	return f == FormatGIF || f == FormatWebP
+}
+
+func joinFormats(fs []Format) string {
+	s := make([]string, len(fs))
+	for i, f := range fs {
+		s[i] = string(f)
+	}
+	return strings.Join(s, ", ")
+}
+
+// Rotation controls the orientation of the output pixels.  Whenever pixels are rotated, the EXIF orientation tag of
+// the output is reset so viewers do not rotate the image a second time.
+type Rotation string
+
+const (
+	// RotateNone writes pixels as stored, leaving viewers to apply the EXIF orientation.  This is the default.
+	RotateNone Rotation = "none"
+	// RotateAuto applies the irot and imir properties of the image
+	RotateAuto Rotation = "auto"
+	// Rotate90, Rotate180, and Rotate270 rotate the stored pixels clockwise, ignoring the container properties
+	Rotate90  Rotation = "90"
+	Rotate180 Rotation = "180"
+	Rotate270 Rotation = "270"
+)
+
+var rotations = []Rotation{RotateNone, RotateAuto, Rotate90, Rotate180, Rotate270}
+
+func ParseRotation(name string) (Rotation, error) {
+	for _, r := range rotations {
+		if strings.EqualFold(string(r), name) {
+			return r, nil
+		}
+	}
+	return "", newError(ErrInvalidOptions, fmt.Errorf("unsupported rotation %q, expected one of none, auto, 90, 180, 270", name))
+}
+
+// MetadataPolicy controls which metadata from the input is written to the output
+type MetadataPolicy string
+
+const (
+	// MetadataKeep copies EXIF data to formats that support it.  This is the default.
+	MetadataKeep MetadataPolicy = "keep"
+	// MetadataStrip removes all EXIF data
+	MetadataStrip MetadataPolicy = "strip"
+	// MetadataStripGPS removes the GPS directory, keeping every other tag
+	MetadataStripGPS MetadataPolicy = "strip-gps"
+	// MetadataAllowlist keeps only the tags named by Options.MetadataTags, along with the orientation
+	MetadataAllowlist MetadataPolicy = "allowlist"
+)
+
+var metadataPolicies = []MetadataPolicy{MetadataKeep, MetadataStrip, MetadataStripGPS, MetadataAllowlist}
+
+func ParseMetadataPolicy(name string) (MetadataPolicy, error) {
+	for _, p := range metadataPolicies {
+		if strings.EqualFold(string(p), name) {
+			return p, nil
+		}
+	}
+	return "", newError(ErrInvalidOptions, fmt.Errorf("unsupported metadata policy %q, expected one of keep, strip, strip-gps, allowlist", name))
+}
+
+// ParseMetadataTags splits a comma separated list of EXIF tag names, e.g. "Make,Model,DateTimeOriginal", returning an
+// error if any name is not known
+func ParseMetadataTags(list string) ([]string, error) {
+	var tags []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if _, ok := lookupEXIFTag(name); !ok {
+			return nil, newError(ErrInvalidOptions, fmt.Errorf("unknown EXIF tag %q", name))
+		}
+		tags = append(tags, name)
+	}
+	return tags, nil
+}
+
+// GainMapMode controls whether the HDR gain map of an image is written to the output
+type GainMapMode string
+
+const (
+	// GainMapKeep writes jpeg outputs of images with an HDR gain map as Ultra HDR, the gain map following the SDR image
+	// so that viewers supporting it can show the HDR rendition.  This is the default.
+	GainMapKeep GainMapMode = "keep"
+	// GainMapStrip writes only the SDR image
+	GainMapStrip GainMapMode = "strip"
+)
+
+var gainMapModes = []GainMapMode{GainMapKeep, GainMapStrip}
+
+func ParseGainMapMode(name string) (GainMapMode, error) {
+	for _, m := range gainMapModes {
+		if strings.EqualFold(string(m), name) {
+			return m, nil
+		}
+	}
+	return "", newError(ErrInvalidOptions, fmt.Errorf("unsupported gain map mode %q, expected one of keep, strip", name))
+}
+
+// HEIFCodec selects how heif outputs store the image
+type HEIFCodec string
+
+const (
+	// HEIFCodecJPEG stores a jpeg item coded at Options.Quality.  This is the default.
+	HEIFCodecJPEG HEIFCodec = "jpeg"
+	// HEIFCodecUncompressed stores an unci item of 8 bit RGB samples, losslessly
+	HEIFCodecUncompressed HEIFCodec = "unci"
+)
+
+var heifCodecs = []HEIFCodec{HEIFCodecJPEG, HEIFCodecUncompressed}
+
+func ParseHEIFCodec(name string) (HEIFCodec, error) {
+	for _, c := range heifCodecs {
+		if strings.EqualFold(string(c), name) {
+			return c, nil
+		}
+	}
+	return "", newError(ErrInvalidOptions, fmt.Errorf("unsupported heif codec %q, expected one of jpeg, unci", name))
+}
+
+// Fit controls how an image is scaled when both a width and a height are requested
+type Fit string
+
+const (
+	// FitContain scales the image to fit within the requested size, preserving its aspect ratio.  This is the default.
+	FitContain Fit = "contain"
+	// FitCover scales the image to cover the requested size, preserving its aspect ratio and cropping the excess
+	// equally from each side
+	FitCover Fit = "cover"
+	// FitFill stretches the image to the requested size
+	FitFill Fit = "fill"
+)
+
+var fits = []Fit{FitContain, FitCover, FitFill}
+
+func ParseFit(name string) (Fit, error) {
+	for _, f := range fits {
+		if strings.EqualFold(string(f), name) {
+			return f, nil
+		}
+	}
+	return "", newError(ErrInvalidOptions, fmt.Errorf("unsupported fit %q, expected one of contain, cover, fill", name))
+}
+
+// Filter is the resampling filter used when resizing
+type Filter string
+
+const (
+	// FilterLanczos is a 3-lobed Lanczos filter, the sharpest and slowest.  This is the default.
+	FilterLanczos Filter = "lanczos"
+	// FilterCatmullRom is a cubic filter, nearly as sharp as Lanczos and faster
+	FilterCatmullRom Filter = "catmullrom"
+	// FilterBilinear interpolates linearly, softer than the cubic filters
+	FilterBilinear Filter = "bilinear"
+	// FilterNearest copies the nearest source pixel, the fastest and blockiest
+	FilterNearest Filter = "nearest"
+)
+
+var filters = []Filter{FilterLanczos, FilterCatmullRom, FilterBilinear, FilterNearest}
+
+func ParseFilter(name string) (Filter, error) {
+	for _, f := range filters {
+		if strings.EqualFold(string(f), name) {
+			return f, nil
+		}
+	}
+	return "", newError(ErrInvalidOptions, fmt.Errorf("unsupported filter %q, expected one of lanczos, catmullrom, bilinear, nearest", name))
+}
+
+// ThumbnailMode selects whether a thumbnail is converted instead of the full image
+type ThumbnailMode string
+
+const (
+	// ThumbnailNone converts the primary image.  This is the default.
+	ThumbnailNone ThumbnailMode = "none"
+	// ThumbnailEmbedded converts the largest thumbnail stored in the file, without decoding the primary image.  The
+	// error is ErrImageNotFound if there is none.
+	ThumbnailEmbedded ThumbnailMode = "embedded"
+	// ThumbnailGenerated resizes the primary image
+	ThumbnailGenerated ThumbnailMode = "generated"
+	// ThumbnailAuto converts the smallest embedded thumbnail at least as large as the requested size, falling back to
+	// resizing the primary image
+	ThumbnailAuto ThumbnailMode = "auto"
+)
+
+// DefaultThumbnailSize is the width and height used by ThumbnailGenerated and ThumbnailAuto when neither is set
+const DefaultThumbnailSize = 256
+
+// maxDimension is the largest width or height that may be requested, the limit of the jpeg format
+const maxDimension = 65535
+
+// maxScale is the largest percentage accepted by Options.Scale
+const maxScale = 1000
+
+// maxFPS is the largest frame rate accepted by Options.MaxFPS
+const maxFPS = 100
+
+// ParseCrop parses a crop rectangle given as "x,y,width,height"
+func ParseCrop(s string) (image.Rectangle, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, newError(ErrInvalidOptions, fmt.Errorf("crop must be x,y,width,height, saw %q", s))
+	}
+	var v [4]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil || n < 0 || (i >= 2 && n == 0) {
+			return image.Rectangle{}, newError(ErrInvalidOptions, fmt.Errorf("crop must be x,y,width,height with a positive width and height, saw %q", s))
+		}
+		v[i] = n
+	}
+	return image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3]), nil
+}
+
+var thumbnailModes = []ThumbnailMode{ThumbnailNone, ThumbnailEmbedded, ThumbnailGenerated, ThumbnailAuto}
+
+func ParseThumbnailMode(name string) (ThumbnailMode, error) {
+	for _, m := range thumbnailModes {
+		if strings.EqualFold(string(m), name) {
+			return m, nil
+		}
+	}
+	return "", newError(ErrInvalidOptions, fmt.Errorf("unsupported thumbnail mode %q, expected one of none, embedded, generated, auto", name))
+}
+
+// ceilingPixels and ceilingTiles take the place of unset Limits, so that no input can exhaust memory.  A canvas of
+// ceilingPixels at 4:4:4 takes 768MB.
+const (
+	ceilingPixels = 1 << 28
+	ceilingTiles  = 4096
+)
+
+// Limits protect against inputs that would be too expensive to convert.  Zero values are unlimited, other than
+// MaxPixels and MaxTiles which then fall back to built-in ceilings of 2^28 pixels and 4096 tiles.
+type Limits struct {
+	// MaxPixels is the maximum width * height of the image
+	MaxPixels int64
+	// MaxTiles is the maximum number of tiles in a grid image
+	MaxTiles int
+	// MaxImages is the maximum number of images, frames and animations converted by ConvertAll, and of frames in an
+	// animation
+	MaxImages int
+	// Parse bounds the parsing of the file's boxes.  Unlike the other limits, its zero fields take the values of
+	// bmff.DefaultLimits.
+	Parse bmff.Limits
+}
+
+// maxPixels returns MaxPixels, or ceilingPixels when it is unset
+func (l Limits) maxPixels() int64 {
+	if l.MaxPixels > 0 {
+		return l.MaxPixels
+	}
+	return ceilingPixels
+}
+
+// maxTiles returns MaxTiles, or ceilingTiles when it is unset
+func (l Limits) maxTiles() int {
+	if l.MaxTiles > 0 {
+		return l.MaxTiles
+	}
+	return ceilingTiles
+}
+
+// Options control a single conversion.  Zero values are replaced by the defaults of the Converter.
+type Options struct {
+	Format   Format
+	Quality  int // 1-100, only used by jpeg and heif, webp is lossless
+	Rotation Rotation
+	Metadata MetadataPolicy
+	// MetadataTags are the names of the EXIF tags kept by MetadataAllowlist
+	MetadataTags []string
+	// Crop is the region of the image kept, in pixels after any rotation.  It is applied before resizing.
+	Crop image.Rectangle
+	// Width and Height resize the output, after any rotation.  When only one is set the other is calculated from the
+	// aspect ratio, otherwise Fit controls how the image is scaled.
+	Width  int
+	Height int
+	Fit    Fit
+	// Scale resizes the output to a percentage of its size, e.g. 50 for half.  It cannot be combined with Width or
+	// Height.
+	Scale float64
+	// MaxWidth and MaxHeight shrink the output to fit within them, preserving its aspect ratio.  They never enlarge it.
+	MaxWidth  int
+	MaxHeight int
+	Filter    Filter
+	Thumbnail ThumbnailMode
+	GainMap   GainMapMode
+	HEIFCodec HEIFCodec
+	// Item selects the image converted by its item ID, and Index by its position among the images listed by Probe,
+	// numbered from 1.  Track selects an image sequence track by its ID instead, of which Frame is converted, numbered
+	// from 1 in presentation order.  When none are set the primary image is converted.  They are never taken from the
+	// defaults of a Converter.
+	Item  uint32
+	Index int
+	Track uint32
+	Frame int
+	// FirstFrame and LastFrame limit the frames of a sequence converted to an animation, or by ConvertAll, numbered
+	// from 1 and inclusive.  They are never taken from the defaults of a Converter.
+	FirstFrame int
+	LastFrame  int
+	// MaxFPS drops frames from animations so they play at no more than this many frames per second, extending the
+	// duration of the frames kept
+	MaxFPS float64
+	// Aux converts an auxiliary image of the selected image instead, AuxDepth or AuxMatte, as a grayscale png.  It is
+	// never taken from the defaults of a Converter, and Format defaults to png when it is set.
+	Aux string
+	// BitDepth is the bits per sample of auxiliary image outputs, 8 or 16.  When 0 it is 16 for images decoded with
+	// more than 8 bits per sample, otherwise 8.
+	BitDepth int
+	Limits   Limits
+}
+
+// merge returns a copy of o with zero values replaced by those in d
+func (o Options) merge(d Options) Options {
+	if o.Format == "" {
+		o.Format = d.Format
+	}
+	if o.Quality == 0 {
+		o.Quality = d.Quality
+	}
+	if o.Rotation == "" {
+		o.Rotation = d.Rotation
+	}
+	if o.Metadata == "" {
+		o.Metadata = d.Metadata
+	}
+	if o.MetadataTags == nil {
+		o.MetadataTags = d.MetadataTags
+	}
+	if o.Crop.Empty() {
+		o.Crop = d.Crop
+	}
+	if o.Width == 0 && o.Height == 0 && o.Scale == 0 {
+		o.Width, o.Height, o.Scale = d.Width, d.Height, d.Scale
+	}
+	if o.Fit == "" {
+		o.Fit = d.Fit
+	}
+	if o.MaxWidth == 0 && o.MaxHeight == 0 {
+		o.MaxWidth, o.MaxHeight = d.MaxWidth, d.MaxHeight
+	}
+	if o.Filter == "" {
+		o.Filter = d.Filter
+	}
+	if o.Thumbnail == "" {
+		o.Thumbnail = d.Thumbnail
+	}
+	if o.GainMap == "" {
+		o.GainMap = d.GainMap
+	}
+	if o.HEIFCodec == "" {
+		o.HEIFCodec = d.HEIFCodec
+	}
+	if o.MaxFPS == 0 {
+		o.MaxFPS = d.MaxFPS
+	}
+	if o.BitDepth == 0 {
+		o.BitDepth = d.BitDepth
+	}
+	if o.Limits.MaxPixels == 0 {
+		o.Limits.MaxPixels = d.Limits.MaxPixels
+	}
+	if o.Limits.MaxTiles == 0 {
+		o.Limits.MaxTiles = d.Limits.MaxTiles
+	}
+	if o.Limits.MaxImages == 0 {
+		o.Limits.MaxImages = d.Limits.MaxImages
+	}
+	if o.Limits.Parse == (bmff.Limits{}) {
+		o.Limits.Parse = d.Limits.Parse
+	}
+	return o
+}
+
+// Validate returns an error of kind ErrInvalidOptions if any option is not supported
+func (o Options) Validate() error {
+	if _, err := ParseFormat(string(o.Format)); err != nil {
+		return err
+	}
+	if o.Quality < 1 || o.Quality > 100 {
+		return newError(ErrInvalidOptions, fmt.Errorf("quality must be between 1 and 100, saw %d", o.Quality))
+	}
+	if _, err := ParseRotation(string(o.Rotation)); err != nil {
+		return err
+	}
+	if _, err := ParseMetadataPolicy(string(o.Metadata)); err != nil {
+		return err
+	}
+	if o.Metadata == MetadataAllowlist && len(o.MetadataTags) == 0 {
+		return newError(ErrInvalidOptions, errors.New("the allowlist metadata policy requires at least one tag"))
+	}
+	for _, name := range o.MetadataTags {
+		if _, ok := lookupEXIFTag(name); !ok {
+			return newError(ErrInvalidOptions, fmt.Errorf("unknown EXIF tag %q", name))
+		}
+	}
+	for _, v := range []int{o.Width, o.Height, o.MaxWidth, o.MaxHeight} {
+		if v < 0 || v > maxDimension {
+			return newError(ErrInvalidOptions, fmt.Errorf("width and height must be between 0 and %d", maxDimension))
+		}
+	}
+	if o.Scale < 0 || o.Scale > maxScale {
+		return newError(ErrInvalidOptions, fmt.Errorf("scale must be a percentage between 0 and %d, saw %g", maxScale, o.Scale))
+	}
+	if o.Scale > 0 && (o.Width > 0 || o.Height > 0) {
+		return newError(ErrInvalidOptions, errors.New("scale cannot be combined with width or height"))
+	}
+	if o.Crop != (image.Rectangle{}) && (o.Crop.Empty() || o.Crop.Min.X < 0 || o.Crop.Min.Y < 0) {
+		return newError(ErrInvalidOptions, fmt.Errorf("crop %v must be a non-empty rectangle with a positive origin", o.Crop))
+	}
+	if _, err := ParseFit(string(o.Fit)); err != nil {
+		return err
+	}
+	if _, err := ParseFilter(string(o.Filter)); err != nil {
+		return err
+	}
+	if _, err := ParseThumbnailMode(string(o.Thumbnail)); err != nil {
+		return err
+	}
+	if _, err := ParseGainMapMode(string(o.GainMap)); err != nil {
+		return err
+	}
+	if _, err := ParseHEIFCodec(string(o.HEIFCodec)); err != nil {
+		return err
+	}
+	if o.Index < 0 || o.Frame < 0 {
+		return newError(ErrInvalidOptions, errors.New("index and frame are numbered from 1"))
+	}
+	if n := btoi(o.Item != 0) + btoi(o.Index != 0) + btoi(o.Track != 0); n > 1 {
+		return newError(ErrInvalidOptions, errors.New("only one of item, index and track can be selected"))
+	}
+	if o.Frame != 0 && o.Track == 0 {
+		return newError(ErrInvalidOptions, errors.New("frame requires a track"))
+	}
+	if o.FirstFrame < 0 || o.LastFrame < 0 {
+		return newError(ErrInvalidOptions, errors.New("first and last frames are numbered from 1"))
+	}
+	if o.LastFrame != 0 && o.LastFrame < o.FirstFrame {
+		return newError(ErrInvalidOptions, fmt.Errorf("last frame %d is before first frame %d", o.LastFrame, o.FirstFrame))
+	}
+	if o.Frame != 0 && (o.FirstFrame != 0 || o.LastFrame != 0) {
+		return newError(ErrInvalidOptions, errors.New("frame cannot be combined with first and last frames"))
+	}
+	if o.MaxFPS < 0 || o.MaxFPS > maxFPS {
+		return newError(ErrInvalidOptions, fmt.Errorf("max fps must be between 0 and %d, saw %g", maxFPS, o.MaxFPS))
+	}
+	if o.Aux != "" {
+		if _, err := ParseAux(o.Aux); err != nil {
+			return err
+		}
+		if o.Format != FormatPNG {
+			return newError(ErrInvalidOptions, errors.New("auxiliary images can only be converted to png"))
+		}
+		if o.Track != 0 || (o.Thumbnail != "" && o.Thumbnail != ThumbnailNone) {
+			return newError(ErrInvalidOptions, errors.New("auxiliary images cannot be combined with a track or a thumbnail"))
+		}
+	}
+	if o.BitDepth != 0 && o.BitDepth != 8 && o.BitDepth != 16 {
+		return newError(ErrInvalidOptions, fmt.Errorf("bit depth must be 8 or 16, saw %d", o.BitDepth))
+	}
+	if o.Limits.MaxPixels < 0 || o.Limits.MaxTiles < 0 || o.Limits.MaxImages < 0 {
+		return newError(ErrInvalidOptions, fmt.Errorf("limits cannot be negative"))
+	}
+	return nil
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,127 @@
+package convert
+
+import (
+	"image"
+	"image/color"
+	"sort"
+)
+
+// medianCut is a draw.Quantizer choosing palettes by median cut.  Colors, reduced to 5 bits per channel, are divided
+// into boxes by repeatedly splitting the box holding the most pixels at the median of its widest channel, each box
+// contributing its mean color to the palette.
+type medianCut struct{}
+
+// medianCutColor is the pixel count and channel sums of one reduced color
+type medianCutColor struct {
+	count   uint64
+	r, g, b uint64
+}
+
+func (c medianCutColor) channel(i int) uint64 {
+	switch i {
+	case 0:
+		return c.r / c.count
+	case 1:
+		return c.g / c.count
+	}
+	return c.b / c.count
+}
+
+func (medianCut) Quantize(p color.Palette, m image.Image) color.Palette {
+	var bins [1 << 15]medianCutColor
+	add := func(r, g, b uint8) {
+		c := &bins[int(r>>3)<<10|int(g>>3)<<5|int(b>>3)]
+		c.count++
+		c.r += uint64(r)
+		c.g += uint64(g)
+		c.b += uint64(b)
+	}
+	b := m.Bounds()
+	if rgba, ok := m.(*image.RGBA); ok {
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			row := rgba.Pix[rgba.PixOffset(b.Min.X, y):rgba.PixOffset(b.Max.X, y)]
+			for i := 0; i < len(row); i += 4 {
+				add(row[i], row[i+1], row[i+2])
+			}
+		}
+	} else {
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r, g, b, _ := m.At(x, y).RGBA()
+				add(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+			}
+		}
+	}
+
+	var colors []medianCutColor
+	for _, c := range bins {
+		if c.count > 0 {
+			colors = append(colors, c)
+		}
+	}
+	if len(colors) == 0 {
+		return append(p, color.Black)
+	}
+
+	// boxes are ranges of colors, split in place
+	type box struct {
+		colors []medianCutColor
+		count  uint64
+	}
+	boxes := []box{{colors: colors}}
+	for _, c := range colors {
+		boxes[0].count += c.count
+	}
+	for len(p)+len(boxes) < cap(p) {
+		i := -1
+		for j, bx := range boxes {
+			if len(bx.colors) > 1 && (i < 0 || bx.count > boxes[i].count) {
+				i = j
+			}
+		}
+		if i < 0 {
+			break
+		}
+		bx := boxes[i]
+
+		widest, width := 0, uint64(0)
+		for ch := 0; ch < 3; ch++ {
+			lo, hi := bx.colors[0].channel(ch), bx.colors[0].channel(ch)
+			for _, c := range bx.colors[1:] {
+				if v := c.channel(ch); v < lo {
+					lo = v
+				} else if v > hi {
+					hi = v
+				}
+			}
+			if hi-lo >= width {
+				widest, width = ch, hi-lo
+			}
+		}
+		sort.Slice(bx.colors, func(a, b int) bool { return bx.colors[a].channel(widest) < bx.colors[b].channel(widest) })
+
+		// split where half the pixels fall either side, leaving at least one color in each box
+		var (
+			n   = 1
+			sum = bx.colors[0].count
+		)
+		for n < len(bx.colors)-1 && sum+bx.colors[n].count <= bx.count/2 {
+			sum += bx.colors[n].count
+			n++
+		}
+		boxes[i] = box{colors: bx.colors[:n], count: sum}
+		boxes = append(boxes, box{colors: bx.colors[n:], count: bx.count - sum})
+	}
+
+	for _, bx := range boxes {
+		var sum medianCutColor
+		for _, c := range bx.colors {
+			sum.count += c.count
+			sum.r += c.r
+			sum.g += c.g
+			sum.b += c.b
+		}
+		p = append(p, color.RGBA{R: uint8(sum.channel(0)), G: uint8(sum.channel(1)), B: uint8(sum.channel(2)), A: 0xff})
+	}
+	return p
+}
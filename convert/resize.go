@@ -0,0 +1,315 @@
+package convert
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// kernel is a resampling filter, evaluated at distances of up to support source pixels when upscaling.  A support of
+// 0 selects the nearest pixel.
+type kernel struct {
+	support float64
+	at      func(x float64) float64
+}
+
+var kernels = map[Filter]kernel{
+	FilterLanczos: {3, func(x float64) float64 {
+		if x = math.Abs(x); x < 3 {
+			return sinc(x) * sinc(x/3)
+		}
+		return 0
+	}},
+	FilterNearest: {0, nil},
+	FilterBilinear: {1, func(x float64) float64 {
+		if x = math.Abs(x); x < 1 {
+			return 1 - x
+		}
+		return 0
+	}},
+	FilterCatmullRom: {2, func(x float64) float64 {
+		switch x = math.Abs(x); {
+		case x < 1:
+			return (1.5*x-2.5)*x*x + 1
+		case x < 2:
+			return ((-0.5*x+2.5)*x-4)*x + 2
+		default:
+			return 0
+		}
+	}},
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	x *= math.Pi
+	return math.Sin(x) / x
+}
+
+// window is the region of the source, in luma pixels, that is resampled into the output
+type window struct {
+	x, y, w, h float64
+}
+
+// contribution is the weights of the source pixels from start onward that make up a single output pixel
+type contribution struct {
+	start   int
+	weights []float32
+}
+
+// contributions returns the contributions to each of n output pixels from the source range [off, off+length) of a
+// line of size source pixels
+func contributions(n int, off, length float64, size int, k kernel) []contribution {
+	var (
+		out   = make([]contribution, n)
+		scale = length / float64(n)
+		// when downscaling the kernel is stretched, so that every source pixel contributes
+		fscale  = math.Max(scale, 1)
+		support = k.support * fscale
+	)
+	for i := range out {
+		center := off + (float64(i)+0.5)*scale
+		if k.support == 0 {
+			out[i] = contribution{start: clampInt(int(center), 0, size-1), weights: []float32{1}}
+			continue
+		}
+
+		lo := int(math.Floor(center - support))
+		hi := int(math.Ceil(center + support))
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > size {
+			hi = size
+		}
+		if hi <= lo {
+			// the window lies at the very edge, use the nearest pixel
+			lo = int(math.Min(math.Max(center, 0), float64(size-1)))
+			hi = lo + 1
+		}
+
+		weights := make([]float32, hi-lo)
+		var sum float64
+		for j := range weights {
+			w := k.at((float64(lo+j) + 0.5 - center) / fscale)
+			weights[j] = float32(w)
+			sum += w
+		}
+		if sum != 0 {
+			for j := range weights {
+				weights[j] /= float32(sum)
+			}
+		}
+		out[i] = contribution{start: lo, weights: weights}
+	}
+	return out
+}
+
+func clampInt(v, lo, hi int) int {
+	switch {
+	case v < lo:
+		return lo
+	case v > hi:
+		return hi
+	default:
+		return v
+	}
+}
+
+func clampByte(v float32) byte {
+	switch {
+	case v <= 0:
+		return 0
+	case v >= 255:
+		return 255
+	default:
+		return byte(v + 0.5)
+	}
+}
+
+// resample returns a w x h plane resampled from win, given in this plane's pixels
+func (p plane) resample(w, h int, win window, k kernel) plane {
+	var (
+		cols = contributions(w, win.x, win.w, p.w, k)
+		rows = contributions(h, win.y, win.h, p.h, k)
+	)
+
+	// only the source rows that contribute to the output are filtered horizontally
+	y0, y1 := p.h, 0
+	for _, r := range rows {
+		if r.start < y0 {
+			y0 = r.start
+		}
+		if end := r.start + len(r.weights); end > y1 {
+			y1 = end
+		}
+	}
+
+	tmp := make([]float32, w*(y1-y0))
+	for y := y0; y < y1; y++ {
+		src := p.pix[y*p.stride : y*p.stride+p.w]
+		dst := tmp[(y-y0)*w : (y-y0+1)*w]
+		for x, c := range cols {
+			var v float32
+			for j, wt := range c.weights {
+				v += float32(src[c.start+j]) * wt
+			}
+			dst[x] = v
+		}
+	}
+
+	out := plane{pix: make([]byte, w*h), stride: w, w: w, h: h}
+	for y, r := range rows {
+		dst := out.pix[y*w : (y+1)*w]
+		for x := range dst {
+			var v float32
+			for j, wt := range r.weights {
+				v += tmp[(r.start-y0+j)*w+x] * wt
+			}
+			dst[x] = clampByte(v)
+		}
+	}
+	return out
+}
+
+// resizeYCbCr resamples win of img to a w x h image, resampling each plane independently so that the chroma
+// subsampling is preserved
+func resizeYCbCr(img *image.YCbCr, w, h int, win window, f Filter) *image.YCbCr {
+	k, ok := kernels[f]
+	if !ok {
+		k = kernels[FilterLanczos]
+	}
+
+	planes := ycbcrPlanes(img)
+	lw, lh := float64(planes[0].w), float64(planes[0].h)
+	cw, ch := chromaSize(w, h, img.SubsampleRatio)
+	for i := range planes {
+		tw, th := w, h
+		// chroma windows are scaled by the subsampling of the source plane
+		sx, sy := 1.0, 1.0
+		if i > 0 {
+			tw, th = cw, ch
+			sx, sy = float64(planes[i].w)/lw, float64(planes[i].h)/lh
+		}
+		planes[i] = planes[i].resample(tw, th, window{win.x * sx, win.y * sy, win.w * sx, win.h * sy}, k)
+	}
+	return fromPlanes(planes, img.SubsampleRatio)
+}
+
+// fitSize returns the output dimensions for an image of sw x sh resized to w x h using fit, and the window of the
+// source that is resampled.  A zero width or height is calculated from the other, preserving the aspect ratio.
+func fitSize(sw, sh, w, h int, fit Fit) (int, int, window) {
+	win := window{0, 0, float64(sw), float64(sh)}
+	switch {
+	case w == 0 && h == 0:
+		return sw, sh, win
+	case w == 0:
+		return atLeastOne(float64(sw) * float64(h) / float64(sh)), h, win
+	case h == 0:
+		return w, atLeastOne(float64(sh) * float64(w) / float64(sw)), win
+	}
+
+	sx, sy := float64(w)/float64(sw), float64(h)/float64(sh)
+	switch fit {
+	case FitFill:
+		return w, h, win
+	case FitCover:
+		// scale to cover both dimensions and crop the excess from the center
+		s := math.Max(sx, sy)
+		win.w, win.h = float64(w)/s, float64(h)/s
+		win.x, win.y = (float64(sw)-win.w)/2, (float64(sh)-win.h)/2
+		return w, h, win
+	default:
+		s := math.Min(sx, sy)
+		return atLeastOne(float64(sw) * s), atLeastOne(float64(sh) * s), win
+	}
+}
+
+func atLeastOne(v float64) int {
+	if n := int(math.Round(v)); n > 0 {
+		return n
+	}
+	return 1
+}
+
+// cropYCbCr copies r of img without resampling.  Chroma is cropped from the sample containing the first pixel of r,
+// so odd offsets of subsampled planes are rounded down.
+func cropYCbCr(img *image.YCbCr, r image.Rectangle) *image.YCbCr {
+	planes := ycbcrPlanes(img)
+	lw, lh := planes[0].w, planes[0].h
+	cw, ch := chromaSize(r.Dx(), r.Dy(), img.SubsampleRatio)
+	for i := range planes {
+		x, y, w, h := r.Min.X, r.Min.Y, r.Dx(), r.Dy()
+		if i > 0 {
+			x, y, w, h = x*planes[i].w/lw, y*planes[i].h/lh, cw, ch
+		}
+		p := planes[i]
+		planes[i] = p.transform(w, h, func(dx, dy int) (int, int) {
+			return clampInt(x+dx, 0, p.w-1), clampInt(y+dy, 0, p.h-1)
+		})
+	}
+	return fromPlanes(planes, img.SubsampleRatio)
+}
+
+// outputSize returns the dimensions of the output for an sw x sh image, and the window of the image resampled into
+// them.  Crop is applied first, then either Scale or Width and Height, and finally MaxWidth and MaxHeight.
+func outputSize(sw, sh int, opts Options) (int, int, window, error) {
+	win := window{0, 0, float64(sw), float64(sh)}
+	if !opts.Crop.Empty() {
+		c := opts.Crop.Intersect(image.Rect(0, 0, sw, sh))
+		if c.Empty() {
+			return 0, 0, win, newError(ErrInvalidOptions, fmt.Errorf("crop %v is outside the %dx%d image", opts.Crop, sw, sh))
+		}
+		win = window{float64(c.Min.X), float64(c.Min.Y), float64(c.Dx()), float64(c.Dy())}
+		sw, sh = c.Dx(), c.Dy()
+	}
+
+	var w, h int
+	if opts.Scale > 0 {
+		w, h = atLeastOne(float64(sw)*opts.Scale/100), atLeastOne(float64(sh)*opts.Scale/100)
+	} else {
+		var sub window
+		w, h, sub = fitSize(sw, sh, opts.Width, opts.Height, opts.Fit)
+		win = window{win.x + sub.x, win.y + sub.y, sub.w, sub.h}
+	}
+
+	s := 1.0
+	if opts.MaxWidth > 0 && w > opts.MaxWidth {
+		s = float64(opts.MaxWidth) / float64(w)
+	}
+	if opts.MaxHeight > 0 && h > opts.MaxHeight {
+		s = math.Min(s, float64(opts.MaxHeight)/float64(h))
+	}
+	if s < 1 {
+		w, h = atLeastOne(float64(w)*s), atLeastOne(float64(h)*s)
+	}
+
+	if w > maxDimension || h > maxDimension {
+		return 0, 0, win, newError(ErrLimitExceeded, fmt.Errorf("output would be %dx%d, exceeding %d pixels in either dimension", w, h, maxDimension))
+	}
+	// resampling filters the rows of the window horizontally first, into a plane of the output width
+	max := opts.Limits.maxPixels()
+	if int64(w)*int64(h) > max || int64(w)*int64(math.Ceil(win.h)) > max {
+		return 0, 0, win, newError(ErrLimitExceeded, fmt.Errorf("output would be %dx%d, exceeding %d pixels", w, h, max))
+	}
+	return w, h, win, nil
+}
+
+// resize applies the requested crop and size, returning true if the pixels were changed
+func resize(img *image.YCbCr, opts Options) (*image.YCbCr, bool, error) {
+	sw, sh := img.Rect.Dx(), img.Rect.Dy()
+	w, h, win, err := outputSize(sw, sh, opts)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if win.w == float64(w) && win.h == float64(h) && win.x == math.Trunc(win.x) && win.y == math.Trunc(win.y) {
+		// a crop, or nothing at all
+		if w == sw && h == sh {
+			return img, false, nil
+		}
+		return cropYCbCr(img, image.Rect(int(win.x), int(win.y), int(win.x)+w, int(win.y)+h)), true, nil
+	}
+	return resizeYCbCr(img, w, h, win, opts.Filter), true, nil
+}
@@ -0,0 +1,150 @@
+package convert
+
+import (
+	"errors"
+	"image"
+	"testing"
+)
+
+func TestFitSize(t *testing.T) {
+	for _, tc := range []struct {
+		sw, sh, w, h int
+		fit          Fit
+		ow, oh       int
+		win          window
+	}{
+		{64, 48, 0, 0, FitContain, 64, 48, window{0, 0, 64, 48}},
+		{64, 48, 32, 0, FitContain, 32, 24, window{0, 0, 64, 48}},
+		{64, 48, 0, 12, FitContain, 16, 12, window{0, 0, 64, 48}},
+		{64, 48, 1000, 1, FitContain, 1, 1, window{0, 0, 64, 48}},
+		{64, 48, 32, 32, FitContain, 32, 24, window{0, 0, 64, 48}},
+		{64, 48, 32, 32, FitFill, 32, 32, window{0, 0, 64, 48}},
+		{64, 48, 32, 32, FitCover, 32, 32, window{8, 0, 48, 48}},
+		{48, 64, 24, 12, FitCover, 24, 12, window{0, 20, 48, 24}},
+	} {
+		ow, oh, win := fitSize(tc.sw, tc.sh, tc.w, tc.h, tc.fit)
+		if ow != tc.ow || oh != tc.oh || win != tc.win {
+			t.Errorf("%dx%d to %dx%d %s: got %dx%d of %+v, want %dx%d of %+v", tc.sw, tc.sh, tc.w, tc.h, tc.fit, ow, oh, win, tc.ow, tc.oh, tc.win)
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	src := image.NewYCbCr(image.Rect(0, 0, 64, 48), image.YCbCrSubsampleRatio420)
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			src.Y[src.YOffset(x, y)] = byte(x * 4)
+		}
+	}
+	for i := range src.Cb {
+		src.Cb[i], src.Cr[i] = 90, 200
+	}
+
+	if out, resized, err := resize(src, Options{Width: 64}); resized || out != src || err != nil {
+		t.Error("resized to the same size")
+	}
+
+	for _, f := range filters {
+		out, resized, err := resize(src, Options{Width: 16, Fit: FitContain, Filter: f})
+		if err != nil || !resized || out.Rect != image.Rect(0, 0, 16, 12) || out.SubsampleRatio != image.YCbCrSubsampleRatio420 {
+			t.Fatalf("%s: got %v of %v", f, out.Rect, out.SubsampleRatio)
+		}
+		// flat chroma stays flat and the luma ramp keeps increasing
+		for i := range out.Cb {
+			if out.Cb[i] != 90 || out.Cr[i] != 200 {
+				t.Fatalf("%s: got chroma %d, %d", f, out.Cb[i], out.Cr[i])
+			}
+		}
+		for x := 1; x < 16; x++ {
+			if a, b := out.Y[out.YOffset(x-1, 6)], out.Y[out.YOffset(x, 6)]; b <= a {
+				t.Errorf("%s: luma %d then %d at %d", f, a, b, x)
+			}
+		}
+	}
+
+	// upscaling
+	out, _, _ := resize(src, Options{Width: 128, Height: 128, Fit: FitCover})
+	if out.Rect != image.Rect(0, 0, 128, 128) {
+		t.Errorf("got %v", out.Rect)
+	}
+
+	// a crop alone copies the pixels
+	out, resized, err := resize(src, Options{Crop: image.Rect(10, 4, 30, 20)})
+	if err != nil || !resized || out.Rect != image.Rect(0, 0, 20, 16) {
+		t.Fatalf("got %v, %t, %v", out.Rect, resized, err)
+	}
+	for x := 0; x < 20; x++ {
+		if got, want := out.Y[out.YOffset(x, 0)], src.Y[src.YOffset(x+10, 4)]; got != want {
+			t.Errorf("cropped luma at %d: got %d, want %d", x, got, want)
+		}
+	}
+}
+
+func TestOutputSize(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts Options
+		w, h int
+		win  window
+		kind error
+	}{
+		{"none", Options{}, 64, 48, window{0, 0, 64, 48}, nil},
+		{"crop", Options{Crop: image.Rect(8, 4, 40, 20)}, 32, 16, window{8, 4, 32, 16}, nil},
+		{"crop clipped", Options{Crop: image.Rect(32, 24, 100, 100)}, 32, 24, window{32, 24, 32, 24}, nil},
+		{"crop outside", Options{Crop: image.Rect(64, 0, 80, 10)}, 0, 0, window{}, ErrInvalidOptions},
+		{"crop then width", Options{Crop: image.Rect(0, 0, 32, 16), Width: 16}, 16, 8, window{0, 0, 32, 16}, nil},
+		{"crop then cover", Options{Crop: image.Rect(4, 0, 36, 16), Width: 16, Height: 16, Fit: FitCover}, 16, 16, window{12, 0, 16, 16}, nil},
+		{"scale", Options{Scale: 50}, 32, 24, window{0, 0, 64, 48}, nil},
+		{"scale tiny", Options{Scale: 0.1}, 1, 1, window{0, 0, 64, 48}, nil},
+		{"max width", Options{MaxWidth: 16}, 16, 12, window{0, 0, 64, 48}, nil},
+		{"max both", Options{Width: 128, MaxWidth: 100, MaxHeight: 24}, 32, 24, window{0, 0, 64, 48}, nil},
+		{"max larger", Options{MaxWidth: 100, MaxHeight: 100}, 64, 48, window{0, 0, 64, 48}, nil},
+		{"pixel limit", Options{Scale: 200, Limits: Limits{MaxPixels: 128*96 - 1}}, 0, 0, window{}, ErrLimitExceeded},
+	} {
+		w, h, win, err := outputSize(64, 48, tc.opts)
+		if tc.kind != nil {
+			if !errors.Is(err, tc.kind) {
+				t.Errorf("%s: got %v, want %v", tc.name, err, tc.kind)
+			}
+			continue
+		}
+		if err != nil || w != tc.w || h != tc.h || win != tc.win {
+			t.Errorf("%s: got %dx%d of %+v, %v, want %dx%d of %+v", tc.name, w, h, win, err, tc.w, tc.h, tc.win)
+		}
+	}
+
+	if _, _, _, err := outputSize(maxDimension, 1, Options{Scale: 200}); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("got %v, want %v", err, ErrLimitExceeded)
+	}
+}
+
+func TestCropYCbCr(t *testing.T) {
+	src := image.NewYCbCr(image.Rect(0, 0, 8, 8), image.YCbCrSubsampleRatio420)
+	for i := range src.Cb {
+		src.Cb[i] = byte(i)
+	}
+	out := cropYCbCr(src, image.Rect(3, 2, 7, 6))
+	if out.Rect != image.Rect(0, 0, 4, 4) || len(out.Cb) != 4 {
+		t.Fatalf("got %v with %d chroma samples", out.Rect, len(out.Cb))
+	}
+	// the chroma of (3, 2) is the sample at (1, 1)
+	if got, want := out.Cb[out.COffset(0, 0)], src.Cb[src.COffset(3, 2)]; got != want {
+		t.Errorf("got chroma %d, want %d", got, want)
+	}
+}
+
+func TestParseCrop(t *testing.T) {
+	for s, want := range map[string]image.Rectangle{
+		"0,0,10,20":    image.Rect(0, 0, 10, 20),
+		" 4, 2, 8, 6 ": image.Rect(4, 2, 12, 8),
+	} {
+		if got, err := ParseCrop(s); err != nil || got != want {
+			t.Errorf("%q: got %v, %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "1,2,3", "1,2,3,4,5", "a,0,1,1", "-1,0,1,1", "0,0,0,1", "0,0,1,0"} {
+		if _, err := ParseCrop(s); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("%q: got %v, want %v", s, err, ErrInvalidOptions)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package convert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+
+	"github.com/dcarbone/go-heicker/heif"
+	"github.com/dcarbone/go-heicker/libde265"
+)
+
+// decodableSampleEntries are the sample entry types frameDecoder supports
+var decodableSampleEntries = map[string]bool{
+	"hvc1": true,
+	"hev1": true,
+}
+
+// frameDecoder decodes the frames of an image sequence track in presentation order
+type frameDecoder struct {
+	track   *heif.Track
+	dec     *libde265.Decoder
+	next    int // the next sample to push
+	flushed bool
+}
+
+// newFrameDecoder returns a decoder starting at sample start, which must be a sync sample
+func newFrameDecoder(t *heif.Track, start int, opts Options) (*frameDecoder, error) {
+	if opts.Thumbnail == ThumbnailEmbedded {
+		return nil, newError(ErrImageNotFound, errors.New("image sequences have no embedded thumbnails"))
+	}
+	if err := checkPixels(t.Width, t.Height, opts); err != nil {
+		return nil, err
+	}
+	if !decodableSampleEntries[t.Codec()] {
+		return nil, newError(ErrUnsupportedCodec, fmt.Errorf("track sample entry %q", t.Codec()))
+	}
+	hvcc, ok := t.HevcConfig()
+	if !ok {
+		return nil, errors.New("track has no hvcC")
+	}
+
+	dec, err := libde265.NewDecoder(libde265.WithSafeEncoding(true))
+	if err != nil {
+		return nil, err
+	}
+	if err := dec.Push(hvcc.AsHeader()); err != nil {
+		dec.Free()
+		return nil, err
+	}
+	return &frameDecoder{track: t, dec: dec, next: start}, nil
+}
+
+// frame returns the next frame, or io.EOF after the last
+func (fd *frameDecoder) frame(ctx context.Context) (*image.YCbCr, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		img, err := fd.dec.NextImage()
+		switch {
+		case err == nil:
+			ycc, err := toYCbCr(img)
+			if err != nil {
+				return nil, err
+			}
+			// decoded frames are padded to a multiple of the coding block size
+			if b := ycc.Rect; fd.track.Width > 0 && fd.track.Height > 0 && fd.track.Width <= b.Dx() && fd.track.Height <= b.Dy() {
+				ycc.Rect = image.Rect(0, 0, fd.track.Width, fd.track.Height)
+			}
+			return ycc, nil
+		case err == io.EOF:
+			return nil, io.EOF
+		case err != libde265.ErrNeedData:
+			return nil, err
+		case fd.next < len(fd.track.Samples):
+			data, err := fd.track.SampleData(fd.next)
+			if err != nil {
+				return nil, err
+			}
+			if err := fd.dec.PushFrame(data); err != nil {
+				return nil, err
+			}
+			fd.next++
+		case !fd.flushed:
+			if err := fd.dec.Flush(); err != nil {
+				return nil, err
+			}
+			fd.flushed = true
+		default:
+			return nil, errors.New("decoder stalled at the end of the track")
+		}
+	}
+}
+
+func (fd *frameDecoder) free() {
+	fd.dec.Free()
+}
+
+// findTrack returns the track of hf with the provided ID
+func findTrack(hf *heif.File, id uint32) (*heif.Track, error) {
+	tracks, err := hf.Tracks()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tracks {
+		if t.ID == id {
+			return t, nil
+		}
+	}
+	return nil, newError(ErrImageNotFound, fmt.Errorf("no image sequence track with ID %d", id))
+}
+
+// syncSample returns the last sync sample of t at or before sample i, where decoding must start to reach it
+func syncSample(t *heif.Track, i int) int {
+	for ; i > 0; i-- {
+		if t.Samples[i].Sync {
+			return i
+		}
+	}
+	return 0
+}
+
+// decodeFrame decodes frame opts.Frame, numbered from 1, of the track with the provided ID.  Decoding starts from the
+// last sync sample before it.
+func decodeFrame(ctx context.Context, hf *heif.File, id uint32, opts Options) (*decodedImage, error) {
+	t, err := findTrack(hf, id)
+	if err != nil {
+		return nil, err
+	}
+
+	n := opts.Frame
+	if n == 0 {
+		n = 1
+	}
+	if n > len(t.Samples) {
+		return nil, newError(ErrImageNotFound, fmt.Errorf("frame %d requested, track %d has %d", n, id, len(t.Samples)))
+	}
+
+	start := syncSample(t, n-1)
+	fd, err := newFrameDecoder(t, start, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.free()
+
+	for i := start; ; i++ {
+		ycc, err := fd.frame(ctx)
+		if err == io.EOF {
+			return nil, fmt.Errorf("track %d ended before frame %d", id, n)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if i == n-1 {
+			return &decodedImage{ycc: ycc, track: id, frame: n}, nil
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package convert
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/dcarbone/go-heicker/heif"
+	"github.com/dcarbone/go-heicker/heif/bmff"
+)
+
+// hevcTiles returns the hvcC box shared by the tiles of the testdata file named name, written by libheif, and the
+// data of each tile.  Those of hevc.heic each code one image.
+func hevcTiles(t testing.TB, name string) ([]byte, [][]byte) {
+	data := readTestdata(t, name)
+	i := bytes.Index(data, []byte("hvcC"))
+	if i < 4 {
+		t.Fatalf("%s has no hvcC", name)
+	}
+	hvcC := data[i-4 : i-4+int(binary.BigEndian.Uint32(data[i-4:]))]
+
+	hf := heif.Open(bytes.NewReader(data))
+	items, err := hf.Items()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var samples [][]byte
+	for _, it := range items {
+		if it.Info.ItemType == "hvc1" {
+			b, err := hf.GetItemData(it)
+			if err != nil {
+				t.Fatal(err)
+			}
+			samples = append(samples, b)
+		}
+	}
+	return hvcC, samples
+}
+
+// sequenceFile returns an msf1 file holding only a 64x48 image sequence track with ID 1, whose samples each last
+// delta hundredths of a second
+func sequenceFile(hvcC []byte, samples [][]byte, delta uint32) []byte {
+	ftyp := testBox("ftyp", []byte("msf1\x00\x00\x00\x00msf1iso8"))
+	moov := func(offset uint32) []byte {
+		sizes := be(uint32(0), uint32(len(samples)))
+		for _, s := range samples {
+			sizes = append(sizes, be(uint32(len(s)))...)
+		}
+		entry := testBox("hvc1", make([]byte, 6), be(uint16(1)), make([]byte, 16), be(uint16(64), uint16(48)),
+			make([]byte, 4+4+4+2+32+2+2), hvcC)
+		stbl := testBox("stbl",
+			testFullBox("stsd", be(uint32(1)), entry),
+			testFullBox("stts", be(uint32(1), uint32(len(samples)), delta)),
+			testFullBox("stsz", sizes),
+			testFullBox("stsc", be(uint32(1), uint32(1), uint32(len(samples)), uint32(1))),
+			testFullBox("stco", be(uint32(1), offset)))
+		tkhd := testBox("tkhd", be(uint32(3)), make([]byte, 8), be(uint32(1)), make([]byte, 4+4+8+2+2+2+2+36),
+			be(uint32(64<<16), uint32(48<<16)))
+		mdhd := testFullBox("mdhd", make([]byte, 8), be(uint32(100), delta*uint32(len(samples))), make([]byte, 4))
+		hdlr := testFullBox("hdlr", []byte("\x00\x00\x00\x00pict"), make([]byte, 12+1))
+		return testBox("moov", testBox("trak", tkhd, testBox("mdia", mdhd, hdlr, testBox("minf", stbl))))
+	}
+
+	// the samples are a single chunk in the mdat following the moov
+	offset := len(ftyp) + len(moov(0)) + 8
+	out := append(ftyp, moov(uint32(offset))...)
+	return append(out, testBox("mdat", bytes.Join(samples, nil))...)
+}
+
+func TestConvertSequence(t *testing.T) {
+	hevc := readTestdata(t, "hevc.heic")
+	hvcC, samples := hevcTiles(t, "hevc.heic")
+	seq := sequenceFile(hvcC, samples, 20)
+
+	info, err := Probe(bytes.NewReader(seq))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Tracks) != 1 || info.Tracks[0] != (TrackInfo{ID: 1, Codec: "hvc1", Width: 64, Height: 48, Frames: 3, Duration: 0.6}) {
+		t.Errorf("got tracks %+v", info.Tracks)
+	}
+	if info.Codec != "hvc1" || info.Width != 64 || info.Height != 48 || info.Images != 0 || info.ChromaFormat != "4:2:0" {
+		t.Errorf("got %+v", info)
+	}
+
+	// each frame is the image coded by the same sample in hevc.heic
+	for _, tc := range []struct {
+		opts Options
+		want Result
+	}{
+		{Options{}, Result{Width: 64, Height: 48, Track: 1, Frame: 1}},
+		{Options{Track: 1}, Result{Width: 64, Height: 48, Track: 1, Frame: 1}},
+		{Options{Track: 1, Frame: 3}, Result{Width: 64, Height: 48, Track: 1, Frame: 3}},
+	} {
+		var buf bytes.Buffer
+		res, err := Convert(context.Background(), bytes.NewReader(seq), &buf, tc.opts)
+		tc.want.Format = FormatJPEG
+		if err != nil || res != tc.want {
+			t.Fatalf("%+v: got %+v, %v, want %+v", tc.opts, res, err, tc.want)
+		}
+		var img bytes.Buffer
+		if _, err := Convert(context.Background(), bytes.NewReader(hevc), &img, Options{Index: res.Frame}); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), img.Bytes()) {
+			t.Errorf("%+v: frame %d differs from image %d", tc.opts, res.Frame, res.Frame)
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		opts Options
+		kind error
+	}{
+		{"no frame", Options{Track: 1, Frame: 4}, ErrImageNotFound},
+		{"no track", Options{Track: 2}, ErrImageNotFound},
+		{"no item", Options{Item: 1}, ErrImageNotFound},
+		{"embedded thumbnail", Options{Thumbnail: ThumbnailEmbedded}, ErrImageNotFound},
+		{"pixel limit", Options{Limits: Limits{MaxPixels: 64*48 - 1}}, ErrLimitExceeded},
+		{"sample limit", Options{Limits: Limits{Parse: bmff.Limits{MaxSamples: 2}}}, ErrLimitExceeded},
+	} {
+		if _, err := Convert(context.Background(), bytes.NewReader(seq), ioutil.Discard, tc.opts); !errors.Is(err, tc.kind) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.kind)
+		}
+	}
+
+	var buf bytes.Buffer
+	results, err := ConvertAll(context.Background(), bytes.NewReader(seq), &buf, Options{Format: FormatPNG})
+	if err != nil || len(results) != 3 || results[2].Frame != 3 {
+		t.Fatalf("got %+v, %v", results, err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"track-1/frame-1.png", "track-1/frame-2.png", "track-1/frame-3.png"} {
+		if i >= len(zr.File) || zr.File[i].Name != name {
+			t.Errorf("entry %d is not %s", i, name)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package convert
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Skip Writer for exif writing
+type writerSkipper struct {
+	w           io.Writer
+	bytesToSkip int
+}
+
+func (w *writerSkipper) Write(data []byte) (int, error) {
+	if w.bytesToSkip <= 0 {
+		return w.w.Write(data)
+	}
+
+	if dataLen := len(data); dataLen < w.bytesToSkip {
+		w.bytesToSkip -= dataLen
+		return dataLen, nil
+	}
+
+	if n, err := w.w.Write(data[w.bytesToSkip:]); err == nil {
+		n += w.bytesToSkip
+		w.bytesToSkip = 0
+		return n, nil
+	} else {
+		return n, err
+	}
+}
+
+// newWriterAPP1 writes the jpeg SOI marker followed by an APP1 segment for each payload, returning a writer that
+// skips the SOI marker written by the encoder
+func newWriterAPP1(w io.Writer, payloads ...[]byte) (io.Writer, error) {
+	var segments [][]byte
+	for _, p := range payloads {
+		if len(p) > 0 {
+			segments = append(segments, p)
+		}
+	}
+	if len(segments) == 0 {
+		return w, nil
+	}
+
+	writer := &writerSkipper{w, 2}
+	soi := []byte{0xff, 0xd8}
+	if _, err := w.Write(soi); err != nil {
+		return nil, err
+	}
+
+	app1Marker := 0xe1
+	for _, seg := range segments {
+		if len(seg) > jpegMaxSegment {
+			return nil, fmt.Errorf("APP1 segment of %d bytes exceeds %d", len(seg), jpegMaxSegment)
+		}
+		markerlen := 2 + len(seg)
+		marker := []byte{0xff, uint8(app1Marker), uint8(markerlen >> 8), uint8(markerlen & 0xff)}
+		if _, err := w.Write(marker); err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(seg); err != nil {
+			return nil, err
+		}
+	}
+
+	return writer, nil
+}
+
+// pngHeaderLen is the length of the png signature and IHDR chunk, which must come first
+const pngHeaderLen = 8 + 12 + 13
+
+// Insert Writer for png chunks, writing insert once offset bytes have been written
+type writerInserter struct {
+	w      io.Writer
+	offset int
+	insert []byte
+}
+
+func (w *writerInserter) Write(data []byte) (int, error) {
+	if w.insert == nil || len(data) < w.offset {
+		w.offset -= len(data)
+		return w.w.Write(data)
+	}
+
+	n, err := w.w.Write(data[:w.offset])
+	if err != nil {
+		return n, err
+	}
+	if _, err := w.w.Write(w.insert); err != nil {
+		return n, err
+	}
+	w.insert = nil
+	m, err := w.w.Write(data[w.offset:])
+	return n + m, err
+}
+
+// newWriterPNGChunk returns a writer inserting a chunk of type typ after the IHDR chunk written by the encoder
+func newWriterPNGChunk(w io.Writer, typ string, data []byte) io.Writer {
+	if len(data) == 0 {
+		return w
+	}
+
+	chunk := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	copy(chunk[4:], typ)
+	chunk = append(chunk, data...)
+	chunk = append(chunk, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(chunk[len(chunk)-4:], crc32.ChecksumIEEE(chunk[4:len(chunk)-4]))
+
+	return &writerInserter{w: w, offset: pngHeaderLen, insert: chunk}
+}
@@ -0,0 +1,83 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestWriterSkipper(t *testing.T) {
+	for _, chunks := range [][]string{
+		{"abcdef"},
+		{"a", "bcdef"},
+		{"ab", "cdef"},
+		{"a", "b", "", "c", "def"},
+	} {
+		var buf bytes.Buffer
+		w := &writerSkipper{w: &buf, bytesToSkip: 2}
+		for _, c := range chunks {
+			n, err := w.Write([]byte(c))
+			if err != nil || n != len(c) {
+				t.Fatalf("%q: wrote %d of %q, %v", chunks, n, c, err)
+			}
+		}
+		if buf.String() != "cdef" {
+			t.Errorf("%q: got %q, want %q", chunks, buf.String(), "cdef")
+		}
+	}
+}
+
+func TestWriterAPP1(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := newWriterAPP1(&buf, []byte("Exif\x00\x00first"), nil, []byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := image.NewGray(image.Rect(0, 0, 8, 8))
+	if err := jpeg.Encode(w, img, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	data := buf.Bytes()
+	want := []byte("\xff\xd8\xff\xe1\x00\x0dExif\x00\x00first\xff\xe1\x00\x08second\xff")
+	if !bytes.HasPrefix(data, want) {
+		t.Errorf("output starts %q, want %q", data[:len(want)], want)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(data)); err != nil {
+		t.Errorf("decoding output: %v", err)
+	}
+
+	// without payloads nothing is written and the writer is returned as is
+	buf.Reset()
+	if w, err := newWriterAPP1(&buf, nil); err != nil || w != &buf || buf.Len() != 0 {
+		t.Errorf("got %T, %v and %d bytes written", w, err, buf.Len())
+	}
+	if _, err := newWriterAPP1(&buf, make([]byte, jpegMaxSegment+1)); err == nil {
+		t.Error("wrote an APP1 segment exceeding the maximum size")
+	}
+}
+
+func TestWriterPNGChunk(t *testing.T) {
+	var buf bytes.Buffer
+	w := newWriterPNGChunk(&buf, "tEXt", []byte("Comment\x00heicker"))
+	if err := png.Encode(w, image.NewGray(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+
+	data := buf.Bytes()
+	chunk := data[pngHeaderLen:]
+	n := binary.BigEndian.Uint32(chunk)
+	if string(chunk[4:8]) != "tEXt" || string(chunk[8:8+n]) != "Comment\x00heicker" {
+		t.Fatalf("no tEXt chunk after the IHDR chunk, got %q", chunk[:16])
+	}
+	if crc := binary.BigEndian.Uint32(chunk[8+n:]); crc != crc32.ChecksumIEEE(chunk[4:8+n]) {
+		t.Errorf("chunk CRC is %08x, want %08x", crc, crc32.ChecksumIEEE(chunk[4:8+n]))
+	}
+	if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+		t.Errorf("decoding output: %v", err)
+	}
+}
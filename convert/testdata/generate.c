@@ -0,0 +1,118 @@
+/*
+ * generate.c writes the coded fixtures of the convert tests, which cannot be produced in Go: hevc.heic, holding the
+ * frames of testFrame as three HEVC images, ramp.heic, holding testRamp as a monochrome HEVC image, and av1.avif,
+ * holding frame 0 as an AV1 image.  It declares the parts of the libheif 1.x API it uses, so only the shared library
+ * is needed, built with x265 and aom:
+ *
+ *	cc -o /tmp/generate generate.c -l:libheif.so.1 && /tmp/generate
+ *
+ * run from this directory.
+ */
+#include <stdint.h>
+#include <stdio.h>
+
+struct heif_error {
+	int code;
+	int subcode;
+	const char *message;
+};
+
+struct heif_context;
+struct heif_encoder;
+struct heif_image;
+struct heif_image_handle;
+
+enum { compression_HEVC = 1, compression_AV1 = 4 };
+enum { colorspace_RGB = 1, colorspace_monochrome = 2 };
+enum { chroma_monochrome = 0, chroma_interleaved_RGB = 10 };
+enum { channel_Y = 0, channel_interleaved = 10 };
+
+struct heif_context *heif_context_alloc(void);
+void heif_context_free(struct heif_context *);
+struct heif_error heif_context_get_encoder_for_format(struct heif_context *, int, struct heif_encoder **);
+void heif_encoder_release(struct heif_encoder *);
+struct heif_error heif_encoder_set_lossy_quality(struct heif_encoder *, int);
+struct heif_error heif_image_create(int, int, int, int, struct heif_image **);
+void heif_image_release(const struct heif_image *);
+struct heif_error heif_image_add_plane(struct heif_image *, int, int, int, int);
+uint8_t *heif_image_get_plane(struct heif_image *, int, int *);
+struct heif_error heif_context_encode_image(struct heif_context *, const struct heif_image *, struct heif_encoder *,
+					    const void *, struct heif_image_handle **);
+void heif_image_handle_release(const struct heif_image_handle *);
+struct heif_error heif_context_write_to_file(struct heif_context *, const char *);
+
+/* the size of testImage in fixtures_test.go */
+#define WIDTH 64
+#define HEIGHT 48
+
+static int check(struct heif_error err, const char *what)
+{
+	if (err.code != 0) {
+		fprintf(stderr, "%s: %s\n", what, err.message);
+		return 1;
+	}
+	return 0;
+}
+
+/* frame returns testFrame(k) of fixtures_test.go */
+static struct heif_image *frame(int k)
+{
+	struct heif_image *img;
+	int stride;
+	if (check(heif_image_create(WIDTH, HEIGHT, colorspace_RGB, chroma_interleaved_RGB, &img), "creating image") ||
+	    check(heif_image_add_plane(img, channel_interleaved, WIDTH, HEIGHT, 8), "adding plane"))
+		return NULL;
+	uint8_t *p = heif_image_get_plane(img, channel_interleaved, &stride);
+	for (int y = 0; y < HEIGHT; y++) {
+		for (int x = 0; x < WIDTH; x++) {
+			uint8_t *px = p + y * stride + x * 3;
+			px[0] = x * 255 / (WIDTH - 1);
+			px[1] = y * 255 / (HEIGHT - 1);
+			px[2] = ((x + 8 * k) / 8 + y / 8) % 2 == 0 ? 0xff : 0;
+		}
+	}
+	return img;
+}
+
+/* ramp returns testRamp of fixtures_test.go */
+static struct heif_image *ramp(int k)
+{
+	struct heif_image *img;
+	int stride;
+	if (check(heif_image_create(WIDTH, HEIGHT, colorspace_monochrome, chroma_monochrome, &img), "creating image") ||
+	    check(heif_image_add_plane(img, channel_Y, WIDTH, HEIGHT, 8), "adding plane"))
+		return NULL;
+	uint8_t *p = heif_image_get_plane(img, channel_Y, &stride);
+	for (int y = 0; y < HEIGHT; y++)
+		for (int x = 0; x < WIDTH; x++)
+			p[y * stride + x] = x * 255 / (WIDTH - 1);
+	return img;
+}
+
+/* write writes n images, image(0) to image(n-1), to path */
+static int write(const char *path, int compression, struct heif_image *(*image)(int), int n)
+{
+	struct heif_context *ctx = heif_context_alloc();
+	struct heif_encoder *enc;
+	if (check(heif_context_get_encoder_for_format(ctx, compression, &enc), "getting encoder") ||
+	    check(heif_encoder_set_lossy_quality(enc, 95), "setting quality"))
+		return 1;
+	for (int k = 0; k < n; k++) {
+		struct heif_image *img = image(k);
+		struct heif_image_handle *h;
+		if (img == NULL || check(heif_context_encode_image(ctx, img, enc, NULL, &h), "encoding"))
+			return 1;
+		heif_image_handle_release(h);
+		heif_image_release(img);
+	}
+	heif_encoder_release(enc);
+	int err = check(heif_context_write_to_file(ctx, path), path);
+	heif_context_free(ctx);
+	return err;
+}
+
+int main(void)
+{
+	return write("hevc.heic", compression_HEVC, frame, 3) || write("ramp.heic", compression_HEVC, ramp, 1) ||
+	       write("av1.avif", compression_AV1, frame, 1);
+}
@@ -0,0 +1,89 @@
+package convert
+
+import (
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/dcarbone/go-heicker/heif"
+)
+
+// thumbnails returns the decodable thumbnails of the item with the provided id, smallest first
+func thumbnails(hf *heif.File, id uint32) ([]*heif.Item, error) {
+	items, err := hf.Items()
+	if err != nil {
+		return nil, err
+	}
+	var out []*heif.Item
+	for _, it := range items {
+		if _, _, ok := it.SpatialExtents(); ok && decodableItemTypes[it.Info.ItemType] && referencesItem(it, "thmb", id) {
+			out = append(out, it)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		iw, ih, _ := out[i].SpatialExtents()
+		jw, jh, _ := out[j].SpatialExtents()
+		return iw*ih < jw*jh
+	})
+	return out, nil
+}
+
+// selectItem returns the item to convert for the image primary according to opts.Thumbnail, and whether it is an
+// embedded thumbnail
+func selectItem(hf *heif.File, primary *heif.Item, opts Options) (*heif.Item, bool, error) {
+	if opts.Thumbnail != ThumbnailEmbedded && opts.Thumbnail != ThumbnailAuto {
+		return primary, false, nil
+	}
+
+	thumbs, err := thumbnails(hf, primary.ID)
+	if err != nil {
+		return nil, false, heifError(err)
+	}
+	if opts.Thumbnail == ThumbnailEmbedded {
+		if len(thumbs) == 0 {
+			return nil, false, newError(ErrImageNotFound, errors.New("image has no embedded thumbnail"))
+		}
+		return thumbs[len(thumbs)-1], true, nil
+	}
+
+	pw, ph, ok := primary.SpatialExtents()
+	if !ok || !opts.Crop.Empty() {
+		// crop rectangles are in pixels of the primary image
+		return primary, false, nil
+	}
+	scale := requiredScale(primary, pw, ph, opts)
+	for _, t := range thumbs {
+		// allow for rounding by the encoder when the thumbnail was scaled
+		tw, th, _ := t.SpatialExtents()
+		if float64(tw) >= scale*float64(pw)-1 && float64(th) >= scale*float64(ph)-1 {
+			return t, true, nil
+		}
+	}
+	return primary, false, nil
+}
+
+// requiredScale returns the fraction of the resolution of a pw x ph primary image needed to produce the output size
+// of opts without upscaling
+func requiredScale(primary *heif.Item, pw, ph int, opts Options) float64 {
+	if quarterTurn(primary, opts.Rotation) {
+		pw, ph = ph, pw
+	}
+	w, h, win, err := outputSize(pw, ph, opts)
+	if err != nil {
+		// an embedded thumbnail cannot help
+		return math.Inf(1)
+	}
+	return math.Max(float64(w)/win.w, float64(h)/win.h)
+}
+
+// quarterTurn returns true if r swaps the width and height of it
+func quarterTurn(it *heif.Item, r Rotation) bool {
+	switch r {
+	case Rotate90, Rotate270:
+		return true
+	case RotateAuto:
+		return it != nil && it.Rotations()%2 == 1
+	default:
+		return false
+	}
+}
@@ -0,0 +1,174 @@
+package convert
+
+import (
+	"image"
+
+	"github.com/dcarbone/go-heicker/heif"
+	"github.com/dcarbone/go-heicker/heif/bmff"
+)
+
+// chromaSize returns the dimensions of the Cb and Cr planes of an image with luma dimensions w x h
+func chromaSize(w, h int, ratio image.YCbCrSubsampleRatio) (cw, ch int) {
+	switch ratio {
+	case image.YCbCrSubsampleRatio420:
+		return (w + 1) / 2, (h + 1) / 2
+	case image.YCbCrSubsampleRatio422:
+		return (w + 1) / 2, h
+	case image.YCbCrSubsampleRatio440:
+		return w, (h + 1) / 2
+	default:
+		return w, h
+	}
+}
+
+// plane is a single channel of an image
+type plane struct {
+	pix    []byte
+	stride int
+	w, h   int
+}
+
+func (p plane) at(x, y int) byte {
+	return p.pix[y*p.stride+x]
+}
+
+// transform returns a new plane where each pixel is read from src via fn, which maps destination to source
+// coordinates
+func (p plane) transform(w, h int, fn func(x, y int) (int, int)) plane {
+	out := plane{pix: make([]byte, w*h), stride: w, w: w, h: h}
+	for y := 0; y < h; y++ {
+		row := out.pix[y*w : (y+1)*w]
+		for x := range row {
+			row[x] = p.at(fn(x, y))
+		}
+	}
+	return out
+}
+
+// rotateCW rotates the plane clockwise by 90 degrees, turns times
+func (p plane) rotateCW(turns int) plane {
+	switch turns % 4 {
+	case 1:
+		return p.transform(p.h, p.w, func(x, y int) (int, int) { return y, p.h - 1 - x })
+	case 2:
+		return p.transform(p.w, p.h, func(x, y int) (int, int) { return p.w - 1 - x, p.h - 1 - y })
+	case 3:
+		return p.transform(p.h, p.w, func(x, y int) (int, int) { return p.w - 1 - y, x })
+	default:
+		return p
+	}
+}
+
+// flip mirrors the plane left to right when horizontal is true, otherwise top to bottom
+func (p plane) flip(horizontal bool) plane {
+	if horizontal {
+		return p.transform(p.w, p.h, func(x, y int) (int, int) { return p.w - 1 - x, y })
+	}
+	return p.transform(p.w, p.h, func(x, y int) (int, int) { return x, p.h - 1 - y })
+}
+
+// ycbcrPlanes splits an image into its three planes, limited to its bounds.  The image must not be offset.
+func ycbcrPlanes(img *image.YCbCr) [3]plane {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	cw, ch := chromaSize(w, h, img.SubsampleRatio)
+	return [3]plane{
+		{pix: img.Y, stride: img.YStride, w: w, h: h},
+		{pix: img.Cb, stride: img.CStride, w: cw, h: ch},
+		{pix: img.Cr, stride: img.CStride, w: cw, h: ch},
+	}
+}
+
+func fromPlanes(p [3]plane, ratio image.YCbCrSubsampleRatio) *image.YCbCr {
+	return &image.YCbCr{
+		Y:              p[0].pix,
+		Cb:             p[1].pix,
+		Cr:             p[2].pix,
+		YStride:        p[0].stride,
+		CStride:        p[1].stride,
+		SubsampleRatio: ratio,
+		Rect:           image.Rect(0, 0, p[0].w, p[0].h),
+	}
+}
+
+// rotateYCbCr rotates each plane independently.  Quarter turns swap horizontal and vertical chroma subsampling.
+func rotateYCbCr(img *image.YCbCr, turns int) *image.YCbCr {
+	if turns%4 == 0 {
+		return img
+	}
+	planes := ycbcrPlanes(img)
+	for i := range planes {
+		planes[i] = planes[i].rotateCW(turns)
+	}
+	ratio := img.SubsampleRatio
+	if turns%2 == 1 {
+		switch ratio {
+		case image.YCbCrSubsampleRatio422:
+			ratio = image.YCbCrSubsampleRatio440
+		case image.YCbCrSubsampleRatio440:
+			ratio = image.YCbCrSubsampleRatio422
+		}
+	}
+	return fromPlanes(planes, ratio)
+}
+
+func flipYCbCr(img *image.YCbCr, horizontal bool) *image.YCbCr {
+	planes := ycbcrPlanes(img)
+	for i := range planes {
+		planes[i] = planes[i].flip(horizontal)
+	}
+	return fromPlanes(planes, img.SubsampleRatio)
+}
+
+// orientStep is a single step of an orientation, either clockwise quarter turns or a flip
+type orientStep struct {
+	turns      int
+	flip       bool
+	horizontal bool // the flip is left to right
+}
+
+// orientSteps returns the steps applying the requested rotation to the image of it
+func orientSteps(it *heif.Item, r Rotation) []orientStep {
+	switch r {
+	case Rotate90:
+		return []orientStep{{turns: 1}}
+	case Rotate180:
+		return []orientStep{{turns: 2}}
+	case Rotate270:
+		return []orientStep{{turns: 3}}
+	case RotateAuto:
+		if it == nil {
+			// frames of image sequences have no transformative properties
+			return nil
+		}
+		// transformative properties are applied in the order they are associated with the item
+		var steps []orientStep
+		for _, p := range it.Properties {
+			switch p := p.(type) {
+			case *bmff.ImageRotation:
+				if p.Angle%4 != 0 {
+					// irot is counter-clockwise
+					steps = append(steps, orientStep{turns: 4 - int(p.Angle%4)})
+				}
+			case *bmff.ImageMirror:
+				// axis 0 is vertical, mirroring left to right
+				steps = append(steps, orientStep{flip: true, horizontal: p.Mirror == 0})
+			}
+		}
+		return steps
+	default:
+		return nil
+	}
+}
+
+// rotate applies the requested rotation, returning true if the pixels were changed
+func rotate(img *image.YCbCr, it *heif.Item, r Rotation) (*image.YCbCr, bool) {
+	steps := orientSteps(it, r)
+	for _, s := range steps {
+		if s.flip {
+			img = flipYCbCr(img, s.horizontal)
+		} else {
+			img = rotateYCbCr(img, s.turns)
+		}
+	}
+	return img, len(steps) > 0
+}
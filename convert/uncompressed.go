@@ -0,0 +1,205 @@
+package convert
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+
+	"github.com/dcarbone/go-heicker/heif"
+	"github.com/dcarbone/go-heicker/heif/bmff"
+)
+
+// uncComponent is a component of an unci item and the layout of its samples
+type uncComponent struct {
+	typ   uint16
+	depth int
+	bytes int // per sample, 1 or 2
+}
+
+// uncProfiles are the components implied by the profile of a version 1 uncC property, 8 bit and pixel interleaved
+var uncProfiles = map[string][]uint16{
+	"rgb3": {bmff.ComponentRed, bmff.ComponentGreen, bmff.ComponentBlue},
+	"rgba": {bmff.ComponentRed, bmff.ComponentGreen, bmff.ComponentBlue, bmff.ComponentAlpha},
+	"abgr": {bmff.ComponentAlpha, bmff.ComponentBlue, bmff.ComponentGreen, bmff.ComponentRed},
+}
+
+// uncSubsampling maps the sampling types of uncC to the chroma subsampling of the decoded image
+var uncSubsampling = map[uint8]image.YCbCrSubsampleRatio{
+	0: image.YCbCrSubsampleRatio444,
+	1: image.YCbCrSubsampleRatio422,
+	2: image.YCbCrSubsampleRatio420,
+}
+
+// uncompressedLayout resolves the components of an unci item, checking that their layout is one decodeUncompressed
+// supports: a single tile of byte aligned 8 to 16 bit unsigned samples, pixel interleaved or planar, with chroma
+// subsampling only for planar YCbCr
+func uncompressedLayout(unc *bmff.UncompressedFrameConfigBox, cmpd *bmff.ComponentDefinitionBox) ([]uncComponent, error) {
+	if unc.Version == 1 {
+		types, ok := uncProfiles[unc.Profile]
+		if !ok {
+			return nil, fmt.Errorf("uncC profile %q", unc.Profile)
+		}
+		comps := make([]uncComponent, len(types))
+		for i, t := range types {
+			comps[i] = uncComponent{typ: t, depth: 8, bytes: 1}
+		}
+		return comps, nil
+	}
+
+	switch {
+	case cmpd == nil:
+		return nil, errors.New("unci item has no cmpd property")
+	case unc.TileColumns != 1 || unc.TileRows != 1:
+		return nil, fmt.Errorf("unci item of %dx%d tiles", unc.TileColumns, unc.TileRows)
+	case unc.BlockSize != 0:
+		return nil, errors.New("unci item with blocks")
+	case unc.InterleaveType > 1:
+		return nil, fmt.Errorf("unci interleave type %d", unc.InterleaveType)
+	case unc.InterleaveType == 1 && unc.SamplingType != 0:
+		return nil, errors.New("pixel interleaved unci item with chroma subsampling")
+	}
+	if _, ok := uncSubsampling[unc.SamplingType]; !ok {
+		return nil, fmt.Errorf("unci sampling type %d", unc.SamplingType)
+	}
+
+	comps := make([]uncComponent, len(unc.Components))
+	for i, c := range unc.Components {
+		if int(c.Index) >= len(cmpd.Types) {
+			return nil, fmt.Errorf("unci component %d is not defined by cmpd", c.Index)
+		}
+		if c.Format != 0 {
+			return nil, fmt.Errorf("unci component format %d", c.Format)
+		}
+		comp := uncComponent{typ: cmpd.Types[c.Index], depth: int(c.BitDepth)}
+		switch {
+		case c.BitDepth == 8 && (c.AlignSize == 0 || c.AlignSize == 1):
+			comp.bytes = 1
+		case c.BitDepth > 8 && c.BitDepth <= 16 && (c.AlignSize == 2 || c.BitDepth == 16 && c.AlignSize == 0):
+			comp.bytes = 2
+		default:
+			return nil, fmt.Errorf("unci component of %d bits aligned to %d bytes", c.BitDepth, c.AlignSize)
+		}
+		comps[i] = comp
+	}
+	return comps, nil
+}
+
+// decodeUncompressed decodes an unci item of RGB, YCbCr or monochrome samples, see ISO/IEC 23001-17.  Samples of more
+// than 8 bits are reduced to 8 and alpha is ignored.
+func decodeUncompressed(hf *heif.File, it *heif.Item) (*image.YCbCr, error) {
+	unc, cmpd, ok := it.UncompressedConfig()
+	if !ok {
+		return nil, errors.New("unci item has no uncC property")
+	}
+	width, height, ok := it.SpatialExtents()
+	if !ok || width == 0 || height == 0 {
+		return nil, errors.New("item has no dimensions")
+	}
+	comps, err := uncompressedLayout(unc, cmpd)
+	if err != nil {
+		return nil, newError(ErrUnsupportedCodec, err)
+	}
+	data, err := hf.GetItemData(it)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		ratio  = uncSubsampling[unc.SamplingType]
+		cw, ch = chromaSize(width, height, ratio)
+		planes = make(map[uint16]plane)
+	)
+	sample := func(off, bytes, depth int) byte {
+		if bytes == 1 {
+			return data[off]
+		}
+		var v int
+		if unc.ComponentsLittleEndian {
+			v = int(data[off]) | int(data[off+1])<<8
+		} else {
+			v = int(data[off])<<8 | int(data[off+1])
+		}
+		return byte(v >> uint(depth-8))
+	}
+	aligned := func(n int) int {
+		if a := int(unc.RowAlignSize); a > 1 && n%a != 0 {
+			n += a - n%a
+		}
+		return n
+	}
+
+	// the profiles of version 1 properties are pixel interleaved
+	if unc.InterleaveType == 1 || unc.Version == 1 {
+		pixelSize := 0
+		for _, c := range comps {
+			pixelSize += c.bytes
+		}
+		if int(unc.PixelSize) > pixelSize {
+			pixelSize = int(unc.PixelSize)
+		}
+		stride := aligned(width * pixelSize)
+		if len(data) < stride*(height-1)+width*pixelSize {
+			return nil, fmt.Errorf("unci data of %d bytes is too short for a %dx%d image", len(data), width, height)
+		}
+		off := 0
+		for _, c := range comps {
+			p := plane{pix: make([]byte, width*height), stride: width, w: width, h: height}
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					p.pix[y*width+x] = sample(y*stride+x*pixelSize+off, c.bytes, c.depth)
+				}
+			}
+			if _, ok := planes[c.typ]; !ok {
+				planes[c.typ] = p
+			}
+			off += c.bytes
+		}
+	} else {
+		off := 0
+		for _, c := range comps {
+			w, h := width, height
+			if c.typ == bmff.ComponentCb || c.typ == bmff.ComponentCr {
+				w, h = cw, ch
+			}
+			stride := aligned(w * c.bytes)
+			if len(data) < off+stride*(h-1)+w*c.bytes {
+				return nil, fmt.Errorf("unci data of %d bytes is too short for a %dx%d image", len(data), width, height)
+			}
+			p := plane{pix: make([]byte, w*h), stride: w, w: w, h: h}
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					p.pix[y*w+x] = sample(off+y*stride+x*c.bytes, c.bytes, c.depth)
+				}
+			}
+			if _, ok := planes[c.typ]; !ok {
+				planes[c.typ] = p
+			}
+			off += stride * h
+		}
+	}
+
+	r, rok := planes[bmff.ComponentRed]
+	g, gok := planes[bmff.ComponentGreen]
+	b, bok := planes[bmff.ComponentBlue]
+	if rok && gok && bok {
+		out := image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio444)
+		for i := range out.Y {
+			out.Y[i], out.Cb[i], out.Cr[i] = color.RGBToYCbCr(r.pix[i], g.pix[i], b.pix[i])
+		}
+		return out, nil
+	}
+
+	y, ok := planes[bmff.ComponentY]
+	if !ok {
+		if y, ok = planes[bmff.ComponentMonochrome]; !ok {
+			return nil, newError(ErrUnsupportedCodec, errors.New("unci item has neither RGB nor luma components"))
+		}
+	}
+	cb, cbok := planes[bmff.ComponentCb]
+	cr, crok := planes[bmff.ComponentCr]
+	if !cbok || !crok {
+		return toYCbCr(&image.Gray{Pix: y.pix, Stride: y.stride, Rect: image.Rect(0, 0, width, height)})
+	}
+	return fromPlanes([3]plane{y, cb, cr}, ratio), nil
+}
@@ -0,0 +1,190 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+	"testing"
+
+	"github.com/dcarbone/go-heicker/heif/bmff"
+)
+
+// uncC returns a version 0 uncC property of a single tile without blocks, each component given as its index in the
+// cmpd property, bit depth and alignment in bytes
+func uncC(sampling, interleave uint8, littleEndian bool, rowAlign uint32, comps ...[3]uint8) []byte {
+	b := be(uint32(0), uint32(len(comps)))
+	for _, c := range comps {
+		b = append(b, be(uint16(c[0]), c[1]-1, uint8(0), c[2])...)
+	}
+	flags := uint8(0)
+	if littleEndian {
+		flags = 0x80
+	}
+	b = append(b, be(sampling, interleave, uint8(0), flags, uint32(0), rowAlign, uint32(0), uint32(0), uint32(0))...)
+	return testFullBox("uncC", b)
+}
+
+// cmpd returns a cmpd property of components of types
+func cmpd(types ...uint16) []byte {
+	return testBox("cmpd", be(uint32(len(types)), types))
+}
+
+func TestConvertUncompressed(t *testing.T) {
+	// a 3x2 RGB image, its rows padded to 12 bytes
+	rgb := []color.RGBA{
+		{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255},
+		{255, 255, 255, 255}, {0, 0, 0, 255}, {200, 100, 50, 255},
+	}
+	var interleaved, profile []byte
+	for i, c := range rgb {
+		interleaved = append(interleaved, c.R, c.G, c.B)
+		profile = append(profile, c.R, c.G, c.B)
+		if i%3 == 2 {
+			interleaved = append(interleaved, 0, 0, 0)
+		}
+	}
+	rgbTypes := cmpd(bmff.ComponentRed, bmff.ComponentGreen, bmff.ComponentBlue)
+
+	// a 4x2 YCbCr 4:2:0 image, planar
+	planar := []byte{16, 50, 100, 235, 16, 50, 100, 235, 90, 240, 240, 110}
+	yccTypes := cmpd(bmff.ComponentY, bmff.ComponentCb, bmff.ComponentCr)
+
+	// a 2x1 12 bit monochrome image, little endian
+	mono := []byte{0xff, 0x0f, 0x00, 0x08}
+
+	for _, tc := range []struct {
+		name  string
+		item  testItem
+		bits  int
+		check func(img image.Image) bool
+	}{
+		{"interleaved rgb", testItem{typ: "unci", data: interleaved,
+			props: [][]byte{rgbTypes, uncC(0, 1, false, 12, [3]uint8{0, 8, 0}, [3]uint8{1, 8, 0}, [3]uint8{2, 8, 0}), ispe(3, 2)}}, 8,
+			func(img image.Image) bool {
+				for i, c := range rgb {
+					if !sameColor(img.At(i%3, i/3), c) {
+						return false
+					}
+				}
+				return true
+			}},
+		{"profile", testItem{typ: "unci", data: profile, props: [][]byte{testBox("uncC", be(uint32(1<<24)), []byte("rgb3")), ispe(3, 2)}}, 8,
+			func(img image.Image) bool { return sameColor(img.At(2, 1), rgb[5]) && sameColor(img.At(1, 0), rgb[1]) }},
+		{"planar 4:2:0", testItem{typ: "unci", data: planar,
+			props: [][]byte{yccTypes, uncC(2, 0, false, 0, [3]uint8{0, 8, 0}, [3]uint8{1, 8, 0}, [3]uint8{2, 8, 0}), ispe(4, 2)}}, 8,
+			func(img image.Image) bool {
+				r, g, b := color.YCbCrToRGB(235, 240, 110)
+				return sameColor(img.At(3, 1), color.RGBA{r, g, b, 255}) && sameColor(img.At(0, 0), color.YCbCr{16, 90, 240})
+			}},
+		{"12 bit monochrome", testItem{typ: "unci", data: mono,
+			props: [][]byte{cmpd(bmff.ComponentMonochrome), uncC(0, 0, true, 0, [3]uint8{0, 12, 2}), ispe(2, 1)}}, 12,
+			func(img image.Image) bool {
+				return sameColor(img.At(0, 0), color.Gray{255}) && sameColor(img.At(1, 0), color.Gray{128})
+			}},
+	} {
+		data := itemFile(t, 1, tc.item)
+		info, err := Probe(bytes.NewReader(data))
+		if err != nil || info.Codec != "unci" || info.BitDepth != tc.bits {
+			t.Errorf("%s: got %+v, %v", tc.name, info, err)
+		}
+		if _, img := convertPNG(t, data, Options{}); !tc.check(img) {
+			t.Errorf("%s: wrong colours", tc.name)
+		}
+	}
+
+	for _, tc := range []struct {
+		name  string
+		props [][]byte
+		kind  error
+	}{
+		{"no cmpd", [][]byte{uncC(0, 1, false, 0, [3]uint8{0, 8, 0})}, ErrUnsupportedCodec},
+		{"undefined component", [][]byte{rgbTypes, uncC(0, 1, false, 0, [3]uint8{3, 8, 0})}, ErrUnsupportedCodec},
+		{"interleaved 4:2:0", [][]byte{yccTypes, uncC(2, 1, false, 0, [3]uint8{0, 8, 0})}, ErrUnsupportedCodec},
+		{"row interleave", [][]byte{rgbTypes, uncC(0, 3, false, 0, [3]uint8{0, 8, 0})}, ErrUnsupportedCodec},
+		{"packed", [][]byte{rgbTypes, uncC(0, 1, false, 0, [3]uint8{0, 10, 0})}, ErrUnsupportedCodec},
+		{"profile", [][]byte{testBox("uncC", be(uint32(1<<24)), []byte("yuv2"))}, ErrUnsupportedCodec},
+		{"short", [][]byte{rgbTypes, uncC(0, 1, false, 0, [3]uint8{0, 8, 0}, [3]uint8{1, 8, 0}, [3]uint8{2, 8, 0})}, ErrDecodeFailed},
+	} {
+		data := itemFile(t, 1, testItem{typ: "unci", data: make([]byte, 16), props: append(tc.props, ispe(4, 4))})
+		if _, err := Convert(context.Background(), bytes.NewReader(data), ioutil.Discard, Options{}); !errors.Is(err, tc.kind) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.kind)
+		}
+	}
+}
+
+func TestConvertJPEGItems(t *testing.T) {
+	// a grid of two jpeg tiles sharing the header held by their jpgC properties
+	src := testNRGBA(64, 16, false)
+	var codestreams [][]byte
+	for _, r := range []image.Rectangle{image.Rect(0, 0, 32, 16), image.Rect(32, 0, 64, 16)} {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, src.SubImage(r), &jpeg.Options{Quality: 90}); err != nil {
+			t.Fatal(err)
+		}
+		codestreams = append(codestreams, buf.Bytes())
+	}
+	const header = 20
+	tile := func(b []byte) testItem {
+		return testItem{typ: "jpeg", data: b[header:], hidden: true, props: [][]byte{testBox("jpgC", b[:header]), ispe(32, 16)}}
+	}
+	data := itemFile(t, 3, tile(codestreams[0]), tile(codestreams[1]),
+		testItem{typ: "grid", data: be(uint16(0), uint8(0), uint8(1), uint16(60), uint16(16)), props: [][]byte{ispe(60, 16)},
+			refs: map[string][]uint16{"dimg": {1, 2}}})
+
+	info, err := Probe(bytes.NewReader(data))
+	if err != nil || info.Codec != "grid" || info.Grid == nil || info.Grid.Columns != 2 || info.Grid.TileWidth != 32 {
+		t.Fatalf("got %+v, %v", info, err)
+	}
+	res, img := convertPNG(t, data, Options{})
+	if res.Width != 60 || res.Height != 16 {
+		t.Fatalf("got %+v", res)
+	}
+	for i, b := range codestreams {
+		want, err := jpeg.Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range []image.Point{{0, 0}, {13, 7}, {27, 15}} {
+			if got := img.At(32*i+p.X, p.Y); !sameColor(got, want.At(p.X, p.Y)) {
+				t.Errorf("tile %d: got %v at %v, want %v", i, got, p, want.At(p.X, p.Y))
+			}
+		}
+	}
+	// tiles whose codestream differs in size from their item
+	for _, tc := range []struct {
+		name  string
+		props [][]byte
+	}{
+		{"smaller item", [][]byte{ispe(16, 16)}},
+		{"larger item", [][]byte{ispe(32, 32)}},
+		{"no ispe", nil},
+	} {
+		data := itemFile(t, 2, testItem{typ: "jpeg", data: codestreams[0], hidden: true, props: tc.props},
+			testItem{typ: "grid", data: be(uint16(0), uint8(0), uint8(0), uint16(16), uint16(16)), props: [][]byte{ispe(16, 16)},
+				refs: map[string][]uint16{"dimg": {1}}})
+		if _, err := Convert(context.Background(), bytes.NewReader(data), ioutil.Discard, Options{}); !errors.Is(err, ErrDecodeFailed) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, ErrDecodeFailed)
+		}
+	}
+
+	// a 4:2:0 jpeg tile followed by a 4:4:4 unci tile
+	var rgb []byte
+	for y := 0; y < 16; y++ {
+		for x := 32; x < 64; x++ {
+			c := src.NRGBAAt(x, y)
+			rgb = append(rgb, c.R, c.G, c.B)
+		}
+	}
+	mixed := itemFile(t, 3, tile(codestreams[0]),
+		testItem{typ: "unci", data: rgb, hidden: true, props: [][]byte{cmpd(bmff.ComponentRed, bmff.ComponentGreen, bmff.ComponentBlue),
+			uncC(0, 1, false, 0, [3]uint8{0, 8, 0}, [3]uint8{1, 8, 0}, [3]uint8{2, 8, 0}), ispe(32, 16)}},
+		testItem{typ: "grid", data: be(uint16(0), uint8(0), uint8(1), uint16(64), uint16(16)), props: [][]byte{ispe(64, 16)},
+			refs: map[string][]uint16{"dimg": {1, 2}}})
+	if _, err := Convert(context.Background(), bytes.NewReader(mixed), ioutil.Discard, Options{}); !errors.Is(err, ErrDecodeFailed) {
+		t.Errorf("mixed chroma: got %v, want %v", err, ErrDecodeFailed)
+	}
+}
@@ -0,0 +1,597 @@
+package convert
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"sort"
+	"time"
+)
+
+// A lossless WebP encoder, see https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification and
+// https://developers.google.com/speed/webp/docs/riff_container.  Images are coded with the subtract green and
+// predictor transforms and a single group of Huffman codes, without backward references or a color cache, trading size
+// for simplicity.
+
+// maxWebPDimension is the largest width or height of a lossless WebP image
+const maxWebPDimension = 1 << 14
+
+// vp8lBitWriter writes values least significant bit first
+type vp8lBitWriter struct {
+	buf  []byte
+	acc  uint64
+	nacc uint
+}
+
+// write writes the low n bits of v, n being at most 32
+func (w *vp8lBitWriter) write(v uint32, n uint) {
+	w.acc |= uint64(v) << w.nacc
+	w.nacc += n
+	for w.nacc >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.nacc -= 8
+	}
+}
+
+// bytes returns what has been written, padded to a whole byte
+func (w *vp8lBitWriter) bytes() []byte {
+	if w.nacc > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc, w.nacc = 0, 0
+	}
+	return w.buf
+}
+
+// huffmanCode is a canonical Huffman code.  Codes are stored bit reversed, as they are written least significant bit
+// first.  A code with a single symbol is written with no bits.
+type huffmanCode struct {
+	lengths []uint8
+	codes   []uint16
+	single  bool
+}
+
+// newHuffmanCode returns a code for the symbol counts of hist, with no code longer than maxLen bits
+func newHuffmanCode(hist []uint32, maxLen int) huffmanCode {
+	h := huffmanCode{lengths: huffmanLengths(hist, maxLen), codes: make([]uint16, len(hist))}
+
+	var (
+		count [16]int
+		next  [16]int
+		used  int
+	)
+	for _, l := range h.lengths {
+		if l > 0 {
+			count[l]++
+			used++
+		}
+	}
+	h.single = used <= 1
+	code := 0
+	for l := 1; l < len(count); l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	for s, l := range h.lengths {
+		if l == 0 {
+			continue
+		}
+		c := next[l]
+		next[l]++
+		var rev uint16
+		for i := uint8(0); i < l; i++ {
+			rev = rev<<1 | uint16(c>>i&1)
+		}
+		h.codes[s] = rev
+	}
+	return h
+}
+
+func (h huffmanCode) write(w *vp8lBitWriter, sym int) {
+	if !h.single {
+		w.write(uint32(h.codes[sym]), uint(h.lengths[sym]))
+	}
+}
+
+// huffmanLengths returns the code length of each symbol of hist, 0 for those not used.  When the optimal code is
+// longer than maxLen the counts are flattened until it fits.
+func huffmanLengths(hist []uint32, maxLen int) []uint8 {
+	lengths := make([]uint8, len(hist))
+	type node struct {
+		weight      uint64
+		left, right int // -1 for leaves
+		sym         int
+	}
+	var leaves []node
+	for s, n := range hist {
+		if n > 0 {
+			leaves = append(leaves, node{weight: uint64(n), left: -1, right: -1, sym: s})
+		}
+	}
+	switch len(leaves) {
+	case 0:
+		return lengths
+	case 1:
+		lengths[leaves[0].sym] = 1
+		return lengths
+	}
+
+	for min := uint64(1); ; min *= 2 {
+		for i := range leaves {
+			if leaves[i].weight < min {
+				leaves[i].weight = min
+			}
+		}
+		sort.SliceStable(leaves, func(i, j int) bool { return leaves[i].weight < leaves[j].weight })
+
+		// merge the two lightest nodes until one remains, internal nodes being created in order of weight
+		nodes := append(make([]node, 0, 2*len(leaves)), leaves...)
+		li, ii := 0, len(leaves)
+		lightest := func() int {
+			if li < len(leaves) && (ii == len(nodes) || nodes[li].weight <= nodes[ii].weight) {
+				li++
+				return li - 1
+			}
+			ii++
+			return ii - 1
+		}
+		for n := len(leaves); n > 1; n-- {
+			a, b := lightest(), lightest()
+			nodes = append(nodes, node{weight: nodes[a].weight + nodes[b].weight, left: a, right: b})
+		}
+
+		depths := make([]int, len(nodes))
+		deepest := 0
+		for i := len(nodes) - 1; i >= len(leaves); i-- {
+			d := depths[i] + 1
+			depths[nodes[i].left], depths[nodes[i].right] = d, d
+			if d > deepest {
+				deepest = d
+			}
+		}
+		if deepest <= maxLen {
+			for i, l := range leaves {
+				lengths[l.sym] = uint8(depths[i])
+			}
+			return lengths
+		}
+	}
+}
+
+// codeLengthOrder is the order code length code lengths are written in
+var codeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// writeHuffmanCode writes the code lengths of h, using a simple code when it has at most two symbols that fit in 8 bits
+func writeHuffmanCode(w *vp8lBitWriter, h huffmanCode) {
+	var syms []int
+	for s, l := range h.lengths {
+		if l > 0 {
+			syms = append(syms, s)
+		}
+	}
+	if len(syms) <= 2 && (len(syms) == 0 || syms[len(syms)-1] < 256) {
+		if len(syms) == 0 {
+			syms = []int{0}
+		}
+		w.write(1, 1)
+		w.write(uint32(len(syms)-1), 1)
+		if syms[0] < 2 {
+			w.write(0, 1)
+			w.write(uint32(syms[0]), 1)
+		} else {
+			w.write(1, 1)
+			w.write(uint32(syms[0]), 8)
+		}
+		if len(syms) == 2 {
+			w.write(uint32(syms[1]), 8)
+		}
+		return
+	}
+
+	// the lengths are themselves Huffman coded, with 17 and 18 coding runs of zeros
+	type token struct {
+		code  int
+		extra uint32
+	}
+	var (
+		tokens []token
+		hist   = make([]uint32, len(codeLengthOrder))
+	)
+	for i := 0; i < len(h.lengths); {
+		run := 0
+		for i+run < len(h.lengths) && h.lengths[i+run] == 0 && run < 138 {
+			run++
+		}
+		var t token
+		switch {
+		case run >= 11:
+			t, i = token{18, uint32(run - 11)}, i+run
+		case run >= 3:
+			t, i = token{17, uint32(run - 3)}, i+run
+		default:
+			t, i = token{int(h.lengths[i]), 0}, i+1
+		}
+		tokens = append(tokens, t)
+		hist[t.code]++
+	}
+	lc := newHuffmanCode(hist, 7)
+
+	n := len(codeLengthOrder)
+	for n > 4 && lc.lengths[codeLengthOrder[n-1]] == 0 {
+		n--
+	}
+	w.write(0, 1)
+	w.write(uint32(n-4), 4)
+	for _, c := range codeLengthOrder[:n] {
+		w.write(uint32(lc.lengths[c]), 3)
+	}
+	w.write(0, 1) // every symbol's length follows
+	for _, t := range tokens {
+		lc.write(w, t.code)
+		switch t.code {
+		case 17:
+			w.write(t.extra, 3)
+		case 18:
+			w.write(t.extra, 7)
+		}
+	}
+}
+
+// writeImageData writes argb as an entropy coded image.  Only the main image signals its prefix code groups.
+func writeImageData(w *vp8lBitWriter, argb []uint32, main bool) {
+	w.write(0, 1) // no color cache
+	if main {
+		w.write(0, 1) // a single prefix code group
+	}
+
+	// green, red, blue and alpha, the green alphabet including the unused backward reference lengths
+	hists := [4][]uint32{make([]uint32, 256+24), make([]uint32, 256), make([]uint32, 256), make([]uint32, 256)}
+	for _, p := range argb {
+		hists[0][p>>8&0xff]++
+		hists[1][p>>16&0xff]++
+		hists[2][p&0xff]++
+		hists[3][p>>24]++
+	}
+	var codes [4]huffmanCode
+	for i, hist := range hists {
+		codes[i] = newHuffmanCode(hist, 15)
+		writeHuffmanCode(w, codes[i])
+	}
+	writeHuffmanCode(w, newHuffmanCode(make([]uint32, 40), 15)) // distances, unused
+
+	for _, p := range argb {
+		codes[0].write(w, int(p>>8&0xff))
+		codes[1].write(w, int(p>>16&0xff))
+		codes[2].write(w, int(p&0xff))
+		codes[3].write(w, int(p>>24))
+	}
+}
+
+// predictorBits is the log2 of the size of the blocks the predictor transform chooses a mode for
+const predictorBits = 4
+
+// predictorModes are the prediction modes tried for each block
+var predictorModes = []int{1, 2, 5, 7, 11, 12, 13}
+
+func average2(a, b uint32) uint32 {
+	return (((a ^ b) & 0xfefefefe) >> 1) + (a & b)
+}
+
+func clampChannel(v int32) uint32 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint32(v)
+}
+
+// predict returns the prediction of a pixel from its left, top, top left and top right neighbours
+func predict(mode int, l, t, tl, tr uint32) uint32 {
+	switch mode {
+	case 0:
+		return 0xff000000
+	case 1:
+		return l
+	case 2:
+		return t
+	case 3:
+		return tr
+	case 4:
+		return tl
+	case 5:
+		return average2(average2(l, tr), t)
+	case 6:
+		return average2(l, tl)
+	case 7:
+		return average2(l, t)
+	case 8:
+		return average2(tl, t)
+	case 9:
+		return average2(t, tr)
+	case 10:
+		return average2(average2(l, tl), average2(t, tr))
+	case 11:
+		var pl, pt int32
+		for s := uint(0); s < 32; s += 8 {
+			a, b, c := int32(l>>s&0xff), int32(t>>s&0xff), int32(tl>>s&0xff)
+			p := a + b - c
+			pl += abs32(p - a)
+			pt += abs32(p - b)
+		}
+		if pl < pt {
+			return l
+		}
+		return t
+	case 12:
+		var out uint32
+		for s := uint(0); s < 32; s += 8 {
+			out |= clampChannel(int32(l>>s&0xff)+int32(t>>s&0xff)-int32(tl>>s&0xff)) << s
+		}
+		return out
+	default:
+		avg := average2(l, t)
+		var out uint32
+		for s := uint(0); s < 32; s += 8 {
+			a := int32(avg >> s & 0xff)
+			out |= clampChannel(a+(a-int32(tl>>s&0xff))/2) << s
+		}
+		return out
+	}
+}
+
+func abs32(v int32) int32 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// residual subtracts pred from p, channel by channel
+func residual(p, pred uint32) uint32 {
+	return ((p|0x00ff00ff)-(pred&0xff00ff00))&0xff00ff00 | ((p|0xff00ff00)-(pred&0x00ff00ff))&0x00ff00ff
+}
+
+// residualCost estimates the cost of coding a residual, by the magnitude of each channel as a signed byte
+func residualCost(r uint32) int {
+	cost := 0
+	for s := uint(0); s < 32; s += 8 {
+		cost += int(abs32(int32(int8(r >> s))))
+	}
+	return cost
+}
+
+// predictorTransform replaces argb with its residuals, returning the image of the modes chosen for each block
+func predictorTransform(argb []uint32, width, height int) []uint32 {
+	const size = 1 << predictorBits
+	bw, bh := (width+size-1)/size, (height+size-1)/size
+	modes := make([]uint32, bw*bh)
+
+	at := func(mode, x, y int) uint32 {
+		i := y*width + x
+		switch {
+		case y == 0 && x == 0:
+			return 0xff000000
+		case y == 0:
+			return argb[i-1]
+		case x == 0:
+			return argb[i-width]
+		}
+		return predict(mode, argb[i-1], argb[i-width], argb[i-width-1], argb[i-width+1])
+	}
+
+	// choose the mode of each block from the original pixels
+	for by := 0; by < bh; by++ {
+		for bx := 0; bx < bw; bx++ {
+			best, bestCost := predictorModes[0], -1
+			for _, mode := range predictorModes {
+				cost := 0
+				for y := by * size; y < (by+1)*size && y < height; y++ {
+					for x := bx * size; x < (bx+1)*size && x < width; x++ {
+						cost += residualCost(residual(argb[y*width+x], at(mode, x, y)))
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = mode, cost
+				}
+			}
+			modes[by*bw+bx] = 0xff000000 | uint32(best)<<8
+		}
+	}
+
+	// working backwards leaves the neighbours of each pixel unchanged until it has been predicted
+	for y := height - 1; y >= 0; y-- {
+		for x := width - 1; x >= 0; x-- {
+			mode := int(modes[(y>>predictorBits)*bw+x>>predictorBits] >> 8 & 0xff)
+			argb[y*width+x] = residual(argb[y*width+x], at(mode, x, y))
+		}
+	}
+	return modes
+}
+
+// toARGB returns the pixels of img, which must not be larger than a WebP image, as non-premultiplied ARGB
+func toARGB(img image.Image) []uint32 {
+	b := img.Bounds()
+	argb := make([]uint32, 0, b.Dx()*b.Dy())
+	if ycc, ok := img.(*image.YCbCr); ok {
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				yi, ci := ycc.YOffset(x, y), ycc.COffset(x, y)
+				r, g, bl := color.YCbCrToRGB(ycc.Y[yi], ycc.Cb[ci], ycc.Cr[ci])
+				argb = append(argb, 0xff000000|uint32(r)<<16|uint32(g)<<8|uint32(bl))
+			}
+		}
+		return argb
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			argb = append(argb, uint32(c.A)<<24|uint32(c.R)<<16|uint32(c.G)<<8|uint32(c.B))
+		}
+	}
+	return argb
+}
+
+// encodeVP8L returns img as a VP8L bitstream, the payload of a "VP8L" chunk, and whether it has transparent pixels
+func encodeVP8L(img image.Image) ([]byte, bool, error) {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width < 1 || height < 1 || width > maxWebPDimension || height > maxWebPDimension {
+		return nil, false, errors.New("webp images must be between 1x1 and 16384x16384")
+	}
+	argb := toARGB(img)
+	alpha := false
+	for _, p := range argb {
+		if p>>24 != 0xff {
+			alpha = true
+			break
+		}
+	}
+
+	w := &vp8lBitWriter{buf: make([]byte, 0, len(argb))}
+	w.write(0x2f, 8)
+	w.write(uint32(width-1), 14)
+	w.write(uint32(height-1), 14)
+	w.write(uint32(btoi(alpha)), 1)
+	w.write(0, 3) // version
+
+	// subtract green
+	for i, p := range argb {
+		g := p >> 8 & 0xff
+		argb[i] = p&0xff00ff00 | (p>>16-g)&0xff<<16 | (p-g)&0xff
+	}
+	w.write(1, 1)
+	w.write(2, 2)
+
+	modes := predictorTransform(argb, width, height)
+	w.write(1, 1)
+	w.write(0, 2)
+	w.write(predictorBits-2, 3)
+	writeImageData(w, modes, false)
+
+	w.write(0, 1) // no more transforms
+	writeImageData(w, argb, true)
+	return w.bytes(), alpha, nil
+}
+
+// VP8X flags
+const (
+	webpFlagAnimation = 1 << 1
+	webpFlagXMP       = 1 << 2
+	webpFlagEXIF      = 1 << 3
+	webpFlagAlpha     = 1 << 4
+)
+
+// appendChunk appends a RIFF chunk to b, padded to an even size
+func appendChunk(b []byte, fourcc string, data []byte) []byte {
+	b = append(b, fourcc...)
+	b = appendUint32LE(b, uint32(len(data)))
+	b = append(b, data...)
+	if len(data)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func appendUint32LE(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint24LE(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16))
+}
+
+// writeWebP writes a RIFF WebP file of the chunks in body, preceded by a VP8X chunk when flags are set or there is
+// metadata, which follows the image data
+func writeWebP(w io.Writer, width, height int, flags byte, body, exif, xmp []byte) error {
+	if len(exif) > 0 {
+		flags |= webpFlagEXIF
+	}
+	if len(xmp) > 0 {
+		flags |= webpFlagXMP
+	}
+	var chunks []byte
+	if flags != 0 {
+		vp8x := appendUint24LE([]byte{flags, 0, 0, 0}, uint32(width-1))
+		vp8x = appendUint24LE(vp8x, uint32(height-1))
+		chunks = appendChunk(chunks, "VP8X", vp8x)
+	}
+	chunks = append(chunks, body...)
+	if len(exif) > 0 {
+		chunks = appendChunk(chunks, "EXIF", exif)
+	}
+	if len(xmp) > 0 {
+		chunks = appendChunk(chunks, "XMP ", xmp)
+	}
+
+	out := append([]byte("RIFF"), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(out[4:], uint32(4+len(chunks)))
+	out = append(out, "WEBP"...)
+	_, err := w.Write(append(out, chunks...))
+	return err
+}
+
+// encodeWebP writes img to w as a lossless WebP, with EXIF and XMP chunks if they are not empty
+func encodeWebP(w io.Writer, img image.Image, exif, xmp []byte) error {
+	vp8l, _, err := encodeVP8L(img)
+	if err != nil {
+		return err
+	}
+	// the VP8L header signals alpha, some decoders reject a still VP8L image whose VP8X chunk does too
+	b := img.Bounds()
+	return writeWebP(w, b.Dx(), b.Dy(), 0, appendChunk(nil, "VP8L", vp8l), exif, xmp)
+}
+
+// webpAnimation encodes frames as an animated WebP, each a lossless "ANMF" chunk covering the canvas
+type webpAnimation struct {
+	width, height int
+	alpha         bool
+	frames        []byte
+}
+
+func (a *webpAnimation) add(img image.Image, d time.Duration) error {
+	b := img.Bounds()
+	if a.frames == nil {
+		a.width, a.height = b.Dx(), b.Dy()
+	} else if b.Dx() != a.width || b.Dy() != a.height {
+		return errors.New("animation frames differ in size")
+	}
+	vp8l, alpha, err := encodeVP8L(img)
+	if err != nil {
+		return err
+	}
+	a.alpha = a.alpha || alpha
+
+	// the duration is 24 bits of milliseconds
+	ms := d / time.Millisecond
+	if ms > 1<<24-1 {
+		ms = 1<<24 - 1
+	}
+	frame := appendUint24LE(make([]byte, 0, 16+8+len(vp8l)), 0) // x and y offsets
+	frame = appendUint24LE(frame, 0)
+	frame = appendUint24LE(frame, uint32(a.width-1))
+	frame = appendUint24LE(frame, uint32(a.height-1))
+	frame = appendUint24LE(frame, uint32(ms))
+	frame = append(frame, 1<<1) // replace the canvas rather than blending
+	a.frames = appendChunk(a.frames, "ANMF", appendChunk(frame, "VP8L", vp8l))
+	return nil
+}
+
+func (a *webpAnimation) encode(w io.Writer, exif, xmp []byte) (bool, bool, error) {
+	if a.frames == nil {
+		return false, false, errors.New("animation has no frames")
+	}
+	flags := byte(webpFlagAnimation)
+	if a.alpha {
+		flags |= webpFlagAlpha
+	}
+	// an opaque white background, looping forever
+	body := appendChunk(nil, "ANIM", []byte{0xff, 0xff, 0xff, 0xff, 0, 0})
+	body = append(body, a.frames...)
+	return len(exif) > 0, len(xmp) > 0, writeWebP(w, a.width, a.height, flags, body, exif, xmp)
+}
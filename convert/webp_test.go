@@ -0,0 +1,175 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+	"time"
+
+	"golang.org/x/image/webp"
+)
+
+// testNRGBA returns a w x h image of gradients and noise, so every transform and code of the encoder is exercised
+func testNRGBA(w, h int, alpha bool) *image.NRGBA {
+	rnd := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBA{R: uint8(x * 255 / w), G: uint8(y * 255 / h), B: uint8(rnd.Intn(256)), A: 0xff}
+			if alpha {
+				c.A = uint8(x + y)
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// webpChunks returns the chunks of a RIFF WebP file in order, failing unless the file is well formed
+func webpChunks(t *testing.T, b []byte) (fourccs []string, data [][]byte) {
+	t.Helper()
+	if len(b) < 12 || string(b[:4]) != "RIFF" || string(b[8:12]) != "WEBP" || int(binary.LittleEndian.Uint32(b[4:])) != len(b)-8 {
+		t.Fatalf("not a RIFF WebP file of %d bytes", len(b))
+	}
+	for b = b[12:]; len(b) > 0; {
+		if len(b) < 8 {
+			t.Fatalf("truncated chunk header")
+		}
+		n := int(binary.LittleEndian.Uint32(b[4:]))
+		if 8+n > len(b) {
+			t.Fatalf("chunk %q of %d bytes overflows the file", b[:4], n)
+		}
+		fourccs, data = append(fourccs, string(b[:4])), append(data, b[8:8+n])
+		b = b[8+n+n%2:]
+	}
+	return fourccs, data
+}
+
+func assertSameNRGBA(t *testing.T, name string, got image.Image, want *image.NRGBA) {
+	t.Helper()
+	if got.Bounds() != want.Bounds() {
+		t.Fatalf("%s: got %v, want %v", name, got.Bounds(), want.Bounds())
+	}
+	b := want.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if c := color.NRGBAModel.Convert(got.At(x, y)).(color.NRGBA); c != want.NRGBAAt(x, y) {
+				t.Fatalf("%s: got %v at %d,%d, want %v", name, c, x, y, want.NRGBAAt(x, y))
+			}
+		}
+	}
+}
+
+func TestEncodeWebP(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		img   *image.NRGBA
+		exif  []byte
+		xmp   []byte
+		chunk []string
+	}{
+		{"opaque", testNRGBA(61, 37, false), nil, nil, []string{"VP8L"}},
+		{"alpha", testNRGBA(16, 9, true), nil, nil, []string{"VP8L"}},
+		{"single pixel", testNRGBA(1, 1, false), nil, nil, []string{"VP8L"}},
+		{"metadata", testNRGBA(33, 20, false), []byte("MM\x00*"), []byte("<x:xmpmeta/>"), []string{"VP8X", "VP8L", "EXIF", "XMP "}},
+	} {
+		var buf bytes.Buffer
+		if err := encodeWebP(&buf, tc.img, tc.exif, tc.xmp); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		fourccs, data := webpChunks(t, buf.Bytes())
+		if len(fourccs) != len(tc.chunk) {
+			t.Fatalf("%s: got chunks %q, want %q", tc.name, fourccs, tc.chunk)
+		}
+		for i := range fourccs {
+			if fourccs[i] != tc.chunk[i] {
+				t.Fatalf("%s: got chunks %q, want %q", tc.name, fourccs, tc.chunk)
+			}
+		}
+		if tc.exif != nil && (data[0][0] != webpFlagEXIF|webpFlagXMP || !bytes.Equal(data[2], tc.exif) || !bytes.Equal(data[3], tc.xmp)) {
+			t.Errorf("%s: got VP8X flags %#x", tc.name, data[0][0])
+		}
+
+		img, err := webp.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		assertSameNRGBA(t, tc.name, img, tc.img)
+	}
+
+	if err := encodeWebP(&bytes.Buffer{}, image.NewNRGBA(image.Rect(0, 0, maxWebPDimension+1, 1)), nil, nil); err == nil {
+		t.Error("expected an error for an image wider than a WebP")
+	}
+}
+
+func TestHuffmanLengths(t *testing.T) {
+	// counts of a Fibonacci sequence make the optimal code as deep as there are symbols
+	hist := []uint32{1, 1}
+	for len(hist) < 30 {
+		hist = append(hist, hist[len(hist)-1]+hist[len(hist)-2])
+	}
+	hist = append(hist, 0)
+
+	for _, maxLen := range []int{15, 7} {
+		lengths := huffmanLengths(hist, maxLen)
+		kraft := 0.0
+		for i, l := range lengths {
+			if int(l) > maxLen || (l == 0) != (hist[i] == 0) {
+				t.Fatalf("max %d: symbol %d of count %d has length %d", maxLen, i, hist[i], l)
+			}
+			if l > 0 {
+				kraft += 1 / float64(uint(1)<<l)
+			}
+		}
+		if kraft > 1 {
+			t.Errorf("max %d: lengths %v are not a prefix code", maxLen, lengths)
+		}
+	}
+}
+
+func TestWebPAnimation(t *testing.T) {
+	frames := []*image.NRGBA{testNRGBA(20, 10, false), testNRGBA(20, 10, true)}
+	a := new(webpAnimation)
+	for i, f := range frames {
+		if err := a.add(f, time.Duration(i+1)*100*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.add(testNRGBA(10, 10, false), time.Second); err == nil {
+		t.Error("expected an error for a frame of another size")
+	}
+
+	var buf bytes.Buffer
+	if _, _, err := a.encode(&buf, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	fourccs, data := webpChunks(t, buf.Bytes())
+	if len(fourccs) != 4 || fourccs[0] != "VP8X" || fourccs[1] != "ANIM" || fourccs[2] != "ANMF" || fourccs[3] != "ANMF" {
+		t.Fatalf("got chunks %q", fourccs)
+	}
+	if data[0][0] != webpFlagAnimation|webpFlagAlpha {
+		t.Errorf("got VP8X flags %#x", data[0][0])
+	}
+	for i, f := range data[2:] {
+		if ms := uint32(f[12]) | uint32(f[13])<<8 | uint32(f[14])<<16; ms != uint32(i+1)*100 {
+			t.Errorf("frame %d lasts %dms", i, ms)
+		}
+		// each frame is a complete VP8L image
+		var still bytes.Buffer
+		if err := writeWebP(&still, 20, 10, 0, f[16:], nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		img, err := webp.Decode(&still)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		assertSameNRGBA(t, "frame", img, frames[i])
+	}
+
+	if _, _, err := new(webpAnimation).encode(&buf, nil, nil); err == nil {
+		t.Error("expected an error for an animation without frames")
+	}
+}
@@ -0,0 +1,221 @@
+package convert
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+const (
+	nsXMLNS = "xmlns"
+	nsEXIF  = "http://ns.adobe.com/exif/1.0/"
+	nsTIFF  = "http://ns.adobe.com/tiff/1.0/"
+
+	// identifiers of the jpeg APP1 segments holding standard and extended XMP, see XMP part 3 1.1.3
+	xmpStandardID = "http://ns.adobe.com/xap/1.0/\x00"
+	xmpExtendedID = "http://ns.adobe.com/xmp/extension/\x00"
+
+	// maximum APP1 payload, after the 2 byte length
+	jpegMaxSegment = 65533
+
+	xmpExtendedHeader = len(xmpExtendedID) + 32 + 4 + 4
+)
+
+var xpacketPI = regexp.MustCompile(`<\?xpacket[^?]*\?>`)
+
+// prepareXMP applies the metadata policy of opts to xmp.  When the pixels have been rotated the tiff:Orientation
+// property is removed, as the EXIF orientation is reset, and when their dimensions may have changed so are
+// exif:PixelXDimension and exif:PixelYDimension.  XMP that cannot be parsed is only passed through when it would have
+// been kept in full.
+func prepareXMP(xmp []byte, opts Options, res Result) []byte {
+	switch {
+	case len(xmp) == 0, opts.Metadata == MetadataStrip, opts.Metadata == MetadataAllowlist:
+		// allowlist names EXIF tags, which do not map to XMP properties
+		return nil
+	case opts.Metadata == MetadataKeep && !res.Rotated && !res.Resized:
+		return xmp
+	}
+
+	var (
+		stripGPS = opts.Metadata == MetadataStripGPS
+		resized  = res.Rotated || res.Resized
+	)
+	out, err := removeXMPProperties(xmp, nsEXIF, func(local string) bool {
+		return stripGPS && strings.HasPrefix(local, "GPS") || resized && (local == "PixelXDimension" || local == "PixelYDimension")
+	})
+	if err == nil && res.Rotated {
+		out, err = removeXMPProperties(out, nsTIFF, func(local string) bool { return local == "Orientation" })
+	}
+	if err != nil {
+		if opts.Metadata == MetadataKeep {
+			return xmp
+		}
+		return nil
+	}
+	return out
+}
+
+// xmpSpan is a range of the input to be replaced
+type xmpSpan struct {
+	start, end int64
+	repl       []byte
+}
+
+// removeXMPProperties removes every property in namespace ns for which match returns true, whether serialized as an
+// element or as an attribute.  The rest of the packet is left byte for byte as it was.
+func removeXMPProperties(xmp []byte, ns string, match func(local string) bool) ([]byte, error) {
+	var (
+		dec   = xml.NewDecoder(bytes.NewReader(xmp))
+		spans []xmpSpan
+		// prefix bindings of each open element
+		scopes []map[string]string
+	)
+	dec.Strict = false
+
+	resolve := func(prefix string) string {
+		for i := len(scopes) - 1; i >= 0; i-- {
+			if uri, ok := scopes[i][prefix]; ok {
+				return uri
+			}
+		}
+		return ""
+	}
+
+	for {
+		start := dec.InputOffset()
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			scope := make(map[string]string)
+			for _, a := range t.Attr {
+				if a.Name.Space == nsXMLNS {
+					scope[a.Name.Local] = a.Value
+				}
+			}
+			scopes = append(scopes, scope)
+
+			if t.Name.Space != "" && resolve(t.Name.Space) == ns && match(t.Name.Local) {
+				if err := skipXMPElement(dec); err != nil {
+					return nil, err
+				}
+				scopes = scopes[:len(scopes)-1]
+				spans = append(spans, xmpSpan{start: start, end: dec.InputOffset()})
+				continue
+			}
+
+			var remove []string
+			for _, a := range t.Attr {
+				if a.Name.Space != "" && a.Name.Space != nsXMLNS && resolve(a.Name.Space) == ns && match(a.Name.Local) {
+					remove = append(remove, a.Name.Space+":"+a.Name.Local)
+				}
+			}
+			if len(remove) > 0 {
+				end := dec.InputOffset()
+				spans = append(spans, xmpSpan{start: start, end: end, repl: removeXMLAttributes(xmp[start:end], remove)})
+			}
+
+		case xml.EndElement:
+			if len(scopes) > 0 {
+				scopes = scopes[:len(scopes)-1]
+			}
+		}
+	}
+
+	if len(spans) == 0 {
+		return xmp, nil
+	}
+	out := make([]byte, 0, len(xmp))
+	var last int64
+	for _, s := range spans {
+		out = append(out, xmp[last:s.start]...)
+		out = append(out, s.repl...)
+		last = s.end
+	}
+	return append(out, xmp[last:]...), nil
+}
+
+// skipXMPElement reads tokens until the end of the element whose start was just read
+func skipXMPElement(dec *xml.Decoder) error {
+	for depth := 1; depth > 0; {
+		tok, err := dec.RawToken()
+		if err != nil {
+			if err == io.EOF {
+				return errors.New("unexpected end of XMP")
+			}
+			return err
+		}
+		switch tok.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+	}
+	return nil
+}
+
+// removeXMLAttributes removes the named attributes from the raw text of a start tag
+func removeXMLAttributes(tag []byte, names []string) []byte {
+	for _, name := range names {
+		re := regexp.MustCompile(`\s+` + regexp.QuoteMeta(name) + `\s*=\s*("[^"]*"|'[^']*')`)
+		tag = re.ReplaceAll(tag, nil)
+	}
+	return tag
+}
+
+// jpegXMPSegments returns the APP1 payloads holding xmp.  A packet too large for one segment is written as extended
+// XMP, with the standard segment holding only a reference to it.
+func jpegXMPSegments(xmp []byte) [][]byte {
+	if len(xmpStandardID)+len(xmp) <= jpegMaxSegment {
+		return [][]byte{append([]byte(xmpStandardID), xmp...)}
+	}
+
+	// extended XMP is serialized without a packet wrapper
+	ext := bytes.TrimSpace(xpacketPI.ReplaceAll(xmp, nil))
+	sum := md5.Sum(ext)
+	guid := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	std := fmt.Sprintf("<?xpacket begin=\"\uFEFF\""+` id="W5M0MpCehiHzreSzNTczkc9d"?>`+
+		`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">`+
+		`<rdf:Description rdf:about="" xmlns:xmpNote="http://ns.adobe.com/xmp/note/" xmpNote:HasExtendedXMP="%s"/>`+
+		`</rdf:RDF></x:xmpmeta><?xpacket end="w"?>`, guid)
+	segs := [][]byte{append([]byte(xmpStandardID), std...)}
+
+	const chunk = jpegMaxSegment - xmpExtendedHeader
+	for off := 0; off < len(ext); off += chunk {
+		end := off + chunk
+		if end > len(ext) {
+			end = len(ext)
+		}
+		seg := make([]byte, xmpExtendedHeader, xmpExtendedHeader+end-off)
+		copy(seg, xmpExtendedID)
+		copy(seg[len(xmpExtendedID):], guid)
+		binary.BigEndian.PutUint32(seg[len(xmpExtendedID)+32:], uint32(len(ext)))
+		binary.BigEndian.PutUint32(seg[len(xmpExtendedID)+36:], uint32(off))
+		segs = append(segs, append(seg, ext[off:end]...))
+	}
+	return segs
+}
+
+// pngXMPChunk returns the data of the iTXt chunk holding xmp, see the PNG extensions for XMP
+func pngXMPChunk(xmp []byte) []byte {
+	if len(xmp) == 0 {
+		return nil
+	}
+	// keyword, then no compression, no language and no translated keyword
+	return append([]byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00"), xmp...)
+}
@@ -0,0 +1,201 @@
+package convert
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"image"
+	"image/jpeg"
+	"strings"
+	"testing"
+)
+
+const (
+	// testXMPElements holds GPS, orientation and other properties in element form
+	testXMPElements = `<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description rdf:about="" xmlns:exif="http://ns.adobe.com/exif/1.0/" xmlns:tiff="http://ns.adobe.com/tiff/1.0/">
+<exif:GPSLatitude>51,30.0N</exif:GPSLatitude>
+<exif:GPSLongitude>0,7.5W</exif:GPSLongitude>
+<exif:ExposureTime>1/60</exif:ExposureTime>
+<exif:PixelXDimension>64</exif:PixelXDimension>
+<exif:PixelYDimension>48</exif:PixelYDimension>
+<tiff:Orientation>6</tiff:Orientation>
+<tiff:Make>Apple</tiff:Make>
+</rdf:Description></rdf:RDF></x:xmpmeta>
+<?xpacket end="w"?>`
+
+	// testXMPAttributes holds the same properties in attribute form, using other prefixes for the namespaces
+	testXMPAttributes = `<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description rdf:about="" xmlns:e="http://ns.adobe.com/exif/1.0/" xmlns:t="http://ns.adobe.com/tiff/1.0/"
+ e:ExposureTime="1/60" e:GPSLatitude="51,30.0N" e:GPSLongitude='0,7.5W' e:PixelXDimension="64" e:PixelYDimension="48"
+ t:Orientation="6" t:Make="Apple"/>
+</rdf:RDF></x:xmpmeta>
+<?xpacket end="w"?>`
+)
+
+func TestPrepareXMP(t *testing.T) {
+	var (
+		gps         = []string{"GPSLatitude", "GPSLongitude", "51,30.0N"}
+		orientation = []string{"Orientation"}
+		dimensions  = []string{"PixelXDimension", "PixelYDimension"}
+		others      = []string{"ExposureTime", "Make", "Apple", "<?xpacket end"}
+	)
+	for _, tc := range []struct {
+		name    string
+		opts    Options
+		res     Result
+		removed []string
+		kept    []string
+	}{
+		{"keep", Options{Metadata: MetadataKeep}, Result{}, nil, join(gps, orientation, dimensions, others)},
+		{"keep rotated", Options{Metadata: MetadataKeep}, Result{Rotated: true}, join(orientation, dimensions), join(gps, others)},
+		{"keep resized", Options{Metadata: MetadataKeep}, Result{Resized: true}, dimensions, join(gps, orientation, others)},
+		{"strip gps", Options{Metadata: MetadataStripGPS}, Result{}, gps, join(orientation, dimensions, others)},
+		{"strip gps rotated", Options{Metadata: MetadataStripGPS}, Result{Rotated: true}, join(gps, orientation, dimensions), others},
+	} {
+		for form, in := range map[string]string{"elements": testXMPElements, "attributes": testXMPAttributes} {
+			out := string(prepareXMP([]byte(in), tc.opts, tc.res))
+			for _, s := range tc.removed {
+				if strings.Contains(out, s) {
+					t.Errorf("%s %s: %s not removed from %s", tc.name, form, s, out)
+				}
+			}
+			for _, s := range tc.kept {
+				if !strings.Contains(out, s) {
+					t.Errorf("%s %s: %s removed from %s", tc.name, form, s, out)
+				}
+			}
+		}
+	}
+	if out := prepareXMP([]byte(testXMPElements), Options{Metadata: MetadataKeep}, Result{}); string(out) != testXMPElements {
+		t.Errorf("keep: changed to %s", out)
+	}
+
+	for _, opts := range []Options{{Metadata: MetadataStrip}, {Metadata: MetadataAllowlist, MetadataTags: []string{"Make"}}} {
+		if out := prepareXMP([]byte(testXMPElements), opts, Result{}); out != nil {
+			t.Errorf("%s: kept %s", opts.Metadata, out)
+		}
+	}
+
+	// unparseable xmp is kept in full, or dropped
+	broken := []byte(`<x:xmpmeta xmlns:tiff="` + nsTIFF + `"><tiff:Orientation>6</tiff:Orientation><rdf:Description rdf:about="`)
+	if out := prepareXMP(broken, Options{Metadata: MetadataKeep}, Result{Rotated: true}); !bytes.Equal(out, broken) {
+		t.Errorf("keep: got %s", out)
+	}
+	if out := prepareXMP(broken, Options{Metadata: MetadataStripGPS}, Result{}); out != nil {
+		t.Errorf("strip-gps: got %s", out)
+	}
+}
+
+func join(lists ...[]string) []string {
+	var out []string
+	for _, l := range lists {
+		out = append(out, l...)
+	}
+	return out
+}
+
+func TestRemoveXMPProperties(t *testing.T) {
+	// the rest of the packet is left byte for byte as it was
+	out, err := removeXMPProperties([]byte(testXMPElements), nsTIFF, func(local string) bool { return local == "Orientation" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Replace(testXMPElements, "<tiff:Orientation>6</tiff:Orientation>", "", 1); string(out) != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+
+	out, err = removeXMPProperties([]byte(testXMPAttributes), nsEXIF, func(local string) bool { return strings.HasPrefix(local, "GPS") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.NewReplacer(` e:GPSLatitude="51,30.0N"`, "", ` e:GPSLongitude='0,7.5W'`, "").Replace(testXMPAttributes)
+	if string(out) != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+
+	// properties of other namespaces sharing a local name are kept
+	other := `<x:a xmlns:x="urn:x" xmlns:y="urn:y"><x:Orientation>1</x:Orientation><y:Orientation>2</y:Orientation></x:a>`
+	out, err = removeXMPProperties([]byte(other), "urn:y", func(local string) bool { return local == "Orientation" })
+	if err != nil || string(out) != `<x:a xmlns:x="urn:x" xmlns:y="urn:y"><x:Orientation>1</x:Orientation></x:a>` {
+		t.Errorf("got %s, %v", out, err)
+	}
+
+	if _, err := removeXMPProperties([]byte(`<a xmlns:t="`+nsTIFF+`"><t:Orientation>`), nsTIFF, func(string) bool { return true }); err == nil {
+		t.Error("removed a property from a truncated packet")
+	}
+}
+
+// jpegAPP1Payloads returns the payload of each APP1 segment at the start of a jpeg
+func jpegAPP1Payloads(t *testing.T, b []byte) [][]byte {
+	t.Helper()
+	var out [][]byte
+	for b = b[2:]; len(b) > 4 && b[0] == 0xff && b[1] == 0xe1; {
+		n := int(binary.BigEndian.Uint16(b[2:]))
+		if n < 2 || 2+n > len(b) {
+			t.Fatalf("APP1 segment of %d bytes overruns the jpeg", n)
+		}
+		out = append(out, b[4:2+n])
+		b = b[2+n:]
+	}
+	return out
+}
+
+func TestJPEGExtendedXMP(t *testing.T) {
+	// a packet of more than 64 KB, so too large for one segment
+	var body strings.Builder
+	for i := 0; body.Len() < 100<<10; i++ {
+		body.WriteString("<exif:UserComment>padding of the packet</exif:UserComment>\n")
+	}
+	xmp := strings.Replace(testXMPElements, "<tiff:Make>", body.String()+"<tiff:Make>", 1)
+
+	var buf bytes.Buffer
+	w, err := newWriterAPP1(&buf, jpegXMPSegments([]byte(xmp))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jpeg.Encode(w, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("decoding output: %v", err)
+	}
+
+	segs := jpegAPP1Payloads(t, buf.Bytes())
+	if len(segs) != 3 {
+		t.Fatalf("got %d APP1 segments, want the standard segment and 2 extended", len(segs))
+	}
+	if !bytes.HasPrefix(segs[0], []byte(xmpStandardID)) {
+		t.Fatalf("first segment is %q", segs[0][:32])
+	}
+
+	// the extended segments hold the packet, without its wrapper, in order
+	ext := make([]byte, 0, len(xmp))
+	var guid string
+	for _, seg := range segs[1:] {
+		if !bytes.HasPrefix(seg, []byte(xmpExtendedID)) || len(seg) > jpegMaxSegment {
+			t.Fatalf("got extended segment of %d bytes starting %q", len(seg), seg[:32])
+		}
+		hdr := seg[len(xmpExtendedID):]
+		guid = string(hdr[:32])
+		if size, off := binary.BigEndian.Uint32(hdr[32:]), binary.BigEndian.Uint32(hdr[36:]); int(off) != len(ext) || size > uint32(len(xmp)) {
+			t.Fatalf("got chunk of %d at offset %d after %d bytes", size, off, len(ext))
+		}
+		ext = append(ext, seg[xmpExtendedHeader:]...)
+	}
+	if want := strings.TrimSpace(xpacketPI.ReplaceAllString(xmp, "")); string(ext) != want {
+		t.Error("extended XMP does not match the packet")
+	}
+	sum := md5.Sum(ext)
+	if want := strings.ToUpper(hex.EncodeToString(sum[:])); guid != want || !bytes.Contains(segs[0], []byte(`xmpNote:HasExtendedXMP="`+want+`"`)) {
+		t.Errorf("got guid %s, want %s in every segment", guid, want)
+	}
+
+	// packets that fit are written as is
+	if segs := jpegXMPSegments([]byte(testXMPElements)); len(segs) != 1 || string(segs[0]) != xmpStandardID+testXMPElements {
+		t.Errorf("got %d segments", len(segs))
+	}
+}
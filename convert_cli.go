@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dcarbone/go-heicker/convert"
+)
+
+const convertUsage = `Usage: heicker convert [flags] <file|dir|glob>...
+
+Converts each HEIC/HEIF input using the same pipeline as the webservice.  Directories are searched for files with a
+.heic, .heics, .heif or .avif extension.  Outputs are written next to their input unless -out-dir is set, in which case
+the layout relative to each directory argument is preserved.
+
+Flags:
+`
+
+// heifExtensions are matched case-insensitively when searching directories
+var heifExtensions = []string{".heic", ".heics", ".heif", ".avif"}
+
+type convertCLIOptions struct {
+	convert.Options
+	OutDir    string
+	Recursive bool
+	Parallel  int
+	Overwrite bool
+	// All converts every image of each input into a zip archive
+	All bool
+}
+
+// convertJob is a single input and the path its output will be written to
+type convertJob struct {
+	in  string
+	out string
+}
+
+type convertJobResult struct {
+	job     convertJob
+	skipped bool
+	err     error
+}
+
+func runConvert(args []string) int {
+	var format, rotation, metadata, metadataTags, crop, fit, filter, thumbnail, aux, gainMap, heifCodec string
+
+	opts := convertCLIOptions{Parallel: runtime.NumCPU()}
+	opts.Quality = convert.DefaultQuality
+
+	fs := flag.NewFlagSet("heicker convert", flag.ContinueOnError)
+	fs.StringVar(&opts.OutDir, "out-dir", "", "Directory to write outputs to, defaults to the directory of each input")
+	fs.StringVar(&format, "format", "", fmt.Sprintf("Output format, one of: %s (default jpeg, or png with -aux)", formatNames()))
+	fs.IntVar(&opts.Quality, "quality", opts.Quality, "JPEG quality, 1-100")
+	fs.StringVar(&rotation, "rotate", string(convert.RotateNone), "Rotation, one of: none, auto, 90, 180, 270")
+	fs.StringVar(&metadata, "metadata", string(convert.MetadataKeep), "Metadata policy, one of: keep, strip, strip-gps, allowlist")
+	fs.StringVar(&metadataTags, "metadata-tags", "", "Comma separated EXIF tags kept by the allowlist metadata policy")
+	fs.StringVar(&crop, "crop", "", "Crop to x,y,width,height, in pixels after rotation, before resizing")
+	fs.IntVar(&opts.Width, "width", 0, "Resize to this width, 0 to calculate it from the height")
+	fs.IntVar(&opts.Height, "height", 0, "Resize to this height, 0 to calculate it from the width")
+	fs.StringVar(&fit, "fit", string(convert.FitContain), "How to resize when both width and height are set, one of: contain, cover, fill")
+	fs.Float64Var(&opts.Scale, "scale", 0, "Resize to this percentage, instead of -width and -height")
+	fs.IntVar(&opts.MaxWidth, "max-width", 0, "Shrink to at most this width, preserving the aspect ratio")
+	fs.IntVar(&opts.MaxHeight, "max-height", 0, "Shrink to at most this height, preserving the aspect ratio")
+	fs.StringVar(&filter, "filter", string(convert.FilterLanczos), "Resampling filter, one of: lanczos, catmullrom, bilinear, nearest")
+	fs.StringVar(&thumbnail, "thumbnail", string(convert.ThumbnailNone), "Convert a thumbnail instead, one of: none, embedded, generated, auto")
+	fs.Var(uint32Value{&opts.Item}, "item", "Convert the image with this item ID instead of the primary image")
+	fs.IntVar(&opts.Index, "index", 0, "Convert this image instead of the primary image, numbered from 1 as listed by /info")
+	fs.Var(uint32Value{&opts.Track}, "track", "Convert a frame of the image sequence track with this ID instead")
+	fs.IntVar(&opts.Frame, "frame", 0, "Frame of -track to convert, numbered from 1, otherwise gif and webp convert every frame to an animation")
+	fs.IntVar(&opts.FirstFrame, "first-frame", 0, "First frame of a sequence converted to an animation or by -all, numbered from 1")
+	fs.IntVar(&opts.LastFrame, "last-frame", 0, "Last frame of a sequence converted to an animation or by -all, 0 for the end")
+	fs.Float64Var(&opts.MaxFPS, "max-fps", 0, "Drop frames so animations play at no more than this many frames per second")
+	fs.StringVar(&aux, "aux", "", "Convert an auxiliary image of the selected image to grayscale png instead, one of: depth, matte")
+	fs.IntVar(&opts.BitDepth, "bit-depth", 0, "Bits per sample of -aux outputs, 8 or 16, 0 to match the auxiliary image")
+	fs.StringVar(&gainMap, "gain-map", string(convert.GainMapKeep), "HDR gain maps of jpeg outputs, one of: keep (Ultra HDR), strip")
+	fs.StringVar(&heifCodec, "heif-codec", string(convert.HEIFCodecJPEG), "How heif outputs store the image, one of: jpeg, unci (uncompressed)")
+	fs.BoolVar(&opts.All, "all", false, "Convert every image and sequence frame into a zip archive")
+	fs.BoolVar(&opts.Recursive, "recursive", false, "Search directories recursively")
+	fs.IntVar(&opts.Parallel, "parallel", opts.Parallel, "Number of files to convert concurrently")
+	fs.BoolVar(&opts.Overwrite, "overwrite", false, "Overwrite existing outputs instead of skipping them")
+	fs.Usage = func() {
+		_, _ = fmt.Fprint(fs.Output(), convertUsage)
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	if err := opts.parse(format, rotation, metadata, metadataTags, crop, fit, filter, thumbnail, aux, gainMap, heifCodec); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 2
+	}
+	if opts.Parallel < 1 {
+		opts.Parallel = 1
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	jobs, err := expandConvertInputs(fs.Args(), opts)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if len(jobs) == 0 {
+		_, _ = fmt.Fprintln(os.Stderr, "No HEIC/HEIF files found")
+		return 1
+	}
+
+	start := time.Now()
+	var converted, skipped, failed int
+	for res := range convertJobs(jobs, opts) {
+		switch {
+		case res.err != nil:
+			failed++
+			_, _ = fmt.Fprintf(os.Stderr, "FAIL %s: %v\n", res.job.in, res.err)
+		case res.skipped:
+			skipped++
+			fmt.Printf("SKIP %s: %s exists\n", res.job.in, res.job.out)
+		default:
+			converted++
+			fmt.Printf("OK   %s -> %s\n", res.job.in, res.job.out)
+		}
+	}
+
+	fmt.Printf("\n%d converted, %d skipped, %d failed in %s\n", converted, skipped, failed, time.Since(start).Round(time.Millisecond))
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// parse sets the options provided by name, validating the result
+func (o *convertCLIOptions) parse(format, rotation, metadata, metadataTags, crop, fit, filter, thumbnail, aux, gainMap, heifCodec string) error {
+	var err error
+	if aux != "" {
+		if o.Aux, err = convert.ParseAux(aux); err != nil {
+			return err
+		}
+	}
+	switch {
+	case format != "":
+		if o.Format, err = convert.ParseFormat(format); err != nil {
+			return err
+		}
+	case o.Aux != "":
+		o.Format = convert.FormatPNG
+	default:
+		o.Format = convert.FormatJPEG
+	}
+	if o.Rotation, err = convert.ParseRotation(rotation); err != nil {
+		return err
+	}
+	if o.Metadata, err = convert.ParseMetadataPolicy(metadata); err != nil {
+		return err
+	}
+	if o.MetadataTags, err = convert.ParseMetadataTags(metadataTags); err != nil {
+		return err
+	}
+	if crop != "" {
+		if o.Crop, err = convert.ParseCrop(crop); err != nil {
+			return err
+		}
+	}
+	if o.Fit, err = convert.ParseFit(fit); err != nil {
+		return err
+	}
+	if o.Filter, err = convert.ParseFilter(filter); err != nil {
+		return err
+	}
+	if o.Thumbnail, err = convert.ParseThumbnailMode(thumbnail); err != nil {
+		return err
+	}
+	if o.GainMap, err = convert.ParseGainMapMode(gainMap); err != nil {
+		return err
+	}
+	if o.HEIFCodec, err = convert.ParseHEIFCodec(heifCodec); err != nil {
+		return err
+	}
+	return o.Options.Validate()
+}
+
+// expandConvertInputs turns the provided arguments into a de-duplicated list of jobs.  Arguments that are neither an
+// existing path nor match a glob are an error.
+func expandConvertInputs(args []string, opts convertCLIOptions) ([]convertJob, error) {
+	var (
+		jobs = make([]convertJob, 0, len(args))
+		seen = make(map[string]bool)
+	)
+
+	add := func(root, path string) {
+		abs, err := filepath.Abs(path)
+		if err == nil && seen[abs] {
+			return
+		}
+		seen[abs] = true
+		ext := opts.Format.Extension()
+		if opts.All {
+			ext = "zip"
+		}
+		jobs = append(jobs, convertJob{in: path, out: convertOutputPath(root, path, opts.OutDir, ext)})
+	}
+
+	for _, arg := range args {
+		matches := []string{arg}
+		if _, err := os.Stat(arg); err != nil {
+			if matches, err = filepath.Glob(arg); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", arg, err)
+			} else if len(matches) == 0 {
+				return nil, fmt.Errorf("no such file or directory: %s", arg)
+			}
+		}
+
+		for _, m := range matches {
+			fi, err := os.Stat(m)
+			if err != nil {
+				return nil, err
+			}
+			if !fi.IsDir() {
+				add("", m)
+				continue
+			}
+			err = filepath.Walk(m, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if info.IsDir() {
+					if path != m && !opts.Recursive {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if isHEIFName(path) {
+					add(m, path)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("error searching %q: %w", m, err)
+			}
+		}
+	}
+
+	return jobs, nil
+}
+
+func isHEIFName(name string) bool {
+	ext := filepath.Ext(name)
+	for _, e := range heifExtensions {
+		if strings.EqualFold(ext, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// convertOutputPath swaps the extension of path for ext.  When an output directory is set, the path of the input
+// relative to root is preserved beneath it.
+func convertOutputPath(root, path, outDir string, ext string) string {
+	name := strings.TrimSuffix(path, filepath.Ext(path)) + "." + ext
+	if outDir == "" {
+		return name
+	}
+	if root != "" {
+		if rel, err := filepath.Rel(root, name); err == nil {
+			return filepath.Join(outDir, rel)
+		}
+	}
+	return filepath.Join(outDir, filepath.Base(name))
+}
+
+// convertJobs runs each job using opts.Parallel workers, the returned channel is closed once all have finished
+func convertJobs(jobs []convertJob, opts convertCLIOptions) <-chan convertJobResult {
+	var (
+		wg      sync.WaitGroup
+		in      = make(chan convertJob)
+		results = make(chan convertJobResult)
+	)
+
+	for i := 0; i < opts.Parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range in {
+				results <- convertFile(job, opts)
+			}
+		}()
+	}
+
+	go func() {
+		for _, job := range jobs {
+			in <- job
+		}
+		close(in)
+		wg.Wait()
+		close(results)
+	}()
+
+	return results
+}
+
+func convertFile(job convertJob, opts convertCLIOptions) convertJobResult {
+	res := convertJobResult{job: job}
+
+	if !opts.Overwrite {
+		if _, err := os.Stat(job.out); err == nil {
+			res.skipped = true
+			return res
+		}
+	}
+
+	res.err = convertPath(job.in, job.out, opts.Options, opts.All)
+	return res
+}
+
+// convertPath writes to a temp file in the destination directory that is renamed on success, so partial outputs are
+// never left behind.  When all is true every image is converted into a zip archive.
+func convertPath(in, out string, opts convert.Options, all bool) error {
+	f, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	buf := new(bytes.Buffer)
+	if all {
+		_, err = convert.ConvertAll(context.Background(), f, buf, opts)
+	} else {
+		_, err = convert.Convert(context.Background(), f, buf, opts)
+	}
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(out, buf)
+}
+
+// uint32Value is a flag.Value for IDs
+type uint32Value struct{ p *uint32 }
+
+func (v uint32Value) String() string {
+	if v.p == nil {
+		return "0"
+	}
+	return strconv.FormatUint(uint64(*v.p), 10)
+}
+
+func (v uint32Value) Set(s string) error {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return err
+	}
+	*v.p = uint32(n)
+	return nil
+}
+
+func formatNames() string {
+	var names []string
+	for _, f := range convert.Formats() {
+		names = append(names, string(f))
+	}
+	return strings.Join(names, ", ")
+}
+
+func writeFileAtomic(path string, r io.Reader) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".heicker-*")
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(tmp, r); err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"archive/zip"
+	"flag"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/dcarbone/go-heicker/convert"
+)
+
+// convert/testdata/hevc.heic is a 64x48 hevc image written by libheif
+func readTestHEIC(t *testing.T) []byte {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join("convert", "testdata", "hevc.heic"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// writeTree creates each file, relative to dir, holding data
+func writeTree(t *testing.T, dir string, data []byte, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExpandConvertInputs(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, nil, "a.heic", "b.HEIF", "d.heics", "e.avif", "notes.txt", "sub/c.heic")
+	opts := convertCLIOptions{Options: convert.Options{Format: convert.FormatPNG}}
+
+	jobs := func(opts convertCLIOptions, args ...string) map[string]string {
+		t.Helper()
+		js, err := expandConvertInputs(args, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := make(map[string]string, len(js))
+		for _, j := range js {
+			rel, _ := filepath.Rel(dir, j.in)
+			m[filepath.ToSlash(rel)] = j.out
+		}
+		return m
+	}
+	keys := func(m map[string]string) []string {
+		ks := make([]string, 0, len(m))
+		for k := range m {
+			ks = append(ks, k)
+		}
+		sort.Strings(ks)
+		return ks
+	}
+
+	if got := keys(jobs(opts, dir)); len(got) != 4 || got[0] != "a.heic" || got[1] != "b.HEIF" || got[2] != "d.heics" || got[3] != "e.avif" {
+		t.Errorf("got %v", got)
+	}
+
+	// duplicates are dropped
+	recursive := opts
+	recursive.Recursive = true
+	if got := keys(jobs(recursive, dir, filepath.Join(dir, "*.heic"), filepath.Join(dir, "sub", "c.heic"))); len(got) != 5 {
+		t.Errorf("got %v recursively", got)
+	}
+
+	// outputs keep their layout beneath out-dir
+	recursive.OutDir = filepath.Join(dir, "out")
+	got := jobs(recursive, dir)
+	if want := filepath.Join(dir, "out", "sub", "c.png"); got["sub/c.heic"] != want {
+		t.Errorf("got output %s, want %s", got["sub/c.heic"], want)
+	}
+	if want := filepath.Join(dir, "a.png"); jobs(opts, filepath.Join(dir, "a.heic"))["a.heic"] != want {
+		t.Errorf("want output %s", want)
+	}
+
+	// -all writes zip archives
+	all := opts
+	all.All = true
+	if want := filepath.Join(dir, "a.zip"); jobs(all, filepath.Join(dir, "a.heic"))["a.heic"] != want {
+		t.Errorf("want output %s", want)
+	}
+
+	if _, err := expandConvertInputs([]string{filepath.Join(dir, "missing*.heic")}, opts); err == nil {
+		t.Error("expected error for a pattern matching nothing")
+	}
+}
+
+func TestConvertJobs(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, readTestHEIC(t), "a.heic", "b.heic")
+	writeTree(t, dir, []byte("not a heic"), "bad.heic")
+	writeTree(t, dir, []byte("existing"), "b.png")
+
+	opts := convertCLIOptions{Options: convert.Options{Format: convert.FormatPNG}, Parallel: 2}
+	jobs, err := expandConvertInputs([]string{dir}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := make(map[string]convertJobResult)
+	for res := range convertJobs(jobs, opts) {
+		results[filepath.Base(res.job.in)] = res
+	}
+
+	if res := results["a.heic"]; res.err != nil || res.skipped {
+		t.Errorf("got %+v", res)
+	}
+	f, err := os.Open(filepath.Join(dir, "a.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if cfg, err := png.DecodeConfig(f); err != nil || cfg.Width != 64 || cfg.Height != 48 {
+		t.Errorf("got %+v, %v", cfg, err)
+	}
+
+	if res := results["b.heic"]; !res.skipped {
+		t.Errorf("got %+v for an existing output", res)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "b.png")); string(b) != "existing" {
+		t.Error("existing output was overwritten")
+	}
+
+	// failures leave nothing behind
+	if res := results["bad.heic"]; res.err == nil {
+		t.Errorf("got %+v for an invalid file", res)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*")); len(matches) != 5 {
+		t.Errorf("got files %v", matches)
+	}
+
+	opts.All = true
+	if err := convertPath(filepath.Join(dir, "a.heic"), filepath.Join(dir, "a.zip"), opts.Options, opts.All); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.OpenReader(filepath.Join(dir, "a.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	if len(zr.File) != 3 || zr.File[0].Name != "image-1.png" {
+		t.Errorf("got %d files in the archive", len(zr.File))
+	}
+}
+
+func TestUint32Value(t *testing.T) {
+	var id uint32
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.Var(uint32Value{&id}, "item", "")
+	if err := fs.Parse([]string{"-item", "4294967295"}); err != nil || id != 4294967295 {
+		t.Errorf("got %d, %v", id, err)
+	}
+	for _, v := range []string{"-1", "4294967296", "a"} {
+		if err := fs.Parse([]string{"-item", v}); err == nil {
+			t.Errorf("%s: expected an error", v)
+		}
+	}
+	if s := (uint32Value{}).String(); s != "0" {
+		t.Errorf("got %q", s)
+	}
+}
+
+func TestConvertCLIOptionsParse(t *testing.T) {
+	parse := func(format, aux string) (convertCLIOptions, error) {
+		o := convertCLIOptions{Options: convert.Options{Quality: 90}}
+		return o, o.parse(format, "auto", "keep", "", "", "contain", "lanczos", "none", aux, "keep", "jpeg")
+	}
+	for _, tc := range []struct {
+		format, aux string
+		want        convert.Format
+	}{
+		{"", "", convert.FormatJPEG},
+		{"", "depth", convert.FormatPNG},
+		{"webp", "", convert.FormatWebP},
+		{"heif", "", convert.FormatHEIF},
+	} {
+		if o, err := parse(tc.format, tc.aux); err != nil || o.Format != tc.want {
+			t.Errorf("%q with aux %q: got %q, %v, want %q", tc.format, tc.aux, o.Format, err, tc.want)
+		}
+	}
+	for _, tc := range [][2]string{{"bmp", ""}, {"", "skin"}, {"jpeg", "matte"}} {
+		if _, err := parse(tc[0], tc[1]); err == nil {
+			t.Errorf("%q with aux %q: expected an error", tc[0], tc[1])
+		}
+	}
+	o := convertCLIOptions{Options: convert.Options{Quality: 90}}
+	if err := o.parse("jpeg", "auto", "keep", "", "", "contain", "lanczos", "none", "", "hdr", "jpeg"); err == nil {
+		t.Error("expected an error for gain map mode hdr")
+	}
+	if err := o.parse("heif", "auto", "keep", "", "", "contain", "lanczos", "none", "", "keep", "hevc"); err == nil {
+		t.Error("expected an error for heif codec hevc")
+	}
+}
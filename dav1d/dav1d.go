@@ -0,0 +1,102 @@
+// Package dav1d decodes AV1 pictures, such as the av01 items of AVIF files, with libdav1d.  The library is loaded
+// when the first Decoder is created rather than linked, so that building requires neither it nor its headers.
+package dav1d
+
+import (
+	"errors"
+	"image"
+	"unsafe"
+)
+
+// ErrUnavailable is returned by NewDecoder when libdav1d could not be loaded
+var ErrUnavailable = errors.New("libdav1d is not available")
+
+// Pixel layouts of a picture, enum Dav1dPixelLayout
+const (
+	layoutI400 = 0
+	layoutI420 = 1
+	layoutI422 = 2
+	layoutI444 = 3
+)
+
+// picture is the part of a Dav1dPicture read to copy it
+type picture struct {
+	planes  [3]unsafe.Pointer
+	strides [2]int
+	width   int
+	height  int
+	layout  int
+	bpc     int
+}
+
+// toImage copies p as an *image.YCbCr, reducing samples of more than 8 bits to 8, or as an *image.Gray or
+// *image.Gray16 for monochrome pictures
+func (p picture) toImage() (image.Image, error) {
+	if p.width <= 0 || p.height <= 0 || p.planes[0] == nil {
+		return nil, errors.New("picture has no luma plane")
+	}
+	if p.height*p.strides[0] >= 1<<30 || p.height*p.strides[1] >= 1<<30 {
+		return nil, errors.New("image too big")
+	}
+	if p.bpc != 8 && (p.bpc <= 8 || p.bpc > 16) {
+		return nil, errors.New("unsupported bit depth")
+	}
+
+	var ratio image.YCbCrSubsampleRatio
+	cw, ch := p.width, p.height
+	switch p.layout {
+	case layoutI400:
+		return p.toGray(), nil
+	case layoutI420:
+		ratio, cw, ch = image.YCbCrSubsampleRatio420, (p.width+1)/2, (p.height+1)/2
+	case layoutI422:
+		ratio, cw = image.YCbCrSubsampleRatio422, (p.width+1)/2
+	case layoutI444:
+		ratio = image.YCbCrSubsampleRatio444
+	default:
+		return nil, errors.New("unsupported pixel layout")
+	}
+
+	ycc := image.NewYCbCr(image.Rect(0, 0, p.width, p.height), ratio)
+	p.copyPlane(ycc.Y, ycc.YStride, p.planes[0], p.strides[0], p.width, p.height)
+	p.copyPlane(ycc.Cb, ycc.CStride, p.planes[1], p.strides[1], cw, ch)
+	p.copyPlane(ycc.Cr, ycc.CStride, p.planes[2], p.strides[1], cw, ch)
+	return ycc, nil
+}
+
+// copyPlane copies w x h samples of src to dst, shifting those of more than 8 bits, stored as native uint16s, down to 8
+func (p picture) copyPlane(dst []byte, dstStride int, src unsafe.Pointer, srcStride, w, h int) {
+	data := (*[1 << 30]byte)(src)[: h*srcStride : h*srcStride]
+	for y := 0; y < h; y++ {
+		row := dst[y*dstStride : y*dstStride+w]
+		if p.bpc == 8 {
+			copy(row, data[y*srcStride:])
+			continue
+		}
+		samples := (*[1 << 29]uint16)(unsafe.Pointer(&data[y*srcStride]))[:w:w]
+		for x, v := range samples {
+			row[x] = byte(v >> uint(p.bpc-8))
+		}
+	}
+}
+
+// toGray copies the luma plane of p.  Samples of more than 8 bits are scaled to the full range of image.Gray16.
+func (p picture) toGray() image.Image {
+	if p.bpc == 8 {
+		g := image.NewGray(image.Rect(0, 0, p.width, p.height))
+		p.copyPlane(g.Pix, g.Stride, p.planes[0], p.strides[0], p.width, p.height)
+		return g
+	}
+
+	data := (*[1 << 30]byte)(p.planes[0])[: p.height*p.strides[0] : p.height*p.strides[0]]
+	g := image.NewGray16(image.Rect(0, 0, p.width, p.height))
+	for y := 0; y < p.height; y++ {
+		src := (*[1 << 29]uint16)(unsafe.Pointer(&data[y*p.strides[0]]))[:p.width:p.width]
+		dst := g.Pix[y*g.Stride:]
+		for x, v := range src {
+			v = v<<uint(16-p.bpc) | v>>uint(2*p.bpc-16)
+			dst[2*x], dst[2*x+1] = byte(v>>8), byte(v)
+		}
+	}
+	return g
+}
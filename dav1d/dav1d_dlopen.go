@@ -0,0 +1,216 @@
+//go:build !windows
+// +build !windows
+
+package dav1d
+
+/*
+#cgo linux LDFLAGS: -ldl
+#include <dlfcn.h>
+#include <errno.h>
+#include <stddef.h>
+#include <stdint.h>
+#include <string.h>
+
+// The structures of dav1d/dav1d.h are declared only as far as their leading fields, which are stable across the
+// 1.x releases, and padded beyond their size so that libdav1d can fill them.
+
+typedef union {
+	struct {
+		int n_threads;
+		int max_frame_delay;
+		int apply_grain;
+		int operating_point;
+		int all_layers;
+		unsigned frame_size_limit;
+		void *allocator[3];
+		void *logger[2];
+	} s;
+	uint8_t pad[1024];
+} dav1d_settings;
+
+typedef union {
+	struct {
+		const uint8_t *data;
+		size_t sz;
+	} s;
+	uint8_t pad[512];
+} dav1d_data;
+
+typedef union {
+	struct {
+		void *seq_hdr;
+		void *frame_hdr;
+		void *data[3];
+		ptrdiff_t stride[2];
+		int w, h, layout, bpc;
+	} s;
+	uint8_t pad[1024];
+} dav1d_picture;
+
+static void *lib;
+static void (*default_settings_fn)(dav1d_settings *);
+static int (*open_fn)(void **, const dav1d_settings *);
+static void (*close_fn)(void **);
+static uint8_t *(*data_create_fn)(dav1d_data *, size_t);
+static void (*data_unref_fn)(dav1d_data *);
+static int (*send_data_fn)(void *, dav1d_data *);
+static int (*get_picture_fn)(void *, dav1d_picture *);
+static void (*picture_unref_fn)(dav1d_picture *);
+
+static int load(void) {
+	static const char *names[] = {"libdav1d.so.7", "libdav1d.so.6", "libdav1d.7.dylib", "libdav1d.6.dylib", "libdav1d.so", "libdav1d.dylib"};
+	for (size_t i = 0; i < sizeof(names) / sizeof(names[0]) && !lib; i++) {
+		lib = dlopen(names[i], RTLD_NOW | RTLD_LOCAL);
+	}
+	if (!lib) {
+		return 0;
+	}
+	default_settings_fn = dlsym(lib, "dav1d_default_settings");
+	open_fn = dlsym(lib, "dav1d_open");
+	close_fn = dlsym(lib, "dav1d_close");
+	data_create_fn = dlsym(lib, "dav1d_data_create");
+	data_unref_fn = dlsym(lib, "dav1d_data_unref");
+	send_data_fn = dlsym(lib, "dav1d_send_data");
+	get_picture_fn = dlsym(lib, "dav1d_get_picture");
+	picture_unref_fn = dlsym(lib, "dav1d_picture_unref");
+	return default_settings_fn && open_fn && close_fn && data_create_fn && data_unref_fn && send_data_fn &&
+		get_picture_fn && picture_unref_fn;
+}
+
+// open_decoder creates a single threaded decoder outputting each picture as soon as it is decoded, of the first
+// operating point only, without logging, and failing frames of more than max_pixels
+static int open_decoder(void **ctx, unsigned max_pixels) {
+	dav1d_settings s;
+	memset(&s, 0, sizeof(s));
+	default_settings_fn(&s);
+	s.s.n_threads = 1;
+	s.s.max_frame_delay = 1;
+	s.s.all_layers = 0;
+	s.s.frame_size_limit = max_pixels;
+	s.s.logger[1] = NULL;
+	return open_fn(ctx, &s);
+}
+
+static void close_decoder(void **ctx) {
+	close_fn(ctx);
+}
+
+// decode sends buf, a temporal unit of OBUs, to ctx and returns the first picture output
+static int decode(void *ctx, const uint8_t *buf, size_t n, dav1d_picture *pic) {
+	dav1d_data data;
+	memset(&data, 0, sizeof(data));
+	uint8_t *p = data_create_fn(&data, n);
+	if (!p) {
+		return -ENOMEM;
+	}
+	memcpy(p, buf, n);
+
+	int res;
+	do {
+		res = send_data_fn(ctx, &data);
+		if (res < 0 && res != -EAGAIN) {
+			break;
+		}
+		res = get_picture_fn(ctx, pic);
+		if (res != -EAGAIN) {
+			break;
+		}
+	} while (data.s.sz > 0);
+	if (data.s.sz > 0) {
+		data_unref_fn(&data);
+	}
+	return res;
+}
+
+static void picture_unref(dav1d_picture *pic) {
+	picture_unref_fn(pic);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"sync"
+	"unsafe"
+)
+
+var (
+	loadOnce sync.Once
+	loaded   bool
+)
+
+// Decoder decodes AV1 pictures of a given size.  It is not safe for concurrent use.
+type Decoder struct {
+	ctx           unsafe.Pointer
+	width, height int
+}
+
+// NewDecoder returns a Decoder of pictures of width x height, such as those given by the ispe property of an av01
+// item, or ErrUnavailable if libdav1d could not be loaded.  libdav1d refuses frames of more pixels than that, before
+// allocating for them.
+func NewDecoder(width, height int) (*Decoder, error) {
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("invalid picture size %dx%d", width, height)
+	}
+	loadOnce.Do(func() { loaded = C.load() != 0 })
+	if !loaded {
+		return nil, ErrUnavailable
+	}
+
+	maxPixels := uint64(math.MaxUint32)
+	if uint64(width) <= maxPixels/uint64(height) {
+		maxPixels = uint64(width) * uint64(height)
+	}
+	dec := &Decoder{width: width, height: height}
+	if res := C.open_decoder(&dec.ctx, C.uint(maxPixels)); res < 0 {
+		return nil, fmt.Errorf("dav1d_open: %s", C.GoString(C.strerror(-res)))
+	}
+	return dec, nil
+}
+
+// Free releases the decoder, which must not be used afterwards
+func (dec *Decoder) Free() {
+	if dec.ctx != nil {
+		C.close_decoder(&dec.ctx)
+	}
+}
+
+// DecodeImage decodes data, the OBUs of a single temporal unit such as the data of an av01 item, returning a copy of
+// its picture as an *image.YCbCr or, for monochrome pictures, an *image.Gray or *image.Gray16.  Pictures of another
+// size than the decoder's are refused.
+func (dec *Decoder) DecodeImage(data []byte) (image.Image, error) {
+	if len(data) == 0 {
+		return nil, errors.New("no data")
+	}
+
+	var pic C.dav1d_picture
+	if res := C.decode(dec.ctx, (*C.uint8_t)(unsafe.Pointer(&data[0])), C.size_t(len(data)), &pic); res < 0 {
+		if res == -C.EAGAIN {
+			return nil, errors.New("no picture")
+		}
+		return nil, fmt.Errorf("decode error: %s", C.GoString(C.strerror(-res)))
+	}
+	defer C.picture_unref(&pic)
+
+	s := (*struct {
+		seqHdr, frameHdr unsafe.Pointer
+		data             [3]unsafe.Pointer
+		stride           [2]C.ptrdiff_t
+		w, h, layout     C.int
+		bpc              C.int
+	})(unsafe.Pointer(&pic))
+	if int(s.w) != dec.width || int(s.h) != dec.height {
+		return nil, fmt.Errorf("picture is %dx%d, not %dx%d", s.w, s.h, dec.width, dec.height)
+	}
+	return picture{
+		planes:  s.data,
+		strides: [2]int{int(s.stride[0]), int(s.stride[1])},
+		width:   int(s.w),
+		height:  int(s.h),
+		layout:  int(s.layout),
+		bpc:     int(s.bpc),
+	}.toImage()
+}
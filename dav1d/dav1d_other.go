@@ -0,0 +1,24 @@
+//go:build windows
+// +build windows
+
+package dav1d
+
+import (
+	"image"
+)
+
+// Decoder decodes AV1 pictures.  libdav1d is never loaded on Windows, so no Decoder can be created.
+type Decoder struct{}
+
+// NewDecoder returns ErrUnavailable
+func NewDecoder(width, height int) (*Decoder, error) {
+	return nil, ErrUnavailable
+}
+
+// Free does nothing
+func (dec *Decoder) Free() {}
+
+// DecodeImage returns ErrUnavailable
+func (dec *Decoder) DecodeImage(data []byte) (image.Image, error) {
+	return nil, ErrUnavailable
+}
@@ -0,0 +1,110 @@
+package dav1d
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"testing"
+	"unsafe"
+
+	"github.com/dcarbone/go-heicker/heif"
+)
+
+func TestPictureToImage(t *testing.T) {
+	// a 3x2 4:2:0 picture, its rows padded to 4 bytes
+	y, u, v := []byte{1, 2, 3, 0, 4, 5, 6, 0}, []byte{7, 8, 0, 0}, []byte{9, 10, 0, 0}
+	p := picture{
+		planes:  [3]unsafe.Pointer{unsafe.Pointer(&y[0]), unsafe.Pointer(&u[0]), unsafe.Pointer(&v[0])},
+		strides: [2]int{4, 4},
+		width:   3, height: 2, layout: layoutI420, bpc: 8,
+	}
+	img, err := p.toImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ycc, ok := img.(*image.YCbCr)
+	if !ok || ycc.SubsampleRatio != image.YCbCrSubsampleRatio420 || string(ycc.Y[ycc.YStride:ycc.YStride+3]) != "\x04\x05\x06" ||
+		string(ycc.Cb[:2]) != "\x07\x08" || string(ycc.Cr[:2]) != "\x09\x0a" {
+		t.Errorf("got %+v", img)
+	}
+
+	// 10 bit monochrome samples are scaled to 16 bits
+	gray := []uint16{0x3ff, 0x200}
+	p = picture{planes: [3]unsafe.Pointer{unsafe.Pointer(&gray[0])}, strides: [2]int{4}, width: 2, height: 1, layout: layoutI400, bpc: 10}
+	img, err = p.toImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, ok := img.(*image.Gray16); !ok || g.Gray16At(0, 0).Y != 0xffff || g.Gray16At(1, 0).Y != 0x8020 {
+		t.Errorf("got %+v", img)
+	}
+
+	// 10 bit chroma samples are reduced to 8 bits
+	p.layout, p.strides[1], p.planes[1], p.planes[2] = layoutI444, 4, p.planes[0], p.planes[0]
+	img, err = p.toImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ycc, ok := img.(*image.YCbCr); !ok || string(ycc.Y[:2]) != "\xff\x80" || string(ycc.Cb[:2]) != "\xff\x80" {
+		t.Errorf("got %+v", img)
+	}
+
+	for _, bad := range []picture{
+		{layout: layoutI420, bpc: 8},
+		{planes: p.planes, strides: p.strides, width: 2, height: 1, layout: 4, bpc: 8},
+		{planes: p.planes, strides: p.strides, width: 2, height: 1, layout: layoutI420, bpc: 7},
+	} {
+		if _, err := bad.toImage(); err == nil {
+			t.Errorf("%+v: expected an error", bad)
+		}
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	if _, err := NewDecoder(0, 48); err == nil {
+		t.Error("expected an error for an empty picture size")
+	}
+
+	dec, err := NewDecoder(64, 48)
+	if err == ErrUnavailable {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Free()
+	if _, err := dec.DecodeImage([]byte("not av1")); err == nil {
+		t.Error("expected an error for data that is not AV1")
+	}
+
+	// the primary item of av1.avif codes a 64x48 picture
+	b, err := ioutil.ReadFile("../convert/testdata/av1.avif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hf := heif.Open(bytes.NewReader(b))
+	it, err := hf.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := hf.GetItemData(it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := dec.DecodeImage(data)
+	if err != nil || img.Bounds() != image.Rect(0, 0, 64, 48) {
+		t.Fatalf("got %v, %v", img, err)
+	}
+
+	// pictures of more pixels are refused by libdav1d, those of as many but another shape after decoding
+	for _, size := range [][2]int{{32, 48}, {48, 64}} {
+		dec, err := NewDecoder(size[0], size[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dec.DecodeImage(data); err == nil {
+			t.Errorf("%dx%d: expected an error for a 64x48 picture", size[0], size[1])
+		}
+		dec.Free()
+	}
+}
@@ -6,7 +6,7 @@ require (
 	github.com/dcarbone/go-confinator v1.0.1
 	github.com/gorilla/mux v1.8.0
 	github.com/hashicorp/hcl/v2 v2.8.2
-	github.com/jdeng/goheif v0.0.0-20200323230657-a0d6a8b3e68f
 	github.com/rs/zerolog v1.20.0
-	github.com/rwcarlsen/goexif v0.0.0-20190401172101-9e8deecbddbd // indirect
+	github.com/rwcarlsen/goexif v0.0.0-20190401172101-9e8deecbddbd
+	golang.org/x/image v0.0.0-20210220032944-ac19c3e999fb
 )
@@ -33,15 +33,26 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"strings"
 )
 
+// NewReader returns a Reader parsing within DefaultLimits.
 func NewReader(r io.Reader) *Reader {
+	return NewReaderWithLimits(r, DefaultLimits)
+}
+
+// NewReaderWithLimits returns a Reader whose boxes, and the boxes within them, are parsed within l.
+func NewReaderWithLimits(r io.Reader, l Limits) *Reader {
+	return newReader(r, &parseState{limits: l.withDefaults()}, 0)
+}
+
+func newReader(r io.Reader, st *parseState, depth int) *Reader {
 	br, ok := r.(*bufio.Reader)
 	if !ok {
 		br = bufio.NewReader(r)
 	}
-	return &Reader{br: bufReader{Reader: br}}
+	return &Reader{br: bufReader{Reader: br, state: st, depth: depth}}
 }
 
 type Reader struct {
@@ -50,6 +61,63 @@ type Reader struct {
 	noMoreBoxes bool // a box with size 0 (the final box) was seen
 }
 
+// Limits bound the work done parsing a file, so that malformed or hostile input fails with an error wrapping
+// ErrLimitExceeded rather than exhausting memory or time.  Fields of zero or less take the value of DefaultLimits.
+type Limits struct {
+	MaxBoxes      int // boxes read in total, at any depth
+	MaxDepth      int // levels of boxes nested within boxes
+	MaxItems      int // entries of an "iinf", "iloc" or "iref" box, and references of each "iref" entry
+	MaxProperties int // properties of an "ipco" box and associations of an "ipma" box
+	MaxNALUnits   int // NAL units of an "hvcC" box
+	MaxSamples    int // samples of an "stsz" box
+}
+
+// DefaultLimits are far above what cameras and image editors write.
+var DefaultLimits = Limits{
+	MaxBoxes:      100000,
+	MaxDepth:      32,
+	MaxItems:      10000,
+	MaxProperties: 10000,
+	MaxNALUnits:   256,
+	MaxSamples:    100000,
+}
+
+func (l Limits) withDefaults() Limits {
+	d := DefaultLimits
+	if l.MaxBoxes <= 0 {
+		l.MaxBoxes = d.MaxBoxes
+	}
+	if l.MaxDepth <= 0 {
+		l.MaxDepth = d.MaxDepth
+	}
+	if l.MaxItems <= 0 {
+		l.MaxItems = d.MaxItems
+	}
+	if l.MaxProperties <= 0 {
+		l.MaxProperties = d.MaxProperties
+	}
+	if l.MaxNALUnits <= 0 {
+		l.MaxNALUnits = d.MaxNALUnits
+	}
+	if l.MaxSamples <= 0 {
+		l.MaxSamples = d.MaxSamples
+	}
+	return l
+}
+
+// ErrLimitExceeded is wrapped by the errors of input exceeding the Limits it is parsed within.
+var ErrLimitExceeded = errors.New("bmff: parse limit exceeded")
+
+func limitError(what string, n, max int) error {
+	return fmt.Errorf("%w: %d %s, more than %d", ErrLimitExceeded, n, what, max)
+}
+
+// parseState is shared by the readers and boxes of a file
+type parseState struct {
+	limits Limits
+	boxes  int // read so far
+}
+
 type BoxType [4]byte
 
 // Common box types.
@@ -120,6 +188,29 @@ var parsers = map[BoxType]parserFunc{
 	boxType("idat"): parseItemDataBox,
 	boxType("iref"): parseItemReferenceBox,
 	boxType("hvcC"): parseItemHevcConfigBox,
+	boxType("colr"): parseColourInformationBox,
+	boxType("auxC"): parseAuxiliaryTypeProperty,
+	boxType("pixi"): parsePixelInformationProperty,
+	boxType("jpgC"): parseJPEGConfigurationBox,
+	boxType("cmpd"): parseComponentDefinitionBox,
+	boxType("uncC"): parseUncompressedFrameConfigBox,
+	boxType("av1C"): parseAV1ConfigurationBox,
+	boxType("moov"): parseMovieBox,
+	boxType("trak"): parseTrackBox,
+	boxType("tkhd"): parseTrackHeaderBox,
+	boxType("mdia"): parseMediaBox,
+	boxType("mdhd"): parseMediaHeaderBox,
+	boxType("minf"): parseMediaInformationBox,
+	boxType("stbl"): parseSampleTableBox,
+	boxType("stsd"): parseSampleDescriptionBox,
+	boxType("hvc1"): parseVisualSampleEntry,
+	boxType("hev1"): parseVisualSampleEntry,
+	boxType("stts"): parseTimeToSampleBox,
+	boxType("stsz"): parseSampleSizeBox,
+	boxType("stsc"): parseSampleToChunkBox,
+	boxType("stco"): parseChunkOffsetBox,
+	boxType("co64"): parseChunkOffsetBox,
+	boxType("stss"): parseSyncSampleBox,
 }
 
 type box struct {
@@ -128,6 +219,8 @@ type box struct {
 	body    io.Reader
 	parsed  Box    // if non-nil, the Parsed result
 	slurp   []byte // if non-nil, the contents slurped to memory
+	state   *parseState
+	depth   int // of the box, 0 at the top level
 }
 
 func (b *box) Size() int64   { return b.size }
@@ -148,7 +241,10 @@ func (b *box) Parse() (Box, error) {
 	if !ok {
 		return nil, ErrUnknownBox
 	}
-	v, err := parser(b, &bufReader{Reader: bufio.NewReader(b.Body())})
+	v, err := parser(b, b.reader())
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("%q box truncated: %w", b.boxType, io.ErrUnexpectedEOF)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -156,6 +252,11 @@ func (b *box) Parse() (Box, error) {
 	return v, nil
 }
 
+// reader returns a bufReader of the body, reading the boxes it contains one level deeper
+func (b *box) reader() *bufReader {
+	return &bufReader{Reader: bufio.NewReader(b.Body()), state: b.state, depth: b.depth + 1}
+}
+
 type FullBox struct {
 	*box
 	Version uint8
@@ -183,13 +284,19 @@ func (r *Reader) ReadBox() (Box, error) {
 	if err != nil {
 		return nil, err
 	}
+	st := r.br.state
+	if st.boxes++; st.boxes > st.limits.MaxBoxes {
+		return nil, limitError("boxes", st.boxes, st.limits.MaxBoxes)
+	}
 	box := &box{
-		size: int64(binary.BigEndian.Uint32(buf[:4])),
+		size:  int64(binary.BigEndian.Uint32(buf[:4])),
+		state: st,
+		depth: r.br.depth,
 	}
 
 	_, err = io.ReadFull(r.br, box.boxType[:]) // 4 more bytes
 	if err != nil {
-		return nil, err
+		return nil, truncated(err)
 	}
 
 	// Special cases for size:
@@ -199,7 +306,7 @@ func (r *Reader) ReadBox() (Box, error) {
 		// 1 means it's actually a 64-bit size, after the type.
 		_, err = io.ReadFull(r.br, buf[:8])
 		if err != nil {
-			return nil, err
+			return nil, truncated(err)
 		}
 		box.size = int64(binary.BigEndian.Uint64(buf[:8]))
 		if box.size < 0 {
@@ -227,19 +334,28 @@ func (r *Reader) ReadBox() (Box, error) {
 	return box, nil
 }
 
+// truncated turns the io.EOF of a box cut short, which would otherwise end its container cleanly, into
+// io.ErrUnexpectedEOF
+func truncated(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
 // ReadAndParseBox wraps the ReadBox method, ensuring that the read box is of type typ
 // and parses successfully. It returns the parsed box.
 func (r *Reader) ReadAndParseBox(typ BoxType) (Box, error) {
 	box, err := r.ReadBox()
 	if err != nil {
-		return nil, fmt.Errorf("error reading %q box: %v", typ, err)
+		return nil, fmt.Errorf("error reading %q box: %w", typ, err)
 	}
 	if box.Type() != typ {
 		return nil, fmt.Errorf("error reading %q box: got box type %q instead", typ, box.Type())
 	}
 	pbox, err := box.Parse()
 	if err != nil {
-		return nil, fmt.Errorf("error parsing read %q box: %v", typ, err)
+		return nil, fmt.Errorf("error parsing read %q box: %w", typ, err)
 	}
 	return pbox, nil
 }
@@ -249,7 +365,7 @@ func readFullBox(outer *box, br *bufReader) (fb FullBox, err error) {
 	// Parse FullBox header.
 	buf, err := br.Peek(4)
 	if err != nil {
-		return FullBox{}, fmt.Errorf("failed to read 4 bytes of FullBox: %v", err)
+		return FullBox{}, fmt.Errorf("failed to read 4 bytes of FullBox: %w", err)
 	}
 	fb.Version = buf[0]
 	buf[0] = 0
@@ -307,7 +423,11 @@ func (br *bufReader) parseAppendBoxes(dst *[]Box) error {
 	if br.err != nil {
 		return br.err
 	}
-	boxr := NewReader(br.Reader)
+	if max := br.state.limits.MaxDepth; br.depth >= max {
+		br.err = limitError("levels of nested boxes", br.depth+1, max)
+		return br.err
+	}
+	boxr := newReader(br.Reader, br.state, br.depth)
 	for {
 		inner, err := boxr.ReadBox()
 		if err == io.EOF {
@@ -317,12 +437,17 @@ func (br *bufReader) parseAppendBoxes(dst *[]Box) error {
 			br.err = err
 			return err
 		}
-		slurp, err := ioutil.ReadAll(inner.Body())
+		b := inner.(*box)
+		slurp, err := ioutil.ReadAll(b.body)
 		if err != nil {
 			br.err = err
 			return err
 		}
-		inner.(*box).slurp = slurp
+		if lr, ok := b.body.(*io.LimitedReader); ok && lr.N > 0 {
+			br.err = fmt.Errorf("%q box truncated, %d of %d bytes missing", b.boxType, lr.N, b.size)
+			return br.err
+		}
+		b.slurp = slurp
 		*dst = append(*dst, inner)
 	}
 }
@@ -367,6 +492,7 @@ func parseItemInfoEntry(outer *box, br *bufReader) (Box, error) {
 		return nil, err
 	}
 	ie.ItemType = string(buf[:4])
+	br.Discard(4)
 	ie.Name, _ = br.readString()
 
 	switch ie.ItemType {
@@ -407,11 +533,14 @@ func parseItemInfoBox(outer *box, br *bufReader) (Box, error) {
 
 	var itemInfos []Box
 	br.parseAppendBoxes(&itemInfos)
+	if max := br.state.limits.MaxItems; br.ok() && len(itemInfos) > max {
+		return nil, limitError("item info entries", len(itemInfos), max)
+	}
 	if br.ok() {
 		for _, box := range itemInfos {
 			pb, err := box.Parse()
 			if err != nil {
-				return nil, fmt.Errorf("error parsing ItemInfoEntry in ItemInfoBox: %v", err)
+				return nil, fmt.Errorf("error parsing ItemInfoEntry in ItemInfoBox: %w", err)
 			}
 			if iie, ok := pb.(*ItemInfoEntry); ok {
 				ib.ItemInfos = append(ib.ItemInfos, iie)
@@ -419,7 +548,7 @@ func parseItemInfoBox(outer *box, br *bufReader) (Box, error) {
 		}
 	}
 	if !br.ok() {
-		return FullBox{}, br.err
+		return nil, br.err
 	}
 	return ib, nil
 }
@@ -446,12 +575,15 @@ func parseItemReferenceBox(outer *box, br *bufReader) (Box, error) {
 
 	var itemRefs []Box
 	br.parseAppendBoxes(&itemRefs)
+	if max := br.state.limits.MaxItems; br.ok() && len(itemRefs) > max {
+		return nil, limitError("item references", len(itemRefs), max)
+	}
 
 	if br.ok() {
 		for _, b := range itemRefs {
-			pb, err := parseItemReferenceEntry(b.(*box), &bufReader{Reader: bufio.NewReader(b.Body())}, ib.Version)
+			pb, err := parseItemReferenceEntry(b.(*box), b.(*box).reader(), ib.Version)
 			if err != nil {
-				return nil, fmt.Errorf("error parsing ItemReferenceEntry in ItemReferenceBox: %v", err)
+				return nil, fmt.Errorf("error parsing ItemReferenceEntry in ItemReferenceBox: %w", err)
 			}
 			if iie, ok := pb.(*ItemReferenceEntry); ok {
 				ib.ItemRefs = append(ib.ItemRefs, iie)
@@ -459,7 +591,7 @@ func parseItemReferenceBox(outer *box, br *bufReader) (Box, error) {
 		}
 	}
 	if !br.ok() {
-		return FullBox{}, br.err
+		return nil, br.err
 	}
 	return ib, nil
 }
@@ -467,30 +599,35 @@ func parseItemReferenceBox(outer *box, br *bufReader) (Box, error) {
 func parseItemReferenceEntry(outer *box, br *bufReader, version uint8) (Box, error) {
 	ie := &ItemReferenceEntry{box: outer}
 
-	if version == 0 {
-		itemID, _ := br.readUint16()
-		ie.FromItemID = uint32(itemID)
-		ie.Count, _ = br.readUint16()
-		for i := 0; i < int(ie.Count); i += 1 {
-			itemID, _ := br.readUint16()
-			ie.ToItemIDs = append(ie.ToItemIDs, uint32(itemID))
-		}
-	} else {
-		ie.FromItemID, _ = br.readUint32()
-		ie.Count, _ = br.readUint16()
-		for i := 0; i < int(ie.Count); i += 1 {
-			itemID, _ := br.readUint32()
-			ie.ToItemIDs = append(ie.ToItemIDs, itemID)
+	// item IDs are 16 bits wide in version 0 boxes and 32 bits in version 1
+	readID := func() uint32 {
+		if version == 0 {
+			id, _ := br.readUint16()
+			return uint32(id)
 		}
+		id, _ := br.readUint32()
+		return id
+	}
+	ie.FromItemID = readID()
+	ie.Count, _ = br.readUint16()
+	if max := br.state.limits.MaxItems; int(ie.Count) > max {
+		return nil, limitError("referenced items", int(ie.Count), max)
+	}
+	for i := 0; i < int(ie.Count) && br.ok(); i += 1 {
+		ie.ToItemIDs = append(ie.ToItemIDs, readID())
+	}
+	if !br.ok() {
+		return nil, br.err
 	}
-
 	return ie, nil
 }
 
 // bufReader adds some HEIF/BMFF-specific methods around a *bufio.Reader.
 type bufReader struct {
 	*bufio.Reader
-	err error // sticky error
+	err   error // sticky error
+	state *parseState
+	depth int // of the boxes read from it
 }
 
 // ok reports whether all previous reads have been error-free.
@@ -599,7 +736,13 @@ type ItemPropertyContainerBox struct {
 
 func parseItemPropertyContainerBox(outer *box, br *bufReader) (Box, error) {
 	ipc := &ItemPropertyContainerBox{box: outer}
-	return ipc, br.parseAppendBoxes(&ipc.Properties)
+	if err := br.parseAppendBoxes(&ipc.Properties); err != nil {
+		return nil, err
+	}
+	if max := br.state.limits.MaxProperties; len(ipc.Properties) > max {
+		return nil, limitError("properties", len(ipc.Properties), max)
+	}
+	return ipc, nil
 }
 
 // HEIF: iprp
@@ -620,12 +763,12 @@ func parseItemPropertiesBox(outer *box, br *bufReader) (Box, error) {
 		return nil, err
 	}
 	if len(boxes) < 2 {
-		return nil, fmt.Errorf("expect at least 2 boxes in children; got 0")
+		return nil, fmt.Errorf("expect at least 2 boxes in children; got %d", len(boxes))
 	}
 
 	cb, err := boxes[0].Parse()
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse first box, %q: %v", boxes[0].Type(), err)
+		return nil, fmt.Errorf("failed to parse first box, %q: %w", boxes[0].Type(), err)
 	}
 
 	var ok bool
@@ -639,7 +782,7 @@ func parseItemPropertiesBox(outer *box, br *bufReader) (Box, error) {
 	for _, box := range boxes[1:] {
 		boxp, err := box.Parse()
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse association box: %v", err)
+			return nil, fmt.Errorf("failed to parse association box: %w", err)
 		}
 		ipa, ok := boxp.(*ItemPropertyAssociation)
 		if !ok {
@@ -677,6 +820,10 @@ func parseItemPropertyAssociation(outer *box, br *bufReader) (Box, error) {
 	ipa := &ItemPropertyAssociation{FullBox: fb}
 	count, _ := br.readUint32()
 	ipa.EntryCount = count
+	if max := br.state.limits.MaxItems; br.ok() && uint64(count) > uint64(max) {
+		return nil, limitError("property association entries", int(count), max)
+	}
+	var total int // associations of every entry
 
 	for i := uint64(0); i < uint64(count) && br.ok(); i++ {
 		var itemID uint32
@@ -691,6 +838,9 @@ func parseItemPropertyAssociation(outer *box, br *bufReader) (Box, error) {
 			ItemID:            itemID,
 			AssociationsCount: int(assocCount),
 		}
+		if total += int(assocCount); total > br.state.limits.MaxProperties {
+			return nil, limitError("property associations", total, br.state.limits.MaxProperties)
+		}
 		for j := 0; j < int(assocCount) && br.ok(); j++ {
 			first, _ := br.readUint8()
 			essential := first&(1<<7) != 0
@@ -774,24 +924,53 @@ func parseItemLocationBox(outer *box, br *bufReader) (Box, error) {
 	ilb := &ItemLocationBox{
 		FullBox: fb,
 	}
-	buf, err := br.Peek(4)
+	if fb.Version > 2 {
+		return nil, fmt.Errorf("unsupported iloc version %d", fb.Version)
+	}
+	buf, err := br.Peek(2)
 	if err != nil {
 		return nil, err
 	}
 	ilb.offsetSize = buf[0] >> 4
 	ilb.lengthSize = buf[0] & 15
 	ilb.baseOffsetSize = buf[1] >> 4
-	if fb.Version > 0 { // version 1
+	if fb.Version > 0 { // version 1 or 2
 		ilb.indexSize = buf[1] & 15
 	}
+	br.Discard(2)
+	for _, size := range []uint8{ilb.offsetSize, ilb.lengthSize, ilb.baseOffsetSize, ilb.indexSize} {
+		if size != 0 && size != 4 && size != 8 {
+			return nil, fmt.Errorf("invalid iloc field size %d", size)
+		}
+	}
 
-	ilb.ItemCount = binary.BigEndian.Uint16(buf[2:4])
-	br.Discard(4)
+	// version 2 boxes have 32 bit item counts and IDs, though IDs are limited to 16 bits here
+	var count uint32
+	if fb.Version < 2 {
+		count16, _ := br.readUint16()
+		count = uint32(count16)
+	} else {
+		count, _ = br.readUint32()
+	}
+	max := br.state.limits.MaxItems
+	if max > math.MaxUint16 {
+		max = math.MaxUint16
+	}
+	if uint64(count) > uint64(max) {
+		return nil, limitError("item locations", int(count), max)
+	}
+	ilb.ItemCount = uint16(count)
 
 	for i := 0; br.ok() && i < int(ilb.ItemCount); i++ {
 		var ent ItemLocationBoxEntry
-		ent.ItemID, _ = br.readUint16()
-		if fb.Version > 0 { // version 1
+		if fb.Version < 2 {
+			ent.ItemID, _ = br.readUint16()
+		} else if id, _ := br.readUint32(); id > math.MaxUint16 {
+			return nil, fmt.Errorf("unsupported item ID %d", id)
+		} else {
+			ent.ItemID = uint16(id)
+		}
+		if fb.Version > 0 { // version 1 or 2
 			cmeth, _ := br.readUint16()
 			ent.ConstructionMethod = byte(cmeth & 15)
 		}
@@ -811,6 +990,7 @@ func parseItemLocationBox(outer *box, br *bufReader) (Box, error) {
 		ent.ExtentCount, _ = br.readUint16()
 		for j := 0; br.ok() && j < int(ent.ExtentCount); j++ {
 			var ol OffsetLength
+			_, _ = br.readUintN(ilb.indexSize * 8) // extent_index, for construction method 2
 			ol.Offset, _ = br.readUintN(ilb.offsetSize * 8)
 			ol.Length, _ = br.readUintN(ilb.lengthSize * 8)
 			if br.err != nil {
@@ -956,26 +1136,301 @@ func parseImageMirror(gen *box, br *bufReader) (Box, error) {
 	return &ImageMirror{box: gen, Mirror: v & 1}, nil
 }
 
-// ItemHevcConfigBox is a HEIF "hvcC" property
-type hevcConfig struct {
-	version                          uint8
-	generalProfileSpace              uint8
-	generalTierFlag                  uint8
-	generalProfileIdc                uint8
-	generalProfileCompatibilityFlags uint32
+// ColourInformationBox is a "colr" property.  Depending on ColourType, either ICCProfile or the nclx fields are set.
+type ColourInformationBox struct {
+	*box
+	ColourType string // "nclx", "rICC" or "prof"
+
+	// If ColourType == "nclx":
+	ColourPrimaries         uint16
+	TransferCharacteristics uint16
+	MatrixCoefficients      uint16
+	FullRange               bool
+
+	// If ColourType == "rICC" or "prof":
+	ICCProfile []byte
+}
+
+func parseColourInformationBox(gen *box, br *bufReader) (Box, error) {
+	buf, err := br.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+	cb := &ColourInformationBox{box: gen, ColourType: string(buf[:4])}
+	br.Discard(4)
+
+	switch cb.ColourType {
+	case "nclx":
+		cb.ColourPrimaries, _ = br.readUint16()
+		cb.TransferCharacteristics, _ = br.readUint16()
+		cb.MatrixCoefficients, _ = br.readUint16()
+		fr, _ := br.readUint8()
+		cb.FullRange = fr&0x80 != 0
+	case "rICC", "prof":
+		cb.ICCProfile, err = ioutil.ReadAll(br)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !br.ok() {
+		return nil, br.err
+	}
+	return cb, nil
+}
+
+// AuxiliaryTypeProperty is an "auxC" property, identifying the kind of an auxiliary image such as alpha or depth.
+type AuxiliaryTypeProperty struct {
+	FullBox
+	AuxType    string // a URN, e.g. "urn:mpeg:hevc:2015:auxid:1"
+	AuxSubtype []byte
+}
+
+func parseAuxiliaryTypeProperty(gen *box, br *bufReader) (Box, error) {
+	fb, err := readFullBox(gen, br)
+	if err != nil {
+		return nil, err
+	}
+	ap := &AuxiliaryTypeProperty{FullBox: fb}
+	ap.AuxType, _ = br.readString()
+	if !br.ok() {
+		return nil, br.err
+	}
+	if ap.AuxSubtype, err = ioutil.ReadAll(br); err != nil {
+		return nil, err
+	}
+	return ap, nil
+}
+
+// PixelInformationProperty is a "pixi" property.
+type PixelInformationProperty struct {
+	FullBox
+	BitsPerChannel []uint8
+}
 
-	generalLevelIdc uint8
+func parsePixelInformationProperty(gen *box, br *bufReader) (Box, error) {
+	fb, err := readFullBox(gen, br)
+	if err != nil {
+		return nil, err
+	}
+	pp := &PixelInformationProperty{FullBox: fb}
+	n, _ := br.readUint8()
+	for i := 0; i < int(n) && br.ok(); i++ {
+		bits, _ := br.readUint8()
+		pp.BitsPerChannel = append(pp.BitsPerChannel, bits)
+	}
+	if !br.ok() {
+		return nil, br.err
+	}
+	return pp, nil
+}
 
-	minSpatialSegmentationIdc uint16
-	parallelismType           uint8
-	chromaFormat              uint8
-	bitDepthLuma              uint8
-	bitDepthChroma            uint8
-	avgFrameRate              uint16
+// JPEGConfigurationBox is a "jpgC" property, holding the start of the JPEG codestream, such as its tables, that is
+// shared by the jpeg items it is associated with and omitted from their data.  See ISO/IEC 23008-12 H.4.
+type JPEGConfigurationBox struct {
+	*box
+	Prefix []byte
+}
 
-	constantFrameRate uint8
-	numTemporalLayers uint8
-	temporalIdNested  uint8
+func parseJPEGConfigurationBox(gen *box, br *bufReader) (Box, error) {
+	prefix, err := ioutil.ReadAll(br)
+	if err != nil {
+		return nil, err
+	}
+	return &JPEGConfigurationBox{box: gen, Prefix: prefix}, nil
+}
+
+// Component types of a "cmpd" box, see ISO/IEC 23001-17 Table 1
+const (
+	ComponentMonochrome uint16 = 0
+	ComponentY          uint16 = 1
+	ComponentCb         uint16 = 2
+	ComponentCr         uint16 = 3
+	ComponentRed        uint16 = 4
+	ComponentGreen      uint16 = 5
+	ComponentBlue       uint16 = 6
+	ComponentAlpha      uint16 = 7
+)
+
+// ComponentDefinitionBox is a "cmpd" property, the types of the components of an uncompressed image.  Types of
+// 0x8000 and above are defined by their URI.
+type ComponentDefinitionBox struct {
+	*box
+	Types []uint16
+	URIs  []string // of each component, empty for types below 0x8000
+}
+
+func parseComponentDefinitionBox(gen *box, br *bufReader) (Box, error) {
+	cb := &ComponentDefinitionBox{box: gen}
+	n, _ := br.readUint32()
+	for i := uint32(0); i < n && br.ok(); i++ {
+		typ, _ := br.readUint16()
+		var uri string
+		if typ >= 0x8000 {
+			uri, _ = br.readString()
+		}
+		cb.Types = append(cb.Types, typ)
+		cb.URIs = append(cb.URIs, uri)
+	}
+	if !br.ok() {
+		return nil, br.err
+	}
+	return cb, nil
+}
+
+// UncompressedComponent is a component of an uncompressed image as laid out by a "uncC" box.  Index is that of its
+// type in the "cmpd" box.
+type UncompressedComponent struct {
+	Index     uint16
+	BitDepth  uint8
+	Format    uint8 // 0 for unsigned integers
+	AlignSize uint8 // in bytes, 0 to pack samples
+}
+
+// UncompressedFrameConfigBox is a "uncC" property, describing the layout of the samples of an uncompressed image,
+// see ISO/IEC 23001-17 5.2.  Version 1 boxes only give a Profile, whose components are implied.
+type UncompressedFrameConfigBox struct {
+	FullBox
+	Profile        string
+	Components     []UncompressedComponent
+	SamplingType   uint8 // 0 none, 1 4:2:2, 2 4:2:0, 3 4:1:1
+	InterleaveType uint8 // 0 component (planar), 1 pixel, 2 mixed, 3 row, 4 tile-component, 5 multi-Y
+	BlockSize      uint8
+	// ComponentsLittleEndian, BlockPadLSB, BlockLittleEndian, BlockReversed and PadUnknown are the flags of the layout
+	ComponentsLittleEndian bool
+	BlockPadLSB            bool
+	BlockLittleEndian      bool
+	BlockReversed          bool
+	PadUnknown             bool
+	PixelSize              uint32
+	RowAlignSize           uint32
+	TileAlignSize          uint32
+	TileColumns            uint32
+	TileRows               uint32
+}
+
+func parseUncompressedFrameConfigBox(gen *box, br *bufReader) (Box, error) {
+	fb, err := readFullBox(gen, br)
+	if err != nil {
+		return nil, err
+	}
+	uc := &UncompressedFrameConfigBox{FullBox: fb, TileColumns: 1, TileRows: 1}
+	profile, _ := br.readUint32()
+	uc.Profile = string([]byte{byte(profile >> 24), byte(profile >> 16), byte(profile >> 8), byte(profile)})
+	if fb.Version == 1 {
+		if !br.ok() {
+			return nil, br.err
+		}
+		return uc, nil
+	}
+	if fb.Version != 0 {
+		return nil, fmt.Errorf("unsupported uncC version %d", fb.Version)
+	}
+
+	n, _ := br.readUint32()
+	for i := uint32(0); i < n && br.ok(); i++ {
+		var c UncompressedComponent
+		c.Index, _ = br.readUint16()
+		depth, _ := br.readUint8()
+		c.BitDepth = depth + 1
+		c.Format, _ = br.readUint8()
+		c.AlignSize, _ = br.readUint8()
+		uc.Components = append(uc.Components, c)
+	}
+	uc.SamplingType, _ = br.readUint8()
+	uc.InterleaveType, _ = br.readUint8()
+	uc.BlockSize, _ = br.readUint8()
+	flags, _ := br.readUint8()
+	uc.ComponentsLittleEndian = flags&0x80 != 0
+	uc.BlockPadLSB = flags&0x40 != 0
+	uc.BlockLittleEndian = flags&0x20 != 0
+	uc.BlockReversed = flags&0x10 != 0
+	uc.PadUnknown = flags&0x08 != 0
+	uc.PixelSize, _ = br.readUint32()
+	uc.RowAlignSize, _ = br.readUint32()
+	uc.TileAlignSize, _ = br.readUint32()
+	cols, _ := br.readUint32()
+	rows, _ := br.readUint32()
+	uc.TileColumns, uc.TileRows = cols+1, rows+1
+	if !br.ok() {
+		return nil, br.err
+	}
+	return uc, nil
+}
+
+// AV1ConfigurationBox is an "av1C" property, the decoder configuration record of an av01 item, see the AV1 Codec ISO
+// Media File Format Binding 2.3.  ConfigOBUs, usually empty, may hold the sequence header also present in the item's
+// data.
+type AV1ConfigurationBox struct {
+	*box
+	SeqProfile           uint8
+	SeqLevelIdx0         uint8
+	SeqTier0             uint8
+	HighBitDepth         bool
+	TwelveBit            bool
+	Monochrome           bool
+	ChromaSubsamplingX   bool
+	ChromaSubsamplingY   bool
+	ChromaSamplePosition uint8
+	ConfigOBUs           []byte
+}
+
+// BitDepth returns the number of bits per sample, 8, 10 or 12
+func (b *AV1ConfigurationBox) BitDepth() int {
+	switch {
+	case b.TwelveBit:
+		return 12
+	case b.HighBitDepth:
+		return 10
+	}
+	return 8
+}
+
+func parseAV1ConfigurationBox(gen *box, br *bufReader) (Box, error) {
+	buf, err := ioutil.ReadAll(br)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < 4 {
+		return nil, fmt.Errorf("av1C of %d bytes", len(buf))
+	}
+	if buf[0] != 0x81 {
+		return nil, fmt.Errorf("unsupported av1C marker and version %#x", buf[0])
+	}
+	return &AV1ConfigurationBox{
+		box:                  gen,
+		SeqProfile:           buf[1] >> 5,
+		SeqLevelIdx0:         buf[1] & 0x1f,
+		SeqTier0:             buf[2] >> 7,
+		HighBitDepth:         buf[2]&0x40 != 0,
+		TwelveBit:            buf[2]&0x20 != 0,
+		Monochrome:           buf[2]&0x10 != 0,
+		ChromaSubsamplingX:   buf[2]&0x08 != 0,
+		ChromaSubsamplingY:   buf[2]&0x04 != 0,
+		ChromaSamplePosition: buf[2] & 0x03,
+		ConfigOBUs:           buf[4:],
+	}, nil
+}
+
+// HevcConfig is the decoder configuration record of an "hvcC" property, see ISO/IEC 14496-15 8.3.3.1
+type HevcConfig struct {
+	Version                          uint8
+	GeneralProfileSpace              uint8
+	GeneralTierFlag                  uint8
+	GeneralProfileIdc                uint8
+	GeneralProfileCompatibilityFlags uint32
+
+	GeneralLevelIdc uint8
+
+	MinSpatialSegmentationIdc uint16
+	ParallelismType           uint8
+	ChromaFormat              uint8 // 0 = monochrome, 1 = 4:2:0, 2 = 4:2:2, 3 = 4:4:4
+	BitDepthLuma              uint8 // in bits, not minus 8
+	BitDepthChroma            uint8 // in bits, not minus 8
+	AvgFrameRate              uint16
+
+	ConstantFrameRate uint8
+	NumTemporalLayers uint8
+	TemporalIdNested  uint8
 }
 
 type hevcNalArray struct {
@@ -984,9 +1439,10 @@ type hevcNalArray struct {
 	units        [][]byte
 }
 
+// ItemHevcConfigBox is a HEIF "hvcC" property
 type ItemHevcConfigBox struct {
 	*box
-	config   hevcConfig
+	Config   HevcConfig
 	nalArray []*hevcNalArray
 }
 
@@ -1009,40 +1465,46 @@ func (ib *ItemHevcConfigBox) AsHeader() []byte {
 func parseItemHevcConfigBox(gen *box, br *bufReader) (Box, error) {
 	ib := &ItemHevcConfigBox{box: gen}
 
-	c := &ib.config
-	c.version, _ = br.readUint8()
+	c := &ib.Config
+	c.Version, _ = br.readUint8()
 
 	ch, _ := br.readUint8()
-	c.generalProfileSpace = uint8((ch >> 6) & 3)
-	c.generalTierFlag = uint8((ch >> 5) & 1)
-	c.generalProfileIdc = uint8(ch & 0x1F)
+	c.GeneralProfileSpace = uint8((ch >> 6) & 3)
+	c.GeneralTierFlag = uint8((ch >> 5) & 1)
+	c.GeneralProfileIdc = uint8(ch & 0x1F)
 
-	c.generalProfileCompatibilityFlags, _ = br.readUint32()
+	c.GeneralProfileCompatibilityFlags, _ = br.readUint32()
 
 	for i := 0; i < 6; i += 1 {
 		//TODO: general_constraint_indicator_flags
 		ch, _ = br.readUint8()
 	}
 
-	c.generalLevelIdc, _ = br.readUint8()
-	c.minSpatialSegmentationIdc, _ = br.readUint16()
-	c.parallelismType, _ = br.readUint8()
-	c.chromaFormat, _ = br.readUint8()
-	c.bitDepthLuma, _ = br.readUint8()
-	c.bitDepthChroma, _ = br.readUint8()
-	c.avgFrameRate, _ = br.readUint16()
+	c.GeneralLevelIdc, _ = br.readUint8()
+	c.MinSpatialSegmentationIdc, _ = br.readUint16()
+	c.MinSpatialSegmentationIdc &= 0x0FFF
+	c.ParallelismType, _ = br.readUint8()
+	c.ParallelismType &= 3
+	c.ChromaFormat, _ = br.readUint8()
+	c.ChromaFormat &= 3
+	c.BitDepthLuma, _ = br.readUint8()
+	c.BitDepthLuma = c.BitDepthLuma&7 + 8
+	c.BitDepthChroma, _ = br.readUint8()
+	c.BitDepthChroma = c.BitDepthChroma&7 + 8
+	c.AvgFrameRate, _ = br.readUint16()
 
 	ch, _ = br.readUint8()
-	c.constantFrameRate = uint8((ch >> 6) & 0x03)
-	c.numTemporalLayers = uint8((ch >> 3) & 0x07)
-	c.temporalIdNested = uint8((ch >> 2) & 1)
+	c.ConstantFrameRate = uint8((ch >> 6) & 0x03)
+	c.NumTemporalLayers = uint8((ch >> 3) & 0x07)
+	c.TemporalIdNested = uint8((ch >> 2) & 1)
 
-	numArrays, err := br.readUint8()
-	if err != nil {
-		return nil, err
+	numArrays, _ := br.readUint8()
+	if !br.ok() {
+		return nil, br.err
 	}
 
-	for i := 0; i < int(numArrays); i += 1 {
+	var total int // NAL units of every array
+	for i := 0; i < int(numArrays) && br.ok(); i += 1 {
 		ch, _ := br.readUint8()
 
 		na := &hevcNalArray{}
@@ -1050,7 +1512,10 @@ func parseItemHevcConfigBox(gen *box, br *bufReader) (Box, error) {
 		na.unitType = uint8(ch & 0x3F)
 
 		numUnits, _ := br.readUint16()
-		for j := 0; j < int(numUnits); j += 1 {
+		if total += int(numUnits); total > br.state.limits.MaxNALUnits {
+			return nil, limitError("NAL units", total, br.state.limits.MaxNALUnits)
+		}
+		for j := 0; j < int(numUnits) && br.ok(); j += 1 {
 			size, _ := br.readUint16()
 			if size == 0 { // ignore empty NAL units
 				continue
@@ -1058,7 +1523,7 @@ func parseItemHevcConfigBox(gen *box, br *bufReader) (Box, error) {
 
 			unit := make([]byte, size)
 			if _, err := io.ReadFull(br, unit); err != nil {
-				return nil, err
+				return nil, truncated(err)
 			}
 			na.units = append(na.units, unit)
 		}
@@ -0,0 +1,200 @@
+package bmff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestReadBoxSizes(t *testing.T) {
+	var buf bytes.Buffer
+	// a largesize "free" box holding 4 bytes
+	buf.Write([]byte{0, 0, 0, 1, 'f', 'r', 'e', 'e', 0, 0, 0, 0, 0, 0, 0, 20, 1, 2, 3, 4})
+	// a "skip" box of size 0, extending to the end of the file
+	buf.Write([]byte{0, 0, 0, 0, 's', 'k', 'i', 'p', 5, 6, 7})
+
+	r := NewReader(&buf)
+	want := []struct {
+		typ  string
+		body []byte
+	}{
+		{"free", []byte{1, 2, 3, 4}},
+		{"skip", []byte{5, 6, 7}},
+	}
+	for _, w := range want {
+		b, err := r.ReadBox()
+		if err != nil {
+			t.Fatalf("reading %q box: %v", w.typ, err)
+		}
+		if !b.Type().EqualString(w.typ) {
+			t.Fatalf("got %q box, want %q", b.Type(), w.typ)
+		}
+		body, err := ioutil.ReadAll(b.Body())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, w.body) {
+			t.Errorf("%q box body is %v, want %v", w.typ, body, w.body)
+		}
+	}
+	if _, err := r.ReadBox(); err != io.EOF {
+		t.Errorf("got %v after the last box, want io.EOF", err)
+	}
+}
+
+func TestReadBoxTruncated(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"header":    {0, 0, 0, 16, 'f', 'r'},
+		"largesize": {0, 0, 0, 1, 'f', 'r', 'e', 'e', 0, 0},
+	} {
+		_, err := NewReader(bytes.NewReader(data)).ReadBox()
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("%s: got %v, want io.ErrUnexpectedEOF", name, err)
+		}
+	}
+
+	// a meta box whose only child claims more bytes than remain
+	w := NewWriter()
+	w.StartFullBox("meta", 0, 0)
+	w.Write([]byte{0, 0, 0, 64, 'h', 'd', 'l', 'r', 0, 0, 0, 0})
+	w.EndBox()
+	b, err := NewReader(bytes.NewReader(w.Bytes())).ReadBox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Parse(); err == nil {
+		t.Error("parsed a meta box with a truncated child")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	w := NewWriter()
+	w.StartFullBox("meta", 0, 0)
+	for i := 0; i < 3; i++ {
+		w.Box("free", nil)
+	}
+	w.EndBox()
+	flat := w.Bytes()
+
+	w = NewWriter()
+	for i := 0; i < 4; i++ {
+		w.StartFullBox("meta", 0, 0)
+	}
+	for i := 0; i < 4; i++ {
+		w.EndBox()
+	}
+	nested := w.Bytes()
+
+	for _, tc := range []struct {
+		name   string
+		data   []byte
+		limits Limits
+	}{
+		{"boxes", flat, Limits{MaxBoxes: 3}},
+		{"depth", nested, Limits{MaxDepth: 2}},
+	} {
+		if err := parseAll(NewReader(bytes.NewReader(tc.data))); err != nil {
+			t.Errorf("%s: default limits: %v", tc.name, err)
+		}
+		err := parseAll(NewReaderWithLimits(bytes.NewReader(tc.data), tc.limits))
+		if !errors.Is(err, ErrLimitExceeded) {
+			t.Errorf("%s: got %v, want ErrLimitExceeded", tc.name, err)
+		}
+	}
+}
+
+func TestItemLocationBox(t *testing.T) {
+	w := NewWriter()
+	w.StartFullBox("iloc", 1, 0)
+	w.Uint8(4<<4 | 4) // offset_size, length_size
+	w.Uint8(4<<4 | 4) // base_offset_size, index_size
+	w.Uint16(1)
+	w.Uint16(7)
+	w.Uint16(1) // construction_method
+	w.Uint16(0)
+	w.Uint32(100)
+	w.Uint16(2)
+	for _, v := range []uint32{1, 10, 20, 2, 30, 40} {
+		w.Uint32(v)
+	}
+	w.EndBox()
+
+	b, err := NewReader(bytes.NewReader(w.Bytes())).ReadBox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pb, err := b.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	iloc := pb.(*ItemLocationBox)
+	if len(iloc.Items) != 1 {
+		t.Fatalf("got %d items, want 1", len(iloc.Items))
+	}
+	it := iloc.Items[0]
+	want := []OffsetLength{{Offset: 10, Length: 20}, {Offset: 30, Length: 40}}
+	if it.ItemID != 7 || it.ConstructionMethod != 1 || it.BaseOffset != 100 || len(it.Extents) != len(want) {
+		t.Fatalf("got %+v", it)
+	}
+	for i := range want {
+		if it.Extents[i] != want[i] {
+			t.Errorf("extent %d is %+v, want %+v", i, it.Extents[i], want[i])
+		}
+	}
+
+	// field sizes other than 0, 4 or 8 are invalid
+	data := append([]byte(nil), w.Bytes()...)
+	data[12] = 3 << 4
+	b, _ = NewReader(bytes.NewReader(data)).ReadBox()
+	if _, err := b.Parse(); err == nil {
+		t.Error("parsed an iloc box with 3 byte offsets")
+	}
+}
+
+func TestWriterLargeBox(t *testing.T) {
+	h := BoxHeader("mdat", 1<<32)
+	if len(h) != 16 || binary.BigEndian.Uint32(h) != 1 || binary.BigEndian.Uint64(h[8:]) != 1<<32+16 {
+		t.Errorf("got header %v for a box of 4GiB", h)
+	}
+	if h := BoxHeader("mdat", 10); !bytes.Equal(h, []byte{0, 0, 0, 18, 'm', 'd', 'a', 't'}) {
+		t.Errorf("got header %v for a box of 10 bytes", h)
+	}
+}
+
+// parseAll parses every box read from r and the boxes they contain, returning the first error other than
+// ErrUnknownBox
+func parseAll(r *Reader) error {
+	for {
+		b, err := r.ReadBox()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := parseBox(b); err != nil {
+			return err
+		}
+	}
+}
+
+func parseBox(b Box) error {
+	pb, err := b.Parse()
+	if err == ErrUnknownBox {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if mb, ok := pb.(*MetaBox); ok {
+		for _, c := range mb.Children {
+			if err := parseBox(c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+//go:build go1.18
+// +build go1.18
+
+package bmff
+
+import (
+	"bytes"
+	"testing"
+)
+
+// FuzzReader parses every box of the input and the boxes within "meta" boxes, which must fail with an error rather
+// than panic or exhaust memory.  Run with go test -fuzz FuzzReader ./heif/bmff
+func FuzzReader(f *testing.F) {
+	w := NewWriter()
+	w.FullBox("ftyp", 0, 0, []byte("mif1\x00\x00\x00\x00mif1heic"))
+	w.StartFullBox("meta", 0, 0)
+	w.FullBox("hdlr", 0, 0, append([]byte("\x00\x00\x00\x00pict"), make([]byte, 13)...))
+	w.FullBox("pitm", 0, 0, []byte{0, 1})
+	w.FullBox("iloc", 0, 0, []byte{0x44, 0, 0, 1, 0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 4})
+	w.StartFullBox("iinf", 0, 0)
+	w.Uint16(1)
+	w.FullBox("infe", 2, 0, []byte("\x00\x01\x00\x00unci\x00"))
+	w.EndBox()
+	w.StartBox("iprp")
+	w.StartBox("ipco")
+	w.FullBox("ispe", 0, 0, []byte{0, 0, 0, 1, 0, 0, 0, 1})
+	w.EndBox()
+	w.FullBox("ipma", 0, 0, []byte{0, 0, 0, 1, 0, 1, 1, 0x81})
+	w.EndBox()
+	w.EndBox()
+	w.Box("mdat", []byte{1, 2, 3, 4})
+	f.Add(w.Bytes())
+	f.Add([]byte{0, 0, 0, 1, 'f', 'r', 'e', 'e', 0, 0, 0, 0, 0, 0, 0, 16})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := NewReaderWithLimits(bytes.NewReader(data), Limits{MaxBoxes: 1000})
+		for i := 0; i < 100; i++ {
+			b, err := r.ReadBox()
+			if err != nil {
+				return
+			}
+			_ = parseBox(b)
+		}
+	})
+}
@@ -0,0 +1,323 @@
+package bmff
+
+// Boxes of the movie structure, as used by HEIF image sequences (ISO/IEC 23008-12 7) and described by ISO/IEC 14496-12
+// 8.2 through 8.7.
+
+// TypeMoov is the type of the "moov" box holding image sequence tracks.
+var TypeMoov = BoxType{'m', 'o', 'o', 'v'}
+
+// MovieBox is a "moov" box.
+type MovieBox struct {
+	*box
+	Children []Box
+}
+
+func parseMovieBox(gen *box, br *bufReader) (Box, error) {
+	mb := &MovieBox{box: gen}
+	return mb, br.parseAppendBoxes(&mb.Children)
+}
+
+// TrackBox is a "trak" box.
+type TrackBox struct {
+	*box
+	Children []Box
+}
+
+func parseTrackBox(gen *box, br *bufReader) (Box, error) {
+	tb := &TrackBox{box: gen}
+	return tb, br.parseAppendBoxes(&tb.Children)
+}
+
+// TrackHeaderBox is a "tkhd" box.
+type TrackHeaderBox struct {
+	FullBox
+	TrackID  uint32
+	Duration uint64 // in the timescale of the movie
+	Width    uint32 // 16.16 fixed point
+	Height   uint32 // 16.16 fixed point
+}
+
+// Enabled reports whether the track_enabled flag is set.
+func (tb *TrackHeaderBox) Enabled() bool { return tb.Flags&1 != 0 }
+
+func parseTrackHeaderBox(gen *box, br *bufReader) (Box, error) {
+	fb, err := readFullBox(gen, br)
+	if err != nil {
+		return nil, err
+	}
+	tb := &TrackHeaderBox{FullBox: fb}
+	// creation and modification times are 64 bits in version 1
+	bits := uint8(32)
+	if fb.Version == 1 {
+		bits = 64
+	}
+	_, _ = br.readUintN(bits)
+	_, _ = br.readUintN(bits)
+	tb.TrackID, _ = br.readUint32()
+	_, _ = br.readUint32()
+	tb.Duration, _ = br.readUintN(bits)
+	// reserved, layer, alternate_group, volume, reserved and the matrix
+	if _, err := br.Discard(8 + 2 + 2 + 2 + 2 + 36); err != nil {
+		br.err = err
+	}
+	tb.Width, _ = br.readUint32()
+	tb.Height, _ = br.readUint32()
+	if !br.ok() {
+		return nil, br.err
+	}
+	return tb, nil
+}
+
+// MediaBox is a "mdia" box.
+type MediaBox struct {
+	*box
+	Children []Box
+}
+
+func parseMediaBox(gen *box, br *bufReader) (Box, error) {
+	mb := &MediaBox{box: gen}
+	return mb, br.parseAppendBoxes(&mb.Children)
+}
+
+// MediaHeaderBox is a "mdhd" box.
+type MediaHeaderBox struct {
+	FullBox
+	Timescale uint32 // units per second
+	Duration  uint64 // in Timescale units
+}
+
+func parseMediaHeaderBox(gen *box, br *bufReader) (Box, error) {
+	fb, err := readFullBox(gen, br)
+	if err != nil {
+		return nil, err
+	}
+	mb := &MediaHeaderBox{FullBox: fb}
+	bits := uint8(32)
+	if fb.Version == 1 {
+		bits = 64
+	}
+	_, _ = br.readUintN(bits)
+	_, _ = br.readUintN(bits)
+	mb.Timescale, _ = br.readUint32()
+	mb.Duration, _ = br.readUintN(bits)
+	if !br.ok() {
+		return nil, br.err
+	}
+	return mb, nil
+}
+
+// MediaInformationBox is a "minf" box.
+type MediaInformationBox struct {
+	*box
+	Children []Box
+}
+
+func parseMediaInformationBox(gen *box, br *bufReader) (Box, error) {
+	mb := &MediaInformationBox{box: gen}
+	return mb, br.parseAppendBoxes(&mb.Children)
+}
+
+// SampleTableBox is a "stbl" box.
+type SampleTableBox struct {
+	*box
+	Children []Box
+}
+
+func parseSampleTableBox(gen *box, br *bufReader) (Box, error) {
+	sb := &SampleTableBox{box: gen}
+	return sb, br.parseAppendBoxes(&sb.Children)
+}
+
+// SampleDescriptionBox is a "stsd" box, holding one sample entry per description.
+type SampleDescriptionBox struct {
+	FullBox
+	Entries []Box
+}
+
+func parseSampleDescriptionBox(gen *box, br *bufReader) (Box, error) {
+	fb, err := readFullBox(gen, br)
+	if err != nil {
+		return nil, err
+	}
+	sb := &SampleDescriptionBox{FullBox: fb}
+	_, _ = br.readUint32() // entry_count, the boxes that follow are authoritative
+	return sb, br.parseAppendBoxes(&sb.Entries)
+}
+
+// VisualSampleEntry is a sample entry of a video or image sequence track, such as "hvc1".  Its children hold the
+// decoder configuration.
+type VisualSampleEntry struct {
+	*box
+	DataReferenceIndex uint16
+	Width              uint16
+	Height             uint16
+	Children           []Box
+}
+
+func parseVisualSampleEntry(gen *box, br *bufReader) (Box, error) {
+	ve := &VisualSampleEntry{box: gen}
+	if _, err := br.Discard(6); err != nil {
+		return nil, err
+	}
+	ve.DataReferenceIndex, _ = br.readUint16()
+	if _, err := br.Discard(16); err != nil {
+		br.err = err
+	}
+	ve.Width, _ = br.readUint16()
+	ve.Height, _ = br.readUint16()
+	// resolutions, reserved, frame_count, compressorname, depth and pre_defined
+	if _, err := br.Discard(4 + 4 + 4 + 2 + 32 + 2 + 2); err != nil {
+		br.err = err
+	}
+	if !br.ok() {
+		return nil, br.err
+	}
+	return ve, br.parseAppendBoxes(&ve.Children)
+}
+
+// TimeToSampleEntry is a run of Count samples each lasting Delta timescale units.
+type TimeToSampleEntry struct {
+	Count uint32
+	Delta uint32
+}
+
+// TimeToSampleBox is a "stts" box.
+type TimeToSampleBox struct {
+	FullBox
+	Entries []TimeToSampleEntry
+}
+
+func parseTimeToSampleBox(gen *box, br *bufReader) (Box, error) {
+	fb, err := readFullBox(gen, br)
+	if err != nil {
+		return nil, err
+	}
+	tb := &TimeToSampleBox{FullBox: fb}
+	n, _ := br.readUint32()
+	for i := uint32(0); i < n && br.ok(); i++ {
+		var e TimeToSampleEntry
+		e.Count, _ = br.readUint32()
+		e.Delta, _ = br.readUint32()
+		tb.Entries = append(tb.Entries, e)
+	}
+	if !br.ok() {
+		return nil, br.err
+	}
+	return tb, nil
+}
+
+// SampleSizeBox is a "stsz" box.  When SampleSize is not 0 every sample is that size and Sizes is empty.
+type SampleSizeBox struct {
+	FullBox
+	SampleSize  uint32
+	SampleCount uint32
+	Sizes       []uint32
+}
+
+func parseSampleSizeBox(gen *box, br *bufReader) (Box, error) {
+	fb, err := readFullBox(gen, br)
+	if err != nil {
+		return nil, err
+	}
+	sb := &SampleSizeBox{FullBox: fb}
+	sb.SampleSize, _ = br.readUint32()
+	sb.SampleCount, _ = br.readUint32()
+	if max := br.state.limits.MaxSamples; uint64(sb.SampleCount) > uint64(max) {
+		return nil, limitError("samples", int(sb.SampleCount), max)
+	}
+	if sb.SampleSize == 0 {
+		for i := uint32(0); i < sb.SampleCount && br.ok(); i++ {
+			size, _ := br.readUint32()
+			sb.Sizes = append(sb.Sizes, size)
+		}
+	}
+	if !br.ok() {
+		return nil, br.err
+	}
+	return sb, nil
+}
+
+// SampleToChunkEntry gives the number of samples in each chunk from FirstChunk, numbered from 1, up to the
+// FirstChunk of the next entry.
+type SampleToChunkEntry struct {
+	FirstChunk             uint32
+	SamplesPerChunk        uint32
+	SampleDescriptionIndex uint32
+}
+
+// SampleToChunkBox is a "stsc" box.
+type SampleToChunkBox struct {
+	FullBox
+	Entries []SampleToChunkEntry
+}
+
+func parseSampleToChunkBox(gen *box, br *bufReader) (Box, error) {
+	fb, err := readFullBox(gen, br)
+	if err != nil {
+		return nil, err
+	}
+	sb := &SampleToChunkBox{FullBox: fb}
+	n, _ := br.readUint32()
+	for i := uint32(0); i < n && br.ok(); i++ {
+		var e SampleToChunkEntry
+		e.FirstChunk, _ = br.readUint32()
+		e.SamplesPerChunk, _ = br.readUint32()
+		e.SampleDescriptionIndex, _ = br.readUint32()
+		sb.Entries = append(sb.Entries, e)
+	}
+	if !br.ok() {
+		return nil, br.err
+	}
+	return sb, nil
+}
+
+// ChunkOffsetBox is a "stco" or "co64" box, giving the file offset of each chunk.
+type ChunkOffsetBox struct {
+	FullBox
+	Offsets []uint64
+}
+
+func parseChunkOffsetBox(gen *box, br *bufReader) (Box, error) {
+	fb, err := readFullBox(gen, br)
+	if err != nil {
+		return nil, err
+	}
+	cb := &ChunkOffsetBox{FullBox: fb}
+	bits := uint8(32)
+	if gen.Type().EqualString("co64") {
+		bits = 64
+	}
+	n, _ := br.readUint32()
+	for i := uint32(0); i < n && br.ok(); i++ {
+		off, _ := br.readUintN(bits)
+		cb.Offsets = append(cb.Offsets, off)
+	}
+	if !br.ok() {
+		return nil, br.err
+	}
+	return cb, nil
+}
+
+// SyncSampleBox is a "stss" box listing the samples, numbered from 1, that can be decoded independently.  When a
+// track has none, every sample is a sync sample.
+type SyncSampleBox struct {
+	FullBox
+	Samples []uint32
+}
+
+func parseSyncSampleBox(gen *box, br *bufReader) (Box, error) {
+	fb, err := readFullBox(gen, br)
+	if err != nil {
+		return nil, err
+	}
+	sb := &SyncSampleBox{FullBox: fb}
+	n, _ := br.readUint32()
+	for i := uint32(0); i < n && br.ok(); i++ {
+		s, _ := br.readUint32()
+		sb.Samples = append(sb.Samples, s)
+	}
+	if !br.ok() {
+		return nil, br.err
+	}
+	return sb, nil
+}
@@ -0,0 +1,133 @@
+package bmff
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Writer builds BMFF boxes in memory.  Boxes are opened by StartBox or StartFullBox and their size is filled in by
+// EndBox, so their contents can be written without knowing it in advance.
+type Writer struct {
+	buf  []byte
+	open []int // offsets of the boxes started and not yet ended
+}
+
+// NewWriter returns an empty Writer
+func NewWriter() *Writer {
+	return new(Writer)
+}
+
+// StartBox opens a box of type typ, whose contents are written until the matching EndBox
+func (w *Writer) StartBox(typ string) {
+	t := boxType(typ)
+	w.open = append(w.open, len(w.buf))
+	w.buf = append(w.buf, 0, 0, 0, 0, t[0], t[1], t[2], t[3])
+}
+
+// StartFullBox opens a full box, writing its version and flags
+func (w *Writer) StartFullBox(typ string, version uint8, flags uint32) {
+	w.StartBox(typ)
+	w.Uint32(uint32(version)<<24 | flags&0xffffff)
+}
+
+// EndBox closes the box opened last, setting its size.  Boxes of more than 4GiB are given a largesize, moving their
+// contents 8 bytes further.
+func (w *Writer) EndBox() {
+	if len(w.open) == 0 {
+		panic("bmff: EndBox without StartBox")
+	}
+	start := w.open[len(w.open)-1]
+	w.open = w.open[:len(w.open)-1]
+
+	size := uint64(len(w.buf) - start)
+	if size <= math.MaxUint32 {
+		binary.BigEndian.PutUint32(w.buf[start:], uint32(size))
+		return
+	}
+	w.buf = append(w.buf, make([]byte, 8)...)
+	copy(w.buf[start+16:], w.buf[start+8:len(w.buf)-8])
+	binary.BigEndian.PutUint32(w.buf[start:], 1)
+	binary.BigEndian.PutUint64(w.buf[start+8:], size+8)
+}
+
+// Box writes a box of type typ holding payload
+func (w *Writer) Box(typ string, payload []byte) {
+	w.StartBox(typ)
+	w.buf = append(w.buf, payload...)
+	w.EndBox()
+}
+
+// FullBox writes a full box holding payload after its version and flags
+func (w *Writer) FullBox(typ string, version uint8, flags uint32, payload []byte) {
+	w.StartFullBox(typ, version, flags)
+	w.buf = append(w.buf, payload...)
+	w.EndBox()
+}
+
+// Write appends p to the box opened last, it never fails
+func (w *Writer) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+func (w *Writer) Uint8(v uint8) {
+	w.buf = append(w.buf, v)
+}
+
+func (w *Writer) Uint16(v uint16) {
+	w.buf = append(w.buf, byte(v>>8), byte(v))
+}
+
+func (w *Writer) Uint32(v uint32) {
+	w.buf = append(w.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (w *Writer) Uint64(v uint64) {
+	w.Uint32(uint32(v >> 32))
+	w.Uint32(uint32(v))
+}
+
+// UintN writes v in n bytes, 0, 4 or 8 as used by the size fields of "iloc" boxes
+func (w *Writer) UintN(v uint64, n int) {
+	switch n {
+	case 4:
+		w.Uint32(uint32(v))
+	case 8:
+		w.Uint64(v)
+	}
+}
+
+// String writes s as a NUL terminated string
+func (w *Writer) String(s string) {
+	w.buf = append(w.buf, s...)
+	w.buf = append(w.buf, 0)
+}
+
+// Len returns the number of bytes written
+func (w *Writer) Len() int {
+	return len(w.buf)
+}
+
+// Bytes returns the boxes written, which must all have been ended
+func (w *Writer) Bytes() []byte {
+	if len(w.open) > 0 {
+		panic("bmff: Bytes with unended boxes")
+	}
+	return w.buf
+}
+
+// BoxHeader returns the header of a box of type typ whose contents are size bytes long, using a largesize when needed
+func BoxHeader(typ string, size uint64) []byte {
+	t := boxType(typ)
+	if size+8 <= math.MaxUint32 {
+		h := make([]byte, 8)
+		binary.BigEndian.PutUint32(h, uint32(size+8))
+		copy(h[4:], t[:])
+		return h
+	}
+	h := make([]byte, 16)
+	binary.BigEndian.PutUint32(h, 1)
+	copy(h[4:], t[:])
+	binary.BigEndian.PutUint64(h[8:], size+16)
+	return h
+}
@@ -0,0 +1,61 @@
+package bmff
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	w := NewWriter()
+	w.StartBox("meta")
+	w.FullBox("pitm", 0, 0, []byte{0, 1})
+	w.StartFullBox("iloc", 1, 0x020304)
+	w.Uint8(1)
+	w.Uint16(2)
+	w.Uint32(3)
+	w.UintN(4, 4)
+	w.UintN(5, 8)
+	w.UintN(6, 0)
+	w.String("a")
+	w.EndBox()
+	w.Box("free", nil)
+	w.EndBox()
+
+	want := []byte("\x00\x00\x00\x3fmeta" +
+		"\x00\x00\x00\x0epitm\x00\x00\x00\x00\x00\x01" +
+		"\x00\x00\x00\x21iloc\x01\x02\x03\x04\x01\x00\x02\x00\x00\x00\x03\x00\x00\x00\x04" +
+		"\x00\x00\x00\x00\x00\x00\x00\x05a\x00" +
+		"\x00\x00\x00\x08free")
+	if got := w.Bytes(); !bytes.Equal(got, want) || w.Len() != len(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestBoxHeader(t *testing.T) {
+	if got := BoxHeader("mdat", 8); !bytes.Equal(got, []byte("\x00\x00\x00\x10mdat")) {
+		t.Errorf("got %q", got)
+	}
+	// contents of 4GiB need a largesize
+	if got := BoxHeader("mdat", 1<<32); !bytes.Equal(got, []byte("\x00\x00\x00\x01mdat\x00\x00\x00\x01\x00\x00\x00\x10")) {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestWriterUnbalanced(t *testing.T) {
+	for name, f := range map[string]func(w *Writer){
+		"EndBox": func(w *Writer) { w.EndBox() },
+		"Bytes": func(w *Writer) {
+			w.StartBox("meta")
+			w.Bytes()
+		},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s did not panic", name)
+				}
+			}()
+			f(NewWriter())
+		}()
+	}
+}
@@ -0,0 +1,188 @@
+package heif
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/dcarbone/go-heicker/heif/bmff"
+)
+
+// DepthRepresentationType is how the samples of a depth image map to depth, see ISO/IEC 23008-2 F.14.3.4.
+type DepthRepresentationType uint32
+
+const (
+	DepthUniformInverseZ     DepthRepresentationType = 0
+	DepthUniformDisparity    DepthRepresentationType = 1
+	DepthUniformZ            DepthRepresentationType = 2
+	DepthNonuniformDisparity DepthRepresentationType = 3
+)
+
+// DepthRepresentation is the depth representation information SEI message carried by the auxC property of a depth
+// image.  Values whose Has flag is false are 0.
+type DepthRepresentation struct {
+	Type                   DepthRepresentationType
+	HasZNear, HasZFar      bool
+	HasDMin, HasDMax       bool
+	ZNear, ZFar            float64
+	DMin, DMax             float64
+	DisparityReferenceView uint32
+}
+
+// depthRepresentationPayload is the SEI payload type of depth_representation_info
+const depthRepresentationPayload = 177
+
+// DepthRepresentation returns the depth representation information of a depth auxiliary image.  ok is false if its
+// auxC property has none.  As for libheif, the auxC subtype is read as a 16 bit length and a single SEI NAL unit.
+func (it *Item) DepthRepresentation() (dr *DepthRepresentation, ok bool, err error) {
+	var sub []byte
+	for _, p := range it.Properties {
+		if p, ok := p.(*bmff.AuxiliaryTypeProperty); ok {
+			sub = p.AuxSubtype
+		}
+	}
+	if len(sub) < 2 {
+		return nil, false, nil
+	}
+	n := int(sub[0])<<8 | int(sub[1])
+	if n > len(sub)-2 || n < 2 {
+		return nil, false, errors.New("heif: auxC subtype is not a SEI NAL unit")
+	}
+	// skip the NAL unit header
+	rbsp := removeEmulationPrevention(sub[4 : 2+n])
+
+	for len(rbsp) > 1 { // the last byte holds the rbsp trailing bits
+		var typ, size int
+		for len(rbsp) > 0 && rbsp[0] == 0xff {
+			typ += 255
+			rbsp = rbsp[1:]
+		}
+		if len(rbsp) == 0 {
+			break
+		}
+		typ += int(rbsp[0])
+		rbsp = rbsp[1:]
+		for len(rbsp) > 0 && rbsp[0] == 0xff {
+			size += 255
+			rbsp = rbsp[1:]
+		}
+		if len(rbsp) == 0 {
+			break
+		}
+		size += int(rbsp[0])
+		rbsp = rbsp[1:]
+		if size > len(rbsp) {
+			return nil, false, fmt.Errorf("heif: SEI payload of %d bytes exceeds the NAL unit", size)
+		}
+		if typ == depthRepresentationPayload {
+			dr, err := parseDepthRepresentation(rbsp[:size])
+			if err != nil {
+				return nil, false, err
+			}
+			return dr, true, nil
+		}
+		rbsp = rbsp[size:]
+	}
+	return nil, false, nil
+}
+
+// removeEmulationPrevention removes the 0x03 bytes inserted after each pair of zero bytes of a NAL unit
+func removeEmulationPrevention(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		out = append(out, c)
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// seiBitReader reads the bits of a SEI payload, most significant first
+type seiBitReader struct {
+	b   []byte
+	pos int // in bits
+	err error
+}
+
+func (r *seiBitReader) bits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= 8*len(r.b) {
+			r.err = errors.New("heif: depth representation info is truncated")
+			return 0
+		}
+		v = v<<1 | uint32(r.b[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+	return v
+}
+
+// uvlc reads an unsigned Exp-Golomb code
+func (r *seiBitReader) uvlc() uint32 {
+	zeros := 0
+	for r.bits(1) == 0 && r.err == nil {
+		if zeros++; zeros > 31 {
+			r.err = errors.New("heif: invalid Exp-Golomb code")
+			return 0
+		}
+	}
+	return 1<<uint(zeros) - 1 + r.bits(zeros)
+}
+
+// element reads a depth_rep_info_element, a floating point value, see ISO/IEC 23008-2 F.14.3.4
+func (r *seiBitReader) element() float64 {
+	sign := r.bits(1)
+	exponent := int(r.bits(7))
+	mlen := int(r.bits(5)) + 1
+	mantissa := float64(r.bits(mlen))
+
+	var v float64
+	if exponent > 0 {
+		v = math.Pow(2, float64(exponent-31)) * (1 + mantissa/math.Pow(2, float64(mlen)))
+	} else {
+		v = math.Pow(2, -float64(30+mlen)) * mantissa
+	}
+	if sign == 1 {
+		v = -v
+	}
+	return v
+}
+
+func parseDepthRepresentation(payload []byte) (*DepthRepresentation, error) {
+	r := &seiBitReader{b: payload}
+	dr := &DepthRepresentation{
+		HasZNear: r.bits(1) == 1,
+		HasZFar:  r.bits(1) == 1,
+		HasDMin:  r.bits(1) == 1,
+		HasDMax:  r.bits(1) == 1,
+	}
+	dr.Type = DepthRepresentationType(r.uvlc())
+	if dr.HasDMin || dr.HasDMax {
+		dr.DisparityReferenceView = r.uvlc()
+	}
+	if dr.HasZNear {
+		dr.ZNear = r.element()
+	}
+	if dr.HasZFar {
+		dr.ZFar = r.element()
+	}
+	if dr.HasDMin {
+		dr.DMin = r.element()
+	}
+	if dr.HasDMax {
+		dr.DMax = r.element()
+	}
+	// the model of nonuniform disparity that follows is not needed to normalize samples
+	if r.err != nil {
+		return nil, r.err
+	}
+	return dr, nil
+}
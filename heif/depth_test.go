@@ -0,0 +1,51 @@
+package heif
+
+import (
+	"testing"
+
+	"github.com/dcarbone/go-heicker/heif/bmff"
+)
+
+func TestDepthRepresentation(t *testing.T) {
+	depth := func(sub []byte) *Item {
+		return &Item{Properties: []bmff.Box{&bmff.AuxiliaryTypeProperty{AuxType: "urn:mpeg:hevc:2015:auxid:2", AuxSubtype: sub}}}
+	}
+	// uniform_z with a near plane of 1 and a far plane of 3: the NAL unit length, a prefix SEI NAL unit header,
+	// payload type 177 of 5 bytes and the rbsp trailing bits
+	sei := []byte{0x00, 0x0a, 0x4e, 0x01, 0xb1, 0x05, 0xc6, 0x3e, 0x01, 0x00, 0x20, 0x80}
+
+	dr, ok, err := depth(sei).DepthRepresentation()
+	if err != nil || !ok || *dr != (DepthRepresentation{Type: DepthUniformZ, HasZNear: true, HasZFar: true, ZNear: 1, ZFar: 3}) {
+		t.Errorf("got %+v, %v, %v", dr, ok, err)
+	}
+
+	// another payload before it, with emulation prevention bytes
+	other := []byte{0x00, 0x10, 0x4e, 0x01, 0x05, 0x03, 0x00, 0x00, 0x03, 0x01}
+	other = append(other, sei[4:]...)
+	if dr, ok, err := depth(other).DepthRepresentation(); err != nil || !ok || dr.ZFar != 3 {
+		t.Errorf("got %+v, %v, %v after another payload", dr, ok, err)
+	}
+
+	for _, sub := range [][]byte{nil, {0x00, 0x04, 0x4e, 0x01, 0x05, 0x00}} {
+		if _, ok, err := depth(sub).DepthRepresentation(); ok || err != nil {
+			t.Errorf("%x: got %v, %v without depth representation information", sub, ok, err)
+		}
+	}
+	for _, sub := range [][]byte{
+		{0x00, 0x20, 0x4e, 0x01},
+		{0x00, 0x08, 0x4e, 0x01, 0xb1, 0x05, 0xc6, 0x3e, 0x01, 0x00},
+		{0x00, 0x07, 0x4e, 0x01, 0xb1, 0x02, 0xc6, 0x3e, 0x80},
+	} {
+		if _, _, err := depth(sub).DepthRepresentation(); err == nil {
+			t.Errorf("%x: expected an error", sub)
+		}
+	}
+}
+
+func TestRemoveEmulationPrevention(t *testing.T) {
+	got := removeEmulationPrevention([]byte{0, 0, 3, 1, 0, 0, 3, 0, 0, 3, 3})
+	want := []byte{0, 0, 1, 0, 0, 0, 0, 3}
+	if string(got) != string(want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
@@ -0,0 +1,40 @@
+//go:build go1.18
+// +build go1.18
+
+package heif
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// FuzzOpen reads the metadata, items and tracks of the input.  Errors reading the metadata must match ErrMalformed.
+// Run with go test -fuzz FuzzOpen ./heif
+func FuzzOpen(f *testing.F) {
+	f.Add(testFile(f))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		hf := Open(bytes.NewReader(data))
+		if _, err := hf.FileType(); err != nil {
+			if !errors.Is(err, ErrMalformed) {
+				t.Fatalf("metadata error not matching ErrMalformed: %v", err)
+			}
+			return
+		}
+		_, _ = hf.PrimaryItem()
+		_, _ = hf.EXIF()
+		_, _ = hf.XMP()
+		items, _ := hf.Items()
+		for _, it := range items {
+			_, _ = hf.GetItemData(it)
+			_, _, _ = it.VisualDimensions()
+		}
+		tracks, _ := hf.Tracks()
+		for _, tr := range tracks {
+			for i := range tr.Samples {
+				_, _ = tr.SampleData(i)
+			}
+		}
+	})
+}
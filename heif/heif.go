@@ -0,0 +1,659 @@
+/*
+Copyright 2018 The go4 Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package heif reads HEIF containers, as found in Apple HEIC/HEVC images.
+// This package does not decode images; it only reads the metadata.
+//
+// This package is a work in progress and makes no API compatibility
+// promises.
+package heif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/dcarbone/go-heicker/heif/bmff"
+)
+
+// File represents a HEIF file.
+//
+// Methods on File should not be called concurrently.
+type File struct {
+	ra      io.ReaderAt
+	size    int64 // of ra, math.MaxInt64 if unknown
+	limits  bmff.Limits
+	primary *Item
+
+	// Populated lazily, by getMeta:
+	metaErr error
+	meta    *BoxMeta
+}
+
+// BoxMeta contains the low-level BMFF metadata boxes.
+type BoxMeta struct {
+	FileType      *bmff.FileTypeBox
+	Handler       *bmff.HandlerBox
+	PrimaryItem   *bmff.PrimaryItemBox
+	ItemInfo      *bmff.ItemInfoBox
+	Properties    *bmff.ItemPropertiesBox
+	ItemLocation  *bmff.ItemLocationBox
+	ItemData      *bmff.ItemDataBox
+	ItemReference *bmff.ItemReferenceBox
+	Movie         *bmff.MovieBox // image sequence tracks, if any
+}
+
+// EXIFItemID returns the item ID of the EXIF part, or 0 if not found.
+func (m *BoxMeta) EXIFItemID() uint32 {
+	if m.ItemInfo == nil {
+		return 0
+	}
+	for _, ife := range m.ItemInfo.ItemInfos {
+		if ife.ItemType == "Exif" {
+			return uint32(ife.ItemID)
+		}
+	}
+	return 0
+}
+
+// ContentTypeXMP is the content type of "mime" items holding XMP.
+const ContentTypeXMP = "application/rdf+xml"
+
+// XMPItemID returns the item ID of the XMP part, or 0 if not found.
+func (m *BoxMeta) XMPItemID() uint32 {
+	if m.ItemInfo == nil {
+		return 0
+	}
+	for _, ife := range m.ItemInfo.ItemInfos {
+		if ife.ItemType == "mime" && ife.ContentType == ContentTypeXMP {
+			return uint32(ife.ItemID)
+		}
+	}
+	return 0
+}
+
+// Item represents an item in a HEIF file.
+type Item struct {
+	f *File
+
+	ID         uint32
+	Info       *bmff.ItemInfoEntry
+	Location   *bmff.ItemLocationBoxEntry // location in file
+	Properties []bmff.Box
+	References []*bmff.ItemReferenceEntry
+}
+
+func (item *Item) Reference(name string) *bmff.ItemReferenceEntry {
+	for _, r := range item.References {
+		if name == r.Type().String() {
+			return r
+		}
+	}
+	return nil
+}
+
+// SpatialExtents returns the item's spatial extents property values, if present,
+// not correcting from any camera rotation metadata.
+func (it *Item) SpatialExtents() (width, height int, ok bool) {
+	for _, p := range it.Properties {
+		if p, ok := p.(*bmff.ImageSpatialExtentsProperty); ok {
+			return int(p.ImageWidth), int(p.ImageHeight), true
+		}
+	}
+	return
+}
+
+// HevcConfig returns the hvcC box
+func (it *Item) HevcConfig() (b *bmff.ItemHevcConfigBox, ok bool) {
+	for _, p := range it.Properties {
+		if p, ok := p.(*bmff.ItemHevcConfigBox); ok {
+			return p, true
+		}
+	}
+	return
+}
+
+// AV1Config returns the av1C property of an av01 item
+func (it *Item) AV1Config() (b *bmff.AV1ConfigurationBox, ok bool) {
+	for _, p := range it.Properties {
+		if p, ok := p.(*bmff.AV1ConfigurationBox); ok {
+			return p, true
+		}
+	}
+	return
+}
+
+// JPEGConfig returns the jpgC property of a jpeg item
+func (it *Item) JPEGConfig() (b *bmff.JPEGConfigurationBox, ok bool) {
+	for _, p := range it.Properties {
+		if p, ok := p.(*bmff.JPEGConfigurationBox); ok {
+			return p, true
+		}
+	}
+	return
+}
+
+// UncompressedConfig returns the uncC and cmpd properties of an unci item.  cmpd is nil for version 1 uncC
+// properties, whose profile implies the components.
+func (it *Item) UncompressedConfig() (unc *bmff.UncompressedFrameConfigBox, cmpd *bmff.ComponentDefinitionBox, ok bool) {
+	for _, p := range it.Properties {
+		switch p := p.(type) {
+		case *bmff.UncompressedFrameConfigBox:
+			unc = p
+		case *bmff.ComponentDefinitionBox:
+			cmpd = p
+		}
+	}
+	return unc, cmpd, unc != nil
+}
+
+// Rotations returns the number of 90 degree rotations counter-clockwise that this
+// image should be rendered at, in the range [0,3].
+func (it *Item) Rotations() int {
+	for _, p := range it.Properties {
+		if p, ok := p.(*bmff.ImageRotation); ok {
+			return int(p.Angle)
+		}
+	}
+	return 0
+}
+
+// Mirror returns the mirroring axis: 0 = vertical, 1 = horizontal
+func (it *Item) Mirror() int {
+	for _, p := range it.Properties {
+		if p, ok := p.(*bmff.ImageMirror); ok {
+			return int(p.Mirror)
+		}
+	}
+	return 0
+}
+
+// Hidden reports whether the item is marked as hidden, as are tiles, thumbnails and auxiliary images that should not
+// be displayed on their own.
+func (it *Item) Hidden() bool {
+	return it.Info != nil && it.Info.Flags&1 != 0
+}
+
+// ICCProfile returns the item's ICC colour profile, if present.
+func (it *Item) ICCProfile() (profile []byte, ok bool) {
+	for _, p := range it.Properties {
+		if p, ok := p.(*bmff.ColourInformationBox); ok && p.ICCProfile != nil {
+			return p.ICCProfile, true
+		}
+	}
+	return
+}
+
+// AuxiliaryType returns the URN of an auxiliary image's auxC property, if present.
+func (it *Item) AuxiliaryType() (urn string, ok bool) {
+	for _, p := range it.Properties {
+		if p, ok := p.(*bmff.AuxiliaryTypeProperty); ok {
+			return p.AuxType, true
+		}
+	}
+	return
+}
+
+// VisualDimensions returns the item's width and height after correcting
+// for any rotations.
+func (it *Item) VisualDimensions() (width, height int, ok bool) {
+	width, height, ok = it.SpatialExtents()
+	for i := 0; i < it.Rotations(); i++ {
+		width, height = height, width
+	}
+	return
+}
+
+// Open returns a handle to access a HEIF file, whose boxes are parsed within bmff.DefaultLimits.
+func Open(f io.ReaderAt) *File {
+	return OpenWithLimits(f, bmff.DefaultLimits)
+}
+
+// OpenWithLimits returns a handle to access a HEIF file, whose boxes are parsed within l.
+func OpenWithLimits(f io.ReaderAt, l bmff.Limits) *File {
+	return &File{ra: f, size: readerSize(f), limits: l}
+}
+
+// readerSize returns the size of ra if it tells, as *bytes.Reader, *io.SectionReader and *os.File do, or
+// math.MaxInt64
+func readerSize(ra io.ReaderAt) int64 {
+	switch v := ra.(type) {
+	case interface{ Size() int64 }:
+		return v.Size()
+	case interface{ Stat() (os.FileInfo, error) }:
+		if fi, err := v.Stat(); err == nil && fi.Mode().IsRegular() {
+			return fi.Size()
+		}
+	}
+	return math.MaxInt64
+}
+
+// ErrMalformed is matched, using errors.Is, by the errors of files whose boxes are malformed or truncated, or exceed
+// the limits they are parsed within, in which case they match bmff.ErrLimitExceeded too.
+var ErrMalformed = errors.New("heif: malformed file")
+
+// malformedError is an error caused by a malformed file
+type malformedError struct {
+	err error
+}
+
+func (e *malformedError) Error() string        { return e.err.Error() }
+func (e *malformedError) Unwrap() error        { return e.err }
+func (e *malformedError) Is(target error) bool { return target == ErrMalformed }
+
+// malformed returns err, if not nil, as an error matching ErrMalformed
+func malformed(err error) error {
+	if err == nil || errors.Is(err, ErrMalformed) {
+		return err
+	}
+	return &malformedError{err: err}
+}
+
+// ErrNoEXIF is returned by File.EXIF when a file does not contain an EXIF item.
+var ErrNoEXIF = errors.New("heif: no EXIF found")
+
+// ErrNoXMP is returned by File.XMP when a file does not contain an XMP item.
+var ErrNoXMP = errors.New("heif: no XMP found")
+
+// ErrUnknownItem is returned by File.ItemByID for unknown items.
+var ErrUnknownItem = errors.New("heif: unknown item")
+
+// EXIF returns the raw EXIF data from the file, starting at the TIFF header.
+// The error is ErrNoEXIF if the file did not contain EXIF.
+//
+// The raw EXIF data can be parsed by the
+// github.com/rwcarlsen/goexif/exif package's Decode function.
+func (f *File) EXIF() ([]byte, error) {
+	meta, err := f.getMeta()
+	if err != nil {
+		return nil, err
+	}
+	exifID := meta.EXIFItemID()
+	if exifID == 0 {
+		return nil, ErrNoEXIF
+	}
+	it, err := f.ItemByID(exifID)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := f.GetItemData(it)
+	if err != nil {
+		return nil, err
+	}
+
+	// the payload is preceded by exif_tiff_header_offset, the number of bytes before the TIFF header, usually those of
+	// an "Exif\0\0" identifier (ISO/IEC 23008-12 A.2.1)
+	if len(data) < 4 {
+		return nil, errors.New("heif: EXIF item too short")
+	}
+	off := binary.BigEndian.Uint32(data)
+	if uint64(off)+8 > uint64(len(data)-4) {
+		return nil, fmt.Errorf("heif: EXIF TIFF header offset %d out of range", off)
+	}
+	data = data[4+off:]
+
+	// some writers leave the offset at 0 despite including the identifier
+	if bytes.HasPrefix(data, []byte(exifIdentifier)) {
+		data = data[len(exifIdentifier):]
+	}
+	if !bytes.HasPrefix(data, []byte("II*\x00")) && !bytes.HasPrefix(data, []byte("MM\x00*")) {
+		return nil, errors.New("heif: EXIF item has no TIFF header")
+	}
+	return data, nil
+}
+
+// exifIdentifier precedes the TIFF header in jpeg APP1 segments and, usually, in EXIF items
+const exifIdentifier = "Exif\x00\x00"
+
+// XMP returns the XMP packet from the file.
+// The error is ErrNoXMP if the file did not contain XMP.
+func (f *File) XMP() ([]byte, error) {
+	meta, err := f.getMeta()
+	if err != nil {
+		return nil, err
+	}
+	xmpID := meta.XMPItemID()
+	if xmpID == 0 {
+		return nil, ErrNoXMP
+	}
+	it, err := f.ItemByID(xmpID)
+	if err != nil {
+		return nil, err
+	}
+	if enc := it.Info.ContentEncoding; enc != "" {
+		return nil, fmt.Errorf("heif: unsupported XMP content encoding %q", enc)
+	}
+	return f.GetItemData(it)
+}
+
+// maxDataSize caps the data of an item or sample read to memory, for sanity
+const maxDataSize = 200 << 20
+
+// GetItemData returns data specified by item's location, the concatenation of its extents, read from the file or
+// from its "idat" box.
+func (f *File) GetItemData(it *Item) ([]byte, error) {
+	loc := it.Location
+	if loc == nil {
+		return nil, malformed(errors.New("heif: item has no location"))
+	}
+	if loc.DataReferenceIndex != 0 {
+		return nil, errors.New("heif: item data in other files is not supported")
+	}
+
+	var (
+		idat []byte
+		size = uint64(f.size)
+	)
+	switch loc.ConstructionMethod {
+	case 0:
+	case 1:
+		if f.meta.ItemData == nil {
+			return nil, malformed(fmt.Errorf("heif: no idat for item"))
+		}
+		idat = f.meta.ItemData.Data
+		size = uint64(len(idat))
+	default:
+		return nil, fmt.Errorf("heif: unsupported construction method %d", loc.ConstructionMethod)
+	}
+	if len(loc.Extents) == 0 {
+		return nil, malformed(errors.New("heif: item has no extents"))
+	}
+
+	// resolve every extent before reading any.  A length of 0 extends to the end of the file or idat.
+	extents := make([]bmff.OffsetLength, len(loc.Extents))
+	var total uint64
+	for i, e := range loc.Extents {
+		off := loc.BaseOffset + e.Offset
+		if off < loc.BaseOffset || off > size {
+			return nil, malformed(fmt.Errorf("heif: extent offset %d out of range", off))
+		}
+		length := e.Length
+		if length == 0 {
+			length = size - off
+		}
+		if length > size-off {
+			return nil, malformed(fmt.Errorf("heif: extent of %d bytes at %d out of range", length, off))
+		}
+		if total += length; total > maxDataSize {
+			return nil, fmt.Errorf("heif: declared size %d exceeds threshold of %d bytes", total, maxDataSize)
+		}
+		extents[i] = bmff.OffsetLength{Offset: off, Length: length}
+	}
+
+	buf := make([]byte, 0, total)
+	for _, e := range extents {
+		if idat != nil {
+			buf = append(buf, idat[e.Offset:e.Offset+e.Length]...)
+			continue
+		}
+		part := buf[len(buf) : len(buf)+int(e.Length)]
+		if err := f.readAt(part, e.Offset); err != nil {
+			return nil, err
+		}
+		buf = buf[:len(buf)+len(part)]
+	}
+	return buf, nil
+}
+
+// readAt fills buf from offset off of the file, failing if it ends first
+func (f *File) readAt(buf []byte, off uint64) error {
+	if off > math.MaxInt64 {
+		return malformed(fmt.Errorf("heif: offset %d out of range", off))
+	}
+	n, err := f.ra.ReadAt(buf, int64(off))
+	if err == io.EOF && n == len(buf) {
+		err = nil
+	}
+	if err == io.EOF {
+		return malformed(fmt.Errorf("heif: file truncated, read %d of %d bytes at %d", n, len(buf), off))
+	}
+	return err
+}
+
+func (f *File) setMetaErr(err error) error {
+	err = malformed(err)
+	if f.metaErr == nil {
+		f.metaErr = err
+	}
+	return err
+}
+
+func (f *File) getMeta() (*BoxMeta, error) {
+	if f.metaErr != nil {
+		return nil, f.metaErr
+	}
+	if f.meta != nil {
+		return f.meta, nil
+	}
+	sr := io.NewSectionReader(f.ra, 0, f.size)
+	bmr := bmff.NewReaderWithLimits(sr, f.limits)
+
+	meta := &BoxMeta{}
+
+	pbox, err := bmr.ReadAndParseBox(bmff.TypeFtyp)
+	if err != nil {
+		return nil, f.setMetaErr(err)
+	}
+	meta.FileType = pbox.(*bmff.FileTypeBox)
+
+	// the meta box follows ftyp.  Image sequences also have a moov box, usually after the meta box and often after the
+	// media data, so the rest of the file is only searched when the brands announce one.
+	sequence := hasBrand(meta.FileType, "msf1")
+	var metabox *bmff.MetaBox
+	for metabox == nil || sequence && meta.Movie == nil {
+		box, err := bmr.ReadBox()
+		if err != nil {
+			if metabox != nil || meta.Movie != nil {
+				// e.g. a truncated mdat after the boxes that were found
+				break
+			}
+			if err == io.EOF {
+				err = errors.New("heif: HEIF file lacks meta box")
+			}
+			return nil, f.setMetaErr(err)
+		}
+		switch box.Type() {
+		case bmff.TypeMeta:
+			pbox, err := box.Parse()
+			if err != nil {
+				return nil, f.setMetaErr(fmt.Errorf("error parsing read %q box: %w", bmff.TypeMeta, err))
+			}
+			metabox = pbox.(*bmff.MetaBox)
+		case bmff.TypeMoov:
+			pbox, err := box.Parse()
+			if err != nil {
+				return nil, f.setMetaErr(fmt.Errorf("error parsing read %q box: %w", bmff.TypeMoov, err))
+			}
+			meta.Movie = pbox.(*bmff.MovieBox)
+		default:
+			if !sequence && metabox == nil {
+				return nil, f.setMetaErr(fmt.Errorf("error reading %q box: got box type %q instead", bmff.TypeMeta, box.Type()))
+			}
+		}
+	}
+	if metabox == nil {
+		// a sequence without still images
+		f.meta = meta
+		return f.meta, nil
+	}
+
+	for _, box := range metabox.Children {
+		boxp, err := box.Parse()
+		if err == bmff.ErrUnknownBox {
+			continue
+		}
+		if err != nil {
+			return nil, f.setMetaErr(err)
+		}
+		switch v := boxp.(type) {
+		case *bmff.HandlerBox:
+			meta.Handler = v
+		case *bmff.PrimaryItemBox:
+			meta.PrimaryItem = v
+		case *bmff.ItemInfoBox:
+			meta.ItemInfo = v
+		case *bmff.ItemPropertiesBox:
+			meta.Properties = v
+		case *bmff.ItemLocationBox:
+			meta.ItemLocation = v
+		case *bmff.ItemDataBox:
+			meta.ItemData = v
+		case *bmff.ItemReferenceBox:
+			meta.ItemReference = v
+		}
+	}
+
+	f.meta = meta
+	return f.meta, nil
+}
+
+func hasBrand(ft *bmff.FileTypeBox, brand string) bool {
+	if ft.MajorBrand == brand {
+		return true
+	}
+	for _, b := range ft.Compatible {
+		if b == brand {
+			return true
+		}
+	}
+	return false
+}
+
+// FileType returns the file's "ftyp" box.
+func (f *File) FileType() (*bmff.FileTypeBox, error) {
+	meta, err := f.getMeta()
+	if err != nil {
+		return nil, err
+	}
+	return meta.FileType, nil
+}
+
+// Items returns every item in the file, in the order they are declared.
+func (f *File) Items() ([]*Item, error) {
+	meta, err := f.getMeta()
+	if err != nil {
+		return nil, err
+	}
+	if meta.ItemInfo == nil {
+		return nil, nil
+	}
+	items := make([]*Item, 0, len(meta.ItemInfo.ItemInfos))
+	for _, iie := range meta.ItemInfo.ItemInfos {
+		it, err := f.ItemByID(uint32(iie.ItemID))
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+	return items, nil
+}
+
+// PrimaryItem returns the HEIF file's primary item.
+func (f *File) PrimaryItem() (*Item, error) {
+	meta, err := f.getMeta()
+	if err != nil {
+		return nil, err
+	}
+	if meta.PrimaryItem == nil {
+		return nil, malformed(errors.New("heif: HEIF file lacks primary item box"))
+	}
+	it, err := f.ItemByID(uint32(meta.PrimaryItem.ItemID))
+	if err == ErrUnknownItem {
+		return nil, malformed(fmt.Errorf("heif: primary item %d has no info entry", meta.PrimaryItem.ItemID))
+	}
+	return it, err
+}
+
+// ItemByID by returns the file's Item of a given ID.
+// If the ID is known, the returned error is ErrUnknownItem.
+func (f *File) ItemByID(id uint32) (*Item, error) {
+	meta, err := f.getMeta()
+	if err != nil {
+		return nil, err
+	}
+	it := &Item{
+		f:  f,
+		ID: id,
+	}
+	if meta.ItemLocation != nil {
+		for _, ilbe := range meta.ItemLocation.Items {
+			if uint32(ilbe.ItemID) == id {
+				shallowCopy := ilbe
+				it.Location = &shallowCopy
+			}
+		}
+	}
+
+	if meta.ItemReference != nil {
+		for _, ir := range meta.ItemReference.ItemRefs {
+			if uint32(ir.FromItemID) == id {
+				it.References = append(it.References, ir)
+			}
+		}
+	}
+
+	if meta.ItemInfo != nil {
+		for _, iie := range meta.ItemInfo.ItemInfos {
+			if uint32(iie.ItemID) == id {
+				it.Info = iie
+			}
+		}
+	}
+	if it.Info == nil {
+		return nil, ErrUnknownItem
+	}
+	if meta.Properties != nil {
+		allProps := meta.Properties.PropertyContainer.Properties
+		for _, ipa := range meta.Properties.Associations {
+			// TODO: I've never seen a file with more than
+			// top-level ItemPropertyAssociation box, but
+			// apparently they can exist with different
+			// versions/flags. For now we just merge them
+			// all together, but that's not really right.
+			// So for now, just bail once a previous loop
+			// found anything.
+			if len(it.Properties) > 0 {
+				break
+			}
+
+			for _, ipai := range ipa.Entries {
+				if ipai.ItemID != id {
+					continue
+				}
+				for _, ass := range ipai.Associations {
+					if ass.Index != 0 && int(ass.Index) <= len(allProps) {
+						box := allProps[ass.Index-1]
+						// properties that fail to parse are kept unparsed, unless they exceed the parse limits
+						boxp, err := box.Parse()
+						if errors.Is(err, bmff.ErrLimitExceeded) {
+							return nil, malformed(err)
+						}
+						if err == nil {
+							box = boxp
+						}
+						it.Properties = append(it.Properties, box)
+					}
+				}
+			}
+		}
+	}
+	return it, nil
+}
@@ -0,0 +1,173 @@
+package heif
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"testing"
+
+	"github.com/dcarbone/go-heicker/heif/bmff"
+)
+
+var (
+	testTIFF = []byte("MM\x00*\x00\x00\x00\x08\x00\x00")
+	testXMP  = []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"></x:xmpmeta>`)
+)
+
+// testFile returns a file of a 4x3 unci image, rotated and mirrored, its data split into three extents, with EXIF
+// and XMP items
+func testFile(t testing.TB) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+	w := NewWriter()
+	it := w.AddUncompressed(img)
+	data := it.Extents[0]
+	it.Extents = [][]byte{data[:5], data[5:20], data[20:]}
+	it.AddProperty(RotationProperty(1), MirrorProperty(bmff.MirrorHorizontal))
+	w.AddEXIF(testTIFF, it.ID)
+	w.AddXMP(testXMP, it.ID)
+
+	var buf bytes.Buffer
+	if _, err := w.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	f := Open(bytes.NewReader(testFile(t)))
+
+	it, err := f.PrimaryItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if it.ID != 1 || it.Info.ItemType != "unci" || it.Hidden() {
+		t.Errorf("got primary item %d of type %q, hidden %v", it.ID, it.Info.ItemType, it.Hidden())
+	}
+	if w, h, ok := it.SpatialExtents(); !ok || w != 4 || h != 3 {
+		t.Errorf("got dimensions %dx%d, %v", w, h, ok)
+	}
+	if it.Rotations() != 1 || it.Mirror() != int(bmff.MirrorHorizontal) {
+		t.Errorf("got %d rotations and mirror %d", it.Rotations(), it.Mirror())
+	}
+	if _, _, ok := it.UncompressedConfig(); !ok {
+		t.Error("no uncC and cmpd properties")
+	}
+
+	data, err := f.GetItemData(it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 4*3*3 {
+		t.Fatalf("got %d bytes of item data, want %d", len(data), 4*3*3)
+	}
+	for i, v := range data {
+		if want := uint8(i/3*4 + i%3); v != want {
+			t.Fatalf("byte %d of item data is %d, want %d", i, v, want)
+		}
+	}
+
+	exif, err := f.EXIF()
+	if err != nil || !bytes.Equal(exif, testTIFF) {
+		t.Errorf("got EXIF %q, %v", exif, err)
+	}
+	xmp, err := f.XMP()
+	if err != nil || !bytes.Equal(xmp, testXMP) {
+		t.Errorf("got XMP %q, %v", xmp, err)
+	}
+
+	items, err := f.Items()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 || !items[1].Hidden() || !items[2].Hidden() {
+		t.Errorf("got %d items, want 3 with the metadata hidden", len(items))
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	data := testFile(t)
+	for n := 0; n < len(data); n++ {
+		f := Open(bytes.NewReader(data[:n]))
+		_, err := f.PrimaryItem()
+		items, _ := f.Items()
+		for _, it := range items {
+			if err == nil {
+				_, err = f.GetItemData(it)
+			}
+		}
+		if !errors.Is(err, ErrMalformed) {
+			t.Fatalf("truncated to %d of %d bytes: got %v, want ErrMalformed", n, len(data), err)
+		}
+	}
+}
+
+// limitsFile returns a file of three 4x4 items, each of 16 bytes and two properties
+func limitsFile(t *testing.T) []byte {
+	t.Helper()
+	w := NewWriter()
+	for i := 0; i < 3; i++ {
+		w.AddItem("unci", make([]byte, 16)).AddProperty(SpatialExtentsProperty(4, 4), RotationProperty(uint8(i)))
+	}
+	var buf bytes.Buffer
+	if _, err := w.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestOpenWithLimits(t *testing.T) {
+	data := limitsFile(t)
+	if items, err := Open(bytes.NewReader(data)).Items(); err != nil || len(items) != 3 {
+		t.Fatalf("got %d items, %v", len(items), err)
+	}
+
+	for _, l := range []bmff.Limits{
+		{MaxBoxes: 10},
+		{MaxDepth: 2},
+		{MaxItems: 2},
+		{MaxProperties: 3},
+	} {
+		_, err := OpenWithLimits(bytes.NewReader(data), l).Items()
+		if !errors.Is(err, bmff.ErrLimitExceeded) || !errors.Is(err, ErrMalformed) {
+			t.Errorf("%+v: got %v", l, err)
+		}
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	data := limitsFile(t)
+	meta := bytes.Index(data, []byte("meta")) - 4
+	iloc := bytes.Index(data, []byte("iloc")) - 4
+
+	// the iloc field sizes are 4 bits each, one of 0, 4 or 8
+	badSize := append([]byte(nil), data...)
+	badSize[iloc+12] = 0x33
+
+	for name, b := range map[string][]byte{
+		"truncated meta":   data[:meta+40],
+		"truncated iloc":   data[:iloc+20],
+		"iloc field sizes": badSize,
+	} {
+		if _, err := Open(bytes.NewReader(b)).Items(); !errors.Is(err, ErrMalformed) {
+			t.Errorf("%s: got %v, want %v", name, err, ErrMalformed)
+		}
+	}
+
+	// the meta box is whole, the item data of the last items cut off
+	f := Open(bytes.NewReader(data[:len(data)-20]))
+	items, err := f.Items()
+	if err != nil || len(items) != 3 {
+		t.Fatalf("got %d items, %v", len(items), err)
+	}
+	if b, err := f.GetItemData(items[0]); err != nil || len(b) != 16 {
+		t.Errorf("got %d bytes, %v", len(b), err)
+	}
+	for _, it := range items[1:] {
+		if _, err := f.GetItemData(it); !errors.Is(err, ErrMalformed) {
+			t.Errorf("item %d: got %v, want %v", it.ID, err, ErrMalformed)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package heif
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dcarbone/go-heicker/heif/bmff"
+)
+
+// Track is an image sequence track, read from a "trak" box of the file's "moov" box.
+type Track struct {
+	f *File
+
+	ID        uint32
+	Handler   string // "pict" for image sequences, "vide" for video
+	Width     int
+	Height    int
+	Timescale uint32 // units per second of sample durations
+	Duration  uint64 // in Timescale units
+
+	// SampleEntry is the first sample description, e.g. a "hvc1" entry.  Tracks whose samples reference more than one
+	// description are rejected.
+	SampleEntry *bmff.VisualSampleEntry
+	Samples     []Sample
+}
+
+// Sample is a single coded frame of a track, in decoding order.
+type Sample struct {
+	Offset   uint64
+	Size     uint32
+	Duration uint32 // in the Timescale of the track
+	Sync     bool   // decodable without reference to previous samples
+}
+
+// Codec returns the type of the track's sample entry, e.g. "hvc1".
+func (t *Track) Codec() string {
+	if t.SampleEntry == nil {
+		return ""
+	}
+	return t.SampleEntry.Type().String()
+}
+
+// HevcConfig returns the hvcC box of the track's sample entry.
+func (t *Track) HevcConfig() (b *bmff.ItemHevcConfigBox, ok bool) {
+	if t.SampleEntry == nil {
+		return
+	}
+	for _, c := range t.SampleEntry.Children {
+		if p, err := c.Parse(); err == nil {
+			if p, ok := p.(*bmff.ItemHevcConfigBox); ok {
+				return p, true
+			}
+		}
+	}
+	return
+}
+
+// SampleData returns the data of sample i, numbered from 0.
+func (t *Track) SampleData(i int) ([]byte, error) {
+	if i < 0 || i >= len(t.Samples) {
+		return nil, fmt.Errorf("heif: sample %d out of range", i)
+	}
+	s := t.Samples[i]
+	if s.Size > maxDataSize {
+		return nil, fmt.Errorf("heif: declared size %d exceeds threshold of %d bytes", s.Size, maxDataSize)
+	}
+	if s.Offset > uint64(t.f.size) || uint64(s.Size) > uint64(t.f.size)-s.Offset {
+		return nil, malformed(fmt.Errorf("heif: sample %d of %d bytes at %d out of range", i, s.Size, s.Offset))
+	}
+	buf := make([]byte, s.Size)
+	if err := t.f.readAt(buf, s.Offset); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Tracks returns the visual tracks of the file, those holding image sequences or video, in the order they are
+// declared.  Files without a "moov" box have none.
+func (f *File) Tracks() ([]*Track, error) {
+	meta, err := f.getMeta()
+	if err != nil {
+		return nil, err
+	}
+	if meta.Movie == nil {
+		return nil, nil
+	}
+
+	var tracks []*Track
+	for _, b := range meta.Movie.Children {
+		p, err := b.Parse()
+		if err != nil {
+			continue
+		}
+		trak, ok := p.(*bmff.TrackBox)
+		if !ok {
+			continue
+		}
+		t, err := f.readTrack(trak)
+		if err != nil {
+			return nil, malformed(err)
+		}
+		if t != nil {
+			tracks = append(tracks, t)
+		}
+	}
+	return tracks, nil
+}
+
+// sampleTable holds the boxes of a "stbl" box needed to locate samples
+type sampleTable struct {
+	desc    *bmff.SampleDescriptionBox
+	times   *bmff.TimeToSampleBox
+	sizes   *bmff.SampleSizeBox
+	chunks  *bmff.SampleToChunkBox
+	offsets *bmff.ChunkOffsetBox
+	sync    *bmff.SyncSampleBox
+}
+
+// readTrack returns nil for tracks that are not visual
+func (f *File) readTrack(trak *bmff.TrackBox) (*Track, error) {
+	var (
+		t  = &Track{f: f}
+		st sampleTable
+	)
+
+	// walk trak -> mdia -> minf -> stbl, picking up the boxes of interest along the way
+	var walk func(children []bmff.Box) error
+	walk = func(children []bmff.Box) error {
+		for _, b := range children {
+			p, err := b.Parse()
+			if err == bmff.ErrUnknownBox {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("heif: error parsing %q box: %w", b.Type(), err)
+			}
+			switch v := p.(type) {
+			case *bmff.TrackHeaderBox:
+				t.ID, t.Width, t.Height = v.TrackID, int(v.Width>>16), int(v.Height>>16)
+			case *bmff.MediaHeaderBox:
+				t.Timescale, t.Duration = v.Timescale, v.Duration
+			case *bmff.HandlerBox:
+				t.Handler = v.HandlerType
+			case *bmff.MediaBox:
+				err = walk(v.Children)
+			case *bmff.MediaInformationBox:
+				err = walk(v.Children)
+			case *bmff.SampleTableBox:
+				err = walk(v.Children)
+			case *bmff.SampleDescriptionBox:
+				st.desc = v
+			case *bmff.TimeToSampleBox:
+				st.times = v
+			case *bmff.SampleSizeBox:
+				st.sizes = v
+			case *bmff.SampleToChunkBox:
+				st.chunks = v
+			case *bmff.ChunkOffsetBox:
+				st.offsets = v
+			case *bmff.SyncSampleBox:
+				st.sync = v
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(trak.Children); err != nil {
+		return nil, err
+	}
+
+	if t.Handler != "pict" && t.Handler != "vide" {
+		return nil, nil
+	}
+	if st.desc == nil || st.sizes == nil || st.chunks == nil || st.offsets == nil {
+		return nil, fmt.Errorf("heif: track %d lacks a sample table", t.ID)
+	}
+	for _, e := range st.desc.Entries {
+		if p, err := e.Parse(); err == nil {
+			if ve, ok := p.(*bmff.VisualSampleEntry); ok {
+				t.SampleEntry = ve
+				break
+			}
+		}
+	}
+	if t.SampleEntry == nil {
+		return nil, fmt.Errorf("heif: track %d has no supported sample entry", t.ID)
+	}
+	if t.Width == 0 || t.Height == 0 {
+		t.Width, t.Height = int(t.SampleEntry.Width), int(t.SampleEntry.Height)
+	}
+
+	var err error
+	if t.Samples, err = st.samples(); err != nil {
+		return nil, fmt.Errorf("heif: track %d: %w", t.ID, err)
+	}
+	return t, nil
+}
+
+// samples resolves the location, duration and sync flag of each sample, see ISO/IEC 14496-12 8.7
+func (st sampleTable) samples() ([]Sample, error) {
+	n := int(st.sizes.SampleCount)
+	if st.sizes.SampleSize == 0 && len(st.sizes.Sizes) != n {
+		return nil, errors.New("sample size count mismatch")
+	}
+	samples := make([]Sample, 0, n)
+
+	// chunks are numbered from 1, each stsc entry applying until the first chunk of the next
+	entries := st.chunks.Entries
+	for i, e := range entries {
+		if e.FirstChunk == 0 || i > 0 && e.FirstChunk <= entries[i-1].FirstChunk {
+			return nil, errors.New("invalid sample to chunk table")
+		}
+		if e.SampleDescriptionIndex != 1 {
+			return nil, errors.New("multiple sample descriptions are not supported")
+		}
+		last := uint32(len(st.offsets.Offsets))
+		if i+1 < len(entries) {
+			last = entries[i+1].FirstChunk - 1
+		}
+		for c := e.FirstChunk; c <= last && len(samples) < n; c++ {
+			if int(c) > len(st.offsets.Offsets) {
+				return nil, errors.New("chunk offset out of range")
+			}
+			off := st.offsets.Offsets[c-1]
+			for j := uint32(0); j < e.SamplesPerChunk && len(samples) < n; j++ {
+				size := st.sizes.SampleSize
+				if size == 0 {
+					size = st.sizes.Sizes[len(samples)]
+				}
+				samples = append(samples, Sample{Offset: off, Size: size, Sync: st.sync == nil})
+				off += uint64(size)
+			}
+		}
+	}
+	if len(samples) != n {
+		return nil, fmt.Errorf("sample table locates %d of %d samples", len(samples), n)
+	}
+
+	if st.times != nil {
+		i := 0
+		for _, e := range st.times.Entries {
+			for j := uint32(0); j < e.Count && i < n; j++ {
+				samples[i].Duration = e.Delta
+				i++
+			}
+		}
+	}
+	if st.sync != nil {
+		for _, s := range st.sync.Samples {
+			if s >= 1 && int(s) <= n {
+				samples[s-1].Sync = true
+			}
+		}
+	}
+	return samples, nil
+}
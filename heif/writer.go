@@ -0,0 +1,446 @@
+package heif
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"math"
+
+	"github.com/dcarbone/go-heicker/heif/bmff"
+)
+
+// Writer builds a HEIF file of items, such as already coded or uncompressed images and their metadata.  The data of
+// every item is written to a single mdat box following the meta box.
+type Writer struct {
+	// Brand and CompatibleBrands are those of the ftyp box, "mif1" by default
+	Brand            string
+	CompatibleBrands []string
+
+	items   []*WriterItem
+	primary uint32
+}
+
+// WriterItem is an item to be written by a Writer.  Its fields may be changed until the file is written.
+type WriterItem struct {
+	ID   uint32
+	Type string
+	Name string
+	// ContentType is that of "mime" items
+	ContentType string
+	// Hidden items, such as the tiles of a grid, are not meant to be displayed on their own
+	Hidden bool
+	// Extents are the data of the item, written in order
+	Extents    [][]byte
+	Properties []Property
+	References []WriterReference
+}
+
+// WriterReference is a reference of an item to others, e.g. "thmb", "cdsc", "auxl" or "dimg"
+type WriterReference struct {
+	Type string
+	To   []uint32
+}
+
+// Property is an item property, the box written to the ipco box.  Decoders must support essential properties to
+// decode an item.  Identical properties are only written once.
+type Property struct {
+	Box       []byte
+	Essential bool
+}
+
+// NewWriter returns an empty Writer
+func NewWriter() *Writer {
+	return &Writer{Brand: "mif1", CompatibleBrands: []string{"mif1"}}
+}
+
+// AddItem adds an item of type typ holding the concatenation of extents, numbered after those added before
+func (w *Writer) AddItem(typ string, extents ...[]byte) *WriterItem {
+	it := &WriterItem{ID: uint32(len(w.items) + 1), Type: typ, Extents: extents}
+	w.items = append(w.items, it)
+	return it
+}
+
+// SetPrimary sets the primary item, by default the first image item added
+func (w *Writer) SetPrimary(id uint32) {
+	w.primary = id
+}
+
+// AddReference adds a reference of type typ from the item to others
+func (it *WriterItem) AddReference(typ string, to ...uint32) {
+	it.References = append(it.References, WriterReference{Type: typ, To: to})
+}
+
+// AddProperty associates properties with the item
+func (it *WriterItem) AddProperty(props ...Property) {
+	it.Properties = append(it.Properties, props...)
+}
+
+// AddJPEG adds a jpeg item holding data, a complete JPEG codestream
+func (w *Writer) AddJPEG(data []byte) (*WriterItem, error) {
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	it := w.AddItem("jpeg", data)
+	it.AddProperty(SpatialExtentsProperty(cfg.Width, cfg.Height))
+	return it, nil
+}
+
+// AddUncompressed adds an unci item holding img as 8 bit RGB samples, pixel interleaved
+func (w *Writer) AddUncompressed(img image.Image) *WriterItem {
+	b := img.Bounds()
+	data := make([]byte, 0, 3*b.Dx()*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			data = append(data, c.R, c.G, c.B)
+		}
+	}
+	it := w.AddItem("unci", data)
+	it.AddProperty(
+		SpatialExtentsProperty(b.Dx(), b.Dy()),
+		ComponentDefinitionProperty(bmff.ComponentRed, bmff.ComponentGreen, bmff.ComponentBlue),
+		UncompressedConfigProperty(&bmff.UncompressedFrameConfigBox{
+			Profile: "rgb3",
+			Components: []bmff.UncompressedComponent{
+				{Index: 0, BitDepth: 8},
+				{Index: 1, BitDepth: 8},
+				{Index: 2, BitDepth: 8},
+			},
+			InterleaveType: 1,
+		}),
+		PixelInformationProperty(8, 8, 8),
+	)
+	return it
+}
+
+// AddEXIF adds an Exif item describing the item to, holding tiff, EXIF data starting with its TIFF header
+func (w *Writer) AddEXIF(tiff []byte, to uint32) *WriterItem {
+	// exif_tiff_header_offset, followed by the identifier it skips
+	data := append([]byte{0, 0, 0, byte(len(exifIdentifier))}, exifIdentifier...)
+	it := w.AddItem("Exif", append(data, tiff...))
+	it.Hidden = true
+	it.AddReference("cdsc", to)
+	return it
+}
+
+// AddXMP adds a mime item holding packet, the XMP describing the item to
+func (w *Writer) AddXMP(packet []byte, to uint32) *WriterItem {
+	it := w.AddItem("mime", packet)
+	it.ContentType = ContentTypeXMP
+	it.Hidden = true
+	it.AddReference("cdsc", to)
+	return it
+}
+
+// SpatialExtentsProperty returns an ispe property, the dimensions of an image item
+func SpatialExtentsProperty(width, height int) Property {
+	bw := bmff.NewWriter()
+	bw.StartFullBox("ispe", 0, 0)
+	bw.Uint32(uint32(width))
+	bw.Uint32(uint32(height))
+	bw.EndBox()
+	return Property{Box: bw.Bytes()}
+}
+
+// RotationProperty returns an irot property, rotating the image item anti-clockwise by angle quarter turns
+func RotationProperty(angle uint8) Property {
+	bw := bmff.NewWriter()
+	bw.Box("irot", []byte{angle & 3})
+	return Property{Box: bw.Bytes(), Essential: true}
+}
+
+// MirrorProperty returns an imir property, mirroring the image item about axis, bmff.MirrorVertical or
+// bmff.MirrorHorizontal
+func MirrorProperty(axis uint8) Property {
+	bw := bmff.NewWriter()
+	bw.Box("imir", []byte{axis & 1})
+	return Property{Box: bw.Bytes(), Essential: true}
+}
+
+// ICCProfileProperty returns a colr property holding an ICC profile
+func ICCProfileProperty(profile []byte) Property {
+	bw := bmff.NewWriter()
+	bw.StartBox("colr")
+	bw.Write([]byte("prof"))
+	bw.Write(profile)
+	bw.EndBox()
+	return Property{Box: bw.Bytes()}
+}
+
+// PixelInformationProperty returns a pixi property, the bits per sample of each channel of an image item
+func PixelInformationProperty(bits ...uint8) Property {
+	bw := bmff.NewWriter()
+	bw.StartFullBox("pixi", 0, 0)
+	bw.Uint8(uint8(len(bits)))
+	bw.Write(bits)
+	bw.EndBox()
+	return Property{Box: bw.Bytes()}
+}
+
+// AuxiliaryTypeProperty returns an auxC property, the type of an auxiliary image such as
+// "urn:mpeg:mpegB:cicp:systems:auxiliary:alpha"
+func AuxiliaryTypeProperty(urn string) Property {
+	bw := bmff.NewWriter()
+	bw.StartFullBox("auxC", 0, 0)
+	bw.String(urn)
+	bw.EndBox()
+	return Property{Box: bw.Bytes(), Essential: true}
+}
+
+// JPEGConfigProperty returns a jpgC property, the start of the codestream of the jpeg items it is associated with
+func JPEGConfigProperty(prefix []byte) Property {
+	bw := bmff.NewWriter()
+	bw.Box("jpgC", prefix)
+	return Property{Box: bw.Bytes()}
+}
+
+// ComponentDefinitionProperty returns a cmpd property, the types of the components of unci items, such as
+// bmff.ComponentRed
+func ComponentDefinitionProperty(types ...uint16) Property {
+	bw := bmff.NewWriter()
+	bw.StartBox("cmpd")
+	bw.Uint32(uint32(len(types)))
+	for _, t := range types {
+		bw.Uint16(t)
+	}
+	bw.EndBox()
+	return Property{Box: bw.Bytes()}
+}
+
+// UncompressedConfigProperty returns a version 0 uncC property describing the layout of unci items.  Zero
+// TileColumns and TileRows are written as a single tile.
+func UncompressedConfigProperty(c *bmff.UncompressedFrameConfigBox) Property {
+	bw := bmff.NewWriter()
+	bw.StartFullBox("uncC", 0, 0)
+	bw.Write([]byte(c.Profile + "\x00\x00\x00\x00")[:4])
+	bw.Uint32(uint32(len(c.Components)))
+	for _, comp := range c.Components {
+		bw.Uint16(comp.Index)
+		bw.Uint8(comp.BitDepth - 1)
+		bw.Uint8(comp.Format)
+		bw.Uint8(comp.AlignSize)
+	}
+	bw.Uint8(c.SamplingType)
+	bw.Uint8(c.InterleaveType)
+	bw.Uint8(c.BlockSize)
+	var flags uint8
+	for bit, set := range []bool{c.ComponentsLittleEndian, c.BlockPadLSB, c.BlockLittleEndian, c.BlockReversed, c.PadUnknown} {
+		if set {
+			flags |= 0x80 >> uint(bit)
+		}
+	}
+	bw.Uint8(flags)
+	bw.Uint32(c.PixelSize)
+	bw.Uint32(c.RowAlignSize)
+	bw.Uint32(c.TileAlignSize)
+	for _, n := range []uint32{c.TileColumns, c.TileRows} {
+		if n > 0 {
+			n--
+		}
+		bw.Uint32(n)
+	}
+	bw.EndBox()
+	return Property{Box: bw.Bytes(), Essential: true}
+}
+
+// WriteTo writes the file to out
+func (w *Writer) WriteTo(out io.Writer) (int64, error) {
+	if len(w.items) == 0 {
+		return 0, errors.New("heif: no items to write")
+	}
+	if len(w.items) > math.MaxUint16 {
+		return 0, fmt.Errorf("heif: %d items, exceeding %d", len(w.items), math.MaxUint16)
+	}
+	primary := w.primary
+	for _, it := range w.items {
+		if primary == 0 && it.Type != "Exif" && it.Type != "mime" {
+			primary = it.ID
+		}
+	}
+	if primary == 0 {
+		return 0, errors.New("heif: no primary item")
+	}
+
+	var size uint64
+	for _, it := range w.items {
+		for _, e := range it.Extents {
+			size += uint64(len(e))
+		}
+	}
+
+	ftyp := bmff.NewWriter()
+	ftyp.StartBox("ftyp")
+	ftyp.Write([]byte(w.Brand))
+	ftyp.Uint32(0)
+	for _, b := range w.CompatibleBrands {
+		ftyp.Write([]byte(b))
+	}
+	ftyp.EndBox()
+
+	// offsets into the file, and so the meta box, depend on the size of the meta box, which does not depend on them
+	meta := w.meta(primary, 0, size)
+	mdatHeader := bmff.BoxHeader("mdat", size)
+	meta = w.meta(primary, uint64(ftyp.Len()+len(meta)+len(mdatHeader)), size)
+
+	var n int64
+	for _, b := range [][]byte{ftyp.Bytes(), meta, mdatHeader} {
+		m, err := out.Write(b)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	for _, it := range w.items {
+		for _, e := range it.Extents {
+			m, err := out.Write(e)
+			n += int64(m)
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// meta returns the meta box, the data of the items starting at offset in the file and being size bytes long
+func (w *Writer) meta(primary uint32, offset, size uint64) []byte {
+	bw := bmff.NewWriter()
+	bw.StartFullBox("meta", 0, 0)
+
+	bw.StartFullBox("hdlr", 0, 0)
+	bw.Uint32(0) // pre_defined
+	bw.Write([]byte("pict"))
+	bw.Write(make([]byte, 12)) // reserved
+	bw.String("")
+	bw.EndBox()
+
+	bw.StartFullBox("pitm", 0, 0)
+	bw.Uint16(uint16(primary))
+	bw.EndBox()
+
+	fieldSize := 4
+	if offset+size > math.MaxUint32 {
+		fieldSize = 8
+	}
+	bw.StartFullBox("iloc", 0, 0)
+	bw.Uint8(uint8(fieldSize<<4 | fieldSize))
+	bw.Uint8(0) // base_offset_size and reserved
+	bw.Uint16(uint16(len(w.items)))
+	for _, it := range w.items {
+		bw.Uint16(uint16(it.ID))
+		bw.Uint16(0) // data_reference_index
+		bw.Uint16(uint16(len(it.Extents)))
+		for _, e := range it.Extents {
+			bw.UintN(offset, fieldSize)
+			bw.UintN(uint64(len(e)), fieldSize)
+			offset += uint64(len(e))
+		}
+	}
+	bw.EndBox()
+
+	bw.StartFullBox("iinf", 0, 0)
+	bw.Uint16(uint16(len(w.items)))
+	for _, it := range w.items {
+		var flags uint32
+		if it.Hidden {
+			flags = 1
+		}
+		bw.StartFullBox("infe", 2, flags)
+		bw.Uint16(uint16(it.ID))
+		bw.Uint16(0) // item_protection_index
+		bw.Write([]byte(it.Type))
+		bw.String(it.Name)
+		if it.Type == "mime" {
+			bw.String(it.ContentType)
+		}
+		bw.EndBox()
+	}
+	bw.EndBox()
+
+	var refs bool
+	for _, it := range w.items {
+		refs = refs || len(it.References) > 0
+	}
+	if refs {
+		bw.StartFullBox("iref", 0, 0)
+		for _, it := range w.items {
+			for _, r := range it.References {
+				bw.StartBox(r.Type)
+				bw.Uint16(uint16(it.ID))
+				bw.Uint16(uint16(len(r.To)))
+				for _, id := range r.To {
+					bw.Uint16(uint16(id))
+				}
+				bw.EndBox()
+			}
+		}
+		bw.EndBox()
+	}
+
+	var (
+		props   [][]byte
+		indices = make([][]int, len(w.items))
+	)
+	for i, it := range w.items {
+		for _, p := range it.Properties {
+			index := -1
+			for j, b := range props {
+				if bytes.Equal(b, p.Box) {
+					index = j
+				}
+			}
+			if index < 0 {
+				index = len(props)
+				props = append(props, p.Box)
+			}
+			if p.Essential {
+				index |= 1 << 15
+			}
+			indices[i] = append(indices[i], index)
+		}
+	}
+	bw.StartBox("iprp")
+	bw.StartBox("ipco")
+	for _, b := range props {
+		bw.Write(b)
+	}
+	bw.EndBox()
+	var large uint32
+	if len(props) >= 1<<7 {
+		large = 1
+	}
+	bw.StartFullBox("ipma", 0, large)
+	var associated uint32
+	for _, ix := range indices {
+		if len(ix) > 0 {
+			associated++
+		}
+	}
+	bw.Uint32(associated)
+	for i, it := range w.items {
+		if len(indices[i]) == 0 {
+			continue
+		}
+		bw.Uint16(uint16(it.ID))
+		bw.Uint8(uint8(len(indices[i])))
+		for _, index := range indices[i] {
+			// property indices are numbered from 1, the essential flag being the top bit
+			essential, index := index>>15, index&(1<<15-1)+1
+			if large == 1 {
+				bw.Uint16(uint16(essential<<15 | index))
+			} else {
+				bw.Uint8(uint8(essential<<7 | index))
+			}
+		}
+	}
+	bw.EndBox()
+	bw.EndBox()
+
+	bw.EndBox()
+	return bw.Bytes()
+}
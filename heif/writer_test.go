@@ -0,0 +1,144 @@
+package heif
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+
+	"github.com/dcarbone/go-heicker/heif/bmff"
+)
+
+// written returns the file written by w, opened
+func written(t *testing.T, w *Writer) *File {
+	t.Helper()
+	var buf bytes.Buffer
+	n, err := w.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("wrote %d bytes, reported %d", buf.Len(), n)
+	}
+	return Open(bytes.NewReader(buf.Bytes()))
+}
+
+func TestWriter(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	img.SetRGBA(2, 1, color.RGBA{200, 100, 50, 255})
+	var codestream bytes.Buffer
+	if err := jpeg.Encode(&codestream, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	tiff := []byte("MM\x00*\x00\x00\x00\x08\x00\x00")
+	xmp := []byte("<x:xmpmeta/>")
+
+	w := NewWriter()
+	w.Brand, w.CompatibleBrands = "heic", []string{"mif1", "heic"}
+	unci := w.AddUncompressed(img)
+	unci.Hidden = true
+	j, err := w.AddJPEG(codestream.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.AddProperty(RotationProperty(1), MirrorProperty(bmff.MirrorHorizontal), ICCProfileProperty([]byte("icc")))
+	j.AddReference("thmb", unci.ID)
+	w.SetPrimary(j.ID)
+	w.AddEXIF(tiff, j.ID)
+	w.AddXMP(xmp, j.ID)
+	split := w.AddItem("jpeg", codestream.Bytes()[:20], codestream.Bytes()[20:])
+	split.Name = "split"
+	split.AddProperty(SpatialExtentsProperty(3, 2))
+
+	f := written(t, w)
+	ft, err := f.FileType()
+	if err != nil || ft.MajorBrand != "heic" || len(ft.Compatible) != 2 {
+		t.Errorf("got %+v, %v", ft, err)
+	}
+	primary, err := f.PrimaryItem()
+	if err != nil || primary.ID != j.ID || primary.Info.ItemType != "jpeg" || primary.Hidden() {
+		t.Fatalf("got %+v, %v", primary, err)
+	}
+	if w, h, ok := primary.SpatialExtents(); !ok || w != 3 || h != 2 {
+		t.Errorf("got %dx%d", w, h)
+	}
+	if icc, ok := primary.ICCProfile(); primary.Rotations() != 1 || primary.Mirror() != int(bmff.MirrorHorizontal) || !ok || string(icc) != "icc" {
+		t.Errorf("got properties %+v", primary.Properties)
+	}
+	if ref := primary.Reference("thmb"); ref == nil || len(ref.ToItemIDs) != 1 || ref.ToItemIDs[0] != unci.ID {
+		t.Errorf("got thmb %+v", ref)
+	}
+	if data, err := f.GetItemData(primary); err != nil || !bytes.Equal(data, codestream.Bytes()) {
+		t.Errorf("got %d bytes, %v", len(data), err)
+	}
+	if b, err := f.EXIF(); err != nil || !bytes.Equal(b, tiff) {
+		t.Errorf("got EXIF %q, %v", b, err)
+	}
+	if b, err := f.XMP(); err != nil || !bytes.Equal(b, xmp) {
+		t.Errorf("got XMP %q, %v", b, err)
+	}
+
+	it, err := f.ItemByID(unci.ID)
+	if err != nil || !it.Hidden() {
+		t.Fatalf("got %+v, %v", it, err)
+	}
+	unc, cmpd, ok := it.UncompressedConfig()
+	if !ok || cmpd == nil || unc.Profile != "rgb3" || unc.InterleaveType != 1 || len(unc.Components) != 3 || unc.TileColumns != 1 ||
+		len(cmpd.Types) != 3 || cmpd.Types[2] != bmff.ComponentBlue {
+		t.Errorf("got %+v, %+v", unc, cmpd)
+	}
+	if data, err := f.GetItemData(it); err != nil || len(data) != 3*3*2 || !bytes.Equal(data[15:], []byte{200, 100, 50}) {
+		t.Errorf("got %v, %v", data, err)
+	}
+
+	// items of several extents, and identical properties written once
+	it, err = f.ItemByID(split.ID)
+	if err != nil || len(it.Location.Extents) != 2 || it.Info.Name != "split" {
+		t.Fatalf("got %+v and %+v, %v", it.Info, it.Location, err)
+	}
+	if data, err := f.GetItemData(it); err != nil || !bytes.Equal(data, codestream.Bytes()) {
+		t.Errorf("got %d bytes, %v", len(data), err)
+	}
+	if e := it.Location.Extents; e[0].Length != 20 || e[1].Offset != e[0].Offset+20 || int(e[1].Length) != codestream.Len()-20 {
+		t.Errorf("got extents %+v", e)
+	}
+	meta, err := f.getMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(meta.Properties.PropertyContainer.Properties); n != 7 {
+		t.Errorf("got %d properties", n)
+	}
+}
+
+func TestWriterLargePropertyIndices(t *testing.T) {
+	// more than 127 properties need 15 bit indices
+	w := NewWriter()
+	for i := 0; i < 130; i++ {
+		w.AddItem("unci").AddProperty(SpatialExtentsProperty(i+1, 1), RotationProperty(uint8(i)))
+	}
+	f := written(t, w)
+	it, err := f.ItemByID(130)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, _, ok := it.SpatialExtents(); !ok || w != 130 || it.Rotations() != 1 {
+		t.Errorf("got width %d and %d rotations", w, it.Rotations())
+	}
+}
+
+func TestWriterErrors(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := NewWriter().WriteTo(&buf); err == nil {
+		t.Error("expected an error writing no items")
+	}
+	w := NewWriter()
+	w.AddXMP([]byte("<x:xmpmeta/>"), 1)
+	if _, err := w.WriteTo(&buf); err == nil {
+		t.Error("expected an error writing no image items")
+	}
+	if _, err := NewWriter().AddJPEG([]byte("not a jpeg")); err == nil {
+		t.Error("expected an error adding an invalid jpeg")
+	}
+}
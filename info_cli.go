@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/dcarbone/go-heicker/convert"
+)
+
+const infoUsage = `Usage: heicker info [flags] <file>...
+
+Prints the same details as the webservice's /info endpoint for each input, one json document per line.  The image data
+is not decoded.
+
+Flags:
+`
+
+// fileInfo is a single line of info output
+type fileInfo struct {
+	Path string `json:"path"`
+	*convert.Info
+}
+
+func runInfo(args []string) int {
+	var indent bool
+
+	fs := flag.NewFlagSet("heicker info", flag.ContinueOnError)
+	fs.BoolVar(&indent, "indent", false, "Indent output")
+	fs.Usage = func() {
+		_, _ = fmt.Fprint(fs.Output(), infoUsage)
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	if indent {
+		enc.SetIndent("", "  ")
+	}
+
+	code := 0
+	for _, path := range fs.Args() {
+		info, err := probeFile(path)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "FAIL %s: %v\n", path, err)
+			code = 1
+			continue
+		}
+		if err := enc.Encode(fileInfo{Path: path, Info: info}); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+	}
+	return code
+}
+
+func probeFile(path string) (*convert.Info, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	return convert.Probe(f)
+}
@@ -0,0 +1,281 @@
+package libde265
+
+//#cgo CXXFLAGS: -Ilibde265 -I. -std=c++11 -Wno-constant-conversion -msse4.1
+//#cgo CFLAGS: -I.
+// #include <stdint.h>
+// #include <stdlib.h>
+// #include "libde265/de265.h"
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"unsafe"
+)
+
+type Decoder struct {
+	ctx        unsafe.Pointer
+	hasImage   bool
+	safeEncode bool
+	flushed    bool // the end of the stream was signalled
+}
+
+func Init() {
+	C.de265_init()
+}
+
+func Fini() {
+	C.de265_free()
+}
+
+func NewDecoder(opts ...Option) (*Decoder, error) {
+	p := C.de265_new_decoder()
+	if p == nil {
+		return nil, fmt.Errorf("Unable to create decoder")
+	}
+
+	dec := &Decoder{ctx: p, hasImage: false}
+	for _, opt := range opts {
+		opt(dec)
+	}
+
+	return dec, nil
+}
+
+type Option func(*Decoder)
+
+func WithSafeEncoding(b bool) Option {
+	return func(dec *Decoder) {
+		dec.safeEncode = b
+	}
+}
+
+func (dec *Decoder) Free() {
+	dec.Reset()
+	C.de265_free_decoder(dec.ctx)
+}
+
+func (dec *Decoder) Reset() {
+	if dec.ctx != nil && dec.hasImage {
+		C.de265_release_next_picture(dec.ctx)
+		dec.hasImage = false
+	}
+
+	C.de265_reset(dec.ctx)
+	dec.flushed = false
+}
+
+func (dec *Decoder) Push(data []byte) error {
+	var pos int
+	totalSize := len(data)
+	for pos < totalSize {
+		if pos+4 > totalSize {
+			return fmt.Errorf("Invalid NAL data")
+		}
+
+		nalSize := uint32(data[pos])<<24 | uint32(data[pos+1])<<16 | uint32(data[pos+2])<<8 | uint32(data[pos+3])
+		pos += 4
+
+		if pos+int(nalSize) > totalSize {
+			return fmt.Errorf("Invalid NAL size: %d", nalSize)
+		}
+
+		C.de265_push_NAL(dec.ctx, unsafe.Pointer(&data[pos]), C.int(nalSize), C.de265_PTS(0), nil)
+		pos += int(nalSize)
+	}
+
+	return nil
+}
+
+func (dec *Decoder) DecodeImage(data []byte) (image.Image, error) {
+	if dec.hasImage {
+		fmt.Printf("previous image may leak")
+	}
+
+	if len(data) > 0 {
+		if err := dec.Push(data); err != nil {
+			return nil, err
+		}
+	}
+
+	if ret := C.de265_flush_data(dec.ctx); ret != C.DE265_OK {
+		return nil, fmt.Errorf("flush_data error")
+	}
+
+	var more C.int = 1
+	for more != 0 {
+		if decerr := C.de265_decode(dec.ctx, &more); decerr != C.DE265_OK {
+			return nil, fmt.Errorf("decode error")
+		}
+
+		for {
+			warning := C.de265_get_warning(dec.ctx)
+			if warning == C.DE265_OK {
+				break
+			}
+			fmt.Printf("warning: %v\n", C.GoString(C.de265_get_error_text(warning)))
+		}
+
+		if img := C.de265_get_next_picture(dec.ctx); img != nil {
+			dec.hasImage = true // lazy release
+			return dec.toImage(img)
+		}
+	}
+
+	return nil, fmt.Errorf("No picture")
+}
+
+// PushFrame pushes the NAL units of a single frame, such as a sample of a sequence track, marking its end so that it
+// can be decoded without waiting for the next
+func (dec *Decoder) PushFrame(data []byte) error {
+	if err := dec.Push(data); err != nil {
+		return err
+	}
+	C.de265_push_end_of_frame(dec.ctx)
+	return nil
+}
+
+// ErrNeedData is returned by NextImage when more data must be pushed before another picture can be output
+var ErrNeedData = errors.New("more data needed")
+
+// Flush marks the end of the stream, so that NextImage outputs every remaining picture
+func (dec *Decoder) Flush() error {
+	if ret := C.de265_flush_data(dec.ctx); ret != C.DE265_OK {
+		return fmt.Errorf("flush_data error")
+	}
+	dec.flushed = true
+	return nil
+}
+
+// NextImage decodes the pushed data until the next picture in output order is available.  Unlike DecodeImage the
+// stream is not flushed, so it may be called repeatedly to decode a sequence of pictures, pushing each as it is needed.
+// The error is ErrNeedData if more data must be pushed first, and io.EOF once the stream has been flushed and every
+// picture has been output.  Pictures are always copied.
+func (dec *Decoder) NextImage() (image.Image, error) {
+	for stalled := 0; stalled < 2; {
+		if img := C.de265_get_next_picture(dec.ctx); img != nil {
+			return dec.copyImage(img)
+		}
+
+		var more C.int
+		switch decerr := C.de265_decode(dec.ctx, &more); decerr {
+		case C.DE265_OK:
+			if more == 0 {
+				if img := C.de265_get_next_picture(dec.ctx); img != nil {
+					return dec.copyImage(img)
+				}
+				if !dec.flushed {
+					// the end of a frame was reached, the next must be pushed
+					return nil, ErrNeedData
+				}
+				return nil, io.EOF
+			}
+			stalled = 0
+		case C.DE265_ERROR_WAITING_FOR_INPUT_DATA:
+			return nil, ErrNeedData
+		case C.DE265_ERROR_IMAGE_BUFFER_FULL:
+			// the picture blocking the buffer is output at the top of the loop, if there is one
+			stalled++
+		default:
+			return nil, fmt.Errorf("decode error: %s", C.GoString(C.de265_get_error_text(decerr)))
+		}
+	}
+	return nil, errors.New("decoded picture buffer is full")
+}
+
+func (dec *Decoder) copyImage(img *C.struct_de265_image) (image.Image, error) {
+	safe := dec.safeEncode
+	dec.safeEncode = true
+	defer func() { dec.safeEncode = safe }()
+	return dec.toImage(img)
+}
+
+// toImage wraps or copies the planes of img, depending on safeEncode.  Monochrome pictures are returned as
+// *image.Gray, or *image.Gray16 when they have more than 8 bits per sample.
+func (dec *Decoder) toImage(img *C.struct_de265_image) (image.Image, error) {
+	width := C.de265_get_image_width(img, 0)
+	height := C.de265_get_image_height(img, 0)
+	if C.de265_get_chroma_format(img) == C.de265_chroma_mono {
+		return toGray(img, int(width), int(height))
+	}
+
+	var ystride, cstride C.int
+	y := C.de265_get_image_plane(img, 0, &ystride)
+	cb := C.de265_get_image_plane(img, 1, &cstride)
+	cheight := C.de265_get_image_height(img, 1)
+	cr := C.de265_get_image_plane(img, 2, &cstride)
+	//			crh := C.de265_get_image_height(img, 2)
+
+	// sanity check
+	if int(height)*int(ystride) >= int(1<<30) {
+		return nil, fmt.Errorf("image too big")
+	}
+
+	var r image.YCbCrSubsampleRatio
+	switch chroma := C.de265_get_chroma_format(img); chroma {
+	case C.de265_chroma_420:
+		r = image.YCbCrSubsampleRatio420
+	case C.de265_chroma_422:
+		r = image.YCbCrSubsampleRatio422
+	case C.de265_chroma_444:
+		r = image.YCbCrSubsampleRatio444
+	}
+	ycc := &image.YCbCr{
+		YStride:        int(ystride),
+		CStride:        int(cstride),
+		SubsampleRatio: r,
+		Rect:           image.Rectangle{Min: image.Point{0, 0}, Max: image.Point{int(width), int(height)}},
+	}
+	if dec.safeEncode {
+		ycc.Y = C.GoBytes(unsafe.Pointer(y), C.int(height*ystride))
+		ycc.Cb = C.GoBytes(unsafe.Pointer(cb), C.int(cheight*cstride))
+		ycc.Cr = C.GoBytes(unsafe.Pointer(cr), C.int(cheight*cstride))
+	} else {
+		ycc.Y = (*[1 << 30]byte)(unsafe.Pointer(y))[:int(height)*int(ystride)]
+		ycc.Cb = (*[1 << 30]byte)(unsafe.Pointer(cb))[:int(cheight)*int(cstride)]
+		ycc.Cr = (*[1 << 30]byte)(unsafe.Pointer(cr))[:int(cheight)*int(cstride)]
+	}
+
+	//C.de265_release_next_picture(dec.ctx)
+
+	return ycc, nil
+}
+
+// toGray copies the luma plane of img.  Samples of more than 8 bits are stored by libde265 as native uint16s, they are
+// scaled to the full range of image.Gray16.
+func toGray(img *C.struct_de265_image, width, height int) (image.Image, error) {
+	var stride C.int
+	y := C.de265_get_image_plane(img, 0, &stride)
+	if y == nil || width <= 0 || height <= 0 {
+		return nil, errors.New("picture has no luma plane")
+	}
+	if height*int(stride) >= 1<<30 {
+		return nil, fmt.Errorf("image too big")
+	}
+	data := (*[1 << 30]byte)(unsafe.Pointer(y))[: height*int(stride) : height*int(stride)]
+
+	bits := int(C.de265_get_bits_per_pixel(img, 0))
+	if bits <= 8 {
+		g := image.NewGray(image.Rect(0, 0, width, height))
+		for row := 0; row < height; row++ {
+			copy(g.Pix[row*g.Stride:row*g.Stride+width], data[row*int(stride):])
+		}
+		return g, nil
+	}
+	if bits > 16 {
+		return nil, fmt.Errorf("unsupported bit depth %d", bits)
+	}
+
+	g := image.NewGray16(image.Rect(0, 0, width, height))
+	for row := 0; row < height; row++ {
+		src := (*[1 << 29]uint16)(unsafe.Pointer(&data[row*int(stride)]))[:width:width]
+		dst := g.Pix[row*g.Stride:]
+		for x, v := range src {
+			v = v<<(16-bits) | v>>(2*bits-16)
+			dst[2*x], dst[2*x+1] = byte(v>>8), byte(v)
+		}
+	}
+	return g, nil
+}
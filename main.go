@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 	_ "time/tzdata"
@@ -20,19 +21,78 @@ var (
 	BuildBranch string
 )
 
+const (
+	cmdServe   = "serve"
+	cmdConvert = "convert"
+	cmdWatch   = "watch"
+	cmdInfo    = "info"
+)
+
+const usage = `Usage: heicker [command] [flags]
+
+Commands:
+  serve    Run the webservice (default)
+  convert  Convert local files
+  watch    Convert files as they appear in watched directories
+  info     Describe local files without converting them
+
+Run "heicker <command> -help" for command flags.
+`
+
 func main() {
 	bi := confinator.NewBuildInfo(BuildName, BuildDate, BuildBranch, "0")
 
-	fs := flag.NewFlagSet("go-heicker", flag.ContinueOnError)
-	conf := buildConfig(fs, bi)
-	if err := fs.Parse(os.Args[1:]); err != nil {
+	// no command, or flags only, means serve for compatibility with previous versions
+	cmd, args := cmdServe, os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case cmdServe:
+		os.Exit(runServe(bi, args))
+	case cmdConvert:
+		os.Exit(runConvert(args))
+	case cmdWatch:
+		os.Exit(runWatch(bi, args))
+	case cmdInfo:
+		os.Exit(runInfo(args))
+	default:
+		_, _ = fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+}
+
+// loadConfig parses args and builds the config for a command.  If the command should not continue, the returned exit
+// code is >= 0.
+func loadConfig(cmd string, bi confinator.BuildInfo, args []string) (*Config, *flag.FlagSet, int) {
+	fs := flag.NewFlagSet("heicker "+cmd, flag.ContinueOnError)
+	conf, diags := buildConfig(cmd, fs, bi)
+	if err := fs.Parse(args); err != nil {
 		if errors.Is(err, flag.ErrHelp) {
-			os.Exit(0)
+			return nil, nil, 0
 		}
-		panic(fmt.Sprintf("Error parsing flags: %v", err))
+		_, _ = fmt.Fprintf(os.Stderr, "Error parsing flags: %v\n", err)
+		return nil, nil, 2
+	}
+	if !diags.HasErrors() {
+		diags = append(diags, conf.load(fs)...)
+	}
+	if len(diags) > 0 {
+		conf.writeDiags(os.Stderr, diags)
+		if diags.HasErrors() {
+			return nil, nil, 1
+		}
+	}
+	return conf, fs, -1
+}
+
+func newLogger(conf *Config) zerolog.Logger {
+	if lvl, err := zerolog.ParseLevel(conf.LogLevel); err == nil {
+		zerolog.SetGlobalLevel(lvl)
 	}
 
-	log := zerolog.New(
+	return zerolog.New(
 		zerolog.NewConsoleWriter(func(w *zerolog.ConsoleWriter) {
 			w.Out = os.Stdout
 			w.TimeFormat = time.RFC3339
@@ -41,6 +101,15 @@ func main() {
 		Timestamp().
 		Str("product", "go-heicker").
 		Logger()
+}
+
+func runServe(bi confinator.BuildInfo, args []string) int {
+	conf, fs, code := loadConfig(cmdServe, bi, args)
+	if code >= 0 {
+		return code
+	}
+
+	log := newLogger(conf)
 
 	log.Info().Msg("go-heicker booting up")
 	log.Info().Object("config", conf).Msg("Runtime config built")
@@ -49,27 +118,45 @@ func main() {
 	ws, err := newWebService(log, conf)
 	if err != nil {
 		log.Error().Err(err).Msg("Error building webservice")
-		os.Exit(1)
+		return 1
 	}
 
 	errc := make(chan error, 1)
 	sigc := make(chan os.Signal, 1)
+	hupc := make(chan os.Signal, 1)
 	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(hupc, syscall.SIGHUP)
 
 	go func() {
 		errc <- ws.serve(conf.IP, conf.Port)
 	}()
 
-	select {
-	case err := <-errc:
-		if err != nil {
-			log.Error().Err(err).Msg("Abnormal exit")
-			os.Exit(1)
+	for {
+		select {
+		case err := <-errc:
+			if err != nil {
+				log.Error().Err(err).Msg("Abnormal exit")
+				return 1
+			}
+			log.Warn().Msg("Listener closed")
+			return 0
+
+		case <-hupc:
+			log.Info().Msg("SIGHUP received, reloading config")
+			next, diags := reloadConfig(conf, fs)
+			rr := ws.applyConfig(next, diags)
+			if !rr.Success {
+				log.Error().Object("reload", rr).Msg("Config reload failed, keeping current config")
+				continue
+			}
+			if len(rr.Rejected) > 0 {
+				log.Warn().Strs("rejected", rr.Rejected).Msg("Some settings cannot be changed while running")
+			}
+			log.Info().Object("reload", rr).Object("config", next).Msg("Config reloaded")
+
+		case sig := <-sigc:
+			log.Warn().Str("signal", sig.String()).Msg("Exiting")
+			return 0
 		}
-		log.Warn().Msg("Listener closed")
-	case sig := <-sigc:
-		log.Warn().Str("signal", sig.String()).Msg("Exiting")
 	}
-
-	os.Exit(0)
 }
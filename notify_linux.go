@@ -0,0 +1,113 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE | syscall.IN_MODIFY |
+	syscall.IN_ATTRIB
+
+// inotifyNotifier is a minimal, non-recursive inotify watcher
+type inotifyNotifier struct {
+	fd     int
+	f      *os.File
+	done   chan struct{}
+	mu     sync.Mutex
+	dirs   map[int32]string
+	events chan string
+}
+
+func newFileNotifier() (fileNotifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	n := new(inotifyNotifier)
+	n.fd = fd
+	// a non-blocking fd is registered with the runtime poller, allowing Close to interrupt a pending Read
+	n.f = os.NewFile(uintptr(fd), "inotify")
+	n.done = make(chan struct{})
+	n.dirs = make(map[int32]string)
+	n.events = make(chan string)
+
+	go n.read()
+
+	return n, nil
+}
+
+func (n *inotifyNotifier) Events() <-chan string {
+	return n.events
+}
+
+func (n *inotifyNotifier) Add(dir string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	wd, err := syscall.InotifyAddWatch(n.fd, dir, inotifyMask)
+	if err != nil {
+		return os.NewSyscallError("inotify_add_watch", err)
+	}
+	n.dirs[int32(wd)] = dir
+	return nil
+}
+
+func (n *inotifyNotifier) Close() error {
+	close(n.done)
+	return n.f.Close()
+}
+
+// send returns false once the notifier has been closed
+func (n *inotifyNotifier) send(path string) bool {
+	select {
+	case n.events <- path:
+		return true
+	case <-n.done:
+		return false
+	}
+}
+
+func (n *inotifyNotifier) read() {
+	defer close(n.events)
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		c, err := n.f.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for off := 0; off+syscall.SizeofInotifyEvent <= c; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := strings.TrimRight(string(buf[off+syscall.SizeofInotifyEvent:off+syscall.SizeofInotifyEvent+int(ev.Len)]), "\x00")
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+
+			// an empty path signals events were lost
+			if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				if !n.send("") {
+					return
+				}
+				continue
+			}
+
+			n.mu.Lock()
+			dir, ok := n.dirs[ev.Wd]
+			if ev.Mask&syscall.IN_IGNORED != 0 {
+				delete(n.dirs, ev.Wd)
+				ok = false
+			}
+			n.mu.Unlock()
+
+			if ok && name != "" && !n.send(filepath.Join(dir, name)) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var errActionTimeout = errors.New("timed out waiting for action")
+
+// actionPool limits the number of concurrently executing actions.  Unlike a buffered channel, its size may be changed
+// at any time.  Shrinking the pool does not interrupt actions already running, new actions will simply wait until
+// enough have been released.
+type actionPool struct {
+	mu     sync.Mutex
+	size   int
+	active int
+	freed  chan struct{} // closed and replaced every time a slot may have become available
+}
+
+func newActionPool(size int) *actionPool {
+	p := new(actionPool)
+	p.size = size
+	p.freed = make(chan struct{})
+	return p
+}
+
+// acquire blocks until either a slot is available, the timeout is reached, or the context is done.
+func (p *actionPool) acquire(ctx context.Context, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		p.mu.Lock()
+		if p.active < p.size {
+			p.active++
+			p.mu.Unlock()
+			return nil
+		}
+		freed := p.freed
+		p.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-timer.C:
+			return errActionTimeout
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (p *actionPool) release() {
+	p.mu.Lock()
+	p.active--
+	p.notify()
+	p.mu.Unlock()
+}
+
+func (p *actionPool) resize(size int) {
+	p.mu.Lock()
+	p.size = size
+	p.notify()
+	p.mu.Unlock()
+}
+
+func (p *actionPool) stats() (size, active int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size, p.active
+}
+
+// notify must be called while holding the lock
+func (p *actionPool) notify() {
+	close(p.freed)
+	p.freed = make(chan struct{})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestActionPoolResize(t *testing.T) {
+	p := newActionPool(1)
+	if err := p.acquire(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.acquire(context.Background(), 10*time.Millisecond); err != errActionTimeout {
+		t.Fatalf("got %v from a full pool, want errActionTimeout", err)
+	}
+
+	// growing the pool frees a slot for an action already waiting
+	done := make(chan error, 1)
+	go func() {
+		done <- p.acquire(context.Background(), time.Minute)
+	}()
+	p.resize(2)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// shrinking it leaves both actions running, but makes the next wait for two releases
+	p.resize(1)
+	if size, active := p.stats(); size != 1 || active != 2 {
+		t.Errorf("got size %d with %d active, want 1 with 2 active", size, active)
+	}
+	p.release()
+	if err := p.acquire(context.Background(), 10*time.Millisecond); err != errActionTimeout {
+		t.Errorf("got %v with 1 of 1 slots in use, want errActionTimeout", err)
+	}
+	p.release()
+	if err := p.acquire(context.Background(), 10*time.Millisecond); err != nil {
+		t.Errorf("got %v with no slots in use", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := p.acquire(ctx, time.Minute); err != context.Canceled {
+		t.Errorf("got %v once cancelled, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dcarbone/go-heicker/convert"
+)
+
+const (
+	ContentTypeProblem = "application/problem+json"
+
+	// problemTypePrefix is prepended to the code of each problem to produce its type uri
+	problemTypePrefix = "urn:go-heicker:problem:"
+)
+
+// Problem codes are part of the api and must not be changed once released
+const (
+	codeBadRequest       = "bad_request"
+	codeInvalidOption    = "invalid_option"
+	codeInvalidForm      = "invalid_form"
+	codeMissingFile      = "missing_file"
+	codeUploadTooLarge   = "upload_too_large"
+	codeNotHEIF          = "not_heif"
+	codeMalformedHEIF    = "malformed_heif"
+	codeUnsupportedCodec = "unsupported_codec"
+	codeImageNotFound    = "image_not_found"
+	codeLimitExceeded    = "limit_exceeded"
+	codeDecodeFailed     = "decode_failed"
+	codeEncodeFailed     = "encode_failed"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+	codeFormatNotAllowed = "format_not_allowed"
+	codeNotFound         = "not_found"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeRateLimited      = "rate_limited"
+	codeQuotaExceeded    = "quota_exceeded"
+	codeQueueFull        = "queue_full"
+	codeRequestTimeout   = "request_timeout"
+	codeInternal         = "internal_error"
+)
+
+// problem is an RFC 7807 problem details object.  Code is an extension member containing the stable machine readable
+// identifier also used as the suffix of Type.
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Code     string `json:"code"`
+}
+
+func newProblem(status int, code, detail string, args ...interface{}) *problem {
+	p := new(problem)
+	p.Type = problemTypePrefix + code
+	p.Title = http.StatusText(status)
+	p.Status = status
+	p.Code = code
+	if len(args) > 0 {
+		detail = fmt.Sprintf(detail, args...)
+	}
+	p.Detail = detail
+	return p
+}
+
+// convertProblem maps an error returned by the convert package to a problem
+func convertProblem(err error) *problem {
+	switch {
+	case errors.Is(err, convert.ErrInvalidOptions):
+		return newProblem(http.StatusBadRequest, codeInvalidOption, err.Error())
+	case errors.Is(err, convert.ErrNotHEIF):
+		return newProblem(http.StatusUnsupportedMediaType, codeNotHEIF, err.Error())
+	case errors.Is(err, convert.ErrMalformed):
+		return newProblem(http.StatusUnprocessableEntity, codeMalformedHEIF, err.Error())
+	case errors.Is(err, convert.ErrUnsupportedCodec):
+		return newProblem(http.StatusUnprocessableEntity, codeUnsupportedCodec, err.Error())
+	case errors.Is(err, convert.ErrImageNotFound):
+		return newProblem(http.StatusUnprocessableEntity, codeImageNotFound, err.Error())
+	case errors.Is(err, convert.ErrLimitExceeded):
+		return newProblem(http.StatusUnprocessableEntity, codeLimitExceeded, err.Error())
+	case errors.Is(err, convert.ErrDecodeFailed):
+		return newProblem(http.StatusUnprocessableEntity, codeDecodeFailed, err.Error())
+	case errors.Is(err, convert.ErrEncodeFailed):
+		return newProblem(http.StatusInternalServerError, codeEncodeFailed, err.Error())
+	default:
+		return newProblem(http.StatusInternalServerError, codeInternal, err.Error())
+	}
+}
+
+var problemHTML = template.Must(template.New("problem").Parse(`<!doctype html>
+<html lang="en">
+<head>
+    <meta charset="utf-8"/>
+    <link rel="stylesheet" href="/css/bootstrap.min.css"/>
+    <title>Heicker - {{ .Title }}</title>
+</head>
+<body>
+<div class="container">
+    <h1>{{ .Title }}</h1>
+    <p>{{ .Detail }}</p>
+    <p><a href="/">Back</a></p>
+</div>
+</body>
+</html>
+`))
+
+// writeProblem writes p as problem json, or as an html page when the client prefers html over json, as browsers
+// submitting the form do
+func (ws *WebService) writeProblem(w http.ResponseWriter, r *http.Request, p *problem) {
+	if p.Instance == "" {
+		p.Instance = r.URL.Path
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if prefersHTML(r.Header.Get("Accept")) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(p.Status)
+		if err := problemHTML.Execute(w, p); err != nil {
+			ws.log.Error().Err(err).Msg("Error writing problem html")
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", ContentTypeProblem)
+	w.WriteHeader(p.Status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		ws.log.Error().Err(err).Msg("Error writing problem json")
+	}
+}
+
+// prefersHTML returns true if the accept header gives text/html a higher quality than any json type
+func prefersHTML(accept string) bool {
+	var htmlQ, jsonQ float64
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch {
+		case mt == "text/html" && q > htmlQ:
+			htmlQ = q
+		case (mt == "application/json" || mt == ContentTypeProblem) && q > jsonQ:
+			jsonQ = q
+		}
+	}
+	return htmlQ > jsonQ
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	quotaStoreMemory = "memory"
+	quotaStoreFile   = "file"
+)
+
+// quotaUsage is the amount of work performed by a single client in a single day
+type quotaUsage struct {
+	Conversions int64 `json:"conversions"`
+	Bytes       int64 `json:"bytes"`
+}
+
+// quotaStore persists daily usage per client.  Days are UTC dates formatted as "2006-01-02".
+type quotaStore interface {
+	get(day, client string) (quotaUsage, error)
+	add(day, client string, usage quotaUsage) (quotaUsage, error)
+}
+
+func newQuotaStore(conf *RateLimitConfig) (quotaStore, error) {
+	switch conf.QuotaStore {
+	case quotaStoreMemory, "":
+		return newMemoryQuotaStore(), nil
+	case quotaStoreFile:
+		return newFileQuotaStore(conf.QuotaStorePath)
+	default:
+		return nil, fmt.Errorf("unknown quota store %q", conf.QuotaStore)
+	}
+}
+
+func quotaDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// untilQuotaReset returns the duration until the next UTC midnight
+func untilQuotaReset(t time.Time) time.Duration {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC).Sub(t)
+}
+
+// memoryQuotaStore only retains the current day's usage
+type memoryQuotaStore struct {
+	mu    sync.Mutex
+	day   string
+	usage map[string]quotaUsage
+}
+
+func newMemoryQuotaStore() *memoryQuotaStore {
+	ms := new(memoryQuotaStore)
+	ms.usage = make(map[string]quotaUsage)
+	return ms
+}
+
+func (ms *memoryQuotaStore) get(day, client string) (quotaUsage, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if day != ms.day {
+		return quotaUsage{}, nil
+	}
+	return ms.usage[client], nil
+}
+
+func (ms *memoryQuotaStore) add(day, client string, usage quotaUsage) (quotaUsage, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.rollover(day)
+	u := ms.usage[client]
+	u.Conversions += usage.Conversions
+	u.Bytes += usage.Bytes
+	ms.usage[client] = u
+	return u, nil
+}
+
+// rollover must be called while holding the lock
+func (ms *memoryQuotaStore) rollover(day string) {
+	if day != ms.day {
+		ms.day = day
+		ms.usage = make(map[string]quotaUsage)
+	}
+}
+
+// fileQuotaStore is a memoryQuotaStore that writes its state to disk after every change, and loads it at start
+type fileQuotaStore struct {
+	*memoryQuotaStore
+	path string
+}
+
+type fileQuotaState struct {
+	Day   string                `json:"day"`
+	Usage map[string]quotaUsage `json:"usage"`
+}
+
+func newFileQuotaStore(path string) (*fileQuotaStore, error) {
+	fs := new(fileQuotaStore)
+	fs.memoryQuotaStore = newMemoryQuotaStore()
+	fs.path = path
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return fs, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading quota state: %w", err)
+	}
+
+	var state fileQuotaState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("error parsing quota state %q: %w", path, err)
+	}
+	fs.day = state.Day
+	if state.Usage != nil {
+		fs.usage = state.Usage
+	}
+
+	return fs, nil
+}
+
+func (fs *fileQuotaStore) add(day, client string, usage quotaUsage) (quotaUsage, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.rollover(day)
+	u := fs.usage[client]
+	u.Conversions += usage.Conversions
+	u.Bytes += usage.Bytes
+	fs.usage[client] = u
+	return u, fs.flush()
+}
+
+// flush must be called while holding the lock.  The state is written to a temp file which then replaces the existing.
+func (fs *fileQuotaStore) flush() error {
+	b, err := json.Marshal(fileQuotaState{Day: fs.day, Usage: fs.usage})
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fs.path), ".quota-*")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(b); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), fs.path)
+}
+
+// quotaLimits returns the daily limits for a request.  A zero value means unlimited.
+func quotaLimits(conf *RateLimitConfig, p *principal) (conversions, bytes int64) {
+	if conf.Enabled {
+		conversions, bytes = conf.DailyConversions, conf.DailyBytesMB<<20
+	}
+	if p != nil {
+		if p.key.DailyConversions > 0 {
+			conversions = p.key.DailyConversions
+		}
+		if p.key.DailyBytesMB > 0 {
+			bytes = p.key.DailyBytesMB << 20
+		}
+	}
+	return
+}
+
+// quotaExceeded reports whether usage has reached either limit
+func quotaExceeded(usage quotaUsage, conversions, bytes int64) bool {
+	return (conversions > 0 && usage.Conversions >= conversions) || (bytes > 0 && usage.Bytes >= bytes)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQuotaStores(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	fs, err := newFileQuotaStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, qs := range map[string]quotaStore{"memory": newMemoryQuotaStore(), "file": fs} {
+		if _, err := qs.add("2021-03-01", "ip:a", quotaUsage{Conversions: 1, Bytes: 10}); err != nil {
+			t.Fatal(err)
+		}
+		u, err := qs.add("2021-03-01", "ip:a", quotaUsage{Conversions: 1, Bytes: 5})
+		if err != nil || u != (quotaUsage{Conversions: 2, Bytes: 15}) {
+			t.Errorf("%s: got %+v, %v", name, u, err)
+		}
+		if u, _ := qs.get("2021-03-01", "ip:b"); u != (quotaUsage{}) {
+			t.Errorf("%s: got %+v for another client", name, u)
+		}
+
+		// usage of earlier days is forgotten
+		if _, err := qs.add("2021-03-02", "ip:b", quotaUsage{Conversions: 1}); err != nil {
+			t.Fatal(err)
+		}
+		if u, _ := qs.get("2021-03-01", "ip:a"); u != (quotaUsage{}) {
+			t.Errorf("%s: got %+v of the previous day", name, u)
+		}
+	}
+
+	// the file store resumes from its file
+	fs, err = newFileQuotaStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := fs.get("2021-03-02", "ip:b"); u.Conversions != 1 {
+		t.Errorf("got %+v once reloaded", u)
+	}
+}
+
+func TestQuotaLimits(t *testing.T) {
+	conf := &RateLimitConfig{Enabled: true, DailyConversions: 10, DailyBytesMB: 1}
+	if c, b := quotaLimits(conf, nil); c != 10 || b != 1<<20 {
+		t.Errorf("got %d conversions and %d bytes", c, b)
+	}
+	p := &principal{key: &APIKeyConfig{DailyConversions: 20}}
+	if c, b := quotaLimits(conf, p); c != 20 || b != 1<<20 {
+		t.Errorf("got %d conversions and %d bytes for a key of 20 conversions", c, b)
+	}
+	if c, b := quotaLimits(&RateLimitConfig{DailyConversions: 10}, nil); c != 0 || b != 0 {
+		t.Errorf("got %d conversions and %d bytes with rate limits disabled", c, b)
+	}
+
+	if quotaExceeded(quotaUsage{Conversions: 9, Bytes: 1 << 19}, 10, 1<<20) {
+		t.Error("exceeded within limits")
+	}
+	if !quotaExceeded(quotaUsage{Bytes: 1 << 20}, 10, 1<<20) || !quotaExceeded(quotaUsage{Conversions: 10}, 10, 0) {
+		t.Error("not exceeded at a limit")
+	}
+
+	if d := untilQuotaReset(time.Date(2021, 3, 1, 23, 0, 0, 0, time.UTC)); d != time.Hour {
+		t.Errorf("got %v until midnight from 23:00", d)
+	}
+}
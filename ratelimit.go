@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HeaderRateLimitLimit     = "X-RateLimit-Limit"
+	HeaderRateLimitRemaining = "X-RateLimit-Remaining"
+	HeaderRateLimitReset     = "X-RateLimit-Reset"
+
+	// bucketSweepInterval is the minimum amount of time between removals of idle client buckets
+	bucketSweepInterval = time.Minute
+)
+
+// tokenBucket is a simple token bucket rate limiter
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket creates a full bucket.  If burst is less than 1, it is set to the ceiling of rate.
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	b := new(tokenBucket)
+	b.rate = rate
+	b.burst = float64(burst)
+	if b.burst < 1 {
+		b.burst = math.Max(1, math.Ceil(rate))
+	}
+	b.tokens = b.burst
+	b.last = time.Now()
+	return b
+}
+
+// take attempts to remove a single token from the bucket.  If none are available, the duration until one will be is
+// returned.
+func (b *tokenBucket) take() (ok bool, retryAfter time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// state returns the number of whole tokens remaining and the duration until the bucket is full again
+func (b *tokenBucket) state() (remaining int, untilFull time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	return int(b.tokens), time.Duration((b.burst - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) full() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	return b.tokens >= b.burst
+}
+
+// refill must be called while holding the lock
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// clientLimiter tracks a token bucket per client
+type clientLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newClientLimiter() *clientLimiter {
+	cl := new(clientLimiter)
+	cl.buckets = make(map[string]*tokenBucket)
+	cl.lastSweep = time.Now()
+	return cl
+}
+
+// bucket returns the bucket for the client, creating a new one if the client has not been seen or if its limits have
+// changed
+func (cl *clientLimiter) bucket(client string, rate float64, burst int) *tokenBucket {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if time.Since(cl.lastSweep) > bucketSweepInterval {
+		cl.sweep()
+	}
+
+	b, ok := cl.buckets[client]
+	if !ok || b.rate != rate || (burst > 0 && b.burst != float64(burst)) {
+		b = newTokenBucket(rate, burst)
+		cl.buckets[client] = b
+	}
+	return b
+}
+
+// sweep removes every full bucket, as they are indistinguishable from new ones.  Must be called while holding the lock.
+func (cl *clientLimiter) sweep() {
+	for k, b := range cl.buckets {
+		if b.full() {
+			delete(cl.buckets, k)
+		}
+	}
+	cl.lastSweep = time.Now()
+}
+
+type clientCtxKey struct{}
+
+// requestClient returns the identifier used for rate limits and quotas
+func requestClient(r *http.Request) string {
+	c, _ := r.Context().Value(clientCtxKey{}).(string)
+	return c
+}
+
+// clientIdentifier returns "key:<name>" for requests authenticated with an api key, otherwise "ip:<address>"
+func clientIdentifier(conf *RateLimitConfig, r *http.Request) string {
+	if p := requestPrincipal(r); p != nil {
+		return "key:" + p.key.Name
+	}
+	return "ip:" + clientIP(conf, r)
+}
+
+// clientIP returns the address of the client, honoring the configured headers only when the request was received from
+// a trusted proxy
+func clientIP(conf *RateLimitConfig, r *http.Request) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+
+	trusted := parseCIDRs(conf.TrustedProxies)
+	if !ipInNets(remote, trusted) {
+		return remote
+	}
+
+	for _, h := range conf.ClientIPHeaders {
+		v := r.Header.Get(h)
+		if v == "" {
+			continue
+		}
+		// walk right to left, the first untrusted hop is the client
+		hops := strings.Split(v, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			if !ipInNets(hop, trusted) || i == 0 {
+				return hop
+			}
+		}
+	}
+
+	return remote
+}
+
+func parseCIDRs(cidrs []string) []*net.IPNet {
+	out := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			if ip := net.ParseIP(c); ip != nil && ip.To4() != nil {
+				c += "/32"
+			} else {
+				c += "/128"
+			}
+		}
+		if _, n, err := net.ParseCIDR(c); err == nil {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+func ipInNets(addr string, nets []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimitMiddleware must run after authMiddleware.  API keys with their own rate_limit are always limited, other
+// clients only when rate limiting is enabled.
+func (ws *WebService) rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conf := ws.config()
+		if ws.authn().isPublic(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		client := clientIdentifier(conf.RateLimit, r)
+		r = r.WithContext(context.WithValue(r.Context(), clientCtxKey{}, client))
+
+		rate, burst := 0.0, 0
+		if conf.RateLimit.Enabled {
+			rate, burst = conf.RateLimit.RequestsPerSecond, conf.RateLimit.Burst
+		}
+		if p := requestPrincipal(r); p != nil && p.key.RateLimit > 0 {
+			rate, burst = p.key.RateLimit, p.key.RateBurst
+		}
+		if rate <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		b := ws.limiter.bucket(client, rate, burst)
+		ok, retryAfter := b.take()
+		remaining, untilFull := b.state()
+
+		w.Header().Set(HeaderRateLimitLimit, strconv.Itoa(int(b.burst)))
+		w.Header().Set(HeaderRateLimitRemaining, strconv.Itoa(remaining))
+		w.Header().Set(HeaderRateLimitReset, strconv.Itoa(int(math.Ceil(untilFull.Seconds()))))
+
+		if !ok {
+			ws.log.Warn().Str("client", client).Msg("Rate limit exceeded")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			ws.writeProblem(w, r, newProblem(http.StatusTooManyRequests, codeRateLimited, "Rate limit exceeded, try again later"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
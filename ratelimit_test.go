@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(1, 2)
+	for i := 0; i < 2; i++ {
+		if ok, _ := b.take(); !ok {
+			t.Fatalf("take %d of a burst of 2 failed", i+1)
+		}
+	}
+	ok, retryAfter := b.take()
+	if ok || retryAfter <= 0 || retryAfter > time.Second {
+		t.Errorf("got %v and retry after %v once empty", ok, retryAfter)
+	}
+	if remaining, untilFull := b.state(); remaining != 0 || untilFull <= time.Second || untilFull > 2*time.Second {
+		t.Errorf("got %d remaining, full in %v", remaining, untilFull)
+	}
+
+	// bursts default to the rate, rounded up
+	if b := newTokenBucket(2.5, 0); b.burst != 3 {
+		t.Errorf("got a burst of %v for a rate of 2.5", b.burst)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	conf := &RateLimitConfig{
+		TrustedProxies:  []string{"10.0.0.0/8", "192.0.2.1"},
+		ClientIPHeaders: []string{"X-Forwarded-For"},
+	}
+	for _, tc := range []struct {
+		remote, forwarded, want string
+	}{
+		{"198.51.100.1:1234", "203.0.113.1", "198.51.100.1"},
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		{"192.0.2.1:1234", "203.0.113.1", "203.0.113.1"},
+		{"192.0.2.1:1234", "203.0.113.2, 203.0.113.1, 10.0.0.2", "203.0.113.1"},
+		{"192.0.2.1:1234", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"192.0.2.1:1234", "unknown", "192.0.2.1"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.remote
+		if tc.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		if got := clientIP(conf, r); got != tc.want {
+			t.Errorf("%s forwarding %q: got %s, want %s", tc.remote, tc.forwarded, got, tc.want)
+		}
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	ws := newTestServiceHCL(t, `
+rate_limit {
+  enabled = true
+  requests_per_second = 0.001
+  burst = 1
+}`)
+	if rec := serve(ws, httptest.NewRequest(http.MethodGet, "/count", nil)); rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.Bytes())
+	}
+	rec := serve(ws, httptest.NewRequest(http.MethodGet, "/count", nil))
+	assertProblem(t, rec, http.StatusTooManyRequests, codeRateLimited)
+	if h := rec.Header(); h.Get("Retry-After") == "" || h.Get(HeaderRateLimitLimit) != "1" || h.Get(HeaderRateLimitRemaining) != "0" {
+		t.Errorf("got headers %v", h)
+	}
+
+	// other clients have their own limits
+	r := httptest.NewRequest(http.MethodGet, "/count", nil)
+	r.RemoteAddr = "198.51.100.1:1234"
+	if rec := serve(ws, r); rec.Code != http.StatusOK {
+		t.Errorf("got %d for another client", rec.Code)
+	}
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	ws := newTestServiceHCL(t, `
+rate_limit {
+  enabled = true
+  requests_per_second = 100
+  daily_conversions = 1
+}`)
+	// the usage of httptest's client address
+	if _, err := ws.quotas.add(quotaDay(time.Now()), "ip:192.0.2.1", quotaUsage{Conversions: 1}); err != nil {
+		t.Fatal(err)
+	}
+	rec := serve(ws, httptest.NewRequest(http.MethodPost, "/convert", nil))
+	assertProblem(t, rec, http.StatusTooManyRequests, codeQuotaExceeded)
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After header")
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/rs/zerolog"
+)
+
+type reloadResult struct {
+	Time        time.Time `json:"time"`
+	Success     bool      `json:"success"`
+	Diagnostics []string  `json:"diagnostics,omitempty"`
+	Rejected    []string  `json:"rejected,omitempty"`
+	Config      *Config   `json:"config,omitempty"`
+}
+
+func (rr *reloadResult) MarshalZerologObject(ev *zerolog.Event) {
+	ev.Time("time", rr.Time)
+	ev.Bool("success", rr.Success)
+	ev.Strs("diagnostics", rr.Diagnostics)
+	ev.Strs("rejected", rr.Rejected)
+}
+
+// applyConfig atomically swaps the tunable settings of the webservice with those in next.  Settings which cannot be
+// changed while running are rejected, and the currently active value kept.  If diags contains errors, next is
+// ignored entirely.
+func (ws *WebService) applyConfig(next *Config, diags hcl.Diagnostics) *reloadResult {
+	ws.reloadMu.Lock()
+	defer ws.reloadMu.Unlock()
+
+	rr := new(reloadResult)
+	rr.Time = time.Now()
+	for _, d := range diags {
+		rr.Diagnostics = append(rr.Diagnostics, d.Error())
+	}
+
+	if diags.HasErrors() || next == nil {
+		ws.lastReload = rr
+		return rr
+	}
+
+	prev := ws.config()
+
+	// bind address can only be set at start
+	if next.IP != prev.IP || next.Port != prev.Port {
+		rr.Rejected = append(
+			rr.Rejected,
+			fmt.Sprintf("bind address cannot be changed while running (current=%s:%d; new=%s:%d)", prev.IP, prev.Port, next.IP, next.Port),
+		)
+		next.IP = prev.IP
+		next.Port = prev.Port
+	}
+
+	// tls settings are only read at start, certificates themselves are reloaded when modified on disk
+	if next.TLSCertFile != prev.TLSCertFile ||
+		next.TLSKeyFile != prev.TLSKeyFile ||
+		next.TLSClientCAFile != prev.TLSClientCAFile ||
+		next.TLSMinVersion != prev.TLSMinVersion ||
+		strings.Join(next.TLSCipherSuites, ",") != strings.Join(prev.TLSCipherSuites, ",") {
+		rr.Rejected = append(rr.Rejected, "tls settings cannot be changed while running")
+		next.TLSCertFile = prev.TLSCertFile
+		next.TLSKeyFile = prev.TLSKeyFile
+		next.TLSClientCAFile = prev.TLSClientCAFile
+		next.TLSMinVersion = prev.TLSMinVersion
+		next.TLSCipherSuites = prev.TLSCipherSuites
+	}
+
+	// the quota store is only built at start
+	if next.RateLimit.QuotaStore != prev.RateLimit.QuotaStore || next.RateLimit.QuotaStorePath != prev.RateLimit.QuotaStorePath {
+		rr.Rejected = append(rr.Rejected, "quota store cannot be changed while running")
+		next.RateLimit.QuotaStore = prev.RateLimit.QuotaStore
+		next.RateLimit.QuotaStorePath = prev.RateLimit.QuotaStorePath
+	}
+
+	if lvl, err := zerolog.ParseLevel(next.LogLevel); err == nil {
+		zerolog.SetGlobalLevel(lvl)
+	}
+
+	if next.ServePath != prev.ServePath {
+		ws.fs.Store(http.FileServer(http.Dir(next.ServePath)))
+	}
+
+	ws.act.resize(next.MaxConcurrent)
+	ws.auth.Store(newAuthenticator(next.Auth))
+	ws.conv.Store(newConverter(next))
+	ws.conf.Store(next)
+
+	rr.Success = true
+	rr.Config = next
+	ws.lastReload = rr
+	return rr
+}
+
+// redactedValue replaces the values of settings that are not shown by /admin/reload
+const redactedValue = "[redacted]"
+
+// redacted returns a copy of c safe to show to clients, with file paths replaced and without the watch settings.  Api
+// keys are never marshalled.
+func (c *Config) redacted() *Config {
+	out := *c
+	for _, v := range []*string{&out.ServePath, &out.TLSCertFile, &out.TLSKeyFile, &out.TLSClientCAFile} {
+		if *v != "" {
+			*v = redactedValue
+		}
+	}
+	out.ConfigFiles = make([]string, len(c.ConfigFiles))
+	for i := range out.ConfigFiles {
+		out.ConfigFiles[i] = redactedValue
+	}
+	if c.RateLimit != nil {
+		rl := *c.RateLimit
+		if rl.QuotaStorePath != "" {
+			rl.QuotaStorePath = redactedValue
+		}
+		out.RateLimit = &rl
+	}
+	out.Watch = nil
+	return &out
+}
+
+// allowAdmin writes a problem and returns false unless r may call an /admin/ path: admin_endpoints must be enabled,
+// and when auth is enabled the request must be made with an admin api key rather than a signed url
+func (ws *WebService) allowAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if !ws.config().AdminEndpoints {
+		ws.writeProblem(w, r, newProblem(http.StatusNotFound, codeNotFound, "No such path %q", r.URL.Path))
+		return false
+	}
+	if !ws.authn().conf.Enabled {
+		return true
+	}
+	if p := requestPrincipal(r); p == nil || p.signed || !p.key.Admin {
+		ws.writeProblem(w, r, newProblem(http.StatusForbidden, codeForbidden, "Admin paths require an admin api key"))
+		return false
+	}
+	return true
+}
+
+func (ws *WebService) getReload(w http.ResponseWriter, r *http.Request) {
+	ws.logRequest(r)
+
+	if !ws.allowAdmin(w, r) {
+		return
+	}
+
+	ws.reloadMu.Lock()
+	var rr *reloadResult
+	if ws.lastReload != nil {
+		cp := *ws.lastReload
+		if cp.Config != nil {
+			cp.Config = cp.Config.redacted()
+		}
+		rr = &cp
+	}
+	ws.reloadMu.Unlock()
+
+	size, active := ws.act.stats()
+	b, err := json.Marshal(map[string]interface{}{
+		"last_reload": rr,
+		"config":      ws.config().redacted(),
+		"concurrency": map[string]int{"size": size, "active": active},
+	})
+	if err != nil {
+		ws.log.Error().Err(err).Msg("Error marshalling reload state")
+		ws.writeProblem(w, r, newProblem(http.StatusInternalServerError, codeInternal, "Error marshalling reload state: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(b)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// certCheckInterval is the minimum amount of time between checks of the certificate files for changes
+var certCheckInterval = 10 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseCipherSuites converts a list of IANA cipher suite names into their ids
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, cs := range tls.CipherSuites() {
+		known[cs.Name] = cs.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// certReloader serves the certificate and client CA pool from disk, reloading them when their modification time
+// changes.  If a reload fails, the previously loaded values continue to be used.
+type certReloader struct {
+	log zerolog.Logger
+
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	caPool    *x509.CertPool
+	modTimes  [3]time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(log zerolog.Logger, certFile, keyFile, caFile string) (*certReloader, error) {
+	cr := new(certReloader)
+	cr.log = log.With().Str("component", "cert-reloader").Logger()
+	cr.certFile = certFile
+	cr.keyFile = keyFile
+	cr.caFile = caFile
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) load() error {
+	modTimes, err := cr.stat()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading key pair: %w", err)
+	}
+
+	var caPool *x509.CertPool
+	if cr.caFile != "" {
+		b, err := ioutil.ReadFile(cr.caFile)
+		if err != nil {
+			return fmt.Errorf("error reading client CA file: %w", err)
+		}
+		caPool = x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(b) {
+			return fmt.Errorf("no certificates found in client CA file %q", cr.caFile)
+		}
+	}
+
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.caPool = caPool
+	cr.modTimes = modTimes
+	cr.lastCheck = time.Now()
+	cr.mu.Unlock()
+
+	return nil
+}
+
+func (cr *certReloader) stat() ([3]time.Time, error) {
+	var out [3]time.Time
+	for i, fname := range []string{cr.certFile, cr.keyFile, cr.caFile} {
+		if fname == "" {
+			continue
+		}
+		fi, err := os.Stat(fname)
+		if err != nil {
+			return out, err
+		}
+		out[i] = fi.ModTime()
+	}
+	return out, nil
+}
+
+// maybeReload reloads the files from disk if they have been modified since last checked
+func (cr *certReloader) maybeReload() {
+	cr.mu.Lock()
+	if time.Since(cr.lastCheck) < certCheckInterval {
+		cr.mu.Unlock()
+		return
+	}
+	cr.lastCheck = time.Now()
+	prev := cr.modTimes
+	cr.mu.Unlock()
+
+	modTimes, err := cr.stat()
+	if err != nil {
+		cr.log.Error().Err(err).Msg("Unable to stat certificate files, continuing to use current certificate")
+		return
+	}
+	if modTimes == prev {
+		return
+	}
+
+	if err := cr.load(); err != nil {
+		cr.log.Error().Err(err).Msg("Error reloading certificate, continuing to use current certificate")
+		return
+	}
+	cr.log.Info().Msg("Certificate reloaded")
+}
+
+func (cr *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	cr.maybeReload()
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, cr.caPool
+}
+
+// buildTLSConfig returns nil if tls is not enabled by the config
+func buildTLSConfig(log zerolog.Logger, conf *Config) (*tls.Config, error) {
+	if conf.TLSCertFile == "" {
+		return nil, nil
+	}
+
+	cr, err := newCertReloader(log, conf.TLSCertFile, conf.TLSKeyFile, conf.TLSClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	suites, err := parseCipherSuites(conf.TLSCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	base := &tls.Config{
+		MinVersion:   tlsVersions[conf.TLSMinVersion],
+		CipherSuites: suites,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if conf.TLSClientCAFile != "" {
+		base.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	tlsConf := base.Clone()
+	tlsConf.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, _ := cr.current()
+		return cert, nil
+	}
+	tlsConf.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cert, caPool := cr.current()
+		c := base.Clone()
+		c.Certificates = []tls.Certificate{*cert}
+		c.ClientCAs = caPool
+		return c, nil
+	}
+
+	return tlsConf, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// testCA is a certificate authority issuing certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "heicker test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{key: key, pool: x509.NewCertPool()}
+	if ca.cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	ca.pool.AddCert(ca.cert)
+	ca.pem = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return ca
+}
+
+// issue returns the PEM encoded certificate and key of a new certificate for localhost, numbered serial
+func (ca *testCA) issue(t *testing.T, serial int64, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb})
+}
+
+// writeFiles writes files, by name, to dir, modified at mtime
+func writeFiles(t *testing.T, dir string, mtime time.Time, files map[string][]byte) {
+	t.Helper()
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// startTLS serves ok responses over tls, configured by conf
+func startTLS(t *testing.T, conf *Config) *httptest.Server {
+	t.Helper()
+	tlsConf, err := buildTLSConfig(zerolog.Nop(), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	srv.TLS = tlsConf
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// handshake returns the state of a new connection to srv made with conf
+func handshake(srv *httptest.Server, conf *tls.Config) (tls.ConnectionState, error) {
+	conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), conf)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+	// tls 1.3 servers reject client certificates after the handshake, which a read reports
+	_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			return tls.ConnectionState{}, err
+		}
+	}
+	return conn.ConnectionState(), nil
+}
+
+func TestCertReload(t *testing.T) {
+	prev := certCheckInterval
+	certCheckInterval = 0
+	defer func() { certCheckInterval = prev }()
+
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	cert, key := ca.issue(t, 10, x509.ExtKeyUsageServerAuth)
+	writeFiles(t, dir, time.Now().Add(-time.Minute), map[string][]byte{"cert.pem": cert, "key.pem": key})
+
+	srv := startTLS(t, &Config{
+		TLSCertFile:   filepath.Join(dir, "cert.pem"),
+		TLSKeyFile:    filepath.Join(dir, "key.pem"),
+		TLSMinVersion: "1.2",
+	})
+	client := &tls.Config{RootCAs: ca.pool}
+	state, err := handshake(srv, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := state.PeerCertificates[0].SerialNumber.Int64(); n != 10 {
+		t.Fatalf("got certificate %d, want 10", n)
+	}
+
+	// a broken key pair keeps the current certificate
+	writeFiles(t, dir, time.Now(), map[string][]byte{"key.pem": []byte("not a key")})
+	if state, err := handshake(srv, client); err != nil || state.PeerCertificates[0].SerialNumber.Int64() != 10 {
+		t.Fatalf("after writing a broken key: %v", err)
+	}
+
+	cert, key = ca.issue(t, 11, x509.ExtKeyUsageServerAuth)
+	writeFiles(t, dir, time.Now().Add(time.Minute), map[string][]byte{"cert.pem": cert, "key.pem": key})
+	if state, err = handshake(srv, client); err != nil {
+		t.Fatal(err)
+	}
+	if n := state.PeerCertificates[0].SerialNumber.Int64(); n != 11 {
+		t.Errorf("got certificate %d after rotating it, want 11", n)
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	cert, key := ca.issue(t, 10, x509.ExtKeyUsageServerAuth)
+	writeFiles(t, dir, time.Now(), map[string][]byte{"cert.pem": cert, "key.pem": key})
+
+	srv := startTLS(t, &Config{
+		TLSCertFile:   filepath.Join(dir, "cert.pem"),
+		TLSKeyFile:    filepath.Join(dir, "key.pem"),
+		TLSMinVersion: "1.3",
+	})
+	if _, err := handshake(srv, &tls.Config{RootCAs: ca.pool, MaxVersion: tls.VersionTLS12}); err == nil {
+		t.Error("handshake of tls 1.2 succeeded with a minimum of 1.3")
+	}
+	if state, err := handshake(srv, &tls.Config{RootCAs: ca.pool}); err != nil || state.Version != tls.VersionTLS13 {
+		t.Errorf("got version %#x, %v", state.Version, err)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	cert, key := ca.issue(t, 10, x509.ExtKeyUsageServerAuth)
+	writeFiles(t, dir, time.Now(), map[string][]byte{"cert.pem": cert, "key.pem": key, "ca.pem": ca.pem})
+
+	srv := startTLS(t, &Config{
+		TLSCertFile:     filepath.Join(dir, "cert.pem"),
+		TLSKeyFile:      filepath.Join(dir, "key.pem"),
+		TLSClientCAFile: filepath.Join(dir, "ca.pem"),
+		TLSMinVersion:   "1.2",
+	})
+
+	clientCert := func(ca *testCA) []tls.Certificate {
+		cert, key := ca.issue(t, 20, x509.ExtKeyUsageClientAuth)
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []tls.Certificate{pair}
+	}
+	for _, tc := range []struct {
+		name  string
+		certs []tls.Certificate
+		ok    bool
+	}{
+		{"no certificate", nil, false},
+		{"other CA", clientCert(newTestCA(t)), false},
+		{"client CA", clientCert(ca), true},
+	} {
+		_, err := handshake(srv, &tls.Config{RootCAs: ca.pool, Certificates: tc.certs})
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: got %v", tc.name, err)
+		}
+	}
+}
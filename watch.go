@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dcarbone/go-confinator"
+	"github.com/dcarbone/go-heicker/convert"
+	"github.com/rs/zerolog"
+)
+
+const (
+	originalsKeep   = "keep"
+	originalsMove   = "move"
+	originalsDelete = "delete"
+
+	// quarantineErrorSuffix is appended to the name of a quarantined file to produce the file its error is written to
+	quarantineErrorSuffix = ".error.txt"
+)
+
+var errNotifyUnsupported = errors.New("filesystem notifications are not supported on this platform")
+
+// fileNotifier reports paths within added directories that may have changed.  An empty path means events were lost
+// and directories should be rescanned.  The events channel is closed when the notifier fails or is closed.
+type fileNotifier interface {
+	Events() <-chan string
+	Add(dir string) error
+	Close() error
+}
+
+func runWatch(bi confinator.BuildInfo, args []string) int {
+	conf, _, code := loadConfig(cmdWatch, bi, args)
+	if code >= 0 {
+		return code
+	}
+
+	log := newLogger(conf)
+
+	log.Info().Msg("go-heicker booting up")
+	log.Info().Object("config", conf).Msg("Runtime config built")
+
+	w, err := newWatcher(log.With().Str("component", "watcher").Logger(), conf.Watch)
+	if err != nil {
+		log.Error().Err(err).Msg("Error building watcher")
+		return 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigc
+		log.Warn().Str("signal", sig.String()).Msg("Exiting")
+		cancel()
+	}()
+
+	if err := w.run(ctx); err != nil {
+		log.Error().Err(err).Msg("Abnormal exit")
+		return 1
+	}
+	return 0
+}
+
+// pendingFile is a file seen by the watcher that has not yet been stable for long enough to convert
+type pendingFile struct {
+	root    string
+	size    int64
+	modTime time.Time
+	since   time.Time
+}
+
+// watchJob is a stable file ready to be converted
+type watchJob struct {
+	root string
+	path string
+	fi   os.FileInfo
+}
+
+type watcher struct {
+	log          zerolog.Logger
+	conf         *WatchConfig
+	opts         convert.Options
+	stableFor    time.Duration
+	pollInterval time.Duration
+
+	roots []string
+	// skip contains directories beneath a root that are never scanned, e.g. the quarantine
+	skip map[string]bool
+
+	state    *watchState
+	notify   fileNotifier
+	pending  map[string]*pendingFile
+	inflight map[string]bool
+}
+
+func newWatcher(log zerolog.Logger, conf *WatchConfig) (*watcher, error) {
+	var err error
+
+	w := new(watcher)
+	w.log = log
+	w.conf = conf
+	w.opts.Format, _ = convert.ParseFormat(conf.Format)
+	w.opts.Quality = conf.Quality
+	w.stableFor, _ = time.ParseDuration(conf.StableFor)
+	w.pollInterval, _ = time.ParseDuration(conf.PollInterval)
+	w.skip = make(map[string]bool)
+	w.pending = make(map[string]*pendingFile)
+	w.inflight = make(map[string]bool)
+
+	for _, d := range conf.Dirs {
+		root, err := filepath.Abs(d)
+		if err != nil {
+			return nil, err
+		}
+		w.roots = append(w.roots, root)
+		for _, sd := range []string{conf.OutDir, conf.QuarantineDir, conf.OriginalsDir} {
+			if sd != "" {
+				w.skip[w.dirFor(root, sd)] = true
+			}
+		}
+	}
+
+	if w.state, err = loadWatchState(conf.StateFile); err != nil {
+		return nil, err
+	}
+
+	if !conf.ForcePoll {
+		if w.notify, err = newFileNotifier(); err != nil {
+			w.log.Warn().Err(err).Msg("Filesystem notifications unavailable, falling back to polling")
+			w.notify = nil
+		}
+	}
+
+	return w, nil
+}
+
+// dirFor resolves a configured directory relative to root
+func (w *watcher) dirFor(root, dir string) string {
+	if filepath.IsAbs(dir) {
+		return filepath.Clean(dir)
+	}
+	return filepath.Join(root, dir)
+}
+
+// rootOf returns the most specific watched root containing path
+func (w *watcher) rootOf(path string) (string, bool) {
+	var found string
+	for _, r := range w.roots {
+		if (path == r || strings.HasPrefix(path, r+string(filepath.Separator))) && len(r) > len(found) {
+			found = r
+		}
+	}
+	return found, found != ""
+}
+
+// skipped returns true if path is within a directory that is never scanned
+func (w *watcher) skipped(path string) bool {
+	for d := range w.skip {
+		if path == d || strings.HasPrefix(path, d+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// run blocks until ctx is cancelled, waiting for any in progress conversions to finish before returning
+func (w *watcher) run(ctx context.Context) error {
+	var (
+		wg      sync.WaitGroup
+		jobs    = make(chan watchJob)
+		done    = make(chan string)
+		queue   []watchJob
+		events  <-chan string
+		check   = time.NewTicker(w.stableFor / 2)
+		rescan  = time.NewTicker(w.pollInterval)
+		started = time.Now()
+	)
+	defer check.Stop()
+	defer rescan.Stop()
+
+	if n := w.notify; n != nil {
+		events = n.Events()
+		defer func() { _ = n.Close() }()
+	}
+
+	for i := 0; i < w.conf.Parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				w.process(job)
+				done <- job.path
+			}
+		}()
+	}
+
+	w.scan()
+	w.log.Info().
+		Strs("dirs", w.roots).
+		Bool("inotify", w.notify != nil).
+		Int("pending", len(w.pending)).
+		Dur("took", time.Since(started)).
+		Msg("Watching for files")
+
+	for {
+		var (
+			send chan<- watchJob
+			next watchJob
+		)
+		if len(queue) > 0 {
+			send, next = jobs, queue[0]
+		}
+
+		select {
+		case <-ctx.Done():
+			close(jobs)
+			go func() {
+				wg.Wait()
+				close(done)
+			}()
+			for range done {
+			}
+			return nil
+
+		case path, ok := <-events:
+			if !ok {
+				w.log.Warn().Msg("Filesystem notifications stopped, falling back to polling")
+				events, w.notify = nil, nil
+			} else if path == "" {
+				w.log.Warn().Msg("Filesystem notification queue overflowed, rescanning")
+				w.scan()
+			} else {
+				w.observe(path)
+			}
+
+		case <-check.C:
+			queue = append(queue, w.ready()...)
+
+		case <-rescan.C:
+			w.scan()
+
+		case send <- next:
+			queue = queue[1:]
+
+		case path := <-done:
+			delete(w.inflight, path)
+		}
+	}
+}
+
+// scan walks each root, observing every file found and adding notifications for every directory
+func (w *watcher) scan() {
+	for _, root := range w.roots {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				// files may be moved or removed while walking
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if info.IsDir() {
+				if path != root && (!w.conf.Recursive || w.skipped(path)) {
+					return filepath.SkipDir
+				}
+				w.addNotify(path)
+				return nil
+			}
+			w.observeFile(root, path, info)
+			return nil
+		})
+		if err != nil {
+			w.log.Error().Err(err).Str("dir", root).Msg("Error scanning directory")
+		}
+	}
+}
+
+func (w *watcher) addNotify(dir string) {
+	if w.notify == nil {
+		return
+	}
+	if err := w.notify.Add(dir); err != nil {
+		w.log.Warn().Err(err).Str("dir", dir).Msg("Unable to watch directory, it will only be polled")
+	}
+}
+
+// observe handles a notification for path
+func (w *watcher) observe(path string) {
+	root, ok := w.rootOf(path)
+	if !ok || w.skipped(path) {
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if info.IsDir() {
+		// pick up anything created before the watch was added
+		if w.conf.Recursive {
+			w.addNotify(path)
+			_ = filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+				if err != nil {
+					return nil
+				}
+				if fi.IsDir() {
+					if w.skipped(p) {
+						return filepath.SkipDir
+					}
+					if p != path {
+						w.addNotify(p)
+					}
+					return nil
+				}
+				w.observeFile(root, p, fi)
+				return nil
+			})
+		}
+		return
+	}
+	if !w.conf.Recursive && filepath.Dir(path) != root {
+		return
+	}
+	w.observeFile(root, path, info)
+}
+
+// observeFile starts or restarts the stability timer of a heif file that has not already been processed
+func (w *watcher) observeFile(root, path string, info os.FileInfo) {
+	if !info.Mode().IsRegular() || !isHEIFName(path) || w.inflight[path] || w.state.processed(path, info) {
+		return
+	}
+	if pf, ok := w.pending[path]; ok {
+		if pf.size != info.Size() || !pf.modTime.Equal(info.ModTime()) {
+			pf.size, pf.modTime, pf.since = info.Size(), info.ModTime(), time.Now()
+		}
+		return
+	}
+	w.log.Debug().Str("file", path).Msg("New file seen")
+	w.pending[path] = &pendingFile{root: root, size: info.Size(), modTime: info.ModTime(), since: time.Now()}
+}
+
+// ready returns each pending file whose size and modification time have not changed for at least stable_for
+func (w *watcher) ready() []watchJob {
+	var jobs []watchJob
+	now := time.Now()
+	for path, pf := range w.pending {
+		info, err := os.Stat(path)
+		if err != nil {
+			delete(w.pending, path)
+			continue
+		}
+		if pf.size != info.Size() || !pf.modTime.Equal(info.ModTime()) {
+			pf.size, pf.modTime, pf.since = info.Size(), info.ModTime(), now
+			continue
+		}
+		if now.Sub(pf.since) < w.stableFor {
+			continue
+		}
+		delete(w.pending, path)
+		w.inflight[path] = true
+		jobs = append(jobs, watchJob{root: pf.root, path: path, fi: info})
+	}
+	return jobs
+}
+
+// process converts a single file then handles the original according to the config.  Failed files are quarantined.
+func (w *watcher) process(job watchJob) {
+	start := time.Now()
+	out := convertOutputPath(job.root, job.path, w.outDir(job.root), w.opts.Format.Extension())
+	log := w.log.With().Str("file", job.path).Logger()
+
+	if err := convertPath(job.path, out, w.opts, false); err != nil {
+		log.Error().Err(err).Msg("Conversion failed")
+		w.quarantine(job, err)
+		return
+	}
+
+	log = log.With().Str("output", out).Dur("took", time.Since(start)).Logger()
+
+	var err error
+	switch w.conf.Originals {
+	case originalsMove:
+		dest := filepath.Join(w.dirFor(job.root, w.conf.OriginalsDir), w.relPath(job))
+		if err = moveFile(job.path, dest); err == nil {
+			log.Info().Str("original", dest).Msg("Converted, original moved")
+		}
+	case originalsDelete:
+		if err = os.Remove(job.path); err == nil {
+			log.Info().Msg("Converted, original deleted")
+		}
+	default:
+		log.Info().Msg("Converted")
+	}
+
+	if err != nil {
+		log.Error().Err(err).Msg("Converted, but unable to handle original")
+	}
+	if w.conf.Originals == originalsKeep || err != nil {
+		w.record(job, watchRecord{Output: out})
+	}
+}
+
+// quarantine moves a failed file and writes its error alongside it.  If the file cannot be moved, the failure is
+// recorded in the state file instead so it is not retried.
+func (w *watcher) quarantine(job watchJob, cause error) {
+	dest := filepath.Join(w.dirFor(job.root, w.conf.QuarantineDir), w.relPath(job))
+	err := moveFile(job.path, dest)
+	if err == nil {
+		msg := fmt.Sprintf("%s\n%s\n%v\n", time.Now().UTC().Format(time.RFC3339), job.path, cause)
+		err = ioutil.WriteFile(dest+quarantineErrorSuffix, []byte(msg), 0644)
+		w.log.Warn().Str("file", job.path).Str("quarantine", dest).Msg("File quarantined")
+	}
+	if err != nil {
+		w.log.Error().Err(err).Str("file", job.path).Msg("Unable to quarantine file")
+		w.record(job, watchRecord{Error: cause.Error()})
+	}
+}
+
+func (w *watcher) record(job watchJob, rec watchRecord) {
+	rec.Size, rec.ModTime, rec.Processed = job.fi.Size(), job.fi.ModTime(), time.Now()
+	if err := w.state.set(job.path, rec); err != nil {
+		w.log.Error().Err(err).Msg("Error writing watch state")
+	}
+}
+
+func (w *watcher) outDir(root string) string {
+	if w.conf.OutDir == "" {
+		return ""
+	}
+	return w.dirFor(root, w.conf.OutDir)
+}
+
+func (w *watcher) relPath(job watchJob) string {
+	if rel, err := filepath.Rel(job.root, job.path); err == nil {
+		return rel
+	}
+	return filepath.Base(job.path)
+}
+
+// moveFile renames src to dst, falling back to copying when they are on different filesystems
+func moveFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	} else if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(dst, f)
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// watchRecord is kept for each file still in a watched directory after processing
+type watchRecord struct {
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mod_time"`
+	Processed time.Time `json:"processed"`
+	Output    string    `json:"output,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// watchState is written to disk after every change.  Records for files that no longer exist are dropped when loaded.
+type watchState struct {
+	mu    sync.Mutex
+	path  string
+	files map[string]watchRecord
+}
+
+func loadWatchState(path string) (*watchState, error) {
+	ws := new(watchState)
+	ws.path = path
+	ws.files = make(map[string]watchRecord)
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ws, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading watch state: %w", err)
+	}
+
+	var files map[string]watchRecord
+	if err := json.Unmarshal(b, &files); err != nil {
+		return nil, fmt.Errorf("error parsing watch state %q: %w", path, err)
+	}
+	for p, rec := range files {
+		if _, err := os.Stat(p); err == nil {
+			ws.files[p] = rec
+		}
+	}
+
+	return ws, nil
+}
+
+// processed returns true if the file has been processed and not modified since
+func (ws *watchState) processed(path string, info os.FileInfo) bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	rec, ok := ws.files[path]
+	return ok && rec.Size == info.Size() && rec.ModTime.Equal(info.ModTime())
+}
+
+func (ws *watchState) set(path string, rec watchRecord) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.files[path] = rec
+
+	b, err := json.MarshalIndent(ws.files, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ws.path, bytes.NewReader(b))
+}
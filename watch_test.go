@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dcarbone/go-heicker/convert"
+	"github.com/rs/zerolog"
+)
+
+const testWatchHCL = `
+watch {
+  format = "png"
+  stable_for = "100ms"
+  poll_interval = "100ms"
+  force_poll = true
+}`
+
+// startWatcher runs a watcher of conf until the returned func is called
+func startWatcher(t *testing.T, conf *WatchConfig) func() {
+	t.Helper()
+	w, err := newWatcher(zerolog.Nop(), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- w.run(ctx) }()
+	return func() {
+		t.Helper()
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// waitForFile fails t unless path exists within 5s
+func waitForFile(t *testing.T, path string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if _, err := os.Stat(path); err == nil {
+			return
+		}
+	}
+	t.Fatalf("%s not written", path)
+}
+
+func TestWatch(t *testing.T) {
+	conf, diags := loadTestWatchConfig(t, testWatchHCL)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	dir := conf.Watch.Dirs[0]
+	writeTree(t, dir, readTestHEIC(t), "a.heic")
+	writeTree(t, dir, []byte("not a heic"), "bad.heic")
+
+	stop := startWatcher(t, conf.Watch)
+	waitForFile(t, filepath.Join(dir, "a.png"))
+	quarantined := filepath.Join(dir, ".quarantine", "bad.heic")
+	waitForFile(t, quarantined+quarantineErrorSuffix)
+	stop()
+
+	if _, err := os.Stat(quarantined); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bad.heic")); !os.IsNotExist(err) {
+		t.Errorf("failed file left in place: %v", err)
+	}
+	if b, _ := ioutil.ReadFile(quarantined + quarantineErrorSuffix); !strings.Contains(string(b), convert.ErrNotHEIF.Error()) {
+		t.Errorf("got error file %q", b)
+	}
+
+	// once restarted, processed files are remembered while new files are converted
+	if err := os.Remove(filepath.Join(dir, "a.png")); err != nil {
+		t.Fatal(err)
+	}
+	stop = startWatcher(t, conf.Watch)
+	writeTree(t, dir, readTestHEIC(t), "b.heic")
+	waitForFile(t, filepath.Join(dir, "b.png"))
+	stop()
+
+	if _, err := os.Stat(filepath.Join(dir, "a.png")); !os.IsNotExist(err) {
+		t.Errorf("a.heic converted again: %v", err)
+	}
+}
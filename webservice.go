@@ -2,48 +2,70 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"image/jpeg"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"path"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/dcarbone/go-heicker/convert"
 	"github.com/gorilla/mux"
-	"github.com/jdeng/goheif"
 	"github.com/rs/zerolog"
 )
 
 type WebService struct {
-	log      zerolog.Logger
-	r        *mux.Router
-	fs       http.Handler
-	maxBytes int64
-	cnt      *uint64
-	act      chan struct{}
+	log  zerolog.Logger
+	r    *mux.Router
+	fs   atomic.Value // http.Handler
+	conf atomic.Value // *Config
+	auth atomic.Value // *authenticator
+	cnt  *uint64
+	act  *actionPool
+	tls  *tls.Config
+
+	conv    atomic.Value // *convert.Converter
+	limiter *clientLimiter
+	quotas  quotaStore
+
+	reloadMu   sync.Mutex
+	lastReload *reloadResult
 }
 
 func newWebService(log zerolog.Logger, conf *Config) (*WebService, error) {
 	ws := new(WebService)
 	ws.log = log.With().Str("component", "webservice").Logger()
 	ws.r = mux.NewRouter()
-	ws.fs = http.FileServer(http.Dir(conf.ServePath))
+	ws.fs.Store(http.FileServer(http.Dir(conf.ServePath)))
+	ws.conf.Store(conf)
+	ws.auth.Store(newAuthenticator(conf.Auth))
+
+	var err error
+	if ws.tls, err = buildTLSConfig(ws.log, conf); err != nil {
+		return nil, fmt.Errorf("error building tls config: %w", err)
+	}
+
+	ws.conv.Store(newConverter(conf))
+	ws.limiter = newClientLimiter()
+	if ws.quotas, err = newQuotaStore(conf.RateLimit); err != nil {
+		return nil, fmt.Errorf("error building quota store: %w", err)
+	}
 
-	ws.maxBytes = conf.MaxSizeMB << 20
 	ws.cnt = new(uint64)
 	*ws.cnt = 0
-	ws.act = make(chan struct{}, conf.MaxConcurrent)
-	for i := 0; i < conf.MaxConcurrent; i++ {
-		ws.act <- struct{}{}
-	}
+	ws.act = newActionPool(conf.MaxConcurrent)
 
 	// form page
 	ws.r.Methods(http.MethodGet).Path("/").HandlerFunc(ws.serveFiles)
 	ws.r.Methods(http.MethodPost).Path("/convert").HandlerFunc(ws.postConvert)
+	ws.r.Methods(http.MethodPost).Path("/thumbnail").HandlerFunc(ws.postThumbnail)
+	ws.r.Methods(http.MethodPost).Path("/info").HandlerFunc(ws.postInfo)
 
 	// assets
 	//ws.r.Methods(http.MethodGet).PathPrefix("/js/").HandlerFunc(ws.serveFiles)
@@ -53,13 +75,39 @@ func newWebService(log zerolog.Logger, conf *Config) (*WebService, error) {
 	// internal stuff
 	ws.r.Methods(http.MethodGet).Path("/check").HandlerFunc(ws.getCheck)
 	ws.r.Methods(http.MethodGet).Path("/count").HandlerFunc(ws.getCount)
+	ws.r.Methods(http.MethodGet).Path("/admin/reload").HandlerFunc(ws.getReload)
+	ws.r.Methods(http.MethodGet).Path("/sign").HandlerFunc(ws.getSign)
+
+	ws.r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws.writeProblem(w, r, newProblem(http.StatusNotFound, codeNotFound, "No such path %q", r.URL.Path))
+	})
+	ws.r.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws.writeProblem(w, r, newProblem(http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method %s is not allowed for %q", r.Method, r.URL.Path))
+	})
+
+	ws.r.Use(ws.authMiddleware, ws.rateLimitMiddleware)
 
 	return ws, nil
 }
 
+// config returns the currently active config
+func (ws *WebService) config() *Config {
+	return ws.conf.Load().(*Config)
+}
+
+// converter returns the converter built from the currently active config
+func (ws *WebService) converter() *convert.Converter {
+	return ws.conv.Load().(*convert.Converter)
+}
+
+// newConverter returns a converter applying the limits of conf to every conversion
+func newConverter(conf *Config) *convert.Converter {
+	return convert.New(convert.Options{Limits: conf.Limits.convertLimits()})
+}
+
 func (ws *WebService) serveFiles(w http.ResponseWriter, r *http.Request) {
 	ws.logRequest(r)
-	ws.fs.ServeHTTP(w, r)
+	ws.fs.Load().(http.Handler).ServeHTTP(w, r)
 }
 
 func (ws *WebService) getCheck(w http.ResponseWriter, _ *http.Request) {
@@ -75,8 +123,18 @@ func (ws *WebService) getCount(w http.ResponseWriter, _ *http.Request) {
 }
 
 func (ws *WebService) postConvert(w http.ResponseWriter, r *http.Request) {
+	ws.serveConversion(w, r, false)
+}
+
+// postThumbnail converts the embedded thumbnail of the uploaded file, or generates one
+func (ws *WebService) postThumbnail(w http.ResponseWriter, r *http.Request) {
+	ws.serveConversion(w, r, true)
+}
+
+// serveConversion converts the uploaded file.  When thumbnail is true the thumbnail option defaults to auto and may
+// not be none.
+func (ws *WebService) serveConversion(w http.ResponseWriter, r *http.Request, thumbnail bool) {
 	// todo: break this func up
-	// todo: handle exif data
 
 	ws.logRequest(r)
 
@@ -86,43 +144,147 @@ func (ws *WebService) postConvert(w http.ResponseWriter, r *http.Request) {
 		_ = r.Body.Close()
 	}()
 
-	var (
-		imageBytes []byte
-		infileName string
-		outname    string
-	)
+	opts, err := parseConvertOptions(r)
+	all := false
+	if v := r.URL.Query().Get("all"); err == nil && v != "" {
+		if all, err = strconv.ParseBool(v); err != nil {
+			err = fmt.Errorf("all must be true or false, saw %q", v)
+		}
+	}
+	if err == nil && thumbnail {
+		switch opts.Thumbnail {
+		case "":
+			opts.Thumbnail = convert.ThumbnailAuto
+		case convert.ThumbnailNone:
+			err = errors.New("thumbnail must be one of embedded, generated, auto")
+		}
+	}
+	if err != nil {
+		ws.log.Warn().Err(err).Msg("Invalid conversion options")
+		ws.writeProblem(w, r, newProblem(http.StatusBadRequest, codeInvalidOption, err.Error()))
+		return
+	}
+
+	if p := requestPrincipal(r); p != nil && !p.allowsFormat(string(opts.Format)) {
+		ws.log.Warn().Str("key", p.key.Name).Str("format", string(opts.Format)).Msg("Format not allowed for key")
+		ws.writeProblem(w, r, newProblem(http.StatusForbidden, codeFormatNotAllowed, "Format %q is not allowed for this api key", opts.Format))
+		return
+	}
+
+	// check daily quotas before doing any work
+	client := requestClient(r)
+	maxConversions, maxQuotaBytes := quotaLimits(ws.config().RateLimit, requestPrincipal(r))
+	if maxConversions > 0 || maxQuotaBytes > 0 {
+		now := time.Now()
+		usage, err := ws.quotas.get(quotaDay(now), client)
+		if err != nil {
+			ws.log.Error().Err(err).Msg("Error reading quota usage")
+		} else if quotaExceeded(usage, maxConversions, maxQuotaBytes) {
+			ws.log.Warn().Str("client", client).Msg("Daily quota exceeded")
+			w.Header().Set("Retry-After", strconv.Itoa(int(untilQuotaReset(now).Seconds())+1))
+			ws.writeProblem(w, r, newProblem(http.StatusTooManyRequests, codeQuotaExceeded, "Daily quota exceeded, try again tomorrow"))
+			return
+		}
+	}
 
-	select {
 	// wait for max of 2 seconds
-	// todo: limit actual maximum # of connections?
-	case <-time.After(2 * time.Second):
+	if err := ws.act.acquire(r.Context(), 2*time.Second); err != nil {
+		// in case request is cancelled
+		if !errors.Is(err, errActionTimeout) {
+			ws.log.Error().Err(err).Msg("Request context expired")
+			ws.writeProblem(w, r, newProblem(http.StatusRequestTimeout, codeRequestTimeout, "Request timeout: %v", err))
+			return
+		}
 		ws.log.Warn().Msg("Took too long to acquire action")
-		w.Header().Set("Content-Type", "text/plain")
-		w.WriteHeader(http.StatusTooManyRequests)
-		_, _ = w.Write([]byte("Too many concurrent requests, try again later"))
+		w.Header().Set("Retry-After", "2")
+		ws.writeProblem(w, r, newProblem(http.StatusServiceUnavailable, codeQueueFull, "Too many concurrent conversions, try again later"))
 		return
+	}
+	defer ws.act.release()
 
-	// in case request is cancelled
-	case <-r.Context().Done():
-		ws.log.Error().Err(r.Context().Err()).Msg("Request context expired")
-		w.Header().Set("Content-Type", "text/plain")
-		w.WriteHeader(http.StatusRequestTimeout)
-		_, _ = w.Write([]byte(fmt.Sprintf("Request timeout: %v", r.Context().Err())))
+	up, ok := ws.readUpload(w, r)
+	if !ok {
 		return
+	}
+	imageBytes, outname := up.data, up.outname
+
+	ext, contentType := opts.Format.Extension(), opts.Format.ContentType()
+	if all {
+		ext, contentType = "zip", "application/zip"
+	}
+	if outname == "" {
+		outname = fmt.Sprintf("%s.%s", path.Base(up.filename), ext)
+	}
+
+	var (
+		buff        = bytes.NewBuffer(nil)
+		res         convert.Result
+		conversions = 1
+	)
+	if all {
+		var results []convert.Result
+		results, err = ws.converter().ConvertAll(r.Context(), bytes.NewReader(imageBytes), buff, opts)
+		conversions = len(results)
+	} else {
+		res, err = ws.converter().Convert(r.Context(), bytes.NewReader(imageBytes), buff, opts)
+	}
+	if err != nil {
+		p := convertProblem(err)
+		if errors.Is(err, r.Context().Err()) {
+			p = newProblem(http.StatusRequestTimeout, codeRequestTimeout, "Request timeout: %v", err)
+		}
+		if p.Status >= http.StatusInternalServerError {
+			ws.log.Error().Err(err).Msg("Error converting file")
+		} else {
+			ws.log.Warn().Err(err).Msg("Unable to convert file")
+		}
+		ws.writeProblem(w, r, p)
+		return
+	}
+	switch {
+	case all:
+		ws.log.Debug().Int("images", conversions).Msg("Converted all images")
+	case res.Format == convert.FormatJPEG && !res.EXIF:
+		ws.log.Warn().Msg("No EXIF data found")
+	}
+	if thumbnail && !all {
+		ws.log.Debug().Bool("embedded", res.Thumbnail).Int("width", res.Width).Int("height", res.Height).Msg("Thumbnail converted")
+	}
 
-	// retrieve action ticket
-	case <-ws.act:
-		defer func() { ws.act <- struct{}{} }()
+	atomic.AddUint64(ws.cnt, 1)
+	if client != "" {
+		if _, err := ws.quotas.add(quotaDay(time.Now()), client, quotaUsage{Conversions: int64(conversions), Bytes: int64(len(imageBytes))}); err != nil {
+			ws.log.Error().Err(err).Str("client", client).Msg("Error recording quota usage")
+		}
 	}
 
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%s", outname))
+	w.Header().Set("Content-Length", strconv.Itoa(buff.Len()))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(buff.Bytes())
+}
+
+// upload is the multipart form submitted to /convert and /info
+type upload struct {
+	data     []byte
+	filename string
+	outname  string
+}
+
+// readUpload reads the multipart form of r.  If the form is invalid a problem is written and false is returned.
+func (ws *WebService) readUpload(w http.ResponseWriter, r *http.Request) (*upload, bool) {
+	var (
+		up       = new(upload)
+		maxBytes = ws.config().MaxSizeMB << 20
+	)
+
 	// fetch multipart reader
 	mpr, err := r.MultipartReader()
 	if err != nil {
-		ws.log.Error().Err(err).Msg("Error creating multipart reader")
-		w.Header().Set("Content-Type", "text/plain")
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte(fmt.Sprintf("error reading body: %v", err)))
-		return
+		ws.log.Warn().Err(err).Msg("Error creating multipart reader")
+		ws.writeProblem(w, r, newProblem(http.StatusBadRequest, codeInvalidForm, "Body must be multipart/form-data: %v", err))
+		return nil, false
 	}
 
 	// parse out parts
@@ -132,41 +294,36 @@ func (ws *WebService) postConvert(w http.ResponseWriter, r *http.Request) {
 			if errors.Is(err, io.EOF) {
 				break
 			}
-			ws.log.Error().Err(err).Msg("Error reading form data")
-			w.Header().Set("Content-Type", "text/plain")
-			w.WriteHeader(http.StatusBadRequest)
-			_, _ = w.Write([]byte(fmt.Sprintf("Error reading body: %v", err)))
-			return
+			ws.log.Warn().Err(err).Msg("Error reading form data")
+			ws.writeProblem(w, r, newProblem(http.StatusBadRequest, codeInvalidForm, "Error reading form data: %v", err))
+			return nil, false
 		}
 
 		switch part.FormName() {
 		// create input file reader
 		case "infile":
-			infileName = part.FileName()
-			mbr := http.MaxBytesReader(w, part, ws.maxBytes)
-			imageBytes, err = ioutil.ReadAll(mbr)
-			_ = mbr.Close()
+			up.filename = part.FileName()
+			up.data, err = ioutil.ReadAll(io.LimitReader(part, maxBytes+1))
 			if err != nil {
-				ws.log.Error().Err(err).Msg("Error reading image data")
-				w.Header().Set("Content-Type", "text/plain")
-				w.WriteHeader(http.StatusUnprocessableEntity)
-				_, _ = w.Write([]byte(fmt.Sprintf("Error reading image data: %v", err)))
-				return
+				ws.log.Warn().Err(err).Msg("Error reading image data")
+				ws.writeProblem(w, r, newProblem(http.StatusBadRequest, codeInvalidForm, "Error reading image data: %v", err))
+				return nil, false
+			}
+			if int64(len(up.data)) > maxBytes {
+				ws.log.Warn().Int64("max_bytes", maxBytes).Msg("Upload too large")
+				ws.writeProblem(w, r, newProblem(http.StatusRequestEntityTooLarge, codeUploadTooLarge, "File exceeds the maximum size of %d MB", maxBytes>>20))
+				return nil, false
 			}
 
 		// limit output name to 512 bytes
 		case "outname":
-			mbr := http.MaxBytesReader(w, part, 512)
-			b, err := ioutil.ReadAll(mbr)
-			_ = mbr.Close()
-			if err != nil {
-				ws.log.Error().Err(err).Msg("Error reading outname")
-				w.Header().Set("Content-Type", "text/plain")
-				w.WriteHeader(http.StatusBadRequest)
-				_, _ = w.Write([]byte(fmt.Sprintf("Error reading outname: %v", err)))
-				return
+			b, err := ioutil.ReadAll(io.LimitReader(part, 513))
+			if err != nil || len(b) > 512 {
+				ws.log.Warn().Err(err).Msg("Error reading outname")
+				ws.writeProblem(w, r, newProblem(http.StatusBadRequest, codeInvalidForm, "outname must be at most 512 bytes"))
+				return nil, false
 			}
-			outname = string(b)
+			up.outname = string(b)
 
 		case "submit":
 			// do nothing
@@ -176,65 +333,183 @@ func (ws *WebService) postConvert(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	img, err := goheif.Decode(bytes.NewBuffer(imageBytes))
-	if err != nil {
-		ws.log.Error().Err(err).Msg("Error decoding file")
-		w.Header().Set("Content-Type", "text/plain")
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		_, _ = w.Write([]byte(fmt.Sprintf("error decoding file: %v", err)))
-		return
+	if len(up.data) == 0 {
+		ws.writeProblem(w, r, newProblem(http.StatusBadRequest, codeMissingFile, "The infile field is required"))
+		return nil, false
 	}
 
-	rdr := bytes.NewReader(imageBytes)
+	return up, true
+}
 
-	exif, err := goheif.ExtractExif(rdr)
-	if err != nil {
-		ws.log.Warn().Err(err).Msg("No EXIF data found")
-	}
+// postInfo describes the uploaded file without decoding it
+func (ws *WebService) postInfo(w http.ResponseWriter, r *http.Request) {
+	ws.logRequest(r)
 
-	if outname == "" {
-		outname = fmt.Sprintf("%s.jpg", path.Base(infileName))
-	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+		_ = r.Body.Close()
+	}()
 
-	buff := bytes.NewBuffer(nil)
+	up, ok := ws.readUpload(w, r)
+	if !ok {
+		return
+	}
 
-	iw, err := newWriterExif(buff, exif)
+	info, err := convert.Probe(bytes.NewReader(up.data))
 	if err != nil {
-		ws.log.Error().Err(err).Msg("Error writing EXIF data")
-		w.Header().Set("Content-Type", "text/plain")
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte(fmt.Sprintf("Error writing EXIF data: %v", err)))
+		ws.log.Warn().Err(err).Msg("Unable to probe file")
+		ws.writeProblem(w, r, convertProblem(err))
 		return
 	}
 
-	if err = jpeg.Encode(iw, img, nil); err != nil {
-		ws.log.Error().Err(err).Msg("Error encoding jpeg")
-		w.Header().Set("Content-Type", "text/plain")
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte(fmt.Sprintf("Error encoding to jpeg: %v", err)))
+	b, err := json.Marshal(info)
+	if err != nil {
+		ws.log.Error().Err(err).Msg("Error encoding info")
+		ws.writeProblem(w, r, newProblem(http.StatusInternalServerError, codeInternal, err.Error()))
 		return
 	}
 
-	atomic.AddUint64(ws.cnt, 1)
-
-	w.Header().Set("Content-Type", "image/jpeg")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%s", outname))
-	w.Header().Set("Content-Length", strconv.Itoa(buff.Len()))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
 	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write(buff.Bytes())
+	_, _ = w.Write(b)
+}
+
+// parseConvertOptions reads the "format", "quality", "rotate", "metadata", "metadata_tags", "crop", "width", "height",
+// "fit", "scale", "max_width", "max_height", "filter", "thumbnail", "item", "index", "track", "frame", "first_frame",
+// "last_frame", "max_fps", "aux", "bit_depth", "gain_map" and "heif_codec" query parameters.  The format defaults to png for
+// auxiliary images, otherwise jpeg.
+func parseConvertOptions(r *http.Request) (convert.Options, error) {
+	var (
+		opts convert.Options
+		err  error
+	)
+	q := r.URL.Query()
+	if v := q.Get("aux"); v != "" {
+		if opts.Aux, err = convert.ParseAux(v); err != nil {
+			return opts, err
+		}
+	}
+	if v := q.Get("format"); v != "" {
+		if opts.Format, err = convert.ParseFormat(v); err != nil {
+			return opts, err
+		}
+	} else if opts.Aux != "" {
+		opts.Format = convert.FormatPNG
+	} else {
+		opts.Format = convert.FormatJPEG
+	}
+	if v := q.Get("quality"); v != "" {
+		if opts.Quality, err = strconv.Atoi(v); err != nil || opts.Quality < 1 || opts.Quality > 100 {
+			return opts, fmt.Errorf("quality must be an integer between 1 and 100, saw %q", v)
+		}
+	}
+	if v := q.Get("rotate"); v != "" {
+		if opts.Rotation, err = convert.ParseRotation(v); err != nil {
+			return opts, err
+		}
+	}
+	if v := q.Get("metadata"); v != "" {
+		if opts.Metadata, err = convert.ParseMetadataPolicy(v); err != nil {
+			return opts, err
+		}
+	}
+	if v := q.Get("metadata_tags"); v != "" {
+		if opts.MetadataTags, err = convert.ParseMetadataTags(v); err != nil {
+			return opts, err
+		}
+	}
+	if v := q.Get("crop"); v != "" {
+		if opts.Crop, err = convert.ParseCrop(v); err != nil {
+			return opts, err
+		}
+	}
+	for name, dst := range map[string]*int{"width": &opts.Width, "height": &opts.Height, "max_width": &opts.MaxWidth, "max_height": &opts.MaxHeight} {
+		if v := q.Get(name); v != "" {
+			if *dst, err = strconv.Atoi(v); err != nil || *dst < 1 || *dst > 65535 {
+				return opts, fmt.Errorf("%s must be an integer between 1 and 65535, saw %q", name, v)
+			}
+		}
+	}
+	if v := q.Get("scale"); v != "" {
+		if opts.Scale, err = strconv.ParseFloat(v, 64); err != nil || opts.Scale <= 0 || opts.Scale > 1000 {
+			return opts, fmt.Errorf("scale must be a percentage between 0 and 1000, saw %q", v)
+		}
+	}
+	if v := q.Get("fit"); v != "" {
+		if opts.Fit, err = convert.ParseFit(v); err != nil {
+			return opts, err
+		}
+	}
+	if v := q.Get("filter"); v != "" {
+		if opts.Filter, err = convert.ParseFilter(v); err != nil {
+			return opts, err
+		}
+	}
+	if v := q.Get("thumbnail"); v != "" {
+		if opts.Thumbnail, err = convert.ParseThumbnailMode(v); err != nil {
+			return opts, err
+		}
+	}
+	for name, dst := range map[string]*int{"index": &opts.Index, "frame": &opts.Frame, "first_frame": &opts.FirstFrame, "last_frame": &opts.LastFrame} {
+		if v := q.Get(name); v != "" {
+			if *dst, err = strconv.Atoi(v); err != nil || *dst < 1 {
+				return opts, fmt.Errorf("%s must be a positive integer, saw %q", name, v)
+			}
+		}
+	}
+	if v := q.Get("gain_map"); v != "" {
+		if opts.GainMap, err = convert.ParseGainMapMode(v); err != nil {
+			return opts, err
+		}
+	}
+	if v := q.Get("heif_codec"); v != "" {
+		if opts.HEIFCodec, err = convert.ParseHEIFCodec(v); err != nil {
+			return opts, err
+		}
+	}
+	if v := q.Get("bit_depth"); v != "" {
+		if opts.BitDepth, err = strconv.Atoi(v); err != nil || (opts.BitDepth != 8 && opts.BitDepth != 16) {
+			return opts, fmt.Errorf("bit_depth must be 8 or 16, saw %q", v)
+		}
+	}
+	if v := q.Get("max_fps"); v != "" {
+		if opts.MaxFPS, err = strconv.ParseFloat(v, 64); err != nil || opts.MaxFPS <= 0 || opts.MaxFPS > 100 {
+			return opts, fmt.Errorf("max_fps must be a number between 0 and 100, saw %q", v)
+		}
+	}
+	for name, dst := range map[string]*uint32{"item": &opts.Item, "track": &opts.Track} {
+		if v := q.Get(name); v != "" {
+			id, err := strconv.ParseUint(v, 10, 32)
+			if err != nil || id == 0 {
+				return opts, fmt.Errorf("%s must be a positive integer ID, saw %q", name, v)
+			}
+			*dst = uint32(id)
+		}
+	}
+	return opts, nil
 }
 
 func (ws *WebService) logRequest(req *http.Request) {
+	u := redactedURL(req.URL)
 	ws.log.Debug().
 		Str("method", req.Method).
-		Str("url", req.URL.String()).
-		Str("requestURI", req.RequestURI).
-		Interface("headers", req.Header).
+		Str("url", u.String()).
+		Str("requestURI", u.RequestURI()).
+		Interface("headers", redactedHeaders(req.Header)).
 		Msg("Incoming request")
 }
 
 func (ws *WebService) serve(ip string, port int) error {
-	addr := fmt.Sprintf("%s:%d", ip, port)
-	ws.log.Info().Msgf("Listener up: %s", addr)
-	return http.ListenAndServe(addr, ws.r)
+	srv := &http.Server{
+		Addr:      fmt.Sprintf("%s:%d", ip, port),
+		Handler:   ws.r,
+		TLSConfig: ws.tls,
+	}
+	if ws.tls != nil {
+		ws.log.Info().Msgf("TLS listener up: %s", srv.Addr)
+		return srv.ListenAndServeTLS("", "")
+	}
+	ws.log.Info().Msgf("Listener up: %s", srv.Addr)
+	return srv.ListenAndServe()
 }
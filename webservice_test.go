@@ -0,0 +1,541 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dcarbone/go-heicker/convert"
+	"github.com/dcarbone/go-heicker/heif"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/rs/zerolog"
+)
+
+const testKey = "0123456789abcdef"
+
+// newTestService returns a WebService using the config of args
+func newTestService(t *testing.T, args ...string) *WebService {
+	t.Helper()
+	conf, _, diags := loadTestConfig(t, args...)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	ws, err := newWebService(zerolog.Nop(), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ws
+}
+
+// newTestServiceHCL returns a WebService using the config file holding src
+func newTestServiceHCL(t *testing.T, src string) *WebService {
+	t.Helper()
+	return newTestService(t, "-config", writeTestConfig(t, "heicker.hcl", src))
+}
+
+// testHEIF returns a file of a 32x24 uncompressed image, modified by fn if not nil
+func testHEIF(t *testing.T, fn func(w *heif.Writer, it *heif.WriterItem)) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 32, 24))
+	for y := 0; y < 24; y++ {
+		for x := 0; x < 32; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(x * 8), G: uint8(y * 10), B: 0x80, A: 0xff})
+		}
+	}
+	w := heif.NewWriter()
+	it := w.AddUncompressed(img)
+	if fn != nil {
+		fn(w, it)
+	}
+	var buf bytes.Buffer
+	if _, err := w.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// uploadRequest returns a POST request of a multipart form holding fields and, unless nil, infile
+func uploadRequest(t *testing.T, target string, infile []byte, fields map[string]string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		if err := mw.WriteField(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if infile != nil {
+		fw, err := mw.CreateFormFile("infile", "photo.heic")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = fw.Write(infile)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, target, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func serve(ws *WebService, r *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	ws.r.ServeHTTP(rec, r)
+	return rec
+}
+
+// assertProblem fails t unless rec holds a problem json of status and code
+func assertProblem(t *testing.T, rec *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+	var p problem
+	if ct := rec.Header().Get("Content-Type"); ct != ContentTypeProblem {
+		t.Fatalf("got %d of type %q: %s", rec.Code, ct, rec.Body.Bytes())
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+		t.Fatalf("decoding problem: %v", err)
+	}
+	if rec.Code != status || p.Status != status || p.Code != code || p.Type != problemTypePrefix+code {
+		t.Errorf("got %d %+v, want %d %s", rec.Code, p, status, code)
+	}
+}
+
+func TestConversionErrors(t *testing.T) {
+	ws := newTestService(t)
+	valid := readTestHEIC(t)
+
+	// an ipma box claiming more entries than any file has
+	overLimit := testHEIF(t, nil)
+	ipma := bytes.Index(overLimit, []byte("ipma"))
+	binary.BigEndian.PutUint32(overLimit[ipma+8:], 0xffffffff)
+
+	brokenForm := httptest.NewRequest(http.MethodPost, "/convert", strings.NewReader("--x\r\nno headers"))
+	brokenForm.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+
+	for _, tc := range []struct {
+		name   string
+		r      *http.Request
+		status int
+		code   string
+	}{
+		{"unknown path", httptest.NewRequest(http.MethodGet, "/nope", nil), http.StatusNotFound, codeNotFound},
+		{"wrong method", httptest.NewRequest(http.MethodGet, "/convert", nil), http.StatusMethodNotAllowed, codeMethodNotAllowed},
+		{"invalid format", uploadRequest(t, "/convert?format=bmp", valid, nil), http.StatusBadRequest, codeInvalidOption},
+		{"unknown tag", uploadRequest(t, "/convert?metadata=allowlist&metadata_tags=Make,Nope", valid, nil), http.StatusBadRequest, codeInvalidOption},
+		{"no thumbnail", uploadRequest(t, "/thumbnail?thumbnail=none", valid, nil), http.StatusBadRequest, codeInvalidOption},
+		{"invalid width", uploadRequest(t, "/thumbnail?width=0", valid, nil), http.StatusBadRequest, codeInvalidOption},
+		{"invalid crop", uploadRequest(t, "/convert?crop=0,0,10", valid, nil), http.StatusBadRequest, codeInvalidOption},
+		{"crop outside", uploadRequest(t, "/convert?crop=64,0,10,10", valid, nil), http.StatusBadRequest, codeInvalidOption},
+		{"invalid scale", uploadRequest(t, "/convert?scale=half", valid, nil), http.StatusBadRequest, codeInvalidOption},
+		{"invalid max width", uploadRequest(t, "/convert?max_width=-1", valid, nil), http.StatusBadRequest, codeInvalidOption},
+		{"invalid index", uploadRequest(t, "/convert?index=0", valid, nil), http.StatusBadRequest, codeInvalidOption},
+		{"invalid item", uploadRequest(t, "/convert?item=x", valid, nil), http.StatusBadRequest, codeInvalidOption},
+		{"invalid all", uploadRequest(t, "/convert?all=some", valid, nil), http.StatusBadRequest, codeInvalidOption},
+		{"all with aux", uploadRequest(t, "/convert?all=true&aux=depth", valid, nil), http.StatusBadRequest, codeInvalidOption},
+		{"item and index", uploadRequest(t, "/convert?item=2&index=1", valid, nil), http.StatusBadRequest, codeInvalidOption},
+		{"no image", uploadRequest(t, "/convert?index=4", valid, nil), http.StatusUnprocessableEntity, codeImageNotFound},
+		{"invalid max fps", uploadRequest(t, "/convert?format=gif&max_fps=0", valid, nil), http.StatusBadRequest, codeInvalidOption},
+		{"invalid first frame", uploadRequest(t, "/convert?format=gif&first_frame=x", valid, nil), http.StatusBadRequest, codeInvalidOption},
+		{"invalid heif codec", uploadRequest(t, "/convert?format=heif&heif_codec=hevc", valid, nil), http.StatusBadRequest, codeInvalidOption},
+		{"invalid gain map", uploadRequest(t, "/convert?gain_map=hdr", valid, nil), http.StatusBadRequest, codeInvalidOption},
+		{"invalid aux", uploadRequest(t, "/convert?aux=skin", valid, nil), http.StatusBadRequest, codeInvalidOption},
+		{"invalid bit depth", uploadRequest(t, "/convert?aux=depth&bit_depth=12", valid, nil), http.StatusBadRequest, codeInvalidOption},
+		{"aux as jpeg", uploadRequest(t, "/convert?aux=depth&format=jpeg", valid, nil), http.StatusBadRequest, codeInvalidOption},
+		{"no depth", uploadRequest(t, "/convert?aux=depth", valid, nil), http.StatusUnprocessableEntity, codeImageNotFound},
+		{"last before first", uploadRequest(t, "/convert?format=gif&first_frame=3&last_frame=2", valid, nil), http.StatusBadRequest, codeInvalidOption},
+		{"embedded thumbnail", uploadRequest(t, "/thumbnail?thumbnail=embedded", valid, nil), http.StatusUnprocessableEntity, codeImageNotFound},
+		{"not multipart", httptest.NewRequest(http.MethodPost, "/convert", strings.NewReader("infile")), http.StatusBadRequest, codeInvalidForm},
+		{"broken form", brokenForm, http.StatusBadRequest, codeInvalidForm},
+		{"long outname", uploadRequest(t, "/convert", valid, map[string]string{"outname": strings.Repeat("a", 513)}), http.StatusBadRequest, codeInvalidForm},
+		{"no infile", uploadRequest(t, "/convert", nil, map[string]string{"outname": "a.jpg"}), http.StatusBadRequest, codeMissingFile},
+		{"not heif", uploadRequest(t, "/convert", []byte("GIF89a"), nil), http.StatusUnsupportedMediaType, codeNotHEIF},
+		{"truncated", uploadRequest(t, "/convert", valid[:200], nil), http.StatusUnprocessableEntity, codeMalformedHEIF},
+		{"parse limit", uploadRequest(t, "/convert", overLimit, nil), http.StatusUnprocessableEntity, codeLimitExceeded},
+		{"unknown codec", uploadRequest(t, "/convert", testHEIF(t, func(_ *heif.Writer, it *heif.WriterItem) {
+			it.Type = "xxxx"
+		}), nil), http.StatusUnprocessableEntity, codeUnsupportedCodec},
+		{"upscale limit", uploadRequest(t, "/convert?width=65535&height=65535&fit=fill", valid, nil), http.StatusUnprocessableEntity, codeLimitExceeded},
+		{"unknown item", uploadRequest(t, "/convert?item=9", valid, nil), http.StatusUnprocessableEntity, codeImageNotFound},
+		{"short data", uploadRequest(t, "/convert", testHEIF(t, func(_ *heif.Writer, it *heif.WriterItem) {
+			it.Extents[0] = it.Extents[0][:10]
+		}), nil), http.StatusUnprocessableEntity, codeDecodeFailed},
+		{"info not heif", uploadRequest(t, "/info", []byte("GIF89a"), nil), http.StatusUnsupportedMediaType, codeNotHEIF},
+		{"info no infile", uploadRequest(t, "/info", nil, nil), http.StatusBadRequest, codeMissingFile},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assertProblem(t, serve(ws, tc.r), tc.status, tc.code)
+		})
+	}
+}
+
+func TestConvertProblem(t *testing.T) {
+	for kind, code := range map[error]string{
+		convert.ErrInvalidOptions:   codeInvalidOption,
+		convert.ErrNotHEIF:          codeNotHEIF,
+		convert.ErrMalformed:        codeMalformedHEIF,
+		convert.ErrUnsupportedCodec: codeUnsupportedCodec,
+		convert.ErrImageNotFound:    codeImageNotFound,
+		convert.ErrLimitExceeded:    codeLimitExceeded,
+		convert.ErrDecodeFailed:     codeDecodeFailed,
+		convert.ErrEncodeFailed:     codeEncodeFailed,
+		io.ErrUnexpectedEOF:         codeInternal,
+	} {
+		err := kind
+		if kind != io.ErrUnexpectedEOF {
+			err = &convert.Error{Kind: kind}
+		}
+		if p := convertProblem(err); p.Code != code {
+			t.Errorf("%v: got %s, want %s", kind, p.Code, code)
+		}
+	}
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	ws := newTestService(t, "-max-size-mb", "1")
+	assertProblem(t, serve(ws, uploadRequest(t, "/convert", make([]byte, 1<<20+1), nil)), http.StatusRequestEntityTooLarge, codeUploadTooLarge)
+	assertProblem(t, serve(ws, uploadRequest(t, "/info", make([]byte, 1<<20+1), nil)), http.StatusRequestEntityTooLarge, codeUploadTooLarge)
+}
+
+func TestInfo(t *testing.T) {
+	ws := newTestService(t)
+	rec := serve(ws, uploadRequest(t, "/info", readTestHEIC(t), nil))
+	var info convert.Info
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.Bytes())
+	}
+	if rec.Header().Get("Content-Type") != "application/json" || info.Width != 64 || info.Height != 48 || info.Codec != "grid" {
+		t.Errorf("got %+v, headers %v", info, rec.Header())
+	}
+	if len(info.ImageItems) != 3 || !info.ImageItems[0].Primary || info.Tracks == nil {
+		t.Errorf("got images %+v and tracks %v", info.ImageItems, info.Tracks)
+	}
+}
+
+func TestProblemHTML(t *testing.T) {
+	ws := newTestService(t)
+	r := uploadRequest(t, "/convert", []byte("GIF89a"), nil)
+	r.Header.Set("Accept", "text/html,application/xhtml+xml;q=0.9,*/*;q=0.8")
+	rec := serve(ws, r)
+	if rec.Code != http.StatusUnsupportedMediaType || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("got %d of type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rec.Body.String(), "<h1>Unsupported Media Type</h1>") {
+		t.Errorf("got %s", rec.Body.String())
+	}
+
+	for accept, want := range map[string]bool{
+		"":                                  false,
+		"application/json":                  false,
+		"text/html;q=0.5, application/json": false,
+		"text/html, application/json;q=0.9": true,
+	} {
+		if got := prefersHTML(accept); got != want {
+			t.Errorf("%q: got %v", accept, got)
+		}
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	ws := newTestService(t)
+	assertProblem(t, serve(ws, httptest.NewRequest(http.MethodGet, "/admin/reload", nil)), http.StatusNotFound, codeNotFound)
+
+	quotaPath := filepath.Join(t.TempDir(), "quota.json")
+	ws = newTestServiceHCL(t, `
+admin_endpoints = true
+auth {
+  enabled = true
+  api_key "user" {
+    key = "`+testKey+`"
+  }
+  api_key "ops" {
+    key = "fedcba9876543210"
+    admin = true
+  }
+}
+rate_limit {
+  quota_store = "file"
+  quota_store_path = "`+quotaPath+`"
+}`)
+
+	r := httptest.NewRequest(http.MethodGet, "/admin/reload", nil)
+	r.Header.Set(HeaderAPIKey, testKey)
+	assertProblem(t, serve(ws, r), http.StatusForbidden, codeForbidden)
+
+	r = httptest.NewRequest(http.MethodGet, "/admin/reload", nil)
+	r.Header.Set(HeaderAPIKey, "fedcba9876543210")
+	rec := serve(ws, r)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.Bytes())
+	}
+	body := rec.Body.String()
+	for _, secret := range []string{testKey, "fedcba9876543210", quotaPath, ws.config().ServePath} {
+		if strings.Contains(body, secret) {
+			t.Errorf("response contains %q: %s", secret, body)
+		}
+	}
+	if !strings.Contains(body, `"quota_store_path":"`+redactedValue+`"`) {
+		t.Errorf("quota store path is not redacted: %s", body)
+	}
+}
+
+func TestLogRequestRedacted(t *testing.T) {
+	ws := newTestService(t)
+	var buf bytes.Buffer
+	ws.log = zerolog.New(&buf).Level(zerolog.DebugLevel)
+
+	r := httptest.NewRequest(http.MethodPost, "/convert?key_name=ci&expires=1&signature=0badc0de", nil)
+	r.Header.Set("Authorization", "Bearer "+testKey)
+	r.Header.Set(HeaderAPIKey, testKey)
+	r.Header.Set("User-Agent", "heicker-test")
+	ws.logRequest(r)
+
+	out := buf.String()
+	for _, secret := range []string{testKey, "0badc0de"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("log contains %q: %s", secret, out)
+		}
+	}
+	if !strings.Contains(out, "heicker-test") || !strings.Contains(out, "key_name=ci") {
+		t.Errorf("log is missing other headers or parameters: %s", out)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	ws := newTestService(t, "-max-concurrent", "1")
+	if err := ws.act.acquire(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	defer ws.act.release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := uploadRequest(t, "/convert", readTestHEIC(t), nil).WithContext(ctx)
+	assertProblem(t, serve(ws, r), http.StatusRequestTimeout, codeRequestTimeout)
+
+	if testing.Short() {
+		t.Skip("waiting for the queue takes 2s")
+	}
+	rec := serve(ws, uploadRequest(t, "/convert", readTestHEIC(t), nil))
+	assertProblem(t, rec, http.StatusServiceUnavailable, codeQueueFull)
+	if rec.Header().Get("Retry-After") != "2" {
+		t.Errorf("got Retry-After %q", rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	admin := writeTestConfig(t, "admin.hcl", "admin_endpoints = true")
+	ws := newTestService(t, "-config", admin, "-max-concurrent", "2")
+	next, _, diags := loadTestConfig(t, "-config", admin, "-max-concurrent", "5", "-port", "9000", "-log-level", "info")
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	defer zerolog.SetGlobalLevel(zerolog.GlobalLevel())
+
+	rr := ws.applyConfig(next, nil)
+	if !rr.Success || len(rr.Rejected) != 1 {
+		t.Errorf("got success %v, rejected %v, want only the port rejected", rr.Success, rr.Rejected)
+	}
+	if c := ws.config(); c.Port != 8191 || c.MaxConcurrent != 5 {
+		t.Errorf("got port %d and max_concurrent %d, want the running port and the new concurrency", c.Port, c.MaxConcurrent)
+	}
+	if size, _ := ws.act.stats(); size != 5 {
+		t.Errorf("got a pool of %d, want 5", size)
+	}
+	if zerolog.GlobalLevel() != zerolog.InfoLevel {
+		t.Errorf("got log level %v", zerolog.GlobalLevel())
+	}
+
+	rec := serve(ws, httptest.NewRequest(http.MethodGet, "/admin/reload", nil))
+	var state struct {
+		LastReload  reloadResult   `json:"last_reload"`
+		Concurrency map[string]int `json:"concurrency"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &state); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.Bytes())
+	}
+	if !state.LastReload.Success || state.Concurrency["size"] != 5 {
+		t.Errorf("got %s", rec.Body.Bytes())
+	}
+
+	// a failed reload keeps the current config
+	if rr := ws.applyConfig(nil, hcl.Diagnostics{{Severity: hcl.DiagError, Summary: "broken"}}); rr.Success || ws.config().MaxConcurrent != 5 {
+		t.Errorf("got success %v and max_concurrent %d after a failed reload", rr.Success, ws.config().MaxConcurrent)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	ws := newTestServiceHCL(t, `
+auth {
+  enabled = true
+  api_key "ci" {
+    key = "`+testKey+`"
+  }
+  api_key "limited" {
+    key = "fedcba9876543210"
+    rate_limit = 0.001
+  }
+}`)
+
+	get := func(target string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		for i := 0; i < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		return serve(ws, r)
+	}
+	for _, tc := range []struct {
+		name   string
+		rec    *httptest.ResponseRecorder
+		status int
+	}{
+		{"no key", get("/count"), http.StatusUnauthorized},
+		{"unknown key", get("/count", HeaderAPIKey, "not the key at all"), http.StatusUnauthorized},
+		{"header", get("/count", HeaderAPIKey, testKey), http.StatusOK},
+		{"bearer", get("/count", "Authorization", "Bearer "+testKey), http.StatusOK},
+		{"public path", get("/check"), http.StatusOK},
+		{"rate limit", get("/count", HeaderAPIKey, "fedcba9876543210"), http.StatusOK},
+		{"rate limited", get("/count", HeaderAPIKey, "fedcba9876543210"), http.StatusTooManyRequests},
+	} {
+		if tc.rec.Code != tc.status {
+			t.Errorf("%s: got %d, want %d", tc.name, tc.rec.Code, tc.status)
+		}
+	}
+	if rec := get("/count", HeaderAPIKey, "fedcba9876543210"); rec.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After header once rate limited")
+	}
+
+	rec := get("/sign?path=/count&method=get&ttl=1m", HeaderAPIKey, testKey)
+	var signed struct {
+		URL     string `json:"url"`
+		Method  string `json:"method"`
+		Expires int64  `json:"expires"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &signed); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.Bytes())
+	}
+	if !strings.HasPrefix(signed.URL, "/count?") || signed.Method != http.MethodGet {
+		t.Fatalf("got %+v", signed)
+	}
+	if rec := get(signed.URL); rec.Code != http.StatusOK {
+		t.Errorf("signed url: got %d", rec.Code)
+	}
+	if rec := get(strings.Replace(signed.URL, "signature=", "signature=0badc0de", 1)); rec.Code != http.StatusUnauthorized {
+		t.Errorf("bad signature: got %d", rec.Code)
+	}
+	if rec := get(strings.Replace(signed.URL, "/count", "/sign", 1)); rec.Code != http.StatusUnauthorized {
+		t.Errorf("signed url of another path: got %d", rec.Code)
+	}
+
+	// the query is signed, whatever the order of its parameters
+	rec = get("/sign?path=/count%3Fwidth%3D8%26format%3Dpng&method=get&ttl=1m", HeaderAPIKey, testKey)
+	if err := json.Unmarshal(rec.Body.Bytes(), &signed); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.Bytes())
+	}
+	u, err := url.Parse(signed.URL)
+	if err != nil || u.Query().Get("format") != "png" || u.Query().Get("width") != "8" {
+		t.Fatalf("got %+v, %v", signed, err)
+	}
+	if rec := get(signed.URL); rec.Code != http.StatusOK {
+		t.Errorf("signed url with a query: got %d", rec.Code)
+	}
+	q := u.Query()
+	reordered := "/count?width=8&signature=" + q.Get("signature") + "&format=png&expires=" + q.Get("expires") + "&key_name=ci"
+	if rec := get(reordered); rec.Code != http.StatusOK {
+		t.Errorf("signed url with its query reordered: got %d", rec.Code)
+	}
+	for name, tampered := range map[string]string{
+		"changed":  strings.Replace(signed.URL, "format=png", "format=jpeg", 1),
+		"added":    signed.URL + "&quality=100",
+		"removed":  strings.Replace(signed.URL, "&width=8", "", 1),
+		"repeated": signed.URL + "&format=jpeg",
+	} {
+		if rec := get(tampered); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s query: got %d", name, rec.Code)
+		}
+	}
+	if rec := get("/sign?path=http://example.com/count", HeaderAPIKey, testKey); rec.Code != http.StatusBadRequest {
+		t.Errorf("signing an absolute url: got %d", rec.Code)
+	}
+
+	a := ws.authn()
+	for name, expires := range map[string]time.Time{
+		"expired":  time.Now().Add(-time.Second),
+		"too long": time.Now().Add(2 * time.Hour),
+	} {
+		q := a.signURL(a.byName["ci"], http.MethodGet, "/count", nil, expires)
+		if rec := get("/count?" + q.Encode()); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: got %d", name, rec.Code)
+		}
+	}
+
+	// only api keys may sign urls
+	q = a.signURL(a.byName["ci"], http.MethodGet, "/sign", nil, time.Now().Add(time.Minute))
+	if rec := get("/sign?" + q.Encode()); rec.Code != http.StatusForbidden {
+		t.Errorf("signing with a signed url: got %d", rec.Code)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	ws := newTestService(t)
+	valid := readTestHEIC(t)
+
+	rec := serve(ws, uploadRequest(t, "/convert?format=png", valid, map[string]string{"outname": "out.png", "submit": "Convert"}))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.Bytes())
+	}
+	if h := rec.Header(); h.Get("Content-Type") != "image/png" || h.Get("Content-Disposition") != "inline; filename=out.png" {
+		t.Errorf("got headers %v", h)
+	}
+	img, err := png.Decode(rec.Body)
+	if err != nil || img.Bounds() != image.Rect(0, 0, 64, 48) {
+		t.Fatalf("got %v, %v", img, err)
+	}
+
+	rec = serve(ws, uploadRequest(t, "/thumbnail?width=8", valid, nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/jpeg" || rec.Header().Get("Content-Disposition") != "inline; filename=photo.heic.jpg" {
+		t.Fatalf("got %d, headers %v", rec.Code, rec.Header())
+	}
+	if img, err := jpeg.Decode(rec.Body); err != nil || img.Bounds() != image.Rect(0, 0, 8, 6) {
+		t.Fatalf("got %v, %v", img, err)
+	}
+
+	rec = serve(ws, uploadRequest(t, "/convert?crop=0,0,32,32&scale=50&filter=nearest", valid, nil))
+	if img, err := jpeg.Decode(rec.Body); rec.Code != http.StatusOK || err != nil || img.Bounds() != image.Rect(0, 0, 16, 16) {
+		t.Fatalf("got %d, %v, %v", rec.Code, img, err)
+	}
+
+	rec = serve(ws, uploadRequest(t, "/convert?all=true&format=png", valid, nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/zip" || rec.Header().Get("Content-Disposition") != "inline; filename=photo.heic.zip" {
+		t.Fatalf("got %d, headers %v", rec.Code, rec.Header())
+	}
+	if zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len())); err != nil || len(zr.File) != 3 {
+		t.Fatalf("got %v", err)
+	}
+
+	rec = serve(ws, uploadRequest(t, "/convert?format=heif&heif_codec=unci", valid, nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/heif" || rec.Header().Get("Content-Disposition") != "inline; filename=photo.heic.heif" {
+		t.Fatalf("got %d, headers %v", rec.Code, rec.Header())
+	}
+	if info, err := convert.Probe(bytes.NewReader(rec.Body.Bytes())); err != nil || info.Codec != "unci" {
+		t.Fatalf("got %+v, %v", info, err)
+	}
+
+	if rec := serve(ws, httptest.NewRequest(http.MethodGet, "/count", nil)); !strings.Contains(rec.Body.String(), "5") {
+		t.Errorf("got count %s after 5 conversions", rec.Body.String())
+	}
+}